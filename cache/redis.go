@@ -0,0 +1,180 @@
+// Package cache keeps copies of file contents at a given modification and
+// of files and logs at a given commit where every replica can reach them, so
+// reads need not go to the shared volume or git each time.
+package cache
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "time"
+)
+
+// Timeout bounds each round trip. A cache that answers slower than the
+// volume it fronts is no use.
+var Timeout = 250 * time.Millisecond
+
+// MaxIdle is how many connections a Redis client keeps open between calls.
+const MaxIdle = 8
+
+// Redis is a client for the few Redis commands the cache needs. It is safe
+// for concurrent use.
+type Redis struct {
+    Addr     string
+    Password string
+    DB       int
+    idle     chan *redisConn
+}
+
+type redisConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func NewRedis(addr, password string, db int) *Redis {
+    return &Redis{Addr: addr, Password: password, DB: db, idle: make(chan *redisConn, MaxIdle)}
+}
+
+// Get returns the value of key; ok is false when it is not set.
+func (c *Redis) Get(ctx context.Context, key string) (value []byte, ok bool, err error) {
+    reply, err := c.do(ctx, "GET", key)
+    if err != nil || reply == nil {
+        return nil, false, err
+    }
+    return reply.([]byte), true, nil
+}
+
+// Set stores value under key for ttl (forever when ttl is zero).
+func (c *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    args := []interface{}{"SET", key, value}
+    if ttl > 0 {
+        args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+    }
+    _, err := c.do(ctx, args...)
+    return err
+}
+
+// Delete removes key; a key that is not set is not an error.
+func (c *Redis) Delete(ctx context.Context, key string) error {
+    _, err := c.do(ctx, "DEL", key)
+    return err
+}
+
+func (c *Redis) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+    conn, err := c.conn(ctx)
+    if err != nil {
+        return nil, err
+    }
+    reply, err := conn.call(ctx, args...)
+    var replyErr redisError
+    if err != nil && !errors.As(err, &replyErr) {
+        conn.Close() // the stream may be out of step
+        return nil, err
+    }
+    select {
+    case c.idle <- conn:
+    default:
+        conn.Close()
+    }
+    return reply, err
+}
+
+// conn returns an idle connection or dials, authenticates and selects the
+// database on a new one.
+func (c *Redis) conn(ctx context.Context) (*redisConn, error) {
+    select {
+    case conn := <-c.idle:
+        return conn, nil
+    default:
+    }
+    d := net.Dialer{Timeout: Timeout}
+    nc, err := d.DialContext(ctx, "tcp", c.Addr)
+    if err != nil {
+        return nil, err
+    }
+    conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+    if c.Password != "" {
+        if _, err := conn.call(ctx, "AUTH", c.Password); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    if c.DB != 0 {
+        if _, err := conn.call(ctx, "SELECT", strconv.Itoa(c.DB)); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    return conn, nil
+}
+
+// redisError is an error reply; the connection stays usable after one.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// call sends one command as an array of bulk strings and reads its reply.
+func (conn *redisConn) call(ctx context.Context, args ...interface{}) (interface{}, error) {
+    deadline := time.Now().Add(Timeout)
+    if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+        deadline = d
+    }
+    conn.SetDeadline(deadline)
+    w := bufio.NewWriter(conn)
+    fmt.Fprintf(w, "*%d\r\n", len(args))
+    for _, arg := range args {
+        var b []byte
+        switch v := arg.(type) {
+        case string:
+            b = []byte(v)
+        case []byte:
+            b = v
+        }
+        fmt.Fprintf(w, "$%d\r\n", len(b))
+        w.Write(b)
+        w.WriteString("\r\n")
+    }
+    if err := w.Flush(); err != nil {
+        return nil, err
+    }
+    return conn.reply()
+}
+
+// reply reads a simple string, error, integer or bulk string reply. A nil
+// bulk string is returned as nil.
+func (conn *redisConn) reply() (interface{}, error) {
+    line, err := conn.r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    if len(line) < 3 || line[len(line)-2] != '\r' {
+        return nil, fmt.Errorf("redis: malformed reply %q", line)
+    }
+    kind, rest := line[0], line[1:len(line)-2]
+    switch kind {
+    case '+':
+        return rest, nil
+    case '-':
+        return nil, redisError(rest)
+    case ':':
+        return strconv.ParseInt(rest, 10, 64)
+    case '$':
+        n, err := strconv.Atoi(rest)
+        if err != nil {
+            return nil, fmt.Errorf("redis: malformed reply %q", line)
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        b := make([]byte, n+2)
+        if _, err := io.ReadFull(conn.r, b); err != nil {
+            return nil, err
+        }
+        return b[:n], nil
+    }
+    return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,304 @@
+package engine
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Style is a canonical layout for JSON and YAML documents. The zero Style
+// only re-indents with two spaces.
+type Style struct {
+    SortKeys bool `yaml:"sort_keys" json:"sortKeys,omitempty"`
+    // Indent is the number of spaces per level; 0 means 2.
+    Indent int `yaml:"indent" json:"indent,omitempty"`
+    // Quote sets how YAML string values are written: double, single or
+    // plain (quoted only where needed). Block scalars and keys are kept.
+    Quote string `yaml:"quote" json:"quote,omitempty"`
+    // SortArrays orders the arrays at these pointers.
+    SortArrays []ArraySort `yaml:"sort_arrays" json:"sortArrays,omitempty"`
+}
+
+// ArraySort orders the array at Pointer ("*" matches any key or index).
+// Items that are objects are ordered by their By field, anything else by its
+// value; numbers compare as numbers. The sort is stable.
+type ArraySort struct {
+    Pointer string `yaml:"pointer" json:"pointer"`
+    By      string `yaml:"by" json:"by,omitempty"`
+}
+
+// Check reports a Style that Canonicalize cannot apply.
+func (s Style) Check() error {
+    switch s.Quote {
+    case "", "double", "single", "plain":
+    default:
+        return fmt.Errorf("quote must be double, single or plain, not %q", s.Quote)
+    }
+    if s.Indent < 0 || s.Indent > 8 {
+        return fmt.Errorf("indent must be between 1 and 8, not %d", s.Indent)
+    }
+    for _, a := range s.SortArrays {
+        if !strings.HasPrefix(a.Pointer, "/") {
+            return fmt.Errorf("sort_arrays pointer %q must start with /", a.Pointer)
+        }
+    }
+    return nil
+}
+
+// Canonicalize rewrites a JSON or YAML document in style. Values are never
+// changed; JSON keeps its number literals and YAML its comments. Other
+// types are returned as they are.
+func Canonicalize(content []byte, fileType string, style Style) ([]byte, error) {
+    if fileType != "json" && fileType != "yaml" && fileType != "yml" {
+        return content, nil
+    }
+    indent := style.Indent
+    if indent == 0 {
+        indent = 2
+    }
+    var b bytes.Buffer
+    if fileType == "json" {
+        if len(bytes.TrimSpace(content)) == 0 {
+            return content, nil
+        }
+        dec := json.NewDecoder(bytes.NewReader(content))
+        dec.UseNumber()
+        root, err := decodeJSON(dec)
+        if err != nil {
+            return nil, err
+        }
+        style.apply(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}})
+        writeJSON(&b, root, strings.Repeat(" ", indent), "")
+        b.WriteByte('\n')
+        return b.Bytes(), nil
+    }
+
+    var docs []*yaml.Node
+    dec := yaml.NewDecoder(bytes.NewReader(content))
+    for {
+        var doc yaml.Node
+        if err := dec.Decode(&doc); err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        style.apply(&doc)
+        docs = append(docs, &doc)
+    }
+    if len(docs) == 0 {
+        return content, nil
+    }
+    enc := yaml.NewEncoder(&b)
+    enc.SetIndent(indent)
+    for _, doc := range docs {
+        if err := enc.Encode(doc); err != nil {
+            return nil, err
+        }
+    }
+    if err := enc.Close(); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+func (s Style) apply(doc *yaml.Node) {
+    if len(doc.Content) == 0 {
+        return
+    }
+    root := doc.Content[0]
+    for _, a := range s.SortArrays {
+        for _, n := range nodesAt(root, strings.Split(strings.TrimPrefix(a.Pointer, "/"), "/")) {
+            if n.Kind == yaml.SequenceNode {
+                sortItems(n, a.By)
+            }
+        }
+    }
+    var walk func(n *yaml.Node)
+    walk = func(n *yaml.Node) {
+        switch n.Kind {
+        case yaml.MappingNode:
+            if s.SortKeys {
+                sortPairs(n)
+            }
+            for i := 1; i < len(n.Content); i += 2 {
+                walk(n.Content[i])
+            }
+        case yaml.SequenceNode:
+            for _, item := range n.Content {
+                walk(item)
+            }
+        case yaml.ScalarNode:
+            if n.Tag != "!!str" || n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+                return
+            }
+            switch s.Quote {
+            case "double":
+                n.Style = yaml.DoubleQuotedStyle
+            case "single":
+                n.Style = yaml.SingleQuotedStyle
+            case "plain":
+                n.Style = 0
+            }
+        }
+    }
+    walk(root)
+}
+
+// nodesAt resolves pointer segments below n, "*" matching every child.
+func nodesAt(n *yaml.Node, segments []string) []*yaml.Node {
+    if len(segments) == 0 || len(segments) == 1 && segments[0] == "" {
+        return []*yaml.Node{n}
+    }
+    segment := strings.NewReplacer("~1", "/", "~0", "~").Replace(segments[0])
+    var found []*yaml.Node
+    switch n.Kind {
+    case yaml.MappingNode:
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            if segment == "*" || n.Content[i].Value == segment {
+                found = append(found, nodesAt(n.Content[i+1], segments[1:])...)
+            }
+        }
+    case yaml.SequenceNode:
+        for i, item := range n.Content {
+            if segment == "*" || segment == strconv.Itoa(i) {
+                found = append(found, nodesAt(item, segments[1:])...)
+            }
+        }
+    }
+    return found
+}
+
+// sortPairs orders a mapping by key, keeping each key with its value and
+// comments. The comment above the first key stays on top: it usually
+// describes the whole mapping.
+func sortPairs(n *yaml.Node) {
+    pairs := make([][2]*yaml.Node, 0, len(n.Content)/2)
+    for i := 0; i+1 < len(n.Content); i += 2 {
+        pairs = append(pairs, [2]*yaml.Node{n.Content[i], n.Content[i+1]})
+    }
+    if len(pairs) == 0 {
+        return
+    }
+    first := pairs[0][0]
+    sort.SliceStable(pairs, func(i, j int) bool { return pairs[i][0].Value < pairs[j][0].Value })
+    if top := pairs[0][0]; top != first && first.HeadComment != "" {
+        top.HeadComment = strings.TrimSuffix(first.HeadComment+"\n"+top.HeadComment, "\n")
+        first.HeadComment = ""
+    }
+    n.Content = n.Content[:0]
+    for _, p := range pairs {
+        n.Content = append(n.Content, p[0], p[1])
+    }
+}
+
+// sortItems orders a sequence by its items' scalar value or by field.
+func sortItems(n *yaml.Node, field string) {
+    key := func(item *yaml.Node) string {
+        if field == "" {
+            return item.Value
+        }
+        for i := 0; i+1 < len(item.Content) && item.Kind == yaml.MappingNode; i += 2 {
+            if item.Content[i].Value == field {
+                return item.Content[i+1].Value
+            }
+        }
+        return ""
+    }
+    sort.SliceStable(n.Content, func(i, j int) bool {
+        a, b := key(n.Content[i]), key(n.Content[j])
+        x, errX := strconv.ParseFloat(a, 64)
+        y, errY := strconv.ParseFloat(b, 64)
+        if errX == nil && errY == nil {
+            return x < y
+        }
+        return a < b
+    })
+}
+
+// decodeJSON reads one JSON value into the node tree Style works on, so that
+// key order and number literals survive.
+func decodeJSON(dec *json.Decoder) (*yaml.Node, error) {
+    tok, err := dec.Token()
+    if err == io.EOF {
+        return nil, io.ErrUnexpectedEOF
+    } else if err != nil {
+        return nil, err
+    }
+    switch tok := tok.(type) {
+    case json.Delim:
+        n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+        if tok == '[' {
+            n.Kind, n.Tag = yaml.SequenceNode, "!!seq"
+        }
+        for dec.More() {
+            if n.Kind == yaml.MappingNode {
+                key, err := dec.Token()
+                if err != nil {
+                    return nil, err
+                }
+                n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+            }
+            item, err := decodeJSON(dec)
+            if err != nil {
+                return nil, err
+            }
+            n.Content = append(n.Content, item)
+        }
+        _, err := dec.Token() // closing delimiter
+        return n, err
+    case string:
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: tok}, nil
+    case json.Number:
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: tok.String()}, nil
+    case bool:
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(tok)}, nil
+    }
+    return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
+
+// writeJSON renders a node tree from decodeJSON.
+func writeJSON(w *bytes.Buffer, n *yaml.Node, indent, prefix string) {
+    switch n.Kind {
+    case yaml.MappingNode, yaml.SequenceNode:
+        open, close, step := "{", "}", 2
+        if n.Kind == yaml.SequenceNode {
+            open, close, step = "[", "]", 1
+        }
+        w.WriteString(open)
+        inner := prefix + indent
+        for i := 0; i < len(n.Content); i += step {
+            if i > 0 {
+                w.WriteByte(',')
+            }
+            w.WriteString("\n" + inner)
+            if step == 2 {
+                writeString(w, n.Content[i].Value)
+                w.WriteString(": ")
+            }
+            writeJSON(w, n.Content[i+step-1], indent, inner)
+        }
+        if len(n.Content) > 0 {
+            w.WriteString("\n" + prefix)
+        }
+        w.WriteString(close)
+    case yaml.ScalarNode:
+        if n.Tag == "!!str" {
+            writeString(w, n.Value)
+        } else {
+            w.WriteString(n.Value)
+        }
+    }
+}
+
+func writeString(w *bytes.Buffer, s string) {
+    enc := json.NewEncoder(w)
+    enc.SetEscapeHTML(false)
+    enc.Encode(s)
+    w.Truncate(w.Len() - 1) // Encode's newline
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "regexp"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Composite is a document made of a structured part and free-form text:
+// Markdown with YAML front matter, or a Helm template whose YAML is
+// interleaved with template actions. Only Head is checked and edited; Body
+// is left exactly as written.
+type Composite struct {
+    Type string // document type of Head
+    Head []byte // the structured part, without delimiters
+    Body []byte
+    // Editable is false when Head is derived from Body (templates) rather
+    // than stored apart from it.
+    Editable bool
+    present  bool // the document had front matter
+    open     []byte
+    close    []byte
+}
+
+var (
+    frontMatterOpen  = regexp.MustCompile(`\A---[ \t]*\r?\n`)
+    frontMatterClose = regexp.MustCompile(`(?m)^(---|\.\.\.)[ \t]*(\r?\n|\z)`)
+    templateAction   = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
+)
+
+// IsComposite reports whether fileType is split by Split.
+func IsComposite(fileType string) bool {
+    return fileType == "markdown" || fileType == "helm"
+}
+
+// Split separates a composite document. Markdown without front matter has
+// an empty Head; Join adds the delimiters back once Head is set.
+func Split(content []byte, fileType string) (*Composite, error) {
+    switch fileType {
+    case "markdown":
+        c := &Composite{Type: "yaml", Body: content, Editable: true, open: []byte("---\n"), close: []byte("---\n")}
+        open := frontMatterOpen.Find(content)
+        if open == nil {
+            return c, nil
+        }
+        rest := content[len(open):]
+        loc := frontMatterClose.FindIndex(rest)
+        if loc == nil {
+            return nil, errors.New("front matter is not closed with ---")
+        }
+        c.open, c.Head, c.close, c.Body = open, rest[:loc[0]], rest[loc[0]:loc[1]], rest[loc[1]:]
+        c.present = true
+        if len(c.close) > 0 && c.close[len(c.close)-1] != '\n' {
+            c.close = append(c.close, '\n')
+        }
+        return c, nil
+    case "helm":
+        return &Composite{Type: "yaml", Head: maskActions(content), Body: content}, nil
+    }
+    return nil, fmt.Errorf("%s documents are not composite", fileType)
+}
+
+// maskActions blanks template actions so the YAML around them can be
+// checked: an action alone on its lines becomes whitespace, one inside a
+// line becomes a plain scalar of the same width. Lines and columns are kept.
+func maskActions(content []byte) []byte {
+    masked := append([]byte(nil), content...)
+    for _, loc := range templateAction.FindAllIndex(content, -1) {
+        start, end := loc[0], loc[1]
+        lineStart := bytes.LastIndexByte(content[:start], '\n') + 1
+        lineEnd := len(content)
+        if i := bytes.IndexByte(content[end:], '\n'); i >= 0 {
+            lineEnd = end + i
+        }
+        alone := len(bytes.TrimSpace(content[lineStart:start])) == 0 && len(bytes.TrimSpace(content[end:lineEnd])) == 0
+        for i := start; i < end; i++ {
+            switch {
+            case content[i] == '\n':
+            case alone:
+                masked[i] = ' '
+            default:
+                masked[i] = '_'
+            }
+        }
+    }
+    return masked
+}
+
+// Join puts a composite document back together.
+func (c *Composite) Join() []byte {
+    if !c.Editable {
+        return c.Body
+    }
+    if !c.present && len(c.Head) == 0 {
+        return c.Body
+    }
+    var b bytes.Buffer
+    b.Write(c.open)
+    b.Write(c.Head)
+    if len(c.Head) > 0 && c.Head[len(c.Head)-1] != '\n' {
+        b.WriteByte('\n')
+    }
+    b.Write(c.close)
+    b.Write(c.Body)
+    return b.Bytes()
+}
+
+// validateComposite checks the structured part of a composite document.
+// Front matter must be a mapping; template YAML only has to parse, since
+// branches of an if/else may legitimately repeat keys.
+func validateComposite(content []byte, fileType string) error {
+    c, err := Split(content, fileType)
+    if err != nil {
+        return err
+    }
+    if !c.Editable {
+        dec := yaml.NewDecoder(bytes.NewReader(c.Head))
+        for {
+            var node yaml.Node
+            if err := dec.Decode(&node); err == io.EOF {
+                return nil
+            } else if err != nil {
+                return err
+            }
+        }
+    }
+    doc, err := Parse(c.Head, c.Type)
+    if err != nil {
+        return fmt.Errorf("front matter: %v", err)
+    }
+    if _, ok := doc.(map[string]interface{}); !ok && doc != nil {
+        return errors.New("front matter must be a mapping")
+    }
+    return nil
+}
+
+// Rewrite renders doc in fileType, keeping what lies outside the structured
+// part of original: for Markdown only the front matter is replaced. YAML
+// and TOML keep their comments and layout where values did not change;
+// other types are marshalled whole.
+func Rewrite(original []byte, doc interface{}, fileType string) ([]byte, error) {
+    if !IsComposite(fileType) {
+        return rewrite(original, doc, fileType)
+    }
+    c, err := Split(original, fileType)
+    if err != nil {
+        return nil, err
+    }
+    if !c.Editable {
+        return nil, fmt.Errorf("%s documents cannot be edited by pointer", fileType)
+    }
+    if c.Head, err = rewrite(c.Head, doc, c.Type); err != nil {
+        return nil, err
+    }
+    return c.Join(), nil
+}
@@ -0,0 +1,161 @@
+package engine
+
+import (
+    "encoding/json"
+    "fmt"
+    "path/filepath"
+    "strings"
+
+    "cuelang.org/go/cue"
+    "cuelang.org/go/cue/cuecontext"
+    cueerrors "cuelang.org/go/cue/errors"
+    "cuelang.org/go/cue/load"
+    "cuelang.org/go/cue/parser"
+)
+
+// CUEError is one error CUE reports, at the place in the file it arose.
+type CUEError struct {
+    Message string `json:"message"`
+    Path    string `json:"path,omitempty"`
+    Line    int    `json:"line,omitempty"`
+    Column  int    `json:"column,omitempty"`
+}
+
+// CUEErrors are the errors of a file; CUE reports every conflict, not only
+// the first.
+type CUEErrors []CUEError
+
+func (e CUEErrors) Error() string {
+    var messages []string
+    for _, err := range e {
+        message := err.Message
+        if err.Path != "" {
+            message = err.Path + ": " + message
+        }
+        if err.Line > 0 {
+            message = fmt.Sprintf("line %d, column %d: %s", err.Line, err.Column, message)
+        }
+        messages = append(messages, message)
+    }
+    return strings.Join(messages, "; ")
+}
+
+// IsCUE reports whether fileType is read by CheckCUE.
+func IsCUE(fileType string) bool {
+    return fileType == "cue"
+}
+
+// cueErrors turns what the CUE API returns into CUEErrors.
+func cueErrors(err error) error {
+    var list CUEErrors
+    for _, e := range cueerrors.Errors(err) {
+        format, args := e.Msg()
+        ce := CUEError{Message: fmt.Sprintf(format, args...), Path: strings.Join(e.Path(), ".")}
+        pos := e.Position()
+        if !pos.IsValid() {
+            for _, p := range e.InputPositions() {
+                if p.IsValid() {
+                    pos = p
+                    break
+                }
+            }
+        }
+        if pos.IsValid() {
+            ce.Line, ce.Column = pos.Line(), pos.Column()
+        }
+        list = append(list, ce)
+    }
+    if len(list) == 0 {
+        return err
+    }
+    return list
+}
+
+// ParseCUE checks the syntax of content. Whether it holds together can only
+// be told with the rest of its package; see CheckCUE.
+func ParseCUE(content []byte) error {
+    if _, err := parser.ParseFile("input.cue", content); err != nil {
+        return cueErrors(err)
+    }
+    return nil
+}
+
+// cueValue builds content, the file name of directory dir, the way cue
+// does: with the other files of its package in dir and the packages they
+// import, content standing in for the saved file. A file without a package
+// clause is loaded alone. With dir empty content is compiled on its own.
+func cueValue(dir, name string, content []byte) (cue.Value, error) {
+    ctx := cuecontext.New()
+    if dir == "" {
+        return ctx.CompileBytes(content, cue.Filename(name)), nil
+    }
+    f, err := parser.ParseFile(name, content, parser.PackageClauseOnly)
+    if err != nil {
+        return cue.Value{}, cueErrors(err)
+    }
+    if dir, err = filepath.Abs(dir); err != nil {
+        return cue.Value{}, err
+    }
+    args := []string{name}
+    if pkg := f.PackageName(); pkg != "" {
+        args = []string{".:" + pkg}
+    }
+    instances := load.Instances(args, &load.Config{
+        Dir:     dir,
+        Overlay: map[string]load.Source{filepath.Join(dir, name): load.FromBytes(content)},
+    })
+    if err := instances[0].Err; err != nil {
+        return cue.Value{}, cueErrors(err)
+    }
+    return ctx.BuildInstance(instances[0]), nil
+}
+
+// CheckCUE builds content as the file name of dir (see cueValue) and checks
+// it for conflicts. Values need not be concrete: a schema rarely is.
+func CheckCUE(dir, name string, content []byte) error {
+    v, err := cueValue(dir, name, content)
+    if err != nil {
+        return err
+    }
+    if err := v.Err(); err != nil {
+        return cueErrors(err)
+    }
+    if err := v.Validate(); err != nil {
+        return cueErrors(err)
+    }
+    return nil
+}
+
+// EvalCUE evaluates content as the file name of dir (see cueValue), or the
+// value at path within it (such as "services.web"), into JSON-compatible
+// values. Everything evaluated must be concrete, as for cue export.
+func EvalCUE(dir, name string, content []byte, path string) (interface{}, error) {
+    v, err := cueValue(dir, name, content)
+    if err != nil {
+        return nil, err
+    }
+    if err := v.Err(); err != nil {
+        return nil, cueErrors(err)
+    }
+    if path != "" {
+        p := cue.ParsePath(path)
+        if err := p.Err(); err != nil {
+            return nil, err
+        }
+        if v = v.LookupPath(p); !v.Exists() {
+            return nil, fmt.Errorf("%s is not defined", path)
+        }
+    }
+    if err := v.Validate(cue.Concrete(true)); err != nil {
+        return nil, cueErrors(err)
+    }
+    b, err := v.MarshalJSON()
+    if err != nil {
+        return nil, cueErrors(err)
+    }
+    var value interface{}
+    if err := json.Unmarshal(b, &value); err != nil {
+        return nil, err
+    }
+    return value, nil
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+    "bytes"
+    "encoding/json"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+// wellKnown maps file names that carry no (or a misleading) extension to
+// their document type.
+var wellKnown = map[string]string{
+    "Dockerfile":         "dockerfile",
+    "Containerfile":      "dockerfile",
+    ".babelrc":           "json",
+    ".eslintrc":          "json",
+    ".jshintrc":          "json",
+    ".prettierrc":        "json",
+    "composer.lock":      "json",
+    "Pipfile.lock":       "json",
+    ".clang-format":      "yaml",
+    ".clang-tidy":        "yaml",
+    ".yamllint":          "yaml",
+    ".gitlab-ci.yml":     "yaml",
+    ".travis.yml":        "yaml",
+    "docker-compose.yml": "yaml",
+}
+
+// knownType returns the type of filename from its name alone, or "".
+func knownType(filename string) string {
+    base := filepath.Base(filename)
+    if t, ok := wellKnown[base]; ok {
+        return t
+    }
+    // .env.local, .env.production
+    if strings.HasPrefix(base, ".env.") {
+        return "env"
+    }
+    // Dockerfile.prod, app.dockerfile
+    if m, _ := filepath.Match("Dockerfile.*", base); m || filepath.Ext(base) == ".dockerfile" {
+        return "dockerfile"
+    }
+    switch filepath.Ext(base) {
+    case ".md", ".markdown":
+        return "markdown"
+    }
+    return ""
+}
+
+// HelmTemplate reports whether filename is a template of a Helm chart: a
+// file under a templates directory whose parent holds Chart.yaml. exists
+// is asked about each candidate Chart.yaml, named like filename.
+func HelmTemplate(filename string, exists func(name string) bool) bool {
+    dirs := strings.Split(filepath.ToSlash(filepath.Dir(filename)), "/")
+    for i, dir := range dirs {
+        if dir != "templates" {
+            continue
+        }
+        chart := append(dirs[:i:i], "Chart.yaml")
+        if exists(filepath.FromSlash(strings.Join(chart, "/"))) {
+            return true
+        }
+    }
+    return false
+}
+
+// Syntax is how an editor should present a document type.
+type Syntax struct {
+    Mode string `json:"mode"` // Ace editor mode
+    MIME string `json:"mime"`
+}
+
+var syntaxes = map[string]Syntax{
+    "json":       {"json", "application/json"},
+    "yaml":       {"yaml", "application/yaml"},
+    "yml":        {"yaml", "application/yaml"},
+    "xml":        {"xml", "application/xml"},
+    "dockerfile": {"dockerfile", "text/x-dockerfile"},
+    "sh":         {"sh", "application/x-sh"},
+    "bash":       {"sh", "application/x-sh"},
+    "markdown":   {"markdown", "text/markdown"},
+    "helm":       {"yaml", "application/yaml"},
+    "toml":       {"toml", "application/toml"},
+    "ini":        {"ini", "text/plain"},
+    "csv":        {"text", "text/csv"},
+    "tsv":        {"text", "text/tab-separated-values"},
+    "tf":         {"terraform", "text/x-terraform"},
+    "hcl":        {"terraform", "text/x-hcl"},
+    "pem":        {"text", "application/x-pem-file"},
+    "crt":        {"text", "application/x-x509-ca-cert"},
+    "env":        {"properties", "text/plain"},
+    "cue":        {"text", "text/x-cue"},
+    "jsonnet":    {"text", "text/x-jsonnet"},
+    "libsonnet":  {"text", "text/x-jsonnet"},
+}
+
+// SyntaxOf returns the editor mode and MIME type of a document type; plain
+// text for types it does not know.
+func SyntaxOf(fileType string) Syntax {
+    if s, ok := syntaxes[fileType]; ok {
+        return s
+    }
+    return Syntax{"text", "text/plain"}
+}
+
+var (
+    dockerInstruction = regexp.MustCompile(`(?im)^\s*FROM\s+\S+`)
+    yamlKey           = regexp.MustCompile(`(?m)^[A-Za-z_][\w.-]*:(\s|$)`)
+)
+
+// Detect returns the document type of filename like FileType and, when the
+// name says nothing, guesses it from content: JSON values, XML prologs and
+// elements, shell shebangs, Dockerfile instructions and YAML mappings. An
+// extension edit3 does not know, such as .txt, still decides the type.
+func Detect(filename string, content []byte) string {
+    if t := FileType(filename); t != "" {
+        return t
+    }
+    trimmed := bytes.TrimSpace(content)
+    switch {
+    case len(trimmed) == 0:
+        return FileType(filename)
+    case (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed):
+        return "json"
+    case bytes.HasPrefix(trimmed, []byte("<?xml")) || trimmed[0] == '<' && bytes.HasSuffix(trimmed, []byte(">")):
+        return "xml"
+    case bytes.HasPrefix(trimmed, []byte("#!")):
+        if line, _, _ := bytes.Cut(trimmed, []byte("\n")); bytes.Contains(line, []byte("sh")) {
+            return "sh"
+        }
+    case dockerInstruction.Match(trimmed) && !yamlKey.Match(trimmed):
+        return "dockerfile"
+    case bytes.HasPrefix(trimmed, []byte("---")) || yamlKey.Match(trimmed):
+        return "yaml"
+    }
+    return FileType(filename)
+}
+
+// IsText reports whether content reads as text: UTF-8 without NUL bytes.
+// content may be the start of a file, cut inside a character.
+func IsText(content []byte) bool {
+    if bytes.IndexByte(content, 0) >= 0 {
+        return false
+    }
+    for len(content) > 0 {
+        r, size := utf8.DecodeRune(content)
+        if r == utf8.RuneError && size == 1 {
+            return !utf8.FullRune(content)
+        }
+        content = content[size:]
+    }
+    return true
+}
@@ -0,0 +1,183 @@
+package engine
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Issue is a problem found on a line of a text document.
+type Issue struct {
+    Line    int    `json:"line"`
+    Message string `json:"message"`
+}
+
+func (i Issue) String() string {
+    return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// dockerInstructions are the instructions Docker accepts.
+var dockerInstructions = map[string]bool{
+    "ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true,
+    "ENV": true, "EXPOSE": true, "FROM": true, "HEALTHCHECK": true, "LABEL": true,
+    "MAINTAINER": true, "ONBUILD": true, "RUN": true, "SHELL": true,
+    "STOPSIGNAL": true, "USER": true, "VOLUME": true, "WORKDIR": true,
+}
+
+var (
+    dockerDirective = regexp.MustCompile(`(?i)^#\s*(escape|syntax|check)\s*=\s*(\S*)`)
+    dockerHeredoc   = regexp.MustCompile(`<<-?["']?([A-Za-z_][A-Za-z0-9_]*)["']?`)
+    exposePort      = regexp.MustCompile(`^(\$\{?\w+\}?|\d+(-\d+)?)(/(tcp|udp|sctp))?$`)
+    aptInstall      = regexp.MustCompile(`\bapt(-get)?\s+(\S+\s+)*install\b`)
+    aptYes          = regexp.MustCompile(`(^|\s)(-[a-zA-Z]*y[a-zA-Z]*|--yes|--assume-yes|-qq)(\s|$)`)
+)
+
+// dockerLine is one instruction after joining continuation lines.
+type dockerLine struct {
+    line        int // where it starts
+    instruction string
+    args        string
+}
+
+// parseDockerfile splits a Dockerfile into instructions, honouring the
+// escape directive, line continuations, comments and heredocs.
+func parseDockerfile(content []byte) ([]dockerLine, []Issue) {
+    var lines []dockerLine
+    var issues []Issue
+    escape := `\`
+    directives := true
+    var current *dockerLine
+    heredoc, heredocLine := "", 0
+    for i, raw := range strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n") {
+        n := i + 1
+        if heredoc != "" {
+            if strings.TrimLeft(raw, "\t") == heredoc {
+                heredoc = ""
+            }
+            continue
+        }
+        text := strings.TrimSpace(raw)
+        if directives {
+            if m := dockerDirective.FindStringSubmatch(text); m != nil {
+                if strings.EqualFold(m[1], "escape") {
+                    if m[2] != `\` && m[2] != "`" {
+                        issues = append(issues, Issue{n, fmt.Sprintf("escape must be \\ or `, not %q", m[2])})
+                    } else {
+                        escape = m[2]
+                    }
+                }
+                continue
+            }
+            if text != "" {
+                directives = false
+            }
+        }
+        if current == nil && (text == "" || strings.HasPrefix(text, "#")) {
+            continue
+        }
+        if current != nil && strings.HasPrefix(text, "#") {
+            continue // comments may sit inside a continued instruction
+        }
+        continued := strings.HasSuffix(text, escape)
+        text = strings.TrimSuffix(text, escape)
+        if current == nil {
+            fields := strings.SplitN(text, " ", 2)
+            current = &dockerLine{line: n, instruction: strings.ToUpper(fields[0])}
+            if len(fields) == 2 {
+                current.args = strings.TrimSpace(fields[1])
+            }
+        } else {
+            current.args = strings.TrimSpace(current.args + " " + text)
+        }
+        if continued {
+            continue
+        }
+        if m := dockerHeredoc.FindStringSubmatch(current.args); m != nil && (current.instruction == "RUN" || current.instruction == "COPY") {
+            heredoc, heredocLine = m[1], current.line
+        }
+        lines = append(lines, *current)
+        current = nil
+    }
+    if current != nil {
+        issues = append(issues, Issue{current.line, current.instruction + " ends with a line continuation but the file ends"})
+        lines = append(lines, *current)
+    }
+    if heredoc != "" {
+        issues = append(issues, Issue{heredocLine, "heredoc " + heredoc + " is never closed"})
+    }
+    return lines, issues
+}
+
+// LintDockerfile parses a Dockerfile and reports what would make the build
+// fail or behave other than intended: unknown instructions, missing
+// arguments, a first instruction other than FROM, malformed exec form,
+// invalid ports, repeated CMD or ENTRYPOINT in one stage, duplicate stage
+// names and apt installs that wait for a confirmation.
+func LintDockerfile(content []byte) []Issue {
+    lines, issues := parseDockerfile(content)
+    stages := make(map[string]bool)
+    seen := make(map[string]int) // CMD, ENTRYPOINT, HEALTHCHECK per stage
+    from := false
+    for _, l := range lines {
+        instruction, args := l.instruction, l.args
+        if !dockerInstructions[instruction] {
+            issues = append(issues, Issue{l.line, fmt.Sprintf("unknown instruction %s", instruction)})
+            continue
+        }
+        if args == "" {
+            issues = append(issues, Issue{l.line, instruction + " needs arguments"})
+            continue
+        }
+        if !from && instruction != "FROM" && instruction != "ARG" {
+            issues = append(issues, Issue{l.line, instruction + " before the first FROM"})
+        }
+        switch instruction {
+        case "FROM":
+            from = true
+            seen = make(map[string]int)
+            fields := strings.Fields(args)
+            for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+                fields = fields[1:]
+            }
+            if len(fields) == 3 && strings.EqualFold(fields[1], "AS") {
+                name := strings.ToLower(fields[2])
+                if stages[name] {
+                    issues = append(issues, Issue{l.line, fmt.Sprintf("stage %s is defined twice", fields[2])})
+                }
+                stages[name] = true
+            } else if len(fields) != 1 {
+                issues = append(issues, Issue{l.line, "FROM takes an image and an optional AS name"})
+            }
+        case "CMD", "ENTRYPOINT", "HEALTHCHECK":
+            if prev, ok := seen[instruction]; ok {
+                issues = append(issues, Issue{l.line, fmt.Sprintf("%s repeats the one on line %d, which is ignored", instruction, prev)})
+            }
+            seen[instruction] = l.line
+            fallthrough
+        case "RUN", "SHELL":
+            if strings.HasPrefix(args, "[") {
+                var argv []string
+                if err := json.Unmarshal([]byte(args), &argv); err != nil {
+                    issues = append(issues, Issue{l.line, instruction + " exec form must be a JSON array of double-quoted strings; otherwise it runs through a shell"})
+                }
+            }
+            if instruction == "RUN" && aptInstall.MatchString(args) && !aptYes.MatchString(args) {
+                issues = append(issues, Issue{l.line, "apt-get install needs -y, the build cannot answer its prompt"})
+            }
+        case "EXPOSE":
+            for _, port := range strings.Fields(args) {
+                if !exposePort.MatchString(port) {
+                    issues = append(issues, Issue{l.line, fmt.Sprintf("EXPOSE %s is not a port, range or port/protocol", port)})
+                } else if p, err := strconv.Atoi(strings.SplitN(strings.SplitN(port, "/", 2)[0], "-", 2)[0]); err == nil && (p < 1 || p > 65535) {
+                    issues = append(issues, Issue{l.line, fmt.Sprintf("port %d is out of range", p)})
+                }
+            }
+        }
+    }
+    if !from && len(lines) > 0 {
+        issues = append(issues, Issue{1, "no FROM instruction"})
+    }
+    return issues
+}
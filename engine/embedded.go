@@ -0,0 +1,117 @@
+package engine
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Embedded is a string value holding a JSON or YAML document of its own, as
+// in Kubernetes annotations (kubectl's last-applied-configuration) or
+// Terraform policy attributes.
+type Embedded struct {
+    Pointer string `json:"pointer"`
+    Type    string `json:"type"`              // json or yaml
+    Compact bool   `json:"compact,omitempty"` // JSON on a single line
+
+    newline bool // the string ends with a newline
+}
+
+// Embed reports whether s holds an embedded document and of which kind.
+// JSON must be an object or array; YAML must span lines and be a mapping or
+// sequence, so that prose with a colon is not mistaken for a document.
+func Embed(s string) (Embedded, bool) {
+    trimmed := strings.TrimSpace(s)
+    e := Embedded{newline: strings.HasSuffix(s, "\n")}
+    if trimmed == "" {
+        return e, false
+    }
+    if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)) {
+        e.Type, e.Compact = "json", !strings.Contains(trimmed, "\n")
+        return e, true
+    }
+    if !strings.Contains(trimmed, "\n") {
+        return e, false
+    }
+    var doc interface{}
+    if yaml.Unmarshal([]byte(s), &doc) != nil {
+        return e, false
+    }
+    switch doc.(type) {
+    case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+        e.Type = "yaml"
+        return e, true
+    }
+    return e, false
+}
+
+// FindEmbedded lists the strings inside doc that hold embedded documents,
+// in pointer order. It does not look inside the embedded documents.
+func FindEmbedded(doc interface{}) []Embedded {
+    found := make([]Embedded, 0)
+    var walk func(pointer string, v interface{})
+    walk = func(pointer string, v interface{}) {
+        switch v := v.(type) {
+        case map[string]interface{}:
+            keys := make([]string, 0, len(v))
+            for k := range v {
+                keys = append(keys, k)
+            }
+            sort.Strings(keys)
+            for _, k := range keys {
+                walk(pointer+"/"+strings.NewReplacer("~", "~0", "/", "~1").Replace(k), v[k])
+            }
+        case []interface{}:
+            for i, item := range v {
+                walk(pointer+"/"+strconv.Itoa(i), item)
+            }
+        case string:
+            if e, ok := Embed(v); ok {
+                e.Pointer = pointer
+                found = append(found, e)
+            }
+        }
+    }
+    walk("", doc)
+    return found
+}
+
+// Unfold returns the document embedded in s ready for editing: JSON is
+// indented, YAML is already readable and kept as written.
+func (e Embedded) Unfold(s string) ([]byte, error) {
+    if e.Type != "json" {
+        return []byte(s), nil
+    }
+    var b bytes.Buffer
+    if err := json.Indent(&b, []byte(strings.TrimSpace(s)), "", "  "); err != nil {
+        return nil, err
+    }
+    b.WriteByte('\n')
+    return b.Bytes(), nil
+}
+
+// Fold turns an edited sub-document back into the string it came from. It
+// is validated first; JSON returns to a single line when it was compact,
+// and the string ends with a newline only if the original did.
+func (e Embedded) Fold(content []byte) (string, error) {
+    if err := Validate(content, e.Type); err != nil {
+        return "", fmt.Errorf("embedded %s: %v", strings.ToUpper(e.Type), err)
+    }
+    if e.Type == "json" && e.Compact {
+        var b bytes.Buffer
+        if err := json.Compact(&b, content); err != nil {
+            return "", err
+        }
+        content = b.Bytes()
+    }
+    s := strings.TrimRight(string(content), " \t\r\n")
+    if e.newline {
+        s += "\n"
+    }
+    return s, nil
+}
@@ -0,0 +1,438 @@
+// Package engine is edit3's document handling without the HTTP server: file
+// type detection, validation, formatting and conversion between formats. It
+// is what the editor runs before every save, so tools embedding it accept
+// and produce exactly the same documents.
+package engine
+
+import (
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// FileType returns the document type of filename: its extension without the
+// dot ("json", "yaml", "yml", "xml", ...), or for well-known names such as
+// Dockerfile or .babelrc the type they hold.
+func FileType(filename string) string {
+    if t := knownType(filename); t != "" {
+        return t
+    }
+    return strings.TrimPrefix(filepath.Ext(filename), ".")
+}
+
+// Supported reports whether filename is a type the editor opens.
+func Supported(filename string) bool {
+    return SupportedType(FileType(filename))
+}
+
+// SupportedType reports whether the editor opens documents of fileType.
+func SupportedType(fileType string) bool {
+    switch fileType {
+    case "json", "yaml", "yml", "xml", "toml", "csv", "tsv", "tf", "hcl", "pem", "crt", "env", "cue", "jsonnet", "libsonnet", "dockerfile", "sh", "bash", "markdown", "helm":
+        return true
+    }
+    return false
+}
+
+// Limits bound syntax checks. JSON and XML are checked by walking tokens
+// instead of building the document, so memory stays near the size of the
+// largest token: MaxToken caps that (bytes), MaxDepth caps nesting. Zero
+// fields take the defaults.
+type Limits struct {
+    MaxDepth int
+    MaxToken int64
+}
+
+const (
+    DefaultMaxDepth = 10000
+    DefaultMaxToken = 64 << 20
+)
+
+func (l Limits) withDefaults() Limits {
+    if l.MaxDepth <= 0 {
+        l.MaxDepth = DefaultMaxDepth
+    }
+    if l.MaxToken <= 0 {
+        l.MaxToken = DefaultMaxToken
+    }
+    return l
+}
+
+// Validate checks that content is a well-formed document of fileType with
+// the default limits. Unknown types are accepted.
+func Validate(content []byte, fileType string) error {
+    return Limits{}.Validate(content, fileType)
+}
+
+// ValidateReader is Validate for a stream.
+func ValidateReader(r io.Reader, fileType string) error {
+    return Limits{}.ValidateReader(r, fileType)
+}
+
+func (l Limits) Validate(content []byte, fileType string) error {
+    switch fileType {
+    case "yaml", "yml":
+        var y interface{}
+        return yaml.Unmarshal(content, &y)
+    case "markdown", "helm":
+        return validateComposite(content, fileType)
+    case "toml":
+        _, err := parseTOML(content)
+        return err
+    case "csv", "tsv":
+        _, err := ParseTable(content, fileType, false)
+        return err
+    case "tf", "hcl":
+        _, err := ParseHCL(content)
+        return err
+    case "pem", "crt":
+        _, err := DecodePEM(content)
+        return err
+    case "env":
+        _, err := ParseEnv(content)
+        return err
+    case "cue":
+        return ParseCUE(content)
+    case "jsonnet", "libsonnet":
+        return CheckJsonnet(content)
+    }
+    return l.ValidateReader(bytes.NewReader(content), fileType)
+}
+
+// ValidateReader checks a stream. JSON and XML are never held in memory
+// whole; YAML has to be.
+func (l Limits) ValidateReader(r io.Reader, fileType string) error {
+    l = l.withDefaults()
+    switch fileType {
+    case "json":
+        return l.validateJSON(r)
+    case "yaml", "yml":
+        content, err := ioutil.ReadAll(r)
+        if err != nil {
+            return err
+        }
+        var y interface{}
+        return yaml.Unmarshal(content, &y)
+    case "xml":
+        return l.validateXML(r)
+    case "markdown", "helm", "toml", "csv", "tsv", "tf", "hcl", "pem", "crt", "env", "cue", "jsonnet", "libsonnet":
+        content, err := ioutil.ReadAll(r)
+        if err != nil {
+            return err
+        }
+        return l.Validate(content, fileType)
+    }
+    return nil
+}
+
+// errTokenLimit stops a decoder reading past the token limit.
+var errTokenLimit = errors.New("token limit")
+
+// tokenReader hands a decoder no more than limit bytes in all. Decoders
+// only read when they have used up what they hold, so moving limit to the
+// offset of each token plus MaxToken fails an oversized token while it is
+// being read, instead of once it is held in memory whole.
+type tokenReader struct {
+    r     io.Reader
+    read  int64
+    limit int64
+}
+
+func (t *tokenReader) Read(p []byte) (int, error) {
+    if t.read >= t.limit {
+        return 0, errTokenLimit
+    }
+    if int64(len(p)) > t.limit-t.read {
+        p = p[:t.limit-t.read]
+    }
+    n, err := t.r.Read(p)
+    t.read += int64(n)
+    return n, err
+}
+
+// after moves the limit to MaxToken bytes past offset, and one more, which
+// a number needs to see where it ends.
+func (t *tokenReader) after(offset int64, l Limits) {
+    t.limit = offset + l.MaxToken + 1
+}
+
+// validateJSON checks that r holds exactly one JSON value.
+func (l Limits) validateJSON(r io.Reader) error {
+    tr := &tokenReader{r: r}
+    tr.after(0, l)
+    dec := json.NewDecoder(tr)
+    dec.UseNumber()
+    depth, values := 0, 0
+    offset := int64(0)
+    for {
+        tok, err := dec.Token()
+        if errors.Is(err, errTokenLimit) {
+            return fmt.Errorf("token at offset %d is over the %d byte limit", offset, l.MaxToken)
+        }
+        if err == io.EOF {
+            if values == 0 {
+                return errors.New("unexpected end of JSON input")
+            }
+            if depth > 0 {
+                return io.ErrUnexpectedEOF
+            }
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if size := dec.InputOffset() - offset; size > l.MaxToken {
+            return fmt.Errorf("token at offset %d is %d bytes, over the %d byte limit", offset, size, l.MaxToken)
+        }
+        offset = dec.InputOffset()
+        tr.after(offset, l)
+        if depth == 0 && values > 0 {
+            return fmt.Errorf("invalid character after top-level value at offset %d", offset)
+        }
+        switch tok {
+        case json.Delim('{'), json.Delim('['):
+            if depth++; depth > l.MaxDepth {
+                return fmt.Errorf("nesting deeper than %d at offset %d", l.MaxDepth, offset)
+            }
+            continue
+        case json.Delim('}'), json.Delim(']'):
+            depth--
+        }
+        if depth == 0 {
+            values++
+        }
+    }
+}
+
+// validateXML checks that r is well-formed XML with a root element.
+func (l Limits) validateXML(r io.Reader) error {
+    tr := &tokenReader{r: r}
+    tr.after(0, l)
+    dec := xml.NewDecoder(tr)
+    depth, roots := 0, 0
+    for {
+        offset := dec.InputOffset()
+        tok, err := dec.Token()
+        if errors.Is(err, errTokenLimit) {
+            return fmt.Errorf("token at offset %d is over the %d byte limit", offset, l.MaxToken)
+        }
+        if err == io.EOF {
+            if roots == 0 {
+                return io.EOF
+            }
+            if depth > 0 {
+                return io.ErrUnexpectedEOF
+            }
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        tr.after(dec.InputOffset(), l)
+        switch t := tok.(type) {
+        case xml.StartElement:
+            if depth == 0 {
+                roots++
+            }
+            if depth++; depth > l.MaxDepth {
+                return fmt.Errorf("nesting deeper than %d at offset %d", l.MaxDepth, dec.InputOffset())
+            }
+        case xml.EndElement:
+            if depth--; depth < 0 {
+                return fmt.Errorf("unexpected end element </%s>", t.Name.Local)
+            }
+        case xml.CharData:
+            if int64(len(t)) > l.MaxToken {
+                return fmt.Errorf("text at offset %d is over the %d byte limit", dec.InputOffset(), l.MaxToken)
+            }
+        }
+    }
+}
+
+// Format re-indents a document with two spaces. JSON keeps its key order and
+// number literals, YAML keeps comments. Unknown types are returned unchanged.
+func Format(content []byte, fileType string) ([]byte, error) {
+    switch fileType {
+    case "json":
+        var buf bytes.Buffer
+        if err := json.Indent(&buf, bytes.TrimSpace(content), "", "  "); err != nil {
+            return nil, err
+        }
+        buf.WriteByte('\n')
+        return buf.Bytes(), nil
+
+    case "yaml", "yml":
+        // Every document of a stream is re-emitted; a stream holding only
+        // comments has none and is left as it is.
+        dec := yaml.NewDecoder(bytes.NewReader(content))
+        var buf bytes.Buffer
+        enc := yaml.NewEncoder(&buf)
+        enc.SetIndent(2)
+        docs := 0
+        for {
+            var doc yaml.Node
+            err := dec.Decode(&doc)
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                return nil, err
+            }
+            if err := enc.Encode(&doc); err != nil {
+                return nil, err
+            }
+            docs++
+        }
+        if docs == 0 {
+            return content, nil
+        }
+        if err := enc.Close(); err != nil {
+            return nil, err
+        }
+        return buf.Bytes(), nil
+
+    case "xml":
+        dec := xml.NewDecoder(bytes.NewReader(content))
+        var buf bytes.Buffer
+        enc := xml.NewEncoder(&buf)
+        enc.Indent("", "  ")
+        for {
+            tok, err := dec.Token()
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                return nil, err
+            }
+            // Drop whitespace between elements; the encoder re-indents
+            if data, ok := tok.(xml.CharData); ok && len(bytes.TrimSpace(data)) == 0 {
+                continue
+            }
+            if err := enc.EncodeToken(xml.CopyToken(tok)); err != nil {
+                return nil, err
+            }
+        }
+        if err := enc.Flush(); err != nil {
+            return nil, err
+        }
+        buf.WriteByte('\n')
+        return buf.Bytes(), nil
+
+    case "markdown":
+        // Only the front matter; the body is prose
+        c, err := Split(content, fileType)
+        if err != nil || len(c.Head) == 0 {
+            return content, err
+        }
+        if c.Head, err = Format(c.Head, c.Type); err != nil {
+            return nil, err
+        }
+        return c.Join(), nil
+    }
+    return content, nil
+}
+
+// Parse decodes JSON, YAML or TOML into plain values: map[string]interface{},
+// []interface{} and scalars. Other types return a nil document.
+func Parse(content []byte, fileType string) (interface{}, error) {
+    var doc interface{}
+    switch fileType {
+    case "json":
+        if err := json.Unmarshal(content, &doc); err != nil {
+            return nil, err
+        }
+        return doc, nil
+    case "yaml", "yml":
+        if err := yaml.Unmarshal(content, &doc); err != nil {
+            return nil, err
+        }
+        return Normalize(doc), nil
+    case "toml":
+        return parseTOML(content)
+    case "markdown":
+        // The front matter is the data model; without one it is empty
+        c, err := Split(content, fileType)
+        if err != nil {
+            return nil, err
+        }
+        if doc, err = Parse(c.Head, c.Type); doc == nil && err == nil {
+            doc = map[string]interface{}{}
+        }
+        return doc, err
+    }
+    return nil, nil
+}
+
+// Normalize turns YAML's map[interface{}]interface{} and timestamps into
+// JSON-compatible values, in place where it can.
+func Normalize(v interface{}) interface{} {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for k, item := range v {
+            v[k] = Normalize(item)
+        }
+        return v
+    case map[interface{}]interface{}:
+        m := make(map[string]interface{}, len(v))
+        for k, item := range v {
+            m[fmt.Sprint(k)] = Normalize(item)
+        }
+        return m
+    case []interface{}:
+        for i, item := range v {
+            v[i] = Normalize(item)
+        }
+        return v
+    case time.Time:
+        return v.Format(time.RFC3339Nano)
+    }
+    return v
+}
+
+// Marshal renders a plain document as JSON (indented), YAML or TOML.
+func Marshal(doc interface{}, fileType string) ([]byte, error) {
+    switch fileType {
+    case "json":
+        b, err := json.MarshalIndent(doc, "", "  ")
+        return append(b, '\n'), err
+    case "yaml", "yml":
+        return yaml.Marshal(doc)
+    case "toml":
+        return marshalTOML(doc)
+    case "xml":
+        return MarshalXML(doc)
+    }
+    return nil, fmt.Errorf("cannot write %s documents", fileType)
+}
+
+// ConvertTypes are the types Convert reads and writes.
+var ConvertTypes = []string{"json", "yaml", "yml", "xml", "toml"}
+
+// Convert rewrites a document from one type to another, e.g. YAML to JSON.
+// Comments and key order are not carried over; see ParseXML for how XML
+// maps to the others.
+func Convert(content []byte, from, to string) ([]byte, error) {
+    var doc interface{}
+    var err error
+    switch from {
+    case "json", "yaml", "yml", "toml":
+        doc, err = Parse(content, from)
+    case "xml":
+        doc, err = ParseXML(content)
+    default:
+        return nil, fmt.Errorf("cannot read %s documents", from)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return Marshal(doc, to)
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+    "bytes"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// EnvVar is one KEY=value assignment of a .env file. Value is unquoted,
+// with the escapes of double quotes resolved.
+type EnvVar struct {
+    Key    string `json:"key"`
+    Value  string `json:"value"`
+    Line   int    `json:"line"`
+    Export bool   `json:"export,omitempty"`
+
+    start, end int // of the value as written, quotes included
+}
+
+// IsEnv reports whether fileType is read by ParseEnv.
+func IsEnv(fileType string) bool {
+    return fileType == "env"
+}
+
+var envKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ParseEnv reads a .env file: KEY=value lines, optionally prefixed with
+// export, between blank lines and # comments. Values are unquoted (up to a
+// " #" comment), 'single quoted' (taken literally) or "double quoted" (with
+// \n, \t, \" and \\ escapes); quoted values may span lines. A key set twice
+// is an error, since only one of the values would take effect.
+func ParseEnv(content []byte) ([]EnvVar, error) {
+    vars := []EnvVar{}
+    seen := map[string]int{}
+    line := 1
+    for pos := 0; pos < len(content); {
+        eol := bytes.IndexByte(content[pos:], '\n')
+        if eol < 0 {
+            eol = len(content)
+        } else {
+            eol += pos
+        }
+        text := strings.TrimRight(string(content[pos:eol]), "\r")
+        trimmed := strings.TrimSpace(text)
+        if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+            pos, line = eol+1, line+1
+            continue
+        }
+        v := EnvVar{Line: line}
+        assignment := strings.TrimLeft(text, " \t")
+        if rest := strings.TrimPrefix(assignment, "export "); rest != assignment {
+            v.Export, assignment = true, strings.TrimLeft(rest, " \t")
+        }
+        eq := strings.IndexByte(assignment, '=')
+        if eq < 0 {
+            return nil, fmt.Errorf("line %d: expected KEY=value", line)
+        }
+        v.Key = assignment[:eq]
+        if !envKey.MatchString(v.Key) {
+            return nil, fmt.Errorf("line %d: %q is not a valid variable name", line, v.Key)
+        }
+        if first, ok := seen[v.Key]; ok {
+            return nil, fmt.Errorf("line %d: %s is already set on line %d", line, v.Key, first)
+        }
+        seen[v.Key] = line
+        v.start = pos + len(text) - len(assignment) + eq + 1
+        for v.start < eol && (content[v.start] == ' ' || content[v.start] == '\t') {
+            v.start++
+        }
+        next, lines, err := envValue(content, &v, eol)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %s: %v", line, v.Key, err)
+        }
+        vars = append(vars, v)
+        pos, line = next, line+lines
+    }
+    return vars, nil
+}
+
+// envValue reads the value starting at v.start, whose line ends at eol. It
+// returns where the next line starts and how many lines the value took.
+func envValue(content []byte, v *EnvVar, eol int) (int, int, error) {
+    if v.start >= eol || (content[v.start] != '\'' && content[v.start] != '"') {
+        value := strings.TrimRight(string(content[v.start:eol]), "\r")
+        if i := strings.Index(value, " #"); i >= 0 {
+            value = value[:i]
+        }
+        value = strings.TrimRight(value, " \t")
+        v.Value, v.end = value, v.start+len(value)
+        return eol + 1, 1, nil
+    }
+    quote := content[v.start]
+    var b strings.Builder
+    i := v.start + 1
+    for ; i < len(content) && content[i] != quote; i++ {
+        c := content[i]
+        if quote == '"' && c == '\\' && i+1 < len(content) {
+            i++
+            switch content[i] {
+            case 'n':
+                c = '\n'
+            case 't':
+                c = '\t'
+            case 'r':
+                c = '\r'
+            default:
+                c = content[i]
+            }
+        }
+        b.WriteByte(c)
+    }
+    if i >= len(content) {
+        return 0, 0, fmt.Errorf("the value opened with %c is not closed", quote)
+    }
+    v.Value, v.end = b.String(), i+1
+    end := bytes.IndexByte(content[v.end:], '\n')
+    if end < 0 {
+        end = len(content)
+    } else {
+        end += v.end
+    }
+    if rest := strings.TrimSpace(string(content[v.end:end])); rest != "" && !strings.HasPrefix(rest, "#") {
+        return 0, 0, fmt.Errorf("unexpected %q after the quoted value", rest)
+    }
+    return end + 1, bytes.Count(content[v.start:end], []byte("\n")) + 1, nil
+}
+
+// MaskEnv replaces the values of keys matching secret with MaskedKey. A
+// file that does not parse is masked line by line, so that nothing after
+// the = of a secret key's line is shown.
+func MaskEnv(content []byte, secret *regexp.Regexp) []byte {
+    vars, err := ParseEnv(content)
+    if err != nil {
+        lines := strings.SplitAfter(string(content), "\n")
+        for i, line := range lines {
+            assignment := strings.TrimPrefix(strings.TrimLeft(line, " \t"), "export ")
+            if eq := strings.IndexByte(assignment, '='); eq > 0 && secret.MatchString(strings.TrimSpace(assignment[:eq])) {
+                end := strings.TrimRight(line, "\r\n")
+                lines[i] = line[:len(line)-len(assignment)+eq+1] + MaskedKey + line[len(end):]
+            }
+        }
+        return []byte(strings.Join(lines, ""))
+    }
+    var masked []EnvVar
+    for _, v := range vars {
+        if secret.MatchString(v.Key) && v.Value != "" {
+            masked = append(masked, v)
+        }
+    }
+    return replaceEnvValues(content, masked, func(EnvVar) []byte { return []byte(MaskedKey) })
+}
+
+// UnmaskEnv puts the values of original back into content wherever MaskEnv
+// left a key masked.
+func UnmaskEnv(content, original []byte) ([]byte, error) {
+    vars, err := ParseEnv(content)
+    if err != nil {
+        return nil, err
+    }
+    saved, _ := ParseEnv(original)
+    values := map[string][]byte{}
+    for _, v := range saved {
+        values[v.Key] = original[v.start:v.end]
+    }
+    var masked []EnvVar
+    for _, v := range vars {
+        if v.Value != MaskedKey {
+            continue
+        }
+        if _, ok := values[v.Key]; !ok {
+            return nil, fmt.Errorf("line %d: %s is masked but has no value in the saved file", v.Line, v.Key)
+        }
+        masked = append(masked, v)
+    }
+    return replaceEnvValues(content, masked, func(v EnvVar) []byte { return values[v.Key] }), nil
+}
+
+// replaceEnvValues swaps the values of vars as written for what value
+// returns.
+func replaceEnvValues(content []byte, vars []EnvVar, value func(EnvVar) []byte) []byte {
+    if len(vars) == 0 {
+        return content
+    }
+    sort.Slice(vars, func(i, j int) bool { return vars[i].start < vars[j].start })
+    var b bytes.Buffer
+    last := 0
+    for _, v := range vars {
+        b.Write(content[last:v.start])
+        b.Write(value(v))
+        last = v.end
+    }
+    b.Write(content[last:])
+    return b.Bytes()
+}
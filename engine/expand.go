@@ -0,0 +1,125 @@
+package engine
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+
+    "gopkg.in/yaml.v3"
+)
+
+// MaxExpandedNodes caps how many nodes Expand may produce, so that nested
+// aliases ("billion laughs") cannot exhaust memory.
+var MaxExpandedNodes = 1000000
+
+// Expand returns YAML with every alias replaced by a copy of its anchored
+// node and merge keys (<<) folded into their mappings: the document a YAML
+// reader sees. Keys written in a mapping win over merged ones, and earlier
+// merge sources over later ones. Comments and key order are kept; anchors
+// are dropped. The result is for reading, not for saving over the original.
+func Expand(content []byte) ([]byte, error) {
+    dec := yaml.NewDecoder(bytes.NewReader(content))
+    var b bytes.Buffer
+    enc := yaml.NewEncoder(&b)
+    x := &expander{}
+    for {
+        var doc yaml.Node
+        if err := dec.Decode(&doc); err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        expanded, err := x.expand(&doc)
+        if err != nil {
+            return nil, err
+        }
+        if err := enc.Encode(expanded); err != nil {
+            return nil, err
+        }
+    }
+    if err := enc.Close(); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+type expander struct {
+    nodes int
+}
+
+// expand returns a copy of n with aliases and merge keys resolved.
+func (x *expander) expand(n *yaml.Node) (*yaml.Node, error) {
+    if x.nodes++; x.nodes > MaxExpandedNodes {
+        return nil, fmt.Errorf("document expands to more than %d nodes", MaxExpandedNodes)
+    }
+    if n.Kind == yaml.AliasNode {
+        expanded, err := x.expand(n.Alias)
+        if err != nil {
+            return nil, err
+        }
+        if n.LineComment != "" {
+            expanded.LineComment = n.LineComment
+        }
+        return expanded, nil
+    }
+    c := *n
+    c.Anchor = ""
+    c.Content = make([]*yaml.Node, 0, len(n.Content))
+    if n.Kind != yaml.MappingNode {
+        for _, child := range n.Content {
+            expanded, err := x.expand(child)
+            if err != nil {
+                return nil, err
+            }
+            c.Content = append(c.Content, expanded)
+        }
+        return &c, nil
+    }
+
+    // Keys written in the mapping itself, which merged keys may not override
+    own := make(map[string]bool)
+    for i := 0; i+1 < len(n.Content); i += 2 {
+        if !isMergeKey(n.Content[i]) {
+            own[n.Content[i].Value] = true
+        }
+    }
+    for i := 0; i+1 < len(n.Content); i += 2 {
+        key, value := n.Content[i], n.Content[i+1]
+        if !isMergeKey(key) {
+            k, err := x.expand(key)
+            if err != nil {
+                return nil, err
+            }
+            v, err := x.expand(value)
+            if err != nil {
+                return nil, err
+            }
+            c.Content = append(c.Content, k, v)
+            continue
+        }
+        sources := []*yaml.Node{value}
+        if value.Kind == yaml.SequenceNode {
+            sources = value.Content
+        }
+        for _, source := range sources {
+            merged, err := x.expand(source)
+            if err != nil {
+                return nil, err
+            }
+            if merged.Kind != yaml.MappingNode {
+                return nil, fmt.Errorf("line %d: << must merge a mapping or a list of mappings", source.Line)
+            }
+            for j := 0; j+1 < len(merged.Content); j += 2 {
+                if name := merged.Content[j].Value; !own[name] {
+                    own[name] = true
+                    c.Content = append(c.Content, merged.Content[j], merged.Content[j+1])
+                }
+            }
+        }
+    }
+    return &c, nil
+}
+
+func isMergeKey(n *yaml.Node) bool {
+    return n.Kind == yaml.ScalarNode && n.Value == "<<" && (n.Tag == "!!merge" || n.Tag == "")
+}
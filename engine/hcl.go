@@ -0,0 +1,118 @@
+package engine
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+
+    "github.com/hashicorp/hcl/v2"
+    "github.com/hashicorp/hcl/v2/hclsyntax"
+    ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// HCLBody is the structure of an HCL document such as a Terraform module:
+// attributes and nested blocks, each in source order.
+type HCLBody struct {
+    Attributes []HCLAttribute `json:"attributes"`
+    Blocks     []HCLBlock     `json:"blocks"`
+}
+
+// HCLAttribute is name = expression. Value is set when the expression is a
+// constant; references and function calls are only known as Expr.
+type HCLAttribute struct {
+    Name  string      `json:"name"`
+    Line  int         `json:"line"`
+    Expr  string      `json:"expr"`
+    Value interface{} `json:"value,omitempty"`
+}
+
+// HCLBlock is a block like resource "aws_instance" "web" { ... }.
+type HCLBlock struct {
+    Type   string   `json:"type"`
+    Labels []string `json:"labels"`
+    Line   int      `json:"line"`
+    Body   HCLBody  `json:"body"`
+}
+
+// IsHCL reports whether fileType is read by ParseHCL.
+func IsHCL(fileType string) bool {
+    return fileType == "tf" || fileType == "hcl"
+}
+
+// ParseHCL reads an HCL document in native syntax. Only syntax is checked:
+// whether references resolve is up to the tools that apply it.
+func ParseHCL(content []byte) (*HCLBody, error) {
+    file, diags := hclsyntax.ParseConfig(content, "", hcl.InitialPos)
+    if diags.HasErrors() {
+        return nil, hclError(diags)
+    }
+    body := hclBody(file.Body.(*hclsyntax.Body), content)
+    return &body, nil
+}
+
+// hclError reports the errors of diags with their positions.
+func hclError(diags hcl.Diagnostics) error {
+    var messages []string
+    for _, d := range diags {
+        if d.Severity != hcl.DiagError {
+            continue
+        }
+        message := d.Summary
+        if d.Detail != "" {
+            message += ": " + d.Detail
+        }
+        if d.Subject != nil {
+            message = fmt.Sprintf("line %d, column %d: %s", d.Subject.Start.Line, d.Subject.Start.Column, message)
+        }
+        messages = append(messages, message)
+    }
+    return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
+
+func hclBody(b *hclsyntax.Body, content []byte) HCLBody {
+    body := HCLBody{Attributes: []HCLAttribute{}, Blocks: []HCLBlock{}}
+    for _, attr := range b.Attributes {
+        a := HCLAttribute{
+            Name: attr.Name,
+            Line: attr.SrcRange.Start.Line,
+            Expr: string(attr.Expr.Range().SliceBytes(content)),
+        }
+        if len(attr.Expr.Variables()) == 0 {
+            a.Value = hclConstant(attr.Expr)
+        }
+        body.Attributes = append(body.Attributes, a)
+    }
+    sort.Slice(body.Attributes, func(i, j int) bool { return body.Attributes[i].Line < body.Attributes[j].Line })
+    for _, block := range b.Blocks {
+        labels := block.Labels
+        if labels == nil {
+            labels = []string{}
+        }
+        body.Blocks = append(body.Blocks, HCLBlock{
+            Type:   block.Type,
+            Labels: labels,
+            Line:   block.TypeRange.Start.Line,
+            Body:   hclBody(block.Body, content),
+        })
+    }
+    return body
+}
+
+// hclConstant evaluates an expression without variables or functions, nil
+// when it needs either.
+func hclConstant(expr hclsyntax.Expression) interface{} {
+    v, diags := expr.Value(nil)
+    if diags.HasErrors() || !v.IsWhollyKnown() {
+        return nil
+    }
+    b, err := ctyjson.Marshal(v, v.Type())
+    if err != nil {
+        return nil
+    }
+    var value interface{}
+    if json.Unmarshal(b, &value) != nil {
+        return nil
+    }
+    return value
+}
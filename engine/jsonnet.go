@@ -0,0 +1,67 @@
+package engine
+
+import (
+    "errors"
+    "path"
+    "strings"
+
+    "github.com/google/go-jsonnet"
+)
+
+// IsJsonnet reports whether fileType is read by EvalJsonnet.
+func IsJsonnet(fileType string) bool {
+    return fileType == "jsonnet" || fileType == "libsonnet"
+}
+
+// JsonnetMaxStack bounds the recursion of an evaluation.
+const JsonnetMaxStack = 500
+
+// JsonnetReader reads a file a Jsonnet program imports. Name is slash
+// separated and relative to where the program's files live, the way the
+// program's own filename is given to EvalJsonnet.
+type JsonnetReader func(name string) ([]byte, error)
+
+// CheckJsonnet parses content without evaluating it, since evaluation
+// needs the files it imports.
+func CheckJsonnet(content []byte) error {
+    _, err := jsonnet.SnippetToAST("input.jsonnet", string(content))
+    return err
+}
+
+// EvalJsonnet evaluates content as the file filename and returns the JSON
+// it produces. Imports are resolved against the importing file and read
+// with read; none may leave the directory filename is relative to.
+func EvalJsonnet(filename string, content []byte, read JsonnetReader) ([]byte, error) {
+    vm := jsonnet.MakeVM()
+    vm.MaxStack = JsonnetMaxStack
+    vm.Importer(&jsonnetImporter{read: read, cache: make(map[string]jsonnet.Contents)})
+    out, err := vm.EvaluateAnonymousSnippet(filename, string(content))
+    if err != nil {
+        return nil, errors.New(strings.TrimSpace(err.Error()))
+    }
+    return []byte(out), nil
+}
+
+// jsonnetImporter serves imports through a JsonnetReader. go-jsonnet wants
+// the same Contents each time a file is imported, hence the cache.
+type jsonnetImporter struct {
+    read  JsonnetReader
+    cache map[string]jsonnet.Contents
+}
+
+func (i *jsonnetImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+    name := path.Clean(path.Join(path.Dir(importedFrom), importedPath))
+    if path.IsAbs(importedPath) || name == ".." || strings.HasPrefix(name, "../") {
+        return jsonnet.Contents{}, "", errors.New("imports must stay within the data directory")
+    }
+    if contents, ok := i.cache[name]; ok {
+        return contents, name, nil
+    }
+    b, err := i.read(name)
+    if err != nil {
+        return jsonnet.Contents{}, "", err
+    }
+    contents := jsonnet.MakeContents(string(b))
+    i.cache[name] = contents
+    return contents, name, nil
+}
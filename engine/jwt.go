@@ -0,0 +1,133 @@
+package engine
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/go-jose/go-jose/v4"
+)
+
+// JWT is a decoded JSON Web Token. Decoding checks nothing but the form;
+// whether the signature holds is up to VerifyJWT.
+type JWT struct {
+    Header    map[string]interface{} `json:"header"`
+    Claims    map[string]interface{} `json:"claims"`
+    IssuedAt  *time.Time             `json:"issuedAt,omitempty"`
+    NotBefore *time.Time             `json:"notBefore,omitempty"`
+    ExpiresAt *time.Time             `json:"expiresAt,omitempty"`
+    Expired   bool                   `json:"expired"`
+}
+
+// jwtPattern matches a compact JWS whose header and payload are JSON
+// objects, which always encode to a leading "eyJ".
+var jwtPattern = regexp.MustCompile(`^eyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*$`)
+
+// LooksLikeJWT reports whether s, with an optional "Bearer " prefix, has the
+// form of a JWT.
+func LooksLikeJWT(s string) bool {
+    return jwtPattern.MatchString(trimBearer(s))
+}
+
+func trimBearer(s string) string {
+    s = strings.TrimSpace(s)
+    if len(s) > 7 && strings.EqualFold(s[:7], "bearer ") {
+        s = strings.TrimSpace(s[7:])
+    }
+    return s
+}
+
+// DecodeJWT reads the header and claims of a token without verifying it.
+// The registered time claims are reported as times, and Expired is set
+// once exp is past at now.
+func DecodeJWT(token string, now time.Time) (*JWT, error) {
+    parts := strings.Split(trimBearer(token), ".")
+    if len(parts) != 3 {
+        return nil, fmt.Errorf("a JWT has 3 parts separated by dots, not %d", len(parts))
+    }
+    t := &JWT{}
+    if err := jwtSegment(parts[0], &t.Header); err != nil {
+        return nil, fmt.Errorf("header: %v", err)
+    }
+    if err := jwtSegment(parts[1], &t.Claims); err != nil {
+        return nil, fmt.Errorf("claims: %v", err)
+    }
+    t.IssuedAt = jwtTime(t.Claims["iat"])
+    t.NotBefore = jwtTime(t.Claims["nbf"])
+    t.ExpiresAt = jwtTime(t.Claims["exp"])
+    t.Expired = t.ExpiresAt != nil && !t.ExpiresAt.After(now)
+    return t, nil
+}
+
+func jwtSegment(s string, v *map[string]interface{}) error {
+    b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+    if err != nil {
+        return errors.New("not base64url")
+    }
+    d := json.NewDecoder(bytes.NewReader(b))
+    d.UseNumber()
+    if err := d.Decode(v); err != nil || *v == nil {
+        return errors.New("not a JSON object")
+    }
+    return nil
+}
+
+// jwtTime reads a NumericDate, seconds since the epoch.
+func jwtTime(v interface{}) *time.Time {
+    n, ok := v.(json.Number)
+    if !ok {
+        return nil
+    }
+    f, err := n.Float64()
+    if err != nil {
+        return nil
+    }
+    sec, frac := math.Modf(f)
+    t := time.Unix(int64(sec), int64(frac*1e9)).UTC()
+    return &t
+}
+
+// jwtAlgorithms are the signature algorithms a JWKS can verify: public
+// keys only, since shared HMAC secrets are not published.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+    jose.RS256, jose.RS384, jose.RS512,
+    jose.PS256, jose.PS384, jose.PS512,
+    jose.ES256, jose.ES384, jose.ES512,
+    jose.EdDSA,
+}
+
+// VerifyJWT checks the signature of token against the keys of a JSON Web
+// Key Set and returns the ID of the key that verified it. A token naming a
+// key (kid) is only checked against that key; one that does not is tried
+// against every key. Expiry is not checked.
+func VerifyJWT(token string, jwks []byte) (string, error) {
+    var set jose.JSONWebKeySet
+    if err := json.Unmarshal(jwks, &set); err != nil {
+        return "", fmt.Errorf("key set: %v", err)
+    }
+    sig, err := jose.ParseSigned(trimBearer(token), jwtAlgorithms)
+    if err != nil {
+        return "", err
+    }
+    keys := set.Keys
+    if kid := sig.Signatures[0].Header.KeyID; kid != "" {
+        if keys = set.Key(kid); len(keys) == 0 {
+            return "", fmt.Errorf("the key set has no key %q", kid)
+        }
+    }
+    for _, key := range keys {
+        if !key.IsPublic() {
+            key = key.Public()
+        }
+        if _, err := sig.Verify(key); err == nil {
+            return key.KeyID, nil
+        }
+    }
+    return "", errors.New("the signature does not match any key of the key set")
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package engine
+
+import (
+    "runtime/debug"
+    "syscall"
+)
+
+// LimitMemory caps the memory the current process may allocate at max
+// bytes, for worker processes running untrusted programs. The Go heap is
+// collected well before the cap, and an allocation past it ends the
+// process.
+func LimitMemory(max int64) error {
+    debug.SetMemoryLimit(max / 4 * 3)
+    return syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: uint64(max), Max: uint64(max)})
+}
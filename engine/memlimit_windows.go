@@ -0,0 +1,11 @@
+package engine
+
+import "runtime/debug"
+
+// LimitMemory caps the memory the current process may allocate at max
+// bytes, for worker processes running untrusted programs. Windows has no
+// per-process data limit, so only the Go heap's soft limit is set.
+func LimitMemory(max int64) error {
+    debug.SetMemoryLimit(max / 4 * 3)
+    return nil
+}
@@ -0,0 +1,208 @@
+package engine
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// PEMBlock describes one block of a PEM file. Certificates are decoded;
+// keys are only described, never returned.
+type PEMBlock struct {
+    Type        string           `json:"type"`
+    Line        int              `json:"line"`
+    Certificate *CertificateInfo `json:"certificate,omitempty"`
+    Key         *KeyInfo         `json:"key,omitempty"`
+}
+
+type CertificateInfo struct {
+    Subject            string    `json:"subject"`
+    Issuer             string    `json:"issuer"`
+    SerialNumber       string    `json:"serialNumber"`
+    NotBefore          time.Time `json:"notBefore"`
+    NotAfter           time.Time `json:"notAfter"`
+    DNSNames           []string  `json:"dnsNames,omitempty"`
+    IPAddresses        []string  `json:"ipAddresses,omitempty"`
+    EmailAddresses     []string  `json:"emailAddresses,omitempty"`
+    URIs               []string  `json:"uris,omitempty"`
+    IsCA               bool      `json:"isCA"`
+    KeyAlgorithm       string    `json:"keyAlgorithm"`
+    SignatureAlgorithm string    `json:"signatureAlgorithm"`
+    SHA256             string    `json:"sha256"` // fingerprint
+}
+
+type KeyInfo struct {
+    Algorithm string `json:"algorithm,omitempty"`
+    Bits      int    `json:"bits,omitempty"`
+    Encrypted bool   `json:"encrypted,omitempty"`
+    Masked    bool   `json:"masked,omitempty"`
+}
+
+// IsPEM reports whether fileType is read by DecodePEM.
+func IsPEM(fileType string) bool {
+    return fileType == "pem" || fileType == "crt"
+}
+
+// MaskedKey stands in for the body of a private key block, or a secret
+// value, in content handed out by MaskPEM and MaskEnv.
+const MaskedKey = "edit3:masked"
+
+var (
+    pemBegin    = regexp.MustCompile(`(?m)^-----BEGIN ([A-Z0-9 ]+)-----`)
+    privateKeys = regexp.MustCompile(`(?s)(-----BEGIN ([A-Z0-9 ]*PRIVATE KEY)-----\r?\n).*?(-----END ([A-Z0-9 ]*PRIVATE KEY)-----)`)
+)
+
+// DecodePEM checks that every block of a PEM file decodes, that
+// certificates parse and that unencrypted keys parse, and describes each.
+// Text between blocks is allowed, as RFC 7468 does; an empty file is an
+// empty bundle.
+func DecodePEM(content []byte) ([]PEMBlock, error) {
+    blocks := []PEMBlock{}
+    for _, loc := range pemBegin.FindAllSubmatchIndex(content, -1) {
+        line := bytes.Count(content[:loc[0]], []byte("\n")) + 1
+        b := PEMBlock{Type: string(content[loc[2]:loc[3]]), Line: line}
+        rest := content[loc[0]:]
+        if strings.HasSuffix(b.Type, "PRIVATE KEY") && bytes.HasPrefix(bytes.TrimLeft(rest[loc[1]-loc[0]:], "\r\n"), []byte(MaskedKey)) {
+            b.Key = &KeyInfo{Masked: true}
+            blocks = append(blocks, b)
+            continue
+        }
+        end := []byte("-----END " + b.Type + "-----")
+        i := bytes.Index(rest, end)
+        if i < 0 {
+            return nil, fmt.Errorf("line %d: the %s block is not closed", line, b.Type)
+        }
+        block, _ := pem.Decode(rest[:i+len(end)])
+        if block == nil {
+            return nil, fmt.Errorf("line %d: the %s block does not decode", line, b.Type)
+        }
+        switch {
+        case block.Type == "CERTIFICATE":
+            cert, err := x509.ParseCertificate(block.Bytes)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", line, err)
+            }
+            b.Certificate = certificateInfo(cert)
+        case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+            key, err := keyInfo(block)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", line, err)
+            }
+            b.Key = key
+        }
+        blocks = append(blocks, b)
+    }
+    return blocks, nil
+}
+
+func certificateInfo(cert *x509.Certificate) *CertificateInfo {
+    sum := sha256.Sum256(cert.Raw)
+    info := &CertificateInfo{
+        Subject:            cert.Subject.String(),
+        Issuer:             cert.Issuer.String(),
+        SerialNumber:       cert.SerialNumber.Text(16),
+        NotBefore:          cert.NotBefore,
+        NotAfter:           cert.NotAfter,
+        DNSNames:           cert.DNSNames,
+        EmailAddresses:     cert.EmailAddresses,
+        IsCA:               cert.IsCA,
+        KeyAlgorithm:       cert.PublicKeyAlgorithm.String(),
+        SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+        SHA256:             hex.EncodeToString(sum[:]),
+    }
+    for _, ip := range cert.IPAddresses {
+        info.IPAddresses = append(info.IPAddresses, ip.String())
+    }
+    for _, u := range cert.URIs {
+        info.URIs = append(info.URIs, u.String())
+    }
+    return info
+}
+
+func keyInfo(block *pem.Block) (*KeyInfo, error) {
+    if block.Type == "ENCRYPTED PRIVATE KEY" || block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+        return &KeyInfo{Encrypted: true}, nil
+    }
+    var key interface{}
+    var err error
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "EC PRIVATE KEY":
+        key, err = x509.ParseECPrivateKey(block.Bytes)
+    case "PRIVATE KEY":
+        key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    default:
+        return &KeyInfo{}, nil // OpenSSH and other formats are kept as they are
+    }
+    if err != nil {
+        return nil, err
+    }
+    switch k := key.(type) {
+    case *rsa.PrivateKey:
+        return &KeyInfo{Algorithm: "RSA", Bits: k.N.BitLen()}, nil
+    case *ecdsa.PrivateKey:
+        return &KeyInfo{Algorithm: "ECDSA", Bits: k.Curve.Params().BitSize}, nil
+    case ed25519.PrivateKey:
+        return &KeyInfo{Algorithm: "Ed25519", Bits: 256}, nil
+    }
+    return &KeyInfo{}, nil
+}
+
+// MaskPEM replaces the body of every private key block with MaskedKey and
+// the key's maskedID, so content can be shown without the keys in it.
+func MaskPEM(content []byte) []byte {
+    return privateKeys.ReplaceAllFunc(content, func(block []byte) []byte {
+        m := privateKeys.FindSubmatch(block)
+        masked := append(append([]byte{}, m[1]...), MaskedKey+" "+maskedID(block)+"\n"...)
+        return append(masked, m[3]...)
+    })
+}
+
+// maskedID names a private key block without revealing it.
+func maskedID(block []byte) string {
+    sum := sha256.Sum256(block)
+    return hex.EncodeToString(sum[:8])
+}
+
+var maskedLine = regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(MaskedKey) + `(?: ([0-9a-f]+))?[ \t\r]*$`)
+
+// UnmaskPEM puts the keys of original back into content where MaskPEM
+// left them masked. Each masked block takes the key of original its
+// maskedID names, wherever it has moved; a bare MaskedKey only when
+// original holds a single key. A masked block matching no key is an error,
+// rather than a guess that could pair a certificate with the wrong key.
+func UnmaskPEM(content, original []byte) ([]byte, error) {
+    all := privateKeys.FindAll(original, -1)
+    keys := make(map[string][]byte, len(all))
+    for _, key := range all {
+        keys[maskedID(key)] = key
+    }
+    var missing error
+    restored := privateKeys.ReplaceAllFunc(content, func(block []byte) []byte {
+        m := maskedLine.FindSubmatch(block)
+        if m == nil {
+            return block
+        }
+        key, ok := keys[string(m[1])]
+        if len(m[1]) == 0 && len(all) == 1 {
+            key, ok = all[0], true
+        }
+        if !ok {
+            missing = errors.New("a masked private key does not match any key of the saved file")
+            return block
+        }
+        return key
+    })
+    return restored, missing
+}
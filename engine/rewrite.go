@@ -0,0 +1,597 @@
+package engine
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "reflect"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/pelletier/go-toml/v2"
+    "github.com/pelletier/go-toml/v2/unstable"
+    "gopkg.in/yaml.v3"
+)
+
+// rewrite renders doc in place of original, a document of fileType, keeping
+// what it can of original: YAML comments, key order and quoting survive on
+// the values that did not change, and TOML is only patched where values
+// changed. Other types are marshalled whole.
+func rewrite(original []byte, doc interface{}, fileType string) ([]byte, error) {
+    if len(bytes.TrimSpace(original)) == 0 {
+        return Marshal(doc, fileType)
+    }
+    switch fileType {
+    case "yaml", "yml":
+        return rewriteYAML(original, doc)
+    case "toml":
+        return rewriteTOML(original, doc)
+    }
+    return Marshal(doc, fileType)
+}
+
+// rewriteYAML merges doc into the node tree of original. Files holding
+// several documents are refused: doc only stands for the first.
+func rewriteYAML(original []byte, doc interface{}) ([]byte, error) {
+    dec := yaml.NewDecoder(bytes.NewReader(original))
+    var root yaml.Node
+    if err := dec.Decode(&root); err == io.EOF {
+        return Marshal(doc, "yaml")
+    } else if err != nil {
+        return nil, err
+    }
+    var next yaml.Node
+    if err := dec.Decode(&next); err == nil {
+        return nil, errors.New("the file holds several YAML documents; only single-document files can be rewritten")
+    } else if err != io.EOF {
+        return nil, err
+    }
+    if len(root.Content) == 0 {
+        return Marshal(doc, "yaml")
+    }
+    if err := mergeYAML(root.Content[0], doc); err != nil {
+        return nil, err
+    }
+    var b bytes.Buffer
+    if line := bytes.SplitN(original, []byte("\n"), 2)[0]; string(bytes.TrimSpace(line)) == "---" {
+        b.WriteString("---\n")
+    }
+    enc := yaml.NewEncoder(&b)
+    enc.SetIndent(yamlIndent(original))
+    if err := enc.Encode(&root); err != nil {
+        return nil, err
+    }
+    if err := enc.Close(); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+// mergeYAML changes n to hold v, leaving the nodes that already hold the
+// right value alone so that their comments, anchors and styles survive.
+// Mappings keep their key order; new keys are added after it in sorted
+// order.
+func mergeYAML(n *yaml.Node, v interface{}) error {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        if n.Kind == yaml.MappingNode && !hasMergeKey(n) {
+            return mergeYAMLMapping(n, v)
+        }
+    case []interface{}:
+        if n.Kind == yaml.SequenceNode {
+            return mergeYAMLSequence(n, v)
+        }
+    }
+    var current interface{}
+    if n.Decode(&current) == nil && reflect.DeepEqual(Normalize(current), v) {
+        return nil
+    }
+    var fresh yaml.Node
+    if err := fresh.Encode(v); err != nil {
+        return err
+    }
+    if n.Kind == yaml.ScalarNode && fresh.Kind == yaml.ScalarNode && n.Tag == fresh.Tag && n.Style != 0 {
+        n.Value = fresh.Value // keep the quoting or block style
+        return nil
+    }
+    fresh.HeadComment, fresh.LineComment, fresh.FootComment = n.HeadComment, n.LineComment, n.FootComment
+    fresh.Anchor = n.Anchor
+    *n = fresh
+    return nil
+}
+
+func mergeYAMLMapping(n *yaml.Node, m map[string]interface{}) error {
+    seen := make(map[string]bool, len(m))
+    var content []*yaml.Node
+    for i := 0; i+1 < len(n.Content); i += 2 {
+        key := n.Content[i].Value
+        value, ok := m[key]
+        if !ok || seen[key] {
+            continue
+        }
+        if err := mergeYAML(n.Content[i+1], value); err != nil {
+            return err
+        }
+        content = append(content, n.Content[i], n.Content[i+1])
+        seen[key] = true
+    }
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        if !seen[key] {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        var k, value yaml.Node
+        if err := k.Encode(key); err != nil {
+            return err
+        }
+        if err := value.Encode(m[key]); err != nil {
+            return err
+        }
+        content = append(content, &k, &value)
+    }
+    n.Content = content
+    return nil
+}
+
+func mergeYAMLSequence(n *yaml.Node, items []interface{}) error {
+    for i, item := range items {
+        if i < len(n.Content) {
+            if err := mergeYAML(n.Content[i], item); err != nil {
+                return err
+            }
+            continue
+        }
+        var node yaml.Node
+        if err := node.Encode(item); err != nil {
+            return err
+        }
+        n.Content = append(n.Content, &node)
+    }
+    n.Content = n.Content[:len(items)]
+    return nil
+}
+
+// hasMergeKey reports whether a mapping merges others in with <<, which
+// its decoded value no longer shows key by key.
+func hasMergeKey(n *yaml.Node) bool {
+    for i := 0; i < len(n.Content); i += 2 {
+        if n.Content[i].Tag == "!!merge" {
+            return true
+        }
+    }
+    return false
+}
+
+// yamlIndent guesses the indentation content is written with, so that it
+// is written back the same way; four spaces, yaml.v3's default, when
+// nothing is indented.
+func yamlIndent(content []byte) int {
+    indent := 0
+    for _, line := range strings.Split(string(content), "\n") {
+        text := strings.TrimLeft(line, " ")
+        n := len(line) - len(text)
+        if n == 0 || strings.TrimSpace(text) == "" || text[0] == '#' {
+            continue
+        }
+        if indent == 0 || n < indent {
+            indent = n
+        }
+    }
+    if indent < 2 || indent > 8 {
+        return 4
+    }
+    return indent
+}
+
+// tomlSpan is a key/value or a table header in the text of a TOML
+// document. Path holds the keys leading to it, with elements of arrays of
+// tables given by their index. For a key/value, value and end delimit its
+// value; for a header, end is where its section ends.
+type tomlSpan struct {
+    path         []string
+    table        bool
+    depth        int // keys of the table holding a key/value
+    start, value int
+    end          int
+    line         int // end of the last line, trailing comment included
+}
+
+// rewriteTOML patches original where its values differ from doc: changed
+// values are replaced, removed keys and tables deleted, and new keys added
+// at the end of their table. Everything else is kept as written. The result
+// is parsed again and refused unless it reads back as doc.
+func rewriteTOML(original []byte, doc interface{}) ([]byte, error) {
+    if _, ok := doc.(map[string]interface{}); !ok {
+        return nil, errors.New("a TOML document must be a table")
+    }
+    before, err := parseTOML(original)
+    if err != nil {
+        return nil, err
+    }
+    if reflect.DeepEqual(before, doc) {
+        return original, nil
+    }
+    spans, err := tomlSpans(original)
+    if err != nil {
+        return nil, err
+    }
+
+    type patch struct {
+        start, end int
+        text       string
+    }
+    var patches []patch
+    var deleted [][2]int
+    inDeleted := func(offset int) bool {
+        for _, d := range deleted {
+            if offset >= d[0] && offset < d[1] {
+                return true
+            }
+        }
+        return false
+    }
+    covered := map[string]bool{} // paths the text still defines
+    leaves := map[string]bool{}  // paths defined by a key/value
+    sections := map[string]int{} // where to add keys to a table
+    sections[""] = 0
+    cover := func(path []string) {
+        for i := 1; i <= len(path); i++ {
+            covered[tomlPathKey(path[:i])] = true
+        }
+    }
+
+    for _, s := range spans {
+        if !s.table || inDeleted(s.start) {
+            continue
+        }
+        if value, ok := tomlLookup(doc, s.path); !ok || !isTable(value) {
+            patches = append(patches, patch{s.start, s.end, ""})
+            deleted = append(deleted, [2]int{s.start, s.end})
+            continue
+        }
+        cover(s.path)
+        sections[tomlPathKey(s.path)] = s.line
+    }
+    for _, s := range spans {
+        if s.table || inDeleted(s.start) {
+            continue
+        }
+        value, ok := tomlLookup(doc, s.path)
+        if !ok {
+            start, end := lineStart(original, s.start), s.line
+            if end < len(original) {
+                end++
+            }
+            patches = append(patches, patch{start, end, ""})
+            continue
+        }
+        cover(s.path)
+        leaves[tomlPathKey(s.path)] = true
+        section := tomlPathKey(s.path[:s.depth])
+        if s.line > sections[section] {
+            sections[section] = s.line
+        }
+        if old, _ := tomlLookup(before, s.path); !reflect.DeepEqual(old, value) {
+            text, err := tomlValue(value)
+            if err != nil {
+                return nil, err
+            }
+            if str, ok := value.(string); ok && bytes.HasPrefix(original[s.value:], []byte(`"`)) && !bytes.HasPrefix(original[s.value:], []byte(`"""`)) {
+                text = tomlBasicString(str) // keep double quotes
+            }
+            patches = append(patches, patch{s.value, s.end, text})
+        }
+    }
+
+    var appended strings.Builder
+    var add func(path []string, m map[string]interface{}) error
+    add = func(path []string, m map[string]interface{}) error {
+        keys := make([]string, 0, len(m))
+        for k := range m {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            child := append(append([]string{}, path...), k)
+            key := tomlPathKey(child)
+            switch {
+            case leaves[key]:
+                continue
+            case covered[key]:
+                switch v := m[k].(type) {
+                case map[string]interface{}:
+                    if err := add(child, v); err != nil {
+                        return err
+                    }
+                case []interface{}:
+                    for i, item := range v {
+                        element := append(append([]string{}, child...), strconv.Itoa(i))
+                        table, _ := item.(map[string]interface{})
+                        if covered[tomlPathKey(element)] {
+                            if err := add(element, table); err != nil {
+                                return err
+                            }
+                            continue
+                        }
+                        body, err := tomlBody(table)
+                        if err != nil {
+                            return err
+                        }
+                        fmt.Fprintf(&appended, "\n[[%s]]\n%s", tomlDottedKey(tomlKeysOnly(doc, child)), body)
+                    }
+                }
+                continue
+            }
+            text, err := tomlValue(m[k])
+            if err != nil {
+                return err
+            }
+            // add to the table's own section, or with a dotted key to the
+            // nearest one above it
+            at := len(path)
+            for at > 0 {
+                if _, ok := sections[tomlPathKey(path[:at])]; ok {
+                    break
+                }
+                at--
+            }
+            rel := append(append([]string{}, path[at:]...), k)
+            offset := sections[tomlPathKey(path[:at])]
+            line := tomlDottedKey(rel) + " = " + text
+            if offset == 0 {
+                patches = append(patches, patch{0, 0, line + "\n"})
+            } else {
+                patches = append(patches, patch{offset, offset, "\n" + line})
+            }
+        }
+        return nil
+    }
+    if err := add(nil, doc.(map[string]interface{})); err != nil {
+        return nil, err
+    }
+
+    sort.SliceStable(patches, func(i, j int) bool { return patches[i].start < patches[j].start })
+    var b bytes.Buffer
+    at := 0
+    for _, p := range patches {
+        if p.start < at {
+            continue // inside a deleted section
+        }
+        b.Write(original[at:p.start])
+        b.WriteString(p.text)
+        at = p.end
+    }
+    b.Write(original[at:])
+    if appended.Len() > 0 {
+        b.Truncate(len(bytes.TrimRight(b.Bytes(), "\n")))
+        b.WriteByte('\n')
+        b.WriteString(appended.String())
+    }
+
+    got, err := parseTOML(b.Bytes())
+    if err != nil {
+        return nil, fmt.Errorf("cannot rewrite the TOML file in place: %v", err)
+    }
+    marshalled, err := marshalTOML(doc)
+    if err != nil {
+        return nil, err
+    }
+    want, err := parseTOML(marshalled)
+    if err != nil {
+        return nil, err
+    }
+    if !reflect.DeepEqual(got, want) {
+        return nil, errors.New("cannot rewrite the TOML file in place")
+    }
+    return b.Bytes(), nil
+}
+
+// tomlSpans lists the key/values and table headers of content in order.
+func tomlSpans(content []byte) ([]tomlSpan, error) {
+    p := unstable.Parser{KeepComments: true}
+    p.Reset(content)
+    var spans []tomlSpan
+    var starts []int // of every expression, where the one before ends
+    var table []string
+    arrays := map[string]int{} // elements seen of each array of tables
+    resolve := func(keys []string) []string {
+        var path []string
+        for _, k := range keys {
+            path = append(path, k)
+            if n, ok := arrays[tomlPathKey(path)]; ok {
+                path = append(path, strconv.Itoa(n-1))
+            }
+        }
+        return path
+    }
+    for p.NextExpression() {
+        e := p.Expression()
+        if e.Kind == unstable.Comment {
+            starts = append(starts, int(e.Raw.Offset))
+            continue
+        }
+        if e.Kind != unstable.KeyValue && e.Kind != unstable.Table && e.Kind != unstable.ArrayTable {
+            continue
+        }
+        var keys []string
+        var first, last unstable.Range
+        for it := e.Key(); it.Next(); {
+            k := it.Node()
+            if keys == nil {
+                first = k.Raw
+            }
+            keys = append(keys, string(k.Data))
+            last = k.Raw
+        }
+        s := tomlSpan{start: int(first.Offset)}
+        switch e.Kind {
+        case unstable.Table:
+            table = resolve(keys)
+            s.path, s.table, s.start = table, true, lineStart(content, s.start)
+        case unstable.ArrayTable:
+            path := append(resolve(keys[:len(keys)-1]), keys[len(keys)-1])
+            arrays[tomlPathKey(path)]++
+            table = append(path, strconv.Itoa(arrays[tomlPathKey(path)]-1))
+            s.path, s.table, s.start = table, true, lineStart(content, s.start)
+        default:
+            s.path, s.depth = append(append([]string{}, table...), keys...), len(table)
+            i := int(last.Offset + last.Length)
+            for i < len(content) && (content[i] == ' ' || content[i] == '\t' || content[i] == '=') {
+                i++
+            }
+            s.value = i
+            if c := e.Next(); c != nil && c.Kind == unstable.Comment {
+                s.end = int(c.Raw.Offset)
+            }
+        }
+        starts = append(starts, s.start)
+        spans = append(spans, s)
+    }
+    if err := p.Error(); err != nil {
+        return nil, err
+    }
+
+    // an expression ends where the next one starts, less the blank space
+    // between them; a section ends at the next header
+    next := func(offset int) int {
+        i := sort.SearchInts(starts, offset+1)
+        if i == len(starts) {
+            return len(content)
+        }
+        return starts[i]
+    }
+    for i := range spans {
+        s := &spans[i]
+        if s.table {
+            s.end = len(content)
+            for _, t := range spans[i+1:] {
+                if t.table {
+                    s.end = t.start
+                    break
+                }
+            }
+            s.line = lineEnd(content, s.start)
+            continue
+        }
+        end := next(s.start)
+        if s.end == 0 || s.end > end {
+            s.end = end
+        }
+        for s.end > s.value && strings.ContainsRune(" \t\r\n", rune(content[s.end-1])) {
+            s.end--
+        }
+        s.line = lineEnd(content, s.end)
+    }
+    return spans, nil
+}
+
+// tomlLookup returns the value at path in doc.
+func tomlLookup(doc interface{}, path []string) (interface{}, bool) {
+    v := doc
+    for _, k := range path {
+        switch c := v.(type) {
+        case map[string]interface{}:
+            var ok bool
+            if v, ok = c[k]; !ok {
+                return nil, false
+            }
+        case []interface{}:
+            i, err := strconv.Atoi(k)
+            if err != nil || i < 0 || i >= len(c) {
+                return nil, false
+            }
+            v = c[i]
+        default:
+            return nil, false
+        }
+    }
+    return v, true
+}
+
+func isTable(v interface{}) bool {
+    _, ok := v.(map[string]interface{})
+    return ok
+}
+
+// tomlValue renders v as the value of a TOML key/value, inline.
+func tomlValue(v interface{}) (string, error) {
+    var b bytes.Buffer
+    enc := toml.NewEncoder(&b)
+    enc.SetTablesInline(true)
+    if err := enc.Encode(map[string]interface{}{"v": v}); err != nil {
+        return "", err
+    }
+    return strings.TrimSuffix(strings.TrimPrefix(b.String(), "v = "), "\n"), nil
+}
+
+// tomlBody renders a table as key/value lines.
+func tomlBody(table map[string]interface{}) (string, error) {
+    var b bytes.Buffer
+    enc := toml.NewEncoder(&b)
+    enc.SetTablesInline(true)
+    if err := enc.Encode(table); err != nil {
+        return "", err
+    }
+    return b.String(), nil
+}
+
+// tomlBasicString quotes s with double quotes. JSON's escapes are all
+// valid in TOML basic strings.
+func tomlBasicString(s string) string {
+    var b bytes.Buffer
+    enc := json.NewEncoder(&b)
+    enc.SetEscapeHTML(false)
+    enc.Encode(s)
+    return strings.TrimSuffix(b.String(), "\n")
+}
+
+var bareTOMLKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tomlDottedKey writes keys as a dotted key, quoting those that need it.
+func tomlDottedKey(keys []string) string {
+    parts := make([]string, len(keys))
+    for i, k := range keys {
+        if bareTOMLKey.MatchString(k) {
+            parts[i] = k
+        } else {
+            parts[i], _ = tomlValue(k)
+        }
+    }
+    return strings.Join(parts, ".")
+}
+
+// tomlKeysOnly drops the indexes into arrays of tables from a path in doc.
+func tomlKeysOnly(doc interface{}, path []string) []string {
+    var keys []string
+    for i, k := range path {
+        if parent, _ := tomlLookup(doc, path[:i]); parent != nil {
+            if _, ok := parent.([]interface{}); ok {
+                continue
+            }
+        }
+        keys = append(keys, k)
+    }
+    return keys
+}
+
+func tomlPathKey(path []string) string {
+    return strings.Join(path, "\x00")
+}
+
+func lineStart(content []byte, offset int) int {
+    return bytes.LastIndexByte(content[:offset], '\n') + 1
+}
+
+func lineEnd(content []byte, offset int) int {
+    if i := bytes.IndexByte(content[offset:], '\n'); i >= 0 {
+        return offset + i
+    }
+    return len(content)
+}
@@ -0,0 +1,54 @@
+package engine
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "path/filepath"
+    "strings"
+
+    "mvdan.cc/sh/v3/syntax"
+)
+
+// shellVariant picks the dialect of a script from its shebang, then its
+// extension; POSIX sh when neither says.
+func shellVariant(filename string, content []byte) syntax.LangVariant {
+    if bytes.HasPrefix(content, []byte("#!")) {
+        line, _, _ := bytes.Cut(content, []byte("\n"))
+        switch {
+        case bytes.Contains(line, []byte("bash")):
+            return syntax.LangBash
+        case bytes.Contains(line, []byte("mksh")):
+            return syntax.LangMirBSDKorn
+        case bytes.Contains(line, []byte("bats")):
+            return syntax.LangBats
+        }
+        return syntax.LangPOSIX
+    }
+    switch filepath.Ext(filename) {
+    case ".bash":
+        return syntax.LangBash
+    case ".mksh":
+        return syntax.LangMirBSDKorn
+    case ".bats":
+        return syntax.LangBats
+    }
+    return syntax.LangPOSIX
+}
+
+// CheckShell parses a shell script with the shfmt parser, in the dialect its
+// shebang or extension names, and reports the first syntax error.
+func CheckShell(filename string, content []byte) error {
+    parser := syntax.NewParser(syntax.Variant(shellVariant(filename, content)), syntax.KeepComments(true))
+    _, err := parser.Parse(bytes.NewReader(content), filepath.Base(filename))
+    var perr syntax.ParseError
+    if errors.As(err, &perr) {
+        return fmt.Errorf("line %d: %s", perr.Pos.Line(), perr.Text)
+    }
+    var lerr syntax.LangError
+    if errors.As(err, &lerr) {
+        msg := strings.TrimPrefix(lerr.Error(), fmt.Sprintf("%s:%s: ", lerr.Filename, lerr.Pos))
+        return fmt.Errorf("line %d: %s", lerr.Pos.Line(), msg)
+    }
+    return err
+}
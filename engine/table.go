@@ -0,0 +1,162 @@
+package engine
+
+import (
+    "bytes"
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+)
+
+// Table is a CSV or TSV document as rows of fields. With a header the first
+// record is Columns and every row must have as many fields.
+type Table struct {
+    Columns   []string   `json:"columns,omitempty"`
+    Rows      [][]string `json:"rows"`
+    Delimiter string     `json:"delimiter"`
+    crlf      bool
+}
+
+// TableEdit changes a table: "set" (the default) replaces the field of Row
+// in Column, "insert" adds Values as a new row before Row (at the end when
+// Row is the row count), "delete" removes Row. Rows count from 0 after the
+// header; Column is a column name or a 0-based index.
+type TableEdit struct {
+    Op     string   `json:"op"`
+    Row    int      `json:"row"`
+    Column string   `json:"column,omitempty"`
+    Value  string   `json:"value,omitempty"`
+    Values []string `json:"values,omitempty"`
+}
+
+// IsTable reports whether fileType is read by ParseTable.
+func IsTable(fileType string) bool {
+    return fileType == "csv" || fileType == "tsv"
+}
+
+func tableDelimiter(fileType string) rune {
+    if fileType == "tsv" {
+        return '\t'
+    }
+    return ','
+}
+
+// ParseTable reads a CSV or TSV document. Every record must have the same
+// number of fields; quoting follows RFC 4180.
+func ParseTable(content []byte, fileType string, header bool) (*Table, error) {
+    if !IsTable(fileType) {
+        return nil, fmt.Errorf("%s documents are not tables", fileType)
+    }
+    r := csv.NewReader(bytes.NewReader(content))
+    r.Comma = tableDelimiter(fileType)
+    t := &Table{Rows: [][]string{}, Delimiter: string(r.Comma), crlf: bytes.Contains(content, []byte("\r\n"))}
+    for {
+        record, err := r.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            var perr *csv.ParseError
+            if errors.As(err, &perr) {
+                return nil, fmt.Errorf("line %d, column %d: %v", perr.Line, perr.Column, perr.Err)
+            }
+            return nil, err
+        }
+        if header && t.Columns == nil {
+            t.Columns = record
+            continue
+        }
+        t.Rows = append(t.Rows, record)
+    }
+    return t, nil
+}
+
+// width is the number of fields every row must have, or -1 for an empty
+// table without a header.
+func (t *Table) width() int {
+    if t.Columns != nil {
+        return len(t.Columns)
+    }
+    if len(t.Rows) > 0 {
+        return len(t.Rows[0])
+    }
+    return -1
+}
+
+// Marshal renders the table with the delimiter and line endings it was
+// parsed with.
+func (t *Table) Marshal() ([]byte, error) {
+    width := t.width()
+    for i, row := range t.Rows {
+        if len(row) != width {
+            return nil, fmt.Errorf("row %d has %d fields, not %d", i, len(row), width)
+        }
+    }
+    var b bytes.Buffer
+    w := csv.NewWriter(&b)
+    w.Comma = ','
+    if d := []rune(t.Delimiter); len(d) == 1 {
+        w.Comma = d[0]
+    }
+    w.UseCRLF = t.crlf
+    if t.Columns != nil {
+        w.Write(t.Columns)
+    }
+    w.WriteAll(t.Rows)
+    return b.Bytes(), w.Error()
+}
+
+// Apply makes edits in order. It stops at the first that does not fit the
+// table and reports which.
+func (t *Table) Apply(edits []TableEdit) error {
+    for i, e := range edits {
+        if err := t.apply(e); err != nil {
+            return fmt.Errorf("edit %d: %v", i, err)
+        }
+    }
+    return nil
+}
+
+func (t *Table) apply(e TableEdit) error {
+    switch e.Op {
+    case "", "set":
+        if e.Row < 0 || e.Row >= len(t.Rows) {
+            return fmt.Errorf("no row %d", e.Row)
+        }
+        col, err := t.column(e.Column)
+        if err != nil {
+            return err
+        }
+        t.Rows[e.Row][col] = e.Value
+    case "insert":
+        if e.Row < 0 || e.Row > len(t.Rows) {
+            return fmt.Errorf("no row %d", e.Row)
+        }
+        if width := t.width(); width >= 0 && len(e.Values) != width {
+            return fmt.Errorf("the new row has %d fields, not %d", len(e.Values), width)
+        }
+        t.Rows = append(t.Rows[:e.Row], append([][]string{e.Values}, t.Rows[e.Row:]...)...)
+    case "delete":
+        if e.Row < 0 || e.Row >= len(t.Rows) {
+            return fmt.Errorf("no row %d", e.Row)
+        }
+        t.Rows = append(t.Rows[:e.Row], t.Rows[e.Row+1:]...)
+    default:
+        return fmt.Errorf("unknown op %q (use set, insert or delete)", e.Op)
+    }
+    return nil
+}
+
+// column finds a column by name, then by index.
+func (t *Table) column(name string) (int, error) {
+    for i, c := range t.Columns {
+        if c == name {
+            return i, nil
+        }
+    }
+    if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < t.width() {
+        return i, nil
+    }
+    return 0, fmt.Errorf("no column %q", name)
+}
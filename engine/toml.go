@@ -0,0 +1,32 @@
+package engine
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/pelletier/go-toml/v2"
+)
+
+// parseTOML decodes a TOML document into a map. Dates and times keep their
+// TOML types, which render as RFC 3339 text in JSON and as TOML dates again
+// when marshalled.
+func parseTOML(content []byte) (map[string]interface{}, error) {
+    doc := map[string]interface{}{}
+    if err := toml.Unmarshal(content, &doc); err != nil {
+        var derr *toml.DecodeError
+        if errors.As(err, &derr) {
+            row, column := derr.Position()
+            return nil, fmt.Errorf("line %d, column %d: %v", row, column, err)
+        }
+        return nil, err
+    }
+    return doc, nil
+}
+
+// marshalTOML renders a document as TOML, which only has tables at the top.
+func marshalTOML(doc interface{}) ([]byte, error) {
+    if _, ok := doc.(map[string]interface{}); !ok {
+        return nil, errors.New("a TOML document must be a table")
+    }
+    return toml.Marshal(doc)
+}
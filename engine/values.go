@@ -0,0 +1,78 @@
+package engine
+
+import (
+    "fmt"
+    "net/netip"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// ValueFormats are the formats CheckValue knows.
+var ValueFormats = []string{"ip", "cidr", "ip_or_cidr", "hostname", "url", "port"}
+
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// CheckValue reports why s is not a well-formed value of format: an IPv4
+// or IPv6 address, a CIDR block (whose host bits must be zero, since
+// 10.0.0.1/8 is rarely what was meant), either of those, an RFC 1123 host
+// name, an absolute URL with a host, or a port number from 1 to 65535.
+func CheckValue(format, s string) error {
+    switch format {
+    case "ip":
+        if _, err := netip.ParseAddr(s); err != nil {
+            return fmt.Errorf("%q is not an IP address", s)
+        }
+    case "cidr":
+        return checkCIDR(s)
+    case "ip_or_cidr":
+        if strings.Contains(s, "/") {
+            return checkCIDR(s)
+        }
+        if _, err := netip.ParseAddr(s); err != nil {
+            return fmt.Errorf("%q is not an IP address or CIDR block", s)
+        }
+    case "hostname":
+        return checkHostname(s)
+    case "url":
+        u, err := url.Parse(s)
+        if err != nil || u.Scheme == "" || u.Host == "" {
+            return fmt.Errorf("%q is not an absolute URL", s)
+        }
+        if u.Port() != "" {
+            return CheckValue("port", u.Port())
+        }
+    case "port":
+        if n, err := strconv.Atoi(s); err != nil || n < 1 || n > 65535 {
+            return fmt.Errorf("%q is not a port number (1-65535)", s)
+        }
+    default:
+        return fmt.Errorf("unknown value format %q", format)
+    }
+    return nil
+}
+
+func checkCIDR(s string) error {
+    prefix, err := netip.ParsePrefix(s)
+    if err != nil {
+        return fmt.Errorf("%q is not a CIDR block", s)
+    }
+    if masked := prefix.Masked(); masked != prefix {
+        return fmt.Errorf("%q has host bits set; the block is %s", s, masked)
+    }
+    return nil
+}
+
+func checkHostname(s string) error {
+    name := strings.TrimSuffix(s, ".")
+    if name == "" || len(name) > 253 {
+        return fmt.Errorf("%q is not a host name", s)
+    }
+    for _, label := range strings.Split(name, ".") {
+        if !hostnameLabel.MatchString(label) {
+            return fmt.Errorf("%q is not a host name", s)
+        }
+    }
+    return nil
+}
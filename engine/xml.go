@@ -0,0 +1,236 @@
+package engine
+
+import (
+    "bytes"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// XML documents map to plain values the way most converters do: the root
+// element becomes the only key of an object, attributes become "@name"
+// keys, repeated elements become arrays, and an element holding only text
+// becomes that text. Text beside attributes or child elements is kept
+// under XMLText.
+const (
+    XMLAttrPrefix = "@"
+    XMLText       = "#text"
+)
+
+// ParseXML decodes an XML document into plain values. XML has no types, so
+// text that reads back unchanged as a number or boolean becomes one; "007"
+// stays a string.
+func ParseXML(content []byte) (interface{}, error) {
+    d := xml.NewDecoder(bytes.NewReader(content))
+    for {
+        tok, err := d.Token()
+        if err == io.EOF {
+            return nil, errors.New("no root element")
+        }
+        if err != nil {
+            return nil, err
+        }
+        if start, ok := tok.(xml.StartElement); ok {
+            value, err := xmlElement(d, start)
+            if err != nil {
+                return nil, err
+            }
+            return map[string]interface{}{xmlName(start.Name): value}, nil
+        }
+    }
+}
+
+// xmlName is the local part of name: encoding/xml resolves namespace
+// prefixes to URLs, which make poor keys.
+func xmlName(name xml.Name) string {
+    return name.Local
+}
+
+// xmlElement reads the content of start up to its end element.
+func xmlElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+    m := map[string]interface{}{}
+    for _, attr := range start.Attr {
+        if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+            continue
+        }
+        m[XMLAttrPrefix+xmlName(attr.Name)] = xmlScalar(attr.Value)
+    }
+    var text strings.Builder
+    children := 0
+    for {
+        tok, err := d.Token()
+        if err != nil {
+            return nil, err
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            child, err := xmlElement(d, t)
+            if err != nil {
+                return nil, err
+            }
+            children++
+            name := xmlName(t.Name)
+            existing, seen := m[name]
+            list, repeated := existing.([]interface{})
+            switch {
+            case !seen:
+                m[name] = child
+            case repeated:
+                m[name] = append(list, child)
+            default:
+                m[name] = []interface{}{existing, child}
+            }
+        case xml.CharData:
+            text.Write(t)
+        case xml.EndElement:
+            s := strings.TrimSpace(text.String())
+            if len(m) == 0 {
+                if children == 0 && s == "" {
+                    return nil, nil
+                }
+                return xmlScalar(s), nil
+            }
+            if s != "" {
+                m[XMLText] = xmlScalar(s)
+            }
+            return m, nil
+        }
+    }
+}
+
+// xmlScalar types s when its value writes back as the same text. NaN and
+// Inf are left as text: no other format can hold them as numbers.
+func xmlScalar(s string) interface{} {
+    switch s {
+    case "true":
+        return true
+    case "false":
+        return false
+    }
+    if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+        return n
+    }
+    if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) && strconv.FormatFloat(f, 'f', -1, 64) == s {
+        return f
+    }
+    return s
+}
+
+// MarshalXML renders plain values as an indented XML document. An object
+// with a single key that is not a list names the root element; anything
+// else is wrapped in <root>, a list as one <item> per element.
+func MarshalXML(doc interface{}) ([]byte, error) {
+    var b bytes.Buffer
+    b.WriteString(xml.Header)
+    e := xml.NewEncoder(&b)
+    e.Indent("", "  ")
+    name, value := "root", doc
+    if list, ok := doc.([]interface{}); ok {
+        value = map[string]interface{}{"item": list}
+    }
+    if m, ok := doc.(map[string]interface{}); ok && len(m) == 1 {
+        for k, v := range m {
+            if _, list := v.([]interface{}); !list && !strings.HasPrefix(k, XMLAttrPrefix) && k != XMLText {
+                name, value = k, v
+            }
+        }
+    }
+    if err := encodeXML(e, name, value); err != nil {
+        return nil, err
+    }
+    if err := e.Flush(); err != nil {
+        return nil, err
+    }
+    b.WriteByte('\n')
+    return b.Bytes(), nil
+}
+
+func encodeXML(e *xml.Encoder, name string, v interface{}) error {
+    if !validXMLName(name) {
+        return fmt.Errorf("%q is not a valid XML element name", name)
+    }
+    if list, ok := v.([]interface{}); ok {
+        for _, item := range list {
+            // A list in a list keeps its bounds as an element of items
+            if inner, ok := item.([]interface{}); ok {
+                item = map[string]interface{}{"item": inner}
+            }
+            if err := encodeXML(e, name, item); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    start := xml.StartElement{Name: xml.Name{Local: name}}
+    m, ok := v.(map[string]interface{})
+    if !ok {
+        if err := e.EncodeToken(start); err != nil {
+            return err
+        }
+        if v != nil {
+            if err := e.EncodeToken(xml.CharData(xmlText(v))); err != nil {
+                return err
+            }
+        }
+        return e.EncodeToken(start.End())
+    }
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        if attr := strings.TrimPrefix(k, XMLAttrPrefix); attr != k {
+            if !validXMLName(attr) {
+                return fmt.Errorf("%q is not a valid XML attribute name", attr)
+            }
+            start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attr}, Value: xmlText(m[k])})
+        }
+    }
+    if err := e.EncodeToken(start); err != nil {
+        return err
+    }
+    if text, ok := m[XMLText]; ok {
+        if err := e.EncodeToken(xml.CharData(xmlText(text))); err != nil {
+            return err
+        }
+    }
+    for _, k := range keys {
+        if strings.HasPrefix(k, XMLAttrPrefix) || k == XMLText {
+            continue
+        }
+        if err := encodeXML(e, k, m[k]); err != nil {
+            return err
+        }
+    }
+    return e.EncodeToken(start.End())
+}
+
+// xmlText writes a scalar the way ParseXML reads it back.
+func xmlText(v interface{}) string {
+    switch v := v.(type) {
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64)
+    case nil:
+        return ""
+    }
+    return fmt.Sprint(v)
+}
+
+func validXMLName(name string) bool {
+    if name == "" {
+        return false
+    }
+    for i, r := range name {
+        letter := r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 0x7f
+        if !letter && (i == 0 || !(r >= '0' && r <= '9' || r == '-' || r == '.')) {
+            return false
+        }
+    }
+    return true
+}
@@ -2,31 +2,126 @@
 package main
 
 import (
+    "archive/tar"
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
     "encoding/json"
-    "encoding/xml"
+    "encoding/pem"
+    "errors"
+    "flag"
     "fmt"
+    "html/template"
+    "io"
     "io/ioutil"
     "log"
+    "math"
+    mathrand "math/rand"
+    "mime"
+    "mime/quotedprintable"
+    "net"
     "net/http"
+    "net/mail"
+    "net/smtp"
+    neturl "net/url"
     "os"
     "os/exec"
+    "os/signal"
+    "path"
     "path/filepath"
+    "reflect"
+    "regexp"
+    "runtime"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "syscall"
+    texttemplate "text/template"
     "time"
+    "unicode"
 
+    "github.com/Masterminds/semver/v3"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    awsconfig "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+    smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+    "github.com/aws/aws-sdk-go-v2/service/ssm"
+    ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+    "github.com/charmbracelet/bubbles/textinput"
+    tea "github.com/charmbracelet/bubbletea"
+    mqtt "github.com/eclipse/paho.mqtt.golang"
+    "github.com/fsnotify/fsnotify"
     "github.com/gin-gonic/gin"
     "github.com/gin-contrib/cors"
+    "github.com/google/cel-go/cel"
+    consul "github.com/hashicorp/consul/api"
+    "github.com/jung-kurt/gofpdf"
+    "github.com/open-policy-agent/opa/rego"
+    amconfig "github.com/prometheus/alertmanager/config"
+    "github.com/prometheus/prometheus/model/rulefmt"
+    "github.com/robfig/cron/v3"
+    "github.com/santhosh-tekuri/jsonschema/v5"
+    "github.com/zserge/lorca"
+    etcd "go.etcd.io/etcd/client/v3"
+    "go.etcd.io/etcd/client/v3/concurrency"
+    "go.starlark.net/starlark"
     "gopkg.in/yaml.v3"
+
+    "edit3/cache"
+    "edit3/engine"
+    "edit3/storage"
+    "edit3/store"
 )
 
 const (
-    DataDir = "./data"
-    Port    = ":3003"
+    Port = ":3003"
+)
+
+// DataDir is the default root. It can point at an existing repository (or a
+// directory inside one) through EDIT3_DATA_DIR.
+var DataDir = "./data"
+
+// allowedRoots lists absolute directories outside DataDir that may be served
+// through the API. Files inside them are addressed by their absolute path.
+// Roots are added while serving, so it is read through roots().
+// versionedRoots are the ones with a git repository to keep history in.
+var (
+    rootsMu        sync.RWMutex
+    allowedRoots   []string
+    versionedRoots = map[string]bool{}
 )
 
+// roots returns a copy of allowedRoots.
+func roots() []string {
+    rootsMu.RLock()
+    defer rootsMu.RUnlock()
+    return append([]string(nil), allowedRoots...)
+}
+
 type FileResponse struct {
-    Content  string `json:"content"`
-    Filename string `json:"filename"`
+    Content  string        `json:"content"`
+    Filename string        `json:"filename"`
+    Freeze   *FreezeStatus `json:"freeze,omitempty"`
+    // Type, Mode and MIME tell the client how to highlight and check it.
+    Type string `json:"type"`
+    Mode string `json:"mode"`
+    MIME string `json:"mime"`
+    // Commit and Date identify the version served for ?asOf=.
+    Commit string `json:"commit,omitempty"`
+    Date   string `json:"date,omitempty"`
+    // View is set for previews such as ?view=expanded, which cannot be
+    // saved back.
+    View     string `json:"view,omitempty"`
+    ReadOnly bool   `json:"readOnly,omitempty"`
 }
 
 type SaveRequest struct {
@@ -34,311 +129,16842 @@ type SaveRequest struct {
 }
 
 type SaveResponse struct {
-    Success   bool   `json:"success"`
-    Message   string `json:"message"`
-    Commit    string `json:"commit"`
-    Timestamp string `json:"timestamp"`
+    Success   bool        `json:"success"`
+    Message   string      `json:"message"`
+    Commit    string      `json:"commit"`
+    Timestamp string      `json:"timestamp"`
+    Warning   string      `json:"warning,omitempty"`
+    Derived   []string    `json:"derived,omitempty"`
+    Budget    []Violation `json:"budget,omitempty"`
+    // Breaking lists the changes compat policies in warn mode let through.
+    Breaking []Violation `json:"breaking,omitempty"`
+    // Impacted are the consumers reading values the save changed.
+    Impacted []ConsumerImpact `json:"impacted,omitempty"`
+    // Normalized is set when a normalize rule rewrote the content, which
+    // then differs from what was sent.
+    Normalized bool `json:"normalized,omitempty"`
 }
 
-type HistoryItem struct {
-    Hash      string `json:"hash"`
-    Timestamp string `json:"timestamp"`
-    Message   string `json:"message"`
-}
+type HistoryItem = store.Commit
 
 type HistoryResponse struct {
     History []HistoryItem `json:"history"`
 }
 
-func initGit() {
-    // Check if git is initialized
-    cmd := exec.Command("git", "rev-parse", "--git-dir")
-    cmd.Dir = DataDir
-    if err := cmd.Run(); err != nil {
-        // Initialize git
-        exec.Command("git", "init").Dir = DataDir
-        exec.Command("git", "config", "user.email", "edit3@local").Dir = DataDir
-        exec.Command("git", "config", "user.name", "Edit3 User").Dir = DataDir
+func initGit(dir string) {
+    ctx := context.Background()
+    // Reuse the repository the directory already belongs to, if any. Its
+    // identity, branch and .gitignore are left exactly as they are.
+    if top, branch, ok := store.Open(ctx, dir); ok {
+        log.Printf("Using existing git repository %s (branch %s) for %s", top, branch, dir)
+        return
+    }
+    if err := store.Init(ctx, dir); err != nil {
+        log.Printf("edit3: %v", err)
     }
 }
 
-func ensureDataDir() {
-    if _, err := os.Stat(DataDir); os.IsNotExist(err) {
-        os.MkdirAll(DataDir, 0755)
+// versionRoot sets up history for an extra root. A root inside an existing
+// repository uses it; a repository is only created for roots listed in
+// version_roots, as opening a file must not leave one behind in an arbitrary
+// directory. Other roots are edited without history.
+func versionRoot(root string) {
+    ctx := context.Background()
+    top, branch, ok := store.Open(ctx, root)
+    switch {
+    case ok:
+        log.Printf("Using existing git repository %s (branch %s) for %s", top, branch, root)
+    case versionsRoot(root):
+        if err := store.Init(ctx, root); err != nil {
+            log.Printf("edit3: %v", err)
+            return
+        }
+    default:
+        log.Printf("edit3: %s is not a git repository, changes to it are not versioned", root)
+        return
     }
+    rootsMu.Lock()
+    versionedRoots[root] = true
+    rootsMu.Unlock()
 }
 
-func validateContent(content string, fileType string) error {
-    switch fileType {
-    case "json":
-        var js interface{}
-        return json.Unmarshal([]byte(content), &js)
-    case "yaml", "yml":
-        var y interface{}
-        return yaml.Unmarshal([]byte(content), &y)
-    case "xml":
-        return xml.Unmarshal([]byte(content), new(interface{}))
+// versionsRoot reports whether version_roots opts root in.
+func versionsRoot(root string) bool {
+    for _, dir := range config.VersionRoots {
+        abs, err := filepath.Abs(dir)
+        if err != nil {
+            continue
+        }
+        if _, ok := relativeTo(abs, root); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// commitFiles commits several paths (including deletions) as one commit on
+// the current branch. Only those paths are committed, so anything else
+// staged in a shared repository is left untouched; ignored files are not
+// force-added.
+func commitFiles(ctx context.Context, dir string, rels []string, message string) error {
+    if !replicas.isLeader() {
+        return errNotLeader
+    }
+    ctx, cancel := writeContext(ctx)
+    defer cancel()
+    _, err := historyFor(dir).Commit(ctx, rels, message)
+    return err
+}
+
+// writeContext detaches a write from ctx, usually a request's: a client
+// that goes away must not kill git halfway through a commit and leave
+// index.lock behind. The write still gives up after the request timeout.
+func writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.WithoutCancel(ctx), timeout(config.Timeouts.Request, RequestTimeout))
+}
+
+// storeErrorJSON reports a failed save or version lookup with a status that
+// says whether retrying can help: 503 while the repository stays locked, 504
+// when git ran out of time, 404 for unknown versions and 500 for a damaged
+// repository or anything unrecognised.
+func storeErrorJSON(c *gin.Context, err error) {
+    status := 500
+    switch {
+    case errors.Is(err, store.ErrLocked):
+        status = 503
+        c.Header("Retry-After", "1")
+    case errors.Is(err, errNotLeader):
+        status = 503
+        c.Header("X-Edit3-Leader", replicas.leaderID())
+    case errors.Is(err, context.DeadlineExceeded):
+        status = 504
+    case errors.Is(err, store.ErrNotFound), errors.Is(err, os.ErrNotExist):
+        status = 404
+    case errors.Is(err, store.ErrCorrupt), errors.Is(err, store.ErrNoRepository):
+        log.Printf("version store: %v (POST /api/admin/fsck?repair=true may fix it)", err)
+    }
+    c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// IgnoreFile holds editor-specific exclusions, read from the root of each
+// served directory. It uses a subset of .gitignore syntax: one glob per line,
+// a trailing "/" matches a directory, and a pattern containing "/" is matched
+// against the whole relative path instead of a single path element.
+const IgnoreFile = ".edit3ignore"
+
+func loadIgnorePatterns(dir string) []string {
+    content, err := ioutil.ReadFile(filepath.Join(dir, IgnoreFile))
+    if err != nil {
+        return nil
+    }
+    var patterns []string
+    for _, line := range strings.Split(string(content), "\n") {
+        line = strings.TrimSpace(line)
+        if line != "" && !strings.HasPrefix(line, "#") {
+            patterns = append(patterns, line)
+        }
+    }
+    return patterns
+}
+
+func matchIgnorePattern(pattern, rel string) bool {
+    rel = filepath.ToSlash(rel)
+    dirOnly := strings.HasSuffix(pattern, "/")
+    pattern = strings.TrimSuffix(pattern, "/")
+
+    if strings.Contains(pattern, "/") {
+        pattern = strings.TrimPrefix(pattern, "/")
+        if ok, _ := path.Match(pattern, rel); ok && !dirOnly {
+            return true
+        }
+        // A matching leading directory excludes everything below it
+        parts := strings.Split(rel, "/")
+        for i := 1; i < len(parts); i++ {
+            if ok, _ := path.Match(pattern, strings.Join(parts[:i], "/")); ok {
+                return true
+            }
+        }
+        return false
+    }
+
+    parts := strings.Split(rel, "/")
+    for i, part := range parts {
+        if dirOnly && i == len(parts)-1 {
+            break
+        }
+        if ok, _ := path.Match(pattern, part); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// ignoredPaths reports which of rels (relative to dir) are excluded, mapping
+// each ignored path to the file that excludes it. .gitignore rules are
+// evaluated by git itself so nested and global excludes behave as usual.
+func ignoredPaths(ctx context.Context, dir string, rels []string) map[string]string {
+    ignored := make(map[string]string)
+    if len(rels) == 0 {
+        return ignored
+    }
+
+    for _, pattern := range loadIgnorePatterns(dir) {
+        for _, rel := range rels {
+            if _, ok := ignored[rel]; !ok && matchIgnorePattern(pattern, rel) {
+                ignored[rel] = IgnoreFile
+            }
+        }
+    }
+
+    // git works with forward slashes; map its answers back to our names
+    byGitPath := make(map[string]string, len(rels))
+    gitPaths := make([]string, 0, len(rels))
+    for _, rel := range rels {
+        byGitPath[filepath.ToSlash(rel)] = rel
+        gitPaths = append(gitPaths, filepath.ToSlash(rel))
+    }
+    ctx, cancel := context.WithTimeout(ctx, store.Timeout)
+    defer cancel()
+    cmd := exec.CommandContext(ctx, "git", "check-ignore", "--stdin")
+    cmd.Dir = dir
+    cmd.Stdin = strings.NewReader(strings.Join(gitPaths, "\n") + "\n")
+    output, _ := cmd.Output()
+    for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+        rel, ok := byGitPath[strings.TrimSpace(line)]
+        if !ok {
+            continue
+        }
+        if _, ok := ignored[rel]; !ok {
+            ignored[rel] = ".gitignore"
+        }
+    }
+    return ignored
+}
+
+// addAllowedRoot registers path as an extra root. When path is a file, its
+// parent directory becomes the root.
+func addAllowedRoot(path string) (string, error) {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return "", err
+    }
+    root := abs
+    if info, err := os.Stat(abs); err == nil && !info.IsDir() {
+        root = filepath.Dir(abs)
+    } else if os.IsNotExist(err) {
+        root = filepath.Dir(abs)
+    }
+    rootsMu.Lock()
+    defer rootsMu.Unlock()
+    for _, r := range allowedRoots {
+        if r == root {
+            return abs, nil
+        }
+    }
+    allowedRoots = append(allowedRoots, root)
+    return abs, nil
+}
+
+// resolvePath maps an API filename to the git working directory it lives in,
+// the path relative to that directory, and the full path on disk. Relative
+// names resolve inside DataDir; absolute names must fall under an allowed root.
+func resolvePath(filename string) (dir, rel, full string, err error) {
+    if filepath.IsAbs(filename) {
+        clean := filepath.Clean(filename)
+        for _, root := range roots() {
+            if _, ok := relativeTo(root, clean); ok {
+                return guardMeta(checkSymlinks(root, clean))
+            }
+        }
+        return "", "", "", fmt.Errorf("path %s is outside the allowed roots", filename)
+    }
+
+    rel = filepath.Clean(filename)
+    if _, ok := relativeTo(".", rel); !ok || rel == "." {
+        return "", "", "", fmt.Errorf("invalid filename: %s", filename)
+    }
+    return guardMeta(checkSymlinks(DataDir, filepath.Join(DataDir, rel)))
+}
+
+// MetaDir holds edit3's own state (sessions and similar sidecar data) inside
+// DataDir. It is hidden from the file API and excluded from git.
+const MetaDir = ".edit3"
+
+// metaPath returns a path inside MetaDir, creating its parent directory and
+// adding MetaDir to the repository's local excludes on first use.
+func metaPath(parts ...string) (string, error) {
+    full := filepath.Join(append([]string{DataDir, MetaDir}, parts...)...)
+    if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+        return "", err
+    }
+    if lines, err := gitLines(context.Background(), DataDir, "rev-parse", "--path-format=absolute", "--git-path", "info/exclude"); err == nil && len(lines) > 0 {
+        exclude := lines[0]
+        content, _ := ioutil.ReadFile(exclude)
+        if !strings.Contains(string(content), "/"+MetaDir+"/") {
+            os.MkdirAll(filepath.Dir(exclude), 0755)
+            if f, err := os.OpenFile(exclude, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+                fmt.Fprintf(f, "\n# edit3 state\n/%s/\n", filepath.ToSlash(filepath.Join(relToRepo(DataDir), MetaDir)))
+                f.Close()
+            }
+        }
+    }
+    return full, nil
+}
+
+// relToRepo returns dir relative to the top of its git repository.
+func relToRepo(dir string) string {
+    lines, err := gitLines(context.Background(), dir, "rev-parse", "--show-prefix")
+    if err != nil || len(lines) == 0 {
+        return ""
+    }
+    return strings.TrimSuffix(lines[0], "/")
+}
+
+// guardMeta refuses API access to MetaDir.
+func guardMeta(dir, rel, full string, err error) (string, string, string, error) {
+    if err == nil && strings.SplitN(filepath.ToSlash(rel), "/", 2)[0] == MetaDir {
+        return "", "", "", fmt.Errorf("%s is reserved for edit3", MetaDir)
+    }
+    return dir, rel, full, err
+}
+
+// Data directory layout
+
+// LayoutVersion is the data directory layout this build reads and writes.
+// Every change to where edit3 keeps its own files adds a migration and bumps
+// it; a directory already upgraded by a newer build is refused rather than
+// misread.
+const LayoutVersion = 1
+
+// Layout is the version record kept in MetaDir.
+type Layout struct {
+    Version int    `json:"version"`
+    Updated string `json:"updated"`
+}
+
+// migration upgrades the data directory from version-1 to version. It must
+// be safe to run again after being interrupted.
+type migration struct {
+    version int
+    summary string
+    apply   func(ctx context.Context) error
+}
+
+var migrations = []migration{
+    {1, "stop tracking edit3 state in git", untrackMetaDir},
+}
+
+// migrateDataDir brings the data directory up to LayoutVersion, recording
+// each step as it completes so an interrupted upgrade resumes where it
+// stopped.
+func migrateDataDir(ctx context.Context) error {
+    path, err := metaPath("layout.json")
+    if err != nil {
+        return err
+    }
+    var layout Layout
+    content, err := ioutil.ReadFile(path)
+    switch {
+    case err == nil:
+        if err := json.Unmarshal(content, &layout); err != nil {
+            return fmt.Errorf("%s: %v", path, err)
+        }
+    case !os.IsNotExist(err):
+        return err
+    }
+    if layout.Version > LayoutVersion {
+        return fmt.Errorf("%s has data layout %d, newer than the %d this edit3 understands; upgrade edit3", DataDir, layout.Version, LayoutVersion)
+    }
+    for _, m := range migrations {
+        if m.version <= layout.Version {
+            continue
+        }
+        log.Printf("edit3: upgrading %s to layout %d: %s", DataDir, m.version, m.summary)
+        if err := m.apply(ctx); err != nil {
+            return fmt.Errorf("upgrading %s to layout %d (%s): %w", DataDir, m.version, m.summary, err)
+        }
+        layout = Layout{Version: m.version, Updated: time.Now().Format(time.RFC3339)}
+        data, _ := json.MarshalIndent(layout, "", "  ")
+        if err := writeFileAtomic(path, data, 0644); err != nil {
+            return err
+        }
     }
     return nil
 }
 
-func getFileType(filename string) string {
-    ext := filepath.Ext(filename)
-    return strings.TrimPrefix(ext, ".")
+// untrackMetaDir removes MetaDir from the index of repositories that
+// committed it before it was excluded. The files themselves stay.
+func untrackMetaDir(ctx context.Context) error {
+    tracked, err := gitLines(ctx, DataDir, "ls-files", "--", MetaDir)
+    if err != nil || len(tracked) == 0 {
+        // Not a repository, or nothing to untrack
+        return nil
+    }
+    return store.Untrack(ctx, DataDir, []string{MetaDir}, "Stop tracking "+MetaDir)
 }
 
-func main() {
-    // Setup
-    ensureDataDir()
-    initGit()
+// EditorPosition is where a user left off in a file.
+type EditorPosition struct {
+    Row       int     `json:"row"`
+    Column    int     `json:"column"`
+    ScrollTop float64 `json:"scrollTop"`
+}
 
-    // Gin setup
-    gin.SetMode(gin.ReleaseMode)
-    r := gin.Default()
-    r.Use(cors.Default())
+// Draft is unsaved editor content, kept so it survives a browser restart.
+type Draft struct {
+    Content string `json:"content"`
+    Updated string `json:"updated"`
+}
 
-    // Serve HTML
-    r.StaticFile("/", "./static/index.html")
-    r.Static("/static", "./static")
+// SessionState is the per-user editor state stored by /api/session.
+type SessionState struct {
+    OpenFiles  []string                  `json:"openFiles"`
+    ActiveFile string                    `json:"activeFile"`
+    Positions  map[string]EditorPosition `json:"positions"`
+    Drafts     map[string]Draft          `json:"drafts"`
+    Updated    string                    `json:"updated"`
+}
 
-    // API Routes
-    r.GET("/api/file/:filename", getFile)
-    r.POST("/api/file/:filename", saveFile)
-    r.GET("/api/history/:filename", getHistory)
-    r.POST("/api/restore/:filename/:hash", restoreVersion)
-    r.GET("/api/files", listFiles)
+// MaxSessionSize bounds a stored session, drafts included.
+const MaxSessionSize = 8 << 20
 
-    fmt.Println(`
-╔══════════════════════════════════════════╗
-║         Edit3 - Visual Data Editor        ║
-║            Go Gin Edition                 ║
-║                                          ║
-║  Server running on http://localhost:3003 ║
-║                                          ║
-║  Usage:                                  ║
-║  edit3 file.json                        ║
-║  edit3 file.yaml                        ║
-║  edit3 file.xml                         ║
-╚══════════════════════════════════════════╝
-    `)
+var sessionMu sync.Mutex
 
-    r.Run(Port)
+// requestUser is the caller's self-declared name from X-Edit3-User, the
+// name roles are checked against. edit3 has no login of its own; put it
+// behind a proxy that sets the header if roles must be trusted.
+func requestUser(c *gin.Context) string {
+    return c.GetHeader("X-Edit3-User")
 }
 
-func getFile(c *gin.Context) {
-    filename := c.Param("filename")
-    filepath := filepath.Join(DataDir, filename)
+// sessionUser picks the session owner from X-Edit3-User (or ?user=, which
+// only labels sessions and never grants a role), falling back to "default"
+// on single-user setups.
+func sessionUser(c *gin.Context) string {
+    user := requestUser(c)
+    if user == "" {
+        user = c.Query("user")
+    }
+    clean := strings.Map(func(r rune) rune {
+        if r == '-' || r == '_' || r == '.' || r == '@' ||
+            (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+            return r
+        }
+        return -1
+    }, user)
+    if clean == "" || strings.Trim(clean, ".") == "" {
+        return "default"
+    }
+    return clean
+}
+
+func getSession(c *gin.Context) {
+    path, err := metaPath("sessions", sessionUser(c)+".json")
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    sessionMu.Lock()
+    content, err := ioutil.ReadFile(path)
+    sessionMu.Unlock()
+
+    state := SessionState{
+        OpenFiles: []string{},
+        Positions: map[string]EditorPosition{},
+        Drafts:    map[string]Draft{},
+    }
+    if err == nil {
+        json.Unmarshal(content, &state)
+    }
+    c.JSON(200, state)
+}
 
-    // Check if file exists, create default if not
-    if _, err := os.Stat(filepath); os.IsNotExist(err) {
-        createDefaultFile(filepath, filename)
+func putSession(c *gin.Context) {
+    c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxSessionSize)
+    var state SessionState
+    if err := c.ShouldBindJSON(&state); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
     }
+    state.Updated = time.Now().Format(time.RFC3339)
 
-    content, err := ioutil.ReadFile(filepath)
+    path, err := metaPath("sessions", sessionUser(c)+".json")
     if err != nil {
         c.JSON(500, gin.H{"error": err.Error()})
         return
     }
+    data, _ := json.MarshalIndent(state, "", "  ")
 
-    c.JSON(200, FileResponse{
-        Content:  string(content),
-        Filename: filename,
-    })
+    sessionMu.Lock()
+    defer sessionMu.Unlock()
+    if err := writeFileAtomic(path, data, 0600); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"success": true, "updated": state.Updated})
 }
 
-func createDefaultFile(filepath, filename string) {
-    var defaultContent string
-    fileType := getFileType(filename)
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+    return store.WriteAtomic(path, data, perm)
+}
 
-    switch fileType {
-    case "json":
-        data := map[string]interface{}{
-            "name":    "New File",
-            "created": time.Now().Format(time.RFC3339),
+// relativeTo returns p relative to root, and whether p lies inside root.
+func relativeTo(root, p string) (string, bool) {
+    r, err := filepath.Rel(root, p)
+    if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+        return "", false
+    }
+    return r, true
+}
+
+// Symlink policies, selected with EDIT3_SYMLINKS.
+const (
+    SymlinksFollow = "follow" // follow links that stay inside their root
+    SymlinksDeny   = "deny"   // refuse any path that goes through a link
+)
+
+var symlinkPolicy = SymlinksFollow
+
+// checkSymlinks applies the symlink policy to full, a path inside root. A link
+// may never lead out of its root. Followed links resolve to their target so
+// reads, writes and git all operate on the real file instead of the link,
+// which git would otherwise record unchanged.
+func checkSymlinks(root, full string) (dir, rel, resolved string, err error) {
+    rel, _ = relativeTo(root, full)
+
+    // Walk the existing part of the path looking for links
+    current := root
+    hasLink := false
+    for _, part := range strings.Split(rel, string(filepath.Separator)) {
+        current = filepath.Join(current, part)
+        info, err := os.Lstat(current)
+        if err != nil {
+            break
         }
-        bytes, _ := json.MarshalIndent(data, "", "  ")
-        defaultContent = string(bytes)
+        if info.Mode()&os.ModeSymlink != 0 {
+            hasLink = true
+        }
+    }
+    if !hasLink {
+        return root, rel, full, nil
+    }
+    if symlinkPolicy == SymlinksDeny {
+        return "", "", "", fmt.Errorf("%s goes through a symlink, which is not allowed", rel)
+    }
 
-    case "yaml", "yml":
-        defaultContent = fmt.Sprintf("name: New File\ncreated: %s\n", time.Now().Format(time.RFC3339))
+    absRoot, _ := filepath.Abs(root)
+    realRoot, err := filepath.EvalSymlinks(absRoot)
+    if err != nil {
+        return "", "", "", err
+    }
+    // Resolve the deepest existing ancestor; the rest does not exist yet
+    existing, rest := filepath.Join(absRoot, rel), ""
+    for {
+        if _, err := os.Lstat(existing); err == nil {
+            break
+        }
+        rest = filepath.Join(filepath.Base(existing), rest)
+        existing = filepath.Dir(existing)
+    }
+    target, err := filepath.EvalSymlinks(existing)
+    if err != nil {
+        return "", "", "", fmt.Errorf("%s: broken symlink", rel)
+    }
+    target = filepath.Join(target, rest)
+    targetRel, ok := relativeTo(realRoot, target)
+    if !ok {
+        return "", "", "", fmt.Errorf("%s links outside of its root", rel)
+    }
+    return root, targetRel, filepath.Join(root, targetRel), nil
+}
 
-    case "xml":
-        defaultContent = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
-<root>
-  <name>New File</name>
-  <created>%s</created>
-</root>`, time.Now().Format(time.RFC3339))
+func ensureDataDir() {
+    if _, err := os.Stat(DataDir); os.IsNotExist(err) {
+        os.MkdirAll(DataDir, 0755)
     }
+}
 
-    ioutil.WriteFile(filepath, []byte(defaultContent), 0644)
+func validateContent(content string, fileType string) error {
+    return validationLimits().Validate([]byte(content), fileType)
+}
 
-    // Git commit
-    cmd := exec.Command("git", "add", filename)
-    cmd.Dir = DataDir
-    cmd.Run()
+// validateReader is validateContent for a stream. JSON and XML are never held
+// in memory whole; YAML has to be.
+func validateReader(r io.Reader, fileType string) error {
+    return validationLimits().ValidateReader(r, fileType)
+}
+
+// ValidationConfig bounds syntax checks. JSON and XML are checked by walking
+// tokens instead of building the document, so memory stays near the size of
+// the largest token: MaxToken caps that (bytes), MaxDepth caps nesting.
+type ValidationConfig struct {
+    MaxDepth int   `yaml:"max_depth"`
+    MaxToken int64 `yaml:"max_token"`
+    // Profiles turns on extra save-time checks: dockerfile, shell.
+    Profiles []string `yaml:"profiles"`
+}
+
+func validationLimits() engine.Limits {
+    return engine.Limits{MaxDepth: config.Validation.MaxDepth, MaxToken: config.Validation.MaxToken}
+}
+
+// formatContent re-indents a document with two spaces. JSON keeps its key
+// order and number literals, YAML keeps comments.
+func formatContent(content string, fileType string) (string, error) {
+    formatted, err := engine.Format([]byte(content), fileType)
+    return string(formatted), err
+}
+
+// supportedFileType reports whether filename is of a type edit3 validates
+// or, in plain text mode, of any type at all.
+func supportedFileType(filename string) bool {
+    return engine.SupportedType(getFileType(filename)) || config.PlainText
+}
+
+// checkEditable refuses content of a type edit3 cannot validate unless plain
+// text mode is on, and then only when it is text.
+func checkEditable(rel, fileType string, content []byte) error {
+    if engine.SupportedType(fileType) {
+        return nil
+    }
+    if !config.PlainText {
+        return fmt.Errorf("%s is not a supported file type; set plain_text to edit it as plain text", rel)
+    }
+    if !engine.IsText(content) {
+        return fmt.Errorf("%s is not a text file", rel)
+    }
+    return nil
+}
+
+// textFile reports whether the file at full starts out as text, which plain
+// text mode asks of the files it lists.
+func textFile(full string) bool {
+    f, err := os.Open(full)
+    if err != nil {
+        return false
+    }
+    defer f.Close()
+    head := make([]byte, 8000)
+    n, _ := io.ReadFull(f, head)
+    return engine.IsText(head[:n])
+}
+
+// getFileType returns the document type of filename, honouring file_types
+// overrides before the name and extension.
+func getFileType(filename string) string {
+    if rule := fileTypeRule(filename); rule != nil {
+        return rule.Type
+    }
+    fileType := engine.FileType(filename)
+    if (fileType == "yaml" || fileType == "yml") && engine.HelmTemplate(filename, chartExists) {
+        return "helm"
+    }
+    return fileType
+}
+
+// chartExists reports whether the Chart.yaml name exists: absolute names
+// on disk, others in the data directory.
+func chartExists(name string) bool {
+    if filepath.IsAbs(name) {
+        _, err := os.Stat(name)
+        return err == nil
+    }
+    _, err := fileStore(DataDir).Stat(storageName(name))
+    return err == nil
+}
+
+// FileTypeRule overrides the type of matching files, e.g. to edit
+// extensionless "config" files as YAML. Mode and MIME replace what the type
+// implies in getFile responses.
+type FileTypeRule struct {
+    Paths []string `yaml:"paths"`
+    Type  string   `yaml:"type"`
+    Mode  string   `yaml:"mode"`
+    MIME  string   `yaml:"mime"`
+}
+
+// NormalizeRule puts matching files into a canonical layout before they are
+// stored, so diffs stay minimal whichever tool or person last wrote them.
+// The first rule matching a file applies.
+type NormalizeRule struct {
+    Paths        []string `yaml:"paths"`
+    engine.Style `yaml:",inline"`
+}
+
+// normalizeContent applies the normalize rule for rel, if any.
+func normalizeContent(rel, fileType string, content []byte) ([]byte, error) {
+    for _, rule := range config.Normalize {
+        if pathMatches(rule.Paths, rel) {
+            return engine.Canonicalize(content, fileType, rule.Style)
+        }
+    }
+    return content, nil
+}
+
+func fileTypeRule(filename string) *FileTypeRule {
+    for i := range config.FileTypes {
+        if pathMatches(config.FileTypes[i].Paths, filename) {
+            return &config.FileTypes[i]
+        }
+    }
+    return nil
+}
+
+// fileHint returns the type, editor mode and MIME type of a file, sniffing
+// the content when neither an override nor the name decides.
+func fileHint(rel string, content []byte) (string, engine.Syntax) {
+    if rule := fileTypeRule(rel); rule != nil {
+        syntax := engine.SyntaxOf(rule.Type)
+        if rule.Mode != "" {
+            syntax.Mode = rule.Mode
+        }
+        if rule.MIME != "" {
+            syntax.MIME = rule.MIME
+        }
+        return rule.Type, syntax
+    }
+    fileType := getFileType(rel)
+    if fileType == "" {
+        fileType = engine.Detect(rel, content)
+    }
+    return fileType, engine.SyntaxOf(fileType)
+}
+
+func main() {
+    args := os.Args[1:]
+    if len(args) == 1 && args[0] == jsonnetWorker {
+        os.Exit(runJsonnetWorker())
+    }
+    if len(args) == 1 && args[0] == scriptWorker {
+        os.Exit(runScriptWorker())
+    }
+    if len(args) > 0 && args[0] == "--in-memory" {
+        inMemory = true
+        args = args[1:]
+    }
+    if len(args) > 0 {
+        if cmd := findCommand(args[0]); cmd != nil {
+            os.Exit(cmd.run(args[1:]))
+        }
+
+        // edit3 <file> opens a file in the data directory, replacing
+        // the bash launcher so no shell is needed (e.g. on Windows)
+        if !supportedFileType(args[0]) {
+            fmt.Println("Usage: edit3 <filename>")
+            fmt.Println("       edit3 --in-memory [filename]")
+            fmt.Println("       edit3 <command> [flags] [args]")
+            fmt.Println("Supported formats: .json, .yaml, .yml, .xml, .toml, .csv, .tsv, .tf, .hcl, .pem, .crt, .env, .cue, .jsonnet, .libsonnet")
+            fmt.Println("Run 'edit3 help' for the list of commands")
+            os.Exit(1)
+        }
+        os.Exit(serve(filepath.ToSlash(args[0]), ""))
+    }
+    os.Exit(serve("", ""))
+}
+
+// inMemory (--in-memory) serves a throwaway data directory that is removed
+// on exit, for demos, client integration tests and scratch editing.
+var inMemory bool
+
+// useScratchDir points DataDir at a fresh directory, on the RAM-backed
+// /dev/shm where it exists, and returns a function removing it again.
+func useScratchDir() (func(), error) {
+    base := ""
+    if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+        base = "/dev/shm"
+    }
+    dir, err := ioutil.TempDir(base, "edit3-")
+    if err != nil {
+        return nil, err
+    }
+    DataDir = dir
+    return func() { os.RemoveAll(dir) }, nil
+}
+
+// dataStorage is the driver behind the data directory, chosen with
+// EDIT3_STORAGE. Unset, files are on local disk.
+var dataStorage storage.Storage
+
+// fileStore returns the storage driver for a served root. Extra roots are
+// always local.
+func fileStore(dir string) storage.Storage {
+    if dir == DataDir && dataStorage != nil {
+        return dataStorage
+    }
+    return storage.Local{Root: dir}
+}
+
+// onDisk reports whether fs keeps files on local disk, where git, the file
+// index and the analysis tools can reach them.
+func onDisk(fs storage.Storage) bool {
+    _, ok := fs.(storage.Local)
+    return ok
+}
+
+// History backends, selected with EDIT3_HISTORY.
+const (
+    HistoryGit       = "git"       // commits in the repository holding the root
+    HistorySnapshots = "snapshots" // whole-file versions kept in the storage
+)
+
+var (
+    historyBackend  string
+    dataHistory     store.History
+    dataHistoryOnce sync.Once
+)
+
+// historyFor returns the history backend of a served root. Extra roots are
+// git repositories when versionRoot found or made one and unversioned
+// otherwise; the data directory defaults to git on local disk and to
+// snapshots with other storage drivers.
+func historyFor(dir string) store.History {
+    if dir != DataDir {
+        rootsMu.RLock()
+        defer rootsMu.RUnlock()
+        if versionedRoots[dir] {
+            return store.Git{Dir: dir}
+        }
+        return store.Unversioned{}
+    }
+    dataHistoryOnce.Do(func() {
+        fs := fileStore(DataDir)
+        if historyBackend == HistorySnapshots || historyBackend == "" && !onDisk(fs) {
+            dataHistory = store.NewSnapshots(fs)
+        } else {
+            dataHistory = store.Git{Dir: DataDir}
+        }
+    })
+    return dataHistory
+}
+
+// storageName converts a path relative to a served root to a storage name.
+func storageName(rel string) string {
+    return filepath.ToSlash(rel)
+}
+
+// envOr returns the environment variable key, or fallback when it is unset.
+func envOr(key, fallback string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return fallback
+}
+
+// configure applies settings taken from the environment.
+func configure() {
+    for _, root := range filepath.SplitList(os.Getenv("EDIT3_ALLOWED_ROOTS")) {
+        if root != "" {
+            if _, err := addAllowedRoot(root); err != nil {
+                log.Fatalf("edit3: %v", err)
+            }
+        }
+    }
+
+    if dir := os.Getenv("EDIT3_DATA_DIR"); dir != "" {
+        DataDir = dir
+    }
+    if spec := os.Getenv("EDIT3_STORAGE"); spec != "" {
+        fs, err := storage.Open(context.Background(), spec)
+        if err != nil {
+            log.Fatalf("edit3: storage: %v", err)
+        }
+        // A local directory is just another data directory, versioned as usual
+        if local, ok := fs.(storage.Local); ok {
+            DataDir = local.Root
+        } else {
+            dataStorage = fs
+        }
+    }
+    switch historyBackend = os.Getenv("EDIT3_HISTORY"); historyBackend {
+    case "", HistorySnapshots:
+    case HistoryGit:
+        if dataStorage != nil {
+            log.Fatalf("edit3: %s history needs the data directory on local disk", HistoryGit)
+        }
+    default:
+        log.Fatalf("edit3: unknown history backend %q (use %s or %s)", historyBackend, HistoryGit, HistorySnapshots)
+    }
+    switch policy := os.Getenv("EDIT3_SYMLINKS"); policy {
+    case "":
+    case SymlinksFollow, SymlinksDeny:
+        symlinkPolicy = policy
+    default:
+        log.Fatalf("edit3: unknown symlink policy %q (use %s or %s)", policy, SymlinksFollow, SymlinksDeny)
+    }
+
+    if err := loadConfig(); err != nil {
+        log.Fatalf("edit3: config: %v", err)
+    }
+}
+
+// Config is the optional server configuration, read at startup from
+// EDIT3_CONFIG (default ./edit3.yaml). It lives outside the data directory so
+// the rules cannot be edited through the editor they constrain.
+type Config struct {
+    Policies PolicyConfig `yaml:"policies"`
+    // Roles maps a role name to the users (as sent in X-Edit3-User) holding it.
+    Roles map[string][]string `yaml:"roles"`
+    // CORSOrigins are the origins, such as https://portal.example.com, whose
+    // pages may call the API; pages of other sites may not.
+    CORSOrigins []string `yaml:"cors_origins"`
+    // VersionRoots are the extra roots, or directories holding them, in
+    // which a git repository is created when they have none. Other roots
+    // outside a repository are edited without history.
+    VersionRoots []string `yaml:"version_roots"`
+    // AdminRole may check and repair the data directory's repository; no one
+    // may when it is unset.
+    AdminRole string `yaml:"admin_role"`
+    // Freezes are change-calendar windows during which saves are refused.
+    Freezes []FreezeWindow `yaml:"freezes"`
+    Notify  NotifyConfig   `yaml:"notify"`
+    Derived []DerivedFile  `yaml:"derived"`
+    KV      *KVConfig      `yaml:"kv"`
+    AWS     *AWSConfig     `yaml:"aws"`
+    Ansible *AnsibleConfig `yaml:"ansible"`
+    Grafana *GrafanaConfig `yaml:"grafana"`
+    // Checks turns on external syntax checkers: the built-in nginx and
+    // haproxy ones by name, others with a command.
+    Checks []ExternalCheck `yaml:"checks"`
+    Commit CommitConfig    `yaml:"commit"`
+    // Redact rules sanitize files for /api/export.
+    Redact []RedactRule   `yaml:"redact"`
+    Unused *UnusedConfig `yaml:"unused"`
+    // Consumers is the manifest of the services reading the files, in the
+    // format of unused.manifest, which it defaults to.
+    Consumers string `yaml:"consumers"`
+    // Budgets warn when files grow past size or complexity limits.
+    Budgets []Budget `yaml:"budgets"`
+    // Consistency narrows the check for values spelled differently.
+    Consistency ConsistencyConfig `yaml:"consistency"`
+    // Expiry finds certificates and dates coming due in values.
+    Expiry ExpiryConfig `yaml:"expiry"`
+    // JWKS are the key sets tokens previewed with /api/jwt are verified
+    // against.
+    JWKS       []JWKSource      `yaml:"jwks"`
+    Env        EnvConfig        `yaml:"env"`
+    Validation ValidationConfig `yaml:"validation"`
+    Timeouts   TimeoutConfig    `yaml:"timeouts"`
+    FileTypes  []FileTypeRule   `yaml:"file_types"`
+    // PlainText opens, lists and saves text files of any other type as
+    // plain text: committed like the rest, but not validated.
+    PlainText bool `yaml:"plain_text"`
+    // MaxUpload caps the size of resumable uploads in bytes
+    // (DefaultMaxUpload when zero).
+    MaxUpload int64 `yaml:"max_upload"`
+    // Normalize rewrites matching JSON and YAML into one layout on save.
+    Normalize []NormalizeRule `yaml:"normalize"`
+    Create    CreateConfig    `yaml:"create"`
+    Events    EventsConfig    `yaml:"events"`
+    Mirror    *MirrorConfig   `yaml:"mirror"`
+    Cluster   *ClusterConfig  `yaml:"cluster"`
+    Cache     *CacheConfig    `yaml:"cache"`
+    // Environments are directories of the data directory holding the same
+    // files for different deployments, between which files are promoted.
+    Environments map[string]Environment `yaml:"environments"`
+    // Reviews ask for files to be changed or confirmed within a window.
+    Reviews []ReviewRule `yaml:"reviews"`
+    // Lookups offer valid values for fields while editing.
+    Lookups []LookupConfig `yaml:"lookups"`
+    // Enums are named lists of values, such as team names or datacenter
+    // codes, that value rules, lookups and schemas (as "x-enum": name)
+    // refer to.
+    Enums map[string][]string `yaml:"enums"`
+    // Schemas pin files to a version of their schema and upgrade them from
+    // one version to the next.
+    Schemas []SchemaConfig `yaml:"schemas"`
+    // Features turns optional feature groups off (or back on); see features.
+    Features map[string]bool `yaml:"features"`
+}
+
+// TimeoutConfig overrides how long slow operations may run, as durations
+// such as "30s". Request is the deadline of an API request's context, which
+// git commands, checkers and scripts started for it inherit; Git bounds each
+// git command on its own. Zero keeps the default.
+type TimeoutConfig struct {
+    Request  time.Duration `yaml:"request"`
+    Git      time.Duration `yaml:"git"`
+    External time.Duration `yaml:"external"`
+    Script   time.Duration `yaml:"script"`
+    Webhook  time.Duration `yaml:"webhook"`
+}
+
+const (
+    RequestTimeout = time.Minute
+    WebhookTimeout = 10 * time.Second
+)
+
+// timeout returns d, or fallback when d is unset.
+func timeout(d, fallback time.Duration) time.Duration {
+    if d > 0 {
+        return d
+    }
+    return fallback
+}
+
+// requestTimeout puts a deadline on each request's context, so a hung git
+// or checker cannot hold its goroutine forever.
+func requestTimeout() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        ctx, cancel := context.WithTimeout(c.Request.Context(), timeout(config.Timeouts.Request, RequestTimeout))
+        defer cancel()
+        c.Request = c.Request.WithContext(ctx)
+        c.Next()
+    }
+}
+
+// Feature flags. Every feature is on unless the configuration turns it off.
+const (
+    FeatureConversions   = "conversions"
+    FeatureHooks         = "hooks"
+    FeatureCollaboration = "collaboration"
+    FeatureRemoteSync    = "remote_sync"
+)
+
+// features lists the flags with what each one covers.
+var features = []struct{ name, summary string }{
+    {FeatureConversions, "converting documents between formats and copying subtrees between them (/api/convert, /api/clipboard, /api/paste)"},
+    {FeatureHooks, "webhook, MQTT and Grafana notifications, and file scripts (/api/script)"},
+    {FeatureCollaboration, "per-user editor sessions with open tabs and drafts, shared across browsers (/api/session)"},
+    {FeatureRemoteSync, "pushing saves to Consul, etcd and AWS, mirroring to a standby, and the AWS drift report (/api/aws/drift)"},
+}
+
+func featureEnabled(name string) bool {
+    on, set := config.Features[name]
+    return on || !set
+}
+
+// requireFeature answers 403 for routes of a feature that is turned off.
+func requireFeature(name string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !featureEnabled(name) {
+            c.AbortWithStatusJSON(403, gin.H{"error": name + " is disabled on this server", "feature": name})
+            return
+        }
+        c.Next()
+    }
+}
+
+// Capabilities tells clients what this deployment offers, so the UI can hide
+// what is turned off.
+type Capabilities struct {
+    Version  string          `json:"version"`
+    Features map[string]bool `json:"features"`
+    Storage  string          `json:"storage"` // local, memory or s3
+    History  string          `json:"history"` // git or snapshots
+    InMemory bool            `json:"inMemory"`
+}
+
+// capabilities reports the features and backends of this server.
+func capabilities() Capabilities {
+    caps := Capabilities{Version: Version, Features: make(map[string]bool), Storage: "local", History: HistoryGit, InMemory: inMemory}
+    for _, f := range features {
+        caps.Features[f.name] = featureEnabled(f.name)
+    }
+    switch fileStore(DataDir).(type) {
+    case *storage.Memory:
+        caps.Storage = "memory"
+    case *storage.S3:
+        caps.Storage = "s3"
+    }
+    if _, ok := historyFor(DataDir).(*store.Snapshots); ok {
+        caps.History = HistorySnapshots
+    }
+    return caps
+}
+
+// getCapabilities handles GET /api/capabilities.
+func getCapabilities(c *gin.Context) {
+    c.JSON(200, capabilities())
+}
+
+// Permission is a role-restricted action and whether the requesting user
+// may take it.
+type Permission struct {
+    Kind     string   `json:"kind"` // change (a diff policy) or override (a freeze)
+    Name     string   `json:"name"`
+    Paths    []string `json:"paths,omitempty"`
+    Pointers []string `json:"pointers,omitempty"`
+    Role     string   `json:"role"`
+    Granted  bool     `json:"granted"`
+}
+
+// Workspace is a root files can be opened from.
+type Workspace struct {
+    Path    string `json:"path"`
+    Default bool   `json:"default"` // addressed by relative names
+}
+
+// ServerLimits are the effective limits clients should check before sending.
+type ServerLimits struct {
+    MaxDepth         int    `json:"maxDepth"`
+    MaxToken         int64  `json:"maxToken"`
+    MaxSessionSize   int64  `json:"maxSessionSize"`
+    MaxGenerateCount int    `json:"maxGenerateCount"`
+    RequestTimeout   string `json:"requestTimeout"`
+    UploadExpiry     string `json:"uploadExpiry"`
+}
+
+// Bootstrap is everything a client needs to configure itself.
+type Bootstrap struct {
+    User         string       `json:"user"`
+    Roles        []string     `json:"roles"`
+    Permissions  []Permission `json:"permissions"`
+    Capabilities Capabilities `json:"capabilities"`
+    Workspaces   []Workspace  `json:"workspaces"`
+    Limits       ServerLimits `json:"limits"`
+}
+
+// getBootstrap handles GET /api/bootstrap, answering in one round trip what
+// a client would otherwise ask several endpoints for.
+func getBootstrap(c *gin.Context) {
+    user := requestUser(c)
+    data, _ := filepath.Abs(DataDir)
+    b := Bootstrap{
+        User:         user,
+        Roles:        []string{},
+        Permissions:  []Permission{},
+        Capabilities: capabilities(),
+        Workspaces:   []Workspace{{Path: data, Default: true}},
+        Limits: ServerLimits{
+            MaxDepth:         config.Validation.MaxDepth,
+            MaxToken:         config.Validation.MaxToken,
+            MaxSessionSize:   MaxSessionSize,
+            MaxGenerateCount: MaxGenerateCount,
+            RequestTimeout:   timeout(config.Timeouts.Request, RequestTimeout).String(),
+            UploadExpiry:     UploadExpiry.String(),
+        },
+    }
+    if b.Limits.MaxDepth <= 0 {
+        b.Limits.MaxDepth = engine.DefaultMaxDepth
+    }
+    if b.Limits.MaxToken <= 0 {
+        b.Limits.MaxToken = engine.DefaultMaxToken
+    }
+    for role := range config.Roles {
+        if hasRole(user, role) {
+            b.Roles = append(b.Roles, role)
+        }
+    }
+    sort.Strings(b.Roles)
+    for _, p := range config.Policies.Diff {
+        if p.RequireRole != "" {
+            b.Permissions = append(b.Permissions, Permission{Kind: "change", Name: p.Name, Paths: p.Paths, Pointers: p.Pointers, Role: p.RequireRole, Granted: hasRole(user, p.RequireRole)})
+        }
+    }
+    for _, f := range config.Freezes {
+        if f.OverrideRole != "" {
+            b.Permissions = append(b.Permissions, Permission{Kind: "override", Name: f.Name, Paths: f.Paths, Role: f.OverrideRole, Granted: hasRole(user, f.OverrideRole)})
+        }
+    }
+    for _, root := range roots() {
+        b.Workspaces = append(b.Workspaces, Workspace{Path: root})
+    }
+    c.JSON(200, b)
+}
+
+type PolicyConfig struct {
+    Rego   []RegoPolicy   `yaml:"rego"`
+    CEL    []CELRule      `yaml:"cel"`
+    Diff   []DiffPolicy   `yaml:"diff"`
+    Semver []SemverPolicy `yaml:"semver"`
+    Values []ValueRule    `yaml:"values"`
+    Compat []CompatPolicy `yaml:"compat"`
+}
+
+// RegoPolicy evaluates an Open Policy Agent module before saves of matching
+// files. The query must produce a set of deny messages (strings, or objects
+// with "msg" and an optional "pointer"); any message blocks the save.
+type RegoPolicy struct {
+    Name  string   `yaml:"name"`
+    Paths []string `yaml:"paths"`
+    File  string   `yaml:"file"`
+    Query string   `yaml:"query"`
+
+    prepared rego.PreparedEvalQuery
+}
+
+var config Config
+
+func loadConfig() error {
+    path := envOr("EDIT3_CONFIG", "edit3.yaml")
+    content, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) && os.Getenv("EDIT3_CONFIG") == "" {
+        // Defaults that have to be compiled apply without a file as well
+        return config.Expiry.compile()
+    }
+    if err != nil {
+        return err
+    }
+    if err := yaml.Unmarshal(content, &config); err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+
+    for i := range config.Policies.Rego {
+        p := &config.Policies.Rego[i]
+        if p.Query == "" {
+            p.Query = "data.edit3.deny"
+        }
+        if p.Name == "" {
+            p.Name = filepath.Base(p.File)
+        }
+        file := p.File
+        if !filepath.IsAbs(file) {
+            file = filepath.Join(filepath.Dir(path), file)
+        }
+        module, err := ioutil.ReadFile(file)
+        if err != nil {
+            return fmt.Errorf("policy %s: %v", p.Name, err)
+        }
+        p.prepared, err = rego.New(
+            rego.Query(p.Query),
+            rego.Module(file, string(module)),
+        ).PrepareForEval(context.Background())
+        if err != nil {
+            return fmt.Errorf("policy %s: %v", p.Name, err)
+        }
+    }
+    for i := range config.Policies.CEL {
+        if err := compileCELRule(&config.Policies.CEL[i]); err != nil {
+            return err
+        }
+    }
+    for i := range config.Policies.Values {
+        if err := compileValueRule(&config.Policies.Values[i]); err != nil {
+            return fmt.Errorf("%s: %v", path, err)
+        }
+    }
+    for i := range config.Policies.Compat {
+        p := &config.Policies.Compat[i]
+        switch p.Strictness {
+        case "":
+            p.Strictness = CompatTypes
+        case CompatRemovals, CompatTypes, CompatStrict:
+        default:
+            return fmt.Errorf("%s: compat policy %s: unknown strictness %q (use removals, types or strict)", path, p.Name, p.Strictness)
+        }
+    }
+    for i := range config.Freezes {
+        if err := compileFreezeWindow(&config.Freezes[i]); err != nil {
+            return err
+        }
+    }
+    if u := config.Unused; u != nil {
+        u.base = filepath.Dir(path)
+        if u.Manifest != "" && !filepath.IsAbs(u.Manifest) {
+            u.Manifest = filepath.Join(u.base, u.Manifest)
+        }
+    }
+    if config.Consumers != "" && !filepath.IsAbs(config.Consumers) {
+        config.Consumers = filepath.Join(filepath.Dir(path), config.Consumers)
+    }
+    for i := range config.Redact {
+        if err := compileRedactRule(&config.Redact[i]); err != nil {
+            return err
+        }
+    }
+    if config.Timeouts.Git > 0 {
+        store.Timeout = config.Timeouts.Git
+    }
+    for name, file := range config.Create.Templates {
+        if !filepath.IsAbs(file) {
+            config.Create.Templates[name] = filepath.Join(filepath.Dir(path), file)
+        }
+    }
+    for i, rule := range config.Normalize {
+        if err := rule.Check(); err != nil {
+            return fmt.Errorf("%s: normalize rule %d: %v", path, i+1, err)
+        }
+    }
+    for _, name := range config.Validation.Profiles {
+        if name != ProfileDockerfile && name != ProfileShell {
+            return fmt.Errorf("%s: unknown validation profile %q", path, name)
+        }
+    }
+    for name, env := range config.Environments {
+        if _, ok := relativeTo(".", filepath.Clean(env.Path)); !ok || env.Path == "" || filepath.IsAbs(env.Path) {
+            return fmt.Errorf("%s: environment %s: path must be a directory inside the data directory", path, name)
+        }
+    }
+    for i, rule := range config.Notify.Approvals {
+        if rule.empty() {
+            return fmt.Errorf("%s: approval rule %d: slack, webhook or email is required", path, i+1)
+        }
+        if (len(rule.Email) > 0 || len(rule.Escalate.Email) > 0) && config.Notify.Email == nil {
+            return fmt.Errorf("%s: approval rule %d: email needs notify.email", path, i+1)
+        }
+        for _, env := range rule.Environments {
+            if _, ok := config.Environments[env]; !ok {
+                return fmt.Errorf("%s: approval rule %d: unknown environment %q", path, i+1, env)
+            }
+        }
+    }
+    for i, rule := range config.Reviews {
+        if len(rule.Paths) == 0 || rule.Within <= 0 {
+            return fmt.Errorf("%s: review rule %d: paths and a positive within are required", path, i+1)
+        }
+        if len(rule.Email) > 0 && config.Notify.Email == nil {
+            return fmt.Errorf("%s: review rule %d: email needs notify.email", path, i+1)
+        }
+    }
+    if err := config.Expiry.compile(); err != nil {
+        return fmt.Errorf("%s: expiry: %v", path, err)
+    }
+    if len(config.Expiry.Email) > 0 && config.Notify.Email == nil {
+        return fmt.Errorf("%s: expiry: email needs notify.email", path)
+    }
+    for i := range config.Lookups {
+        if err := compileLookup(&config.Lookups[i]); err != nil {
+            return fmt.Errorf("%s: %v", path, err)
+        }
+    }
+    if k := config.Consistency.Keys; k != "" {
+        keys, err := regexp.Compile(k)
+        if err != nil {
+            return fmt.Errorf("%s: consistency: %v", path, err)
+        }
+        config.Consistency.keys = keys
+    }
+    if err := config.Env.compile(); err != nil {
+        return fmt.Errorf("%s: env: %v", path, err)
+    }
+    for i := range config.Schemas {
+        if err := config.Schemas[i].compile(filepath.Dir(path)); err != nil {
+            return fmt.Errorf("%s: %v", path, err)
+        }
+    }
+    for i := range config.JWKS {
+        src := &config.JWKS[i]
+        if src.URL == "" {
+            return fmt.Errorf("%s: jwks %d: url is required", path, i+1)
+        }
+        if !src.remote() && !filepath.IsAbs(src.URL) {
+            src.URL = filepath.Join(filepath.Dir(path), src.URL)
+        }
+    }
+    if c := config.Cluster; c != nil {
+        switch {
+        case c.Backend != "" && c.Backend != "file" && c.Backend != "etcd":
+            return fmt.Errorf("%s: unknown cluster backend %q (use file or etcd)", path, c.Backend)
+        case c.Backend == "etcd" && len(c.Endpoints) == 0:
+            return fmt.Errorf("%s: the etcd cluster backend needs endpoints", path)
+        }
+    }
+    for name := range config.Features {
+        known := false
+        for _, f := range features {
+            known = known || f.name == name
+        }
+        if !known {
+            return fmt.Errorf("%s: unknown feature %q", path, name)
+        }
+    }
+    for _, dest := range config.Notify.Destinations {
+        if u, err := neturl.Parse(dest); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("%s: notify destination %q must be an http(s) url", path, dest)
+        }
+    }
+    if config.Notify.Email != nil {
+        if err := config.Notify.Email.compile(); err != nil {
+            return fmt.Errorf("%s: email: %v", path, err)
+        }
+    }
+    if d := config.Notify.Digest; d != nil {
+        if d.empty() {
+            return fmt.Errorf("%s: digest: slack, webhook or email is required", path)
+        }
+        if len(d.Email) > 0 && config.Notify.Email == nil {
+            return fmt.Errorf("%s: digest: email needs notify.email", path)
+        }
+        if d.Schedule == "" {
+            d.Schedule = "@daily"
+        }
+        schedule, err := cron.ParseStandard(d.Schedule)
+        if err != nil {
+            return fmt.Errorf("%s: digest: %v", path, err)
+        }
+        d.schedule = schedule
+    }
+    return compileCommitConfig(&config.Commit)
+}
+
+// pathMatches reports whether rel matches any of the globs. "*" stays within
+// a path element, "**" spans directories. No patterns matches everything.
+func pathMatches(patterns []string, rel string) bool {
+    if len(patterns) == 0 {
+        return true
+    }
+    rel = filepath.ToSlash(rel)
+    for _, pattern := range patterns {
+        if globRegexp(pattern).MatchString(rel) {
+            return true
+        }
+    }
+    return false
+}
+
+var globCache sync.Map
+
+func globRegexp(pattern string) *regexp.Regexp {
+    if re, ok := globCache.Load(pattern); ok {
+        return re.(*regexp.Regexp)
+    }
+    var b strings.Builder
+    b.WriteString("^")
+    for i := 0; i < len(pattern); i++ {
+        switch ch := pattern[i]; ch {
+        case '*':
+            if i+1 < len(pattern) && pattern[i+1] == '*' {
+                i++
+                if i+1 < len(pattern) && pattern[i+1] == '/' {
+                    // "**/" also matches no directory at all
+                    i++
+                    b.WriteString("(.*/)?")
+                } else {
+                    b.WriteString(".*")
+                }
+            } else {
+                b.WriteString("[^/]*")
+            }
+        case '?':
+            b.WriteString("[^/]")
+        default:
+            b.WriteString(regexp.QuoteMeta(string(ch)))
+        }
+    }
+    b.WriteString("$")
+    re := regexp.MustCompile(b.String())
+    globCache.Store(pattern, re)
+    return re
+}
+
+// Save gates
+
+// Violation is one reason a save was refused.
+type Violation struct {
+    Policy  string `json:"policy"`
+    Message string `json:"message"`
+    Pointer string `json:"pointer,omitempty"`
+}
+
+// SaveCandidate describes content about to be written, for save gates.
+// FullPath is where the current version lives; User is whoever asked for the
+// save, as far as edit3 can tell.
+type SaveCandidate struct {
+    Filename string
+    Dir      string
+    Rel      string
+    FullPath string
+    FileType string
+    Content  []byte
+    User     string
+    // Ticket is the change ticket ID sent with the request, if any.
+    Ticket string
+    // SchemaVersion, when set, is the schema version the file is saved at
+    // by a save that also writes its sidecar.
+    SchemaVersion string
+    // Context is cancelled with the request; gates that run commands or call
+    // out honour it.
+    Context context.Context
+
+    doc    interface{}
+    docErr error
+    parsed bool
+}
+
+func (s *SaveCandidate) ctx() context.Context {
+    if s.Context == nil {
+        return context.Background()
+    }
+    return s.Context
+}
+
+// Document returns the candidate parsed into JSON-compatible values (nil for
+// formats without a data model, such as XML).
+func (s *SaveCandidate) Document() (interface{}, error) {
+    if !s.parsed {
+        s.doc, s.docErr = parseDocument(s.Content, s.FileType)
+        s.parsed = true
+    }
+    return s.doc, s.docErr
+}
+
+// PreviousDocument parses the version currently stored; nil if there is none.
+func (s *SaveCandidate) PreviousDocument() (interface{}, error) {
+    content, err := fileStore(s.Dir).Read(storageName(s.Rel))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return parseDocument(content, s.FileType)
+}
+
+// parseDocument decodes JSON or YAML into the plain map/slice form used by
+// policies: map[string]interface{}, []interface{} and scalars.
+func parseDocument(content []byte, fileType string) (interface{}, error) {
+    return engine.Parse(content, fileType)
+}
+
+// normalizeDocument turns YAML's map[interface{}]interface{} and timestamps
+// into JSON-compatible values.
+func normalizeDocument(v interface{}) interface{} {
+    return engine.Normalize(v)
+}
+
+// saveGate inspects a candidate and returns the violations that block it.
+type saveGate func(s *SaveCandidate) []Violation
+
+var saveGates = []saveGate{freezeGate, ansibleGate, monitoringGate, grafanaGate, ciGate, externalGate, profileGate, cueGate, regoGate, celGate, valueGate, schemaVersionGate, diffGate, compatGate, semverGate}
+
+// PolicyError is returned when save gates refuse a save.
+type PolicyError struct {
+    Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+    var msgs []string
+    for _, v := range e.Violations {
+        msgs = append(msgs, v.Message)
+    }
+    return "save denied by policy: " + strings.Join(msgs, "; ")
+}
+
+// checkSaveGates runs every gate and returns a *PolicyError if any objects.
+func checkSaveGates(s *SaveCandidate) error {
+    var violations []Violation
+    for _, gate := range saveGates {
+        violations = append(violations, gate(s)...)
+    }
+    if len(violations) > 0 {
+        return &PolicyError{Violations: violations}
+    }
+    return nil
+}
+
+// policyErrorJSON writes the 422 response for a refused save.
+func policyErrorJSON(c *gin.Context, err *PolicyError) {
+    c.JSON(422, gin.H{"error": err.Error(), "violations": err.Violations})
+}
+
+func regoGate(s *SaveCandidate) []Violation {
+    var violations []Violation
+    for i := range config.Policies.Rego {
+        p := &config.Policies.Rego[i]
+        if !pathMatches(p.Paths, s.Rel) {
+            continue
+        }
+        doc, err := s.Document()
+        if err != nil {
+            continue
+        }
+        input := map[string]interface{}{
+            "document": doc,
+            "content":  string(s.Content),
+            "file": map[string]interface{}{
+                "name": s.Filename,
+                "path": filepath.ToSlash(s.Rel),
+                "type": s.FileType,
+            },
+        }
+        results, err := p.prepared.Eval(context.Background(), rego.EvalInput(input))
+        if err != nil {
+            violations = append(violations, Violation{Policy: p.Name, Message: "policy evaluation failed: " + err.Error()})
+            continue
+        }
+        for _, result := range results {
+            for _, expr := range result.Expressions {
+                violations = append(violations, regoMessages(p.Name, expr.Value)...)
+            }
+        }
+    }
+    return violations
+}
+
+func regoMessages(policy string, value interface{}) []Violation {
+    var violations []Violation
+    switch v := value.(type) {
+    case []interface{}:
+        for _, item := range v {
+            violations = append(violations, regoMessages(policy, item)...)
+        }
+    case string:
+        violations = append(violations, Violation{Policy: policy, Message: v})
+    case map[string]interface{}:
+        msg, _ := v["msg"].(string)
+        pointer, _ := v["pointer"].(string)
+        violations = append(violations, Violation{Policy: policy, Message: msg, Pointer: pointer})
+    case bool:
+        if v {
+            violations = append(violations, Violation{Policy: policy, Message: "denied by " + policy})
+        }
+    }
+    return violations
+}
+
+// CELRule is a lightweight constraint: Expr must evaluate to true for the
+// value at Pointer (a JSON pointer, where a "*" segment fans out over every
+// array element or object member). The value is bound as "self", and the keys
+// of an object value are also bound directly, so "size(spec.containers) > 0"
+// works against the document root.
+type CELRule struct {
+    Name    string   `yaml:"name"`
+    Paths   []string `yaml:"paths"`
+    Pointer string   `yaml:"pointer"`
+    Expr    string   `yaml:"expr"`
+    Message string   `yaml:"message"`
+
+    program cel.Program
+}
+
+var celEnv *cel.Env
+
+func compileCELRule(r *CELRule) error {
+    if celEnv == nil {
+        env, err := cel.NewEnv()
+        if err != nil {
+            return err
+        }
+        celEnv = env
+    }
+    if r.Name == "" {
+        r.Name = r.Expr
+    }
+    // Parse without type checking: the variables are whatever keys the
+    // document has, which are only known at save time.
+    ast, iss := celEnv.Parse(r.Expr)
+    if iss.Err() != nil {
+        return fmt.Errorf("cel rule %s: %v", r.Name, iss.Err())
+    }
+    program, err := celEnv.Program(ast)
+    if err != nil {
+        return fmt.Errorf("cel rule %s: %v", r.Name, err)
+    }
+    r.program = program
+    return nil
+}
+
+func celGate(s *SaveCandidate) []Violation {
+    var violations []Violation
+    for i := range config.Policies.CEL {
+        r := &config.Policies.CEL[i]
+        if !pathMatches(r.Paths, s.Rel) {
+            continue
+        }
+        doc, err := s.Document()
+        if err != nil || doc == nil {
+            continue
+        }
+        for _, match := range selectPointer(doc, r.Pointer) {
+            vars := map[string]interface{}{"self": match.Value}
+            if obj, ok := match.Value.(map[string]interface{}); ok {
+                for k, v := range obj {
+                    if _, taken := vars[k]; !taken {
+                        vars[k] = v
+                    }
+                }
+            }
+            out, _, err := r.program.Eval(vars)
+            message := r.Message
+            if message == "" {
+                message = "constraint failed: " + r.Expr
+            }
+            if err != nil {
+                message = fmt.Sprintf("%s (%v)", message, err)
+            } else if ok, _ := out.Value().(bool); ok {
+                continue
+            }
+            violations = append(violations, Violation{Policy: r.Name, Message: message, Pointer: match.Pointer})
+        }
+    }
+    return violations
+}
+
+type pointerMatch struct {
+    Pointer string
+    Value   interface{}
+}
+
+// selectPointer resolves a JSON pointer against a parsed document, expanding
+// "*" segments. Segments that do not exist yield no matches.
+func selectPointer(doc interface{}, pointer string) []pointerMatch {
+    matches := []pointerMatch{{Pointer: "", Value: doc}}
+    if pointer == "" || pointer == "/" {
+        return matches
+    }
+    for _, segment := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+        segment = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+        var next []pointerMatch
+        for _, m := range matches {
+            switch v := m.Value.(type) {
+            case map[string]interface{}:
+                if segment == "*" {
+                    keys := make([]string, 0, len(v))
+                    for k := range v {
+                        keys = append(keys, k)
+                    }
+                    sort.Strings(keys)
+                    for _, k := range keys {
+                        next = append(next, pointerMatch{m.Pointer + "/" + escapePointer(k), v[k]})
+                    }
+                } else if item, ok := v[segment]; ok {
+                    next = append(next, pointerMatch{m.Pointer + "/" + escapePointer(segment), item})
+                }
+            case []interface{}:
+                if segment == "*" {
+                    for i, item := range v {
+                        next = append(next, pointerMatch{fmt.Sprintf("%s/%d", m.Pointer, i), item})
+                    }
+                } else if i, err := strconv.Atoi(segment); err == nil && i >= 0 && i < len(v) {
+                    next = append(next, pointerMatch{m.Pointer + "/" + segment, v[i]})
+                }
+            }
+        }
+        matches = next
+    }
+    return matches
+}
+
+func escapePointer(key string) string {
+    return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// DiffPolicy limits what a single save may change, judged on the structural
+// diff against the file on disk. Pointers narrows the policy to changes at or
+// below those JSON pointers ("*" matches one segment). MaxChanges caps how many
+// values may change; RequireRole restricts the change to members of a role.
+type DiffPolicy struct {
+    Name        string   `yaml:"name"`
+    Paths       []string `yaml:"paths"`
+    Pointers    []string `yaml:"pointers"`
+    MaxChanges  int      `yaml:"max_changes"`
+    RequireRole string   `yaml:"require_role"`
+}
+
+// Change is one difference between two parsed documents.
+type Change struct {
+    Op      string      `json:"op"`
+    Pointer string      `json:"pointer"`
+    Old     interface{} `json:"old,omitempty"`
+    New     interface{} `json:"new,omitempty"`
+}
+
+// diffDocuments lists the leaf-level changes from a to b. Objects are compared
+// key by key and arrays index by index; anything else is replaced whole.
+func diffDocuments(a, b interface{}) []Change {
+    var changes []Change
+    var walk func(ptr string, a, b interface{})
+    walk = func(ptr string, a, b interface{}) {
+        switch av := a.(type) {
+        case map[string]interface{}:
+            if bv, ok := b.(map[string]interface{}); ok {
+                keys := make([]string, 0, len(av)+len(bv))
+                for k := range av {
+                    keys = append(keys, k)
+                }
+                for k := range bv {
+                    if _, ok := av[k]; !ok {
+                        keys = append(keys, k)
+                    }
+                }
+                sort.Strings(keys)
+                for _, k := range keys {
+                    child := ptr + "/" + escapePointer(k)
+                    old, inA := av[k]
+                    cur, inB := bv[k]
+                    switch {
+                    case !inB:
+                        changes = append(changes, Change{Op: "remove", Pointer: child, Old: old})
+                    case !inA:
+                        changes = append(changes, Change{Op: "add", Pointer: child, New: cur})
+                    default:
+                        walk(child, old, cur)
+                    }
+                }
+                return
+            }
+        case []interface{}:
+            if bv, ok := b.([]interface{}); ok {
+                for i := 0; i < len(av) || i < len(bv); i++ {
+                    child := fmt.Sprintf("%s/%d", ptr, i)
+                    switch {
+                    case i >= len(bv):
+                        changes = append(changes, Change{Op: "remove", Pointer: child, Old: av[i]})
+                    case i >= len(av):
+                        changes = append(changes, Change{Op: "add", Pointer: child, New: bv[i]})
+                    default:
+                        walk(child, av[i], bv[i])
+                    }
+                }
+                return
+            }
+        }
+        if !reflect.DeepEqual(a, b) {
+            changes = append(changes, Change{Op: "replace", Pointer: ptr, Old: a, New: b})
+        }
+    }
+    walk("", a, b)
+    return changes
+}
+
+// MaxSummaryChanges is how many changes a summary spells out before
+// collapsing the rest into a count.
+const MaxSummaryChanges = 5
+
+// summarizeChanges describes a structural diff for humans, e.g.
+// "replicas: 2→5; added env var FOO; removed key legacy.timeout".
+func summarizeChanges(changes []Change) string {
+    var parts []string
+    for i, change := range changes {
+        if i == MaxSummaryChanges {
+            parts = append(parts, fmt.Sprintf("%d more changes", len(changes)-i))
+            break
+        }
+        switch change.Op {
+        case "add":
+            parts = append(parts, "added "+describeKey(change.Pointer, change.New))
+        case "remove":
+            parts = append(parts, "removed "+describeKey(change.Pointer, change.Old))
+        default:
+            parts = append(parts, fmt.Sprintf("%s: %s→%s", dottedPath(change.Pointer), summaryValue(change.Old), summaryValue(change.New)))
+        }
+    }
+    return strings.Join(parts, "; ")
+}
+
+// describeKey names an added or removed value: list items by their "name"
+// field, environment variables as such, anything else as a dotted key.
+func describeKey(pointer string, value interface{}) string {
+    segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+    last := segments[len(segments)-1]
+    parent := ""
+    if len(segments) > 1 {
+        parent = segments[len(segments)-2]
+    }
+    if _, err := strconv.Atoi(last); err == nil {
+        if m, ok := value.(map[string]interface{}); ok {
+            if name, ok := m["name"].(string); ok {
+                last = name
+            }
+        }
+    }
+    switch strings.ToLower(parent) {
+    case "env", "environment", "variables":
+        return "env var " + strings.NewReplacer("~1", "/", "~0", "~").Replace(last)
+    }
+    return "key " + dottedPath(pointer)
+}
+
+func dottedPath(pointer string) string {
+    if pointer == "" {
+        return "document"
+    }
+    segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+    for i, s := range segments {
+        segments[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(s)
+    }
+    return strings.Join(segments, ".")
+}
+
+func summaryValue(v interface{}) string {
+    var s string
+    switch v := v.(type) {
+    case string:
+        s = v
+    case map[string]interface{}, []interface{}:
+        b, _ := json.Marshal(v)
+        s = string(b)
+    default:
+        s = fmt.Sprint(v)
+    }
+    if r := []rune(s); len(r) > 40 {
+        s = string(r[:37]) + "..."
+    }
+    return s
+}
+
+// changeSummary summarizes what a save changes against the file on disk, or
+// returns "" when that cannot be told (new file, XML, parse error).
+func changeSummary(s *SaveCandidate) string {
+    if summary := grafanaSummary(s); summary != "" {
+        return summary
+    }
+    doc, err := s.Document()
+    if err != nil || doc == nil {
+        return ""
+    }
+    previous, err := s.PreviousDocument()
+    if err != nil || previous == nil {
+        return ""
+    }
+    return summarizeChanges(diffDocuments(previous, doc))
+}
+
+// CommitConfig shapes default commit messages. Template is a Go template over
+// CommitInfo, e.g. "chore(config): {{.Summary}} [{{.Ticket}}]". The ticket
+// comes from the TicketHeader request header (default X-Edit3-Ticket); when
+// TicketPattern is set, its first match (or first group) is the ticket ID.
+type CommitConfig struct {
+    Template      string `yaml:"template"`
+    TicketHeader  string `yaml:"ticket_header"`
+    TicketPattern string `yaml:"ticket_pattern"`
+
+    template *texttemplate.Template
+    ticket   *regexp.Regexp
+}
+
+// CommitInfo is the data available to commit message templates. Action is
+// "update" or "script"; Summary falls back to the timestamp when the change
+// cannot be summarized.
+type CommitInfo struct {
+    Action    string
+    File      string
+    Author    string
+    Ticket    string
+    Summary   string
+    Timestamp string
+}
+
+var commitActions = map[string]string{"update": "Update", "script": "Script edit"}
+
+func compileCommitConfig(cc *CommitConfig) error {
+    if cc.TicketHeader == "" {
+        cc.TicketHeader = "X-Edit3-Ticket"
+    }
+    if cc.Template != "" {
+        tmpl, err := texttemplate.New("commit").Funcs(templateFuncs).Option("missingkey=error").Parse(cc.Template)
+        if err != nil {
+            return fmt.Errorf("commit template: %v", err)
+        }
+        cc.template = tmpl
+    }
+    if cc.TicketPattern != "" {
+        re, err := regexp.Compile(cc.TicketPattern)
+        if err != nil {
+            return fmt.Errorf("commit ticket_pattern: %v", err)
+        }
+        cc.ticket = re
+    }
+    return nil
+}
+
+// requestTicket extracts the ticket ID for a save from the request headers.
+func requestTicket(c *gin.Context) string {
+    header := config.Commit.TicketHeader
+    if header == "" {
+        header = "X-Edit3-Ticket"
+    }
+    value := strings.TrimSpace(c.GetHeader(header))
+    if value == "" || config.Commit.ticket == nil {
+        return value
+    }
+    m := config.Commit.ticket.FindStringSubmatch(value)
+    switch {
+    case m == nil:
+        return ""
+    case len(m) > 1:
+        return m[1]
+    }
+    return m[0]
+}
+
+// commitMessage builds the default commit message for a save.
+func commitMessage(action string, s *SaveCandidate) string {
+    info := CommitInfo{
+        Action:    action,
+        File:      filepath.ToSlash(s.Rel),
+        Author:    s.User,
+        Ticket:    s.Ticket,
+        Summary:   changeSummary(s),
+        Timestamp: time.Now().Format(time.RFC3339),
+    }
+    if info.Summary == "" {
+        info.Summary = info.Timestamp
+    }
+    if tmpl := config.Commit.template; tmpl != nil {
+        var b strings.Builder
+        if err := tmpl.Execute(&b, info); err == nil && strings.TrimSpace(b.String()) != "" {
+            return strings.TrimSpace(b.String())
+        } else if err != nil {
+            log.Printf("commit template: %v", err)
+        }
+    }
+    return fmt.Sprintf("%s %s: %s", commitActions[action], info.File, info.Summary)
+}
+
+// pointerAffects reports whether a change at ptr touches the subtree named by
+// pattern: either ptr lies under it, or ptr is an ancestor that replaced it.
+func pointerAffects(pattern, ptr string) bool {
+    split := func(p string) []string {
+        if p == "" || p == "/" {
+            return nil
+        }
+        return strings.Split(strings.TrimPrefix(p, "/"), "/")
+    }
+    pat, segs := split(pattern), split(ptr)
+    for i := 0; i < len(pat) && i < len(segs); i++ {
+        if pat[i] != "*" && pat[i] != segs[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// pointerUnder reports whether ptr is at or below the subtree named by pattern.
+func pointerUnder(pattern, ptr string) bool {
+    return strings.Count(ptr, "/") >= strings.Count(strings.TrimSuffix(pattern, "/"), "/") && pointerAffects(pattern, ptr)
+}
+
+func hasRole(user, role string) bool {
+    for _, member := range config.Roles[role] {
+        if member == user && user != "" {
+            return true
+        }
+    }
+    return false
+}
+
+func diffGate(s *SaveCandidate) []Violation {
+    var violations []Violation
+    var changes []Change
+    diffed := false
+    for _, p := range config.Policies.Diff {
+        if !pathMatches(p.Paths, s.Rel) {
+            continue
+        }
+        if !diffed {
+            diffed = true
+            doc, err := s.Document()
+            if err != nil || doc == nil {
+                return nil
+            }
+            previous, err := s.PreviousDocument()
+            if err != nil {
+                return nil
+            }
+            changes = diffDocuments(previous, doc)
+        }
+
+        var relevant []Change
+        for _, change := range changes {
+            if len(p.Pointers) == 0 {
+                relevant = append(relevant, change)
+                continue
+            }
+            for _, pattern := range p.Pointers {
+                if pointerAffects(pattern, change.Pointer) {
+                    relevant = append(relevant, change)
+                    break
+                }
+            }
+        }
+        if len(relevant) == 0 {
+            continue
+        }
+
+        if p.MaxChanges > 0 && len(relevant) > p.MaxChanges {
+            violations = append(violations, Violation{
+                Policy:  p.Name,
+                Message: fmt.Sprintf("save changes %d values, more than the %d allowed", len(relevant), p.MaxChanges),
+            })
+        }
+        if p.RequireRole != "" && !hasRole(s.User, p.RequireRole) {
+            for _, change := range relevant {
+                violations = append(violations, Violation{
+                    Policy:  p.Name,
+                    Message: fmt.Sprintf("changing %s requires the %s role", change.Pointer, p.RequireRole),
+                    Pointer: change.Pointer,
+                })
+            }
+        }
+    }
+    return violations
+}
+
+// CompatPolicy flags changes to matching files that could break the readers
+// consuming them, judged against the file's last commit. Strictness picks
+// what breaks: "removals" only removed keys, "types" (the default) also
+// values whose type changes, and "strict" also removed array items and
+// values set to or from null. Pointers narrows the check to the values
+// readers consume ("*" matches one segment). With Warn the save goes
+// through and its response lists the breaking changes instead.
+type CompatPolicy struct {
+    Name       string   `yaml:"name"`
+    Paths      []string `yaml:"paths"`
+    Pointers   []string `yaml:"pointers"`
+    Strictness string   `yaml:"strictness"`
+    Warn       bool     `yaml:"warn"`
+}
+
+// Compat policy strictness levels.
+const (
+    CompatRemovals = "removals"
+    CompatTypes    = "types"
+    CompatStrict   = "strict"
+)
+
+func compatGate(s *SaveCandidate) []Violation {
+    doc, err := s.Document()
+    if err != nil || doc == nil {
+        return nil
+    }
+    return breakingChanges(s.ctx(), s.Dir, s.Rel, s.FileType, doc, false)
+}
+
+// breakingChanges checks doc, the new content of rel, against the compat
+// policies that refuse saves or, with warn, those that only warn.
+func breakingChanges(ctx context.Context, dir, rel, fileType string, doc interface{}, warn bool) []Violation {
+    var violations []Violation
+    var changes []Change
+    var previous interface{}
+    diffed := false
+    for _, p := range config.Policies.Compat {
+        if p.Warn != warn || !pathMatches(p.Paths, rel) {
+            continue
+        }
+        if !diffed {
+            diffed = true
+            content, err := fileAtVersion(ctx, dir, rel, "HEAD")
+            if err != nil {
+                return nil
+            }
+            if previous, err = parseDocument(content, fileType); err != nil {
+                return nil
+            }
+            changes = diffDocuments(previous, doc)
+        }
+        for _, change := range changes {
+            if len(p.Pointers) > 0 && !pointerMatchesAny(p.Pointers, change.Pointer) {
+                continue
+            }
+            if message := p.breaking(previous, change); message != "" {
+                violations = append(violations, Violation{Policy: p.Name, Message: message, Pointer: change.Pointer})
+            }
+        }
+    }
+    return violations
+}
+
+func pointerMatchesAny(patterns []string, ptr string) bool {
+    for _, pattern := range patterns {
+        if pointerAffects(pattern, ptr) {
+            return true
+        }
+    }
+    return false
+}
+
+// breaking describes why change breaks readers under the policy's
+// strictness, or returns "".
+func (p CompatPolicy) breaking(previous interface{}, change Change) string {
+    switch change.Op {
+    case "remove":
+        parent := change.Pointer[:strings.LastIndex(change.Pointer, "/")]
+        if matches := selectPointer(previous, parent); len(matches) == 1 {
+            if _, list := matches[0].Value.([]interface{}); list {
+                if p.Strictness == CompatStrict {
+                    return fmt.Sprintf("removes item %s", dottedPath(change.Pointer))
+                }
+                return ""
+            }
+        }
+        return fmt.Sprintf("removes %s, which the last commit has", dottedPath(change.Pointer))
+    case "replace":
+        if p.Strictness == CompatRemovals {
+            return ""
+        }
+        before, after := valueType(change.Old), valueType(change.New)
+        if before == after || (before == "null" || after == "null") && p.Strictness != CompatStrict {
+            return ""
+        }
+        return fmt.Sprintf("changes %s from %s to %s", dottedPath(change.Pointer), before, after)
+    }
+    return ""
+}
+
+// valueType names the JSON type of a parsed value.
+func valueType(v interface{}) string {
+    switch v.(type) {
+    case nil:
+        return "null"
+    case map[string]interface{}:
+        return "object"
+    case []interface{}:
+        return "array"
+    case string:
+        return "string"
+    case bool:
+        return "boolean"
+    }
+    return "number"
+}
+
+// SemverPolicy marks fields holding semantic versions. Saves must keep them
+// valid and may only move them forward; POST /api/semver bumps them.
+type SemverPolicy struct {
+    Name     string   `yaml:"name"`
+    Paths    []string `yaml:"paths"`
+    Pointers []string `yaml:"pointers"`
+}
+
+func semverGate(s *SaveCandidate) []Violation {
+    var violations []Violation
+    for _, p := range config.Policies.Semver {
+        if !pathMatches(p.Paths, s.Rel) {
+            continue
+        }
+        doc, err := s.Document()
+        if err != nil || doc == nil {
+            return nil
+        }
+        previous, err := s.PreviousDocument()
+        if err != nil {
+            return nil
+        }
+        for _, pattern := range p.Pointers {
+            for _, m := range selectPointer(doc, pattern) {
+                current, err := semver.NewVersion(fmt.Sprint(m.Value))
+                if err != nil {
+                    violations = append(violations, Violation{
+                        Policy:  p.Name,
+                        Message: fmt.Sprintf("%v is not a semantic version", m.Value),
+                        Pointer: m.Pointer,
+                    })
+                    continue
+                }
+                for _, old := range selectPointer(previous, m.Pointer) {
+                    before, err := semver.NewVersion(fmt.Sprint(old.Value))
+                    if err == nil && current.LessThan(before) {
+                        violations = append(violations, Violation{
+                            Policy:  p.Name,
+                            Message: fmt.Sprintf("version may not go back from %s to %s", before.Original(), current.Original()),
+                            Pointer: m.Pointer,
+                        })
+                    }
+                }
+            }
+        }
+    }
+    return violations
+}
+
+// ValueRule checks the format of values whatever the schema says: values
+// under keys matching Keys (a regular expression on the key name), or at
+// Pointers, must be a Format of engine.ValueFormats, or one of the values of
+// the named Enum of the enums config. Lists are checked item by item, and
+// with Separator so are strings holding a list, such as
+// ALLOWED_CIDRS=10.0.0.0/8,192.168.0.0/16 in a .env file. With Resolve,
+// host names and the hosts of URLs must also resolve in DNS.
+type ValueRule struct {
+    Name      string   `yaml:"name"`
+    Paths     []string `yaml:"paths"`
+    Keys      string   `yaml:"keys"`
+    Pointers  []string `yaml:"pointers"`
+    Format    string   `yaml:"format"`
+    Enum      string   `yaml:"enum"`
+    Separator string   `yaml:"separator"`
+    Resolve   bool     `yaml:"resolve"`
+
+    keys *regexp.Regexp
+}
+
+func compileValueRule(r *ValueRule) error {
+    if r.Name == "" {
+        r.Name = r.Format + r.Enum
+    }
+    known := false
+    for _, f := range engine.ValueFormats {
+        known = known || f == r.Format
+    }
+    switch {
+    case (r.Format == "") == (r.Enum == ""):
+        return fmt.Errorf("value rule %s: give either format or enum", r.Name)
+    case r.Format != "" && !known:
+        return fmt.Errorf("value rule %s: format must be one of %s", r.Name, strings.Join(engine.ValueFormats, ", "))
+    case r.Enum != "" && config.Enums[r.Enum] == nil:
+        return fmt.Errorf("value rule %s: unknown enum %q", r.Name, r.Enum)
+    }
+    if r.Keys == "" && len(r.Pointers) == 0 {
+        return fmt.Errorf("value rule %s: keys or pointers are required", r.Name)
+    }
+    if r.Keys != "" {
+        keys, err := regexp.Compile(r.Keys)
+        if err != nil {
+            return fmt.Errorf("value rule %s: %v", r.Name, err)
+        }
+        r.keys = keys
+    }
+    return nil
+}
+
+// check returns why v is not a value of the rule's format or enum, or "".
+func (r *ValueRule) check(ctx context.Context, v interface{}) string {
+    s := strings.TrimSpace(fmt.Sprint(v))
+    if r.Enum != "" {
+        if !inEnum(r.Enum, s) {
+            return fmt.Sprintf("%q is not in the %s enum", s, r.Enum)
+        }
+        return ""
+    }
+    if err := engine.CheckValue(r.Format, s); err != nil {
+        return err.Error()
+    }
+    if !r.Resolve {
+        return ""
+    }
+    host := s
+    switch r.Format {
+    case "url":
+        u, _ := neturl.Parse(s)
+        host = u.Hostname()
+    case "hostname":
+    default:
+        return ""
+    }
+    if net.ParseIP(host) != nil {
+        return ""
+    }
+    ctx, cancel := context.WithTimeout(ctx, timeout(config.Timeouts.External, ExternalCheckTimeout))
+    defer cancel()
+    if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+        return fmt.Sprintf("%s does not resolve", host)
+    }
+    return ""
+}
+
+// valueDocument is what value rules look at: the parsed document, or the
+// variables of a .env file.
+func valueDocument(s *SaveCandidate) interface{} {
+    if engine.IsEnv(s.FileType) {
+        return envDocument(s.Content)
+    }
+    doc, err := s.Document()
+    if err != nil {
+        return nil
+    }
+    return doc
+}
+
+// envDocument is a .env file as an object of its variables; nil when it
+// does not parse.
+func envDocument(content []byte) interface{} {
+    vars, err := engine.ParseEnv(content)
+    if err != nil {
+        return nil
+    }
+    doc := make(map[string]interface{}, len(vars))
+    for _, v := range vars {
+        doc[v.Key] = v.Value
+    }
+    return doc
+}
+
+func valueGate(s *SaveCandidate) []Violation {
+    var violations []Violation
+    for i := range config.Policies.Values {
+        r := &config.Policies.Values[i]
+        if !pathMatches(r.Paths, s.Rel) {
+            continue
+        }
+        doc := valueDocument(s)
+        if doc == nil {
+            return nil
+        }
+        var check func(ptr string, v interface{})
+        check = func(ptr string, v interface{}) {
+            switch val := v.(type) {
+            case nil, map[string]interface{}:
+                return
+            case []interface{}:
+                for i, item := range val {
+                    check(fmt.Sprintf("%s/%d", ptr, i), item)
+                }
+                return
+            case string:
+                if r.Separator != "" && strings.Contains(val, r.Separator) {
+                    for _, item := range strings.Split(val, r.Separator) {
+                        if message := r.check(s.ctx(), item); message != "" {
+                            violations = append(violations, Violation{Policy: r.Name, Message: message, Pointer: ptr})
+                        }
+                    }
+                    return
+                }
+            }
+            if message := r.check(s.ctx(), v); message != "" {
+                violations = append(violations, Violation{Policy: r.Name, Message: message, Pointer: ptr})
+            }
+        }
+        for _, pattern := range r.Pointers {
+            for _, m := range selectPointer(doc, pattern) {
+                check(m.Pointer, m.Value)
+            }
+        }
+        if r.keys == nil {
+            continue
+        }
+        var walk func(ptr string, v interface{})
+        walk = func(ptr string, v interface{}) {
+            switch val := v.(type) {
+            case map[string]interface{}:
+                keys := make([]string, 0, len(val))
+                for k := range val {
+                    keys = append(keys, k)
+                }
+                sort.Strings(keys)
+                for _, k := range keys {
+                    child := ptr + "/" + escapePointer(k)
+                    if r.keys.MatchString(k) {
+                        check(child, val[k])
+                    }
+                    walk(child, val[k])
+                }
+            case []interface{}:
+                for i, item := range val {
+                    walk(fmt.Sprintf("%s/%d", ptr, i), item)
+                }
+            }
+        }
+        walk("", doc)
+    }
+    return violations
+}
+
+type BumpRequest struct {
+    Pointer string `json:"pointer" binding:"required"`
+    Bump    string `json:"bump" binding:"required"`
+    Message string `json:"message"`
+}
+
+// bumpVersion increments the semantic version at a pointer (major, minor or
+// patch) and saves the file through the usual gates.
+func bumpVersion(c *gin.Context) {
+    filename := c.Param("filename")
+    dir, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+
+    var req BumpRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    fileType := getFileType(filename)
+    content, err := fileStore(dir).Read(storageName(rel))
+    if err != nil {
+        c.JSON(404, gin.H{"error": "File not found"})
+        return
+    }
+    doc, err := parseDocument(content, fileType)
+    if err != nil || doc == nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("cannot edit %s: %v", rel, err)})
+        return
+    }
+    matches := selectPointer(doc, req.Pointer)
+    if len(matches) != 1 {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s does not select a single value", req.Pointer)})
+        return
+    }
+    previous, err := semver.NewVersion(fmt.Sprint(matches[0].Value))
+    if err != nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%v is not a semantic version", matches[0].Value)})
+        return
+    }
+    var next semver.Version
+    switch req.Bump {
+    case "major":
+        next = previous.IncMajor()
+    case "minor":
+        next = previous.IncMinor()
+    case "patch":
+        next = previous.IncPatch()
+    default:
+        c.JSON(400, gin.H{"error": "bump must be major, minor or patch"})
+        return
+    }
+
+    if doc, err = setPointer(doc, matches[0].Pointer, next.Original()); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if content, err = rewriteDocument(content, doc, fileType); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    candidate := &SaveCandidate{Filename: filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: content, User: requestUser(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+
+    message := req.Message
+    if message == "" {
+        message = fmt.Sprintf("Bump %s %s: %s -> %s", rel, req.Pointer, previous.Original(), next.Original())
+    }
+    resp, err := storeFile(c.Request.Context(), dir, rel, fullPath, content, message)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, gin.H{"previous": previous.Original(), "version": next.Original(), "commit": resp.Commit, "derived": resp.Derived})
+}
+
+// Conversion
+
+// ConvertRequest asks for Content, a document of type From, as type To; both
+// are one of engine.ConvertTypes. From may be left out when the content
+// shows what it is.
+type ConvertRequest struct {
+    Content string `json:"content"`
+    From    string `json:"from"`
+    To      string `json:"to" binding:"required"`
+}
+
+// convertDocument handles POST /api/convert. Numbers, booleans and nulls
+// keep their types between JSON, YAML and TOML; XML text that reads as one
+// becomes one.
+func convertDocument(c *gin.Context) {
+    var req ConvertRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    from := req.From
+    if from == "" {
+        if from = engine.Detect("", []byte(req.Content)); from == "" {
+            c.JSON(400, gin.H{"error": "from is required: the type of the content could not be detected"})
+            return
+        }
+    }
+    for _, t := range []string{from, req.To} {
+        if !containsString(engine.ConvertTypes, t) {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("cannot convert %s documents (use %s)", t, strings.Join(engine.ConvertTypes, ", "))})
+            return
+        }
+    }
+    if err := validateContent(req.Content, from); err != nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid %s format: %v", strings.ToUpper(from), err)})
+        return
+    }
+    out, err := engine.Convert([]byte(req.Content), from, req.To)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    syntax := engine.SyntaxOf(req.To)
+    c.JSON(200, gin.H{"content": string(out), "from": from, "type": req.To, "mode": syntax.Mode, "mime": syntax.MIME})
+}
+
+// Clipboard
+
+// ClipboardEntry is a subtree copied out of a file, kept per user so it can
+// be pasted into another file.
+type ClipboardEntry struct {
+    File    string      `json:"file"`
+    Pointer string      `json:"pointer"`
+    Value   interface{} `json:"value"`
+    Copied  time.Time   `json:"copied"`
+}
+
+var (
+    clipboardMu sync.Mutex
+    clipboards  = make(map[string]*ClipboardEntry)
+)
+
+type CopyRequest struct {
+    File    string `json:"file" binding:"required"`
+    Pointer string `json:"pointer"`
+}
+
+// PasteRequest inserts the clipboard (or From, copied on the fly) at Pointer.
+// Mode "replace" (default) overwrites the target value, "merge" merges
+// objects recursively with the pasted keys winning.
+type PasteRequest struct {
+    Pointer string       `json:"pointer"`
+    Mode    string       `json:"mode"`
+    From    *CopyRequest `json:"from"`
+    DryRun  bool         `json:"dryRun"`
+    Message string       `json:"message"`
+}
+
+// copySubtree reads the value at pointer from a structured file.
+func copySubtree(req CopyRequest) (*ClipboardEntry, error) {
+    dir, rel, _, err := resolvePath(req.File)
+    if err != nil {
+        return nil, err
+    }
+    content, err := fileStore(dir).Read(storageName(rel))
+    if err != nil {
+        return nil, fmt.Errorf("%s not found", req.File)
+    }
+    doc, err := parseDocument(content, getFileType(req.File))
+    if err != nil {
+        return nil, err
+    }
+    if doc == nil {
+        return nil, fmt.Errorf("%s has no data model to copy from", req.File)
+    }
+    matches := selectPointer(doc, req.Pointer)
+    if len(matches) != 1 {
+        return nil, fmt.Errorf("%s does not select a single value in %s", req.Pointer, req.File)
+    }
+    return &ClipboardEntry{File: req.File, Pointer: matches[0].Pointer, Value: matches[0].Value, Copied: time.Now().UTC()}, nil
+}
+
+// copyToClipboard handles POST /api/clipboard.
+func copyToClipboard(c *gin.Context) {
+    var req CopyRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    entry, err := copySubtree(req)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    clipboardMu.Lock()
+    clipboards[sessionUser(c)] = entry
+    clipboardMu.Unlock()
+    c.JSON(200, entry)
+}
+
+// getClipboard handles GET /api/clipboard.
+func getClipboard(c *gin.Context) {
+    clipboardMu.Lock()
+    entry := clipboards[sessionUser(c)]
+    clipboardMu.Unlock()
+    if entry == nil {
+        c.JSON(404, gin.H{"error": "clipboard is empty"})
+        return
+    }
+    c.JSON(200, entry)
+}
+
+// pasteSubtree handles POST /api/paste/:filename, writing the clipboard into
+// the target file through validation and the save gates.
+func pasteSubtree(c *gin.Context) {
+    filename := c.Param("filename")
+    dir, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    var req PasteRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    var entry *ClipboardEntry
+    if req.From != nil {
+        if entry, err = copySubtree(*req.From); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+    } else {
+        clipboardMu.Lock()
+        entry = clipboards[sessionUser(c)]
+        clipboardMu.Unlock()
+        if entry == nil {
+            c.JSON(400, gin.H{"error": "clipboard is empty"})
+            return
+        }
+    }
+
+    fileType := getFileType(filename)
+    var doc interface{}
+    original, err := fileStore(dir).Read(storageName(rel))
+    if err == nil {
+        if doc, err = parseDocument(original, fileType); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+    }
+    value := entry.Value
+    switch req.Mode {
+    case "", "replace":
+    case "merge":
+        if existing := selectPointer(doc, req.Pointer); len(existing) == 1 {
+            value = mergeValues(existing[0].Value, value)
+        }
+    default:
+        c.JSON(400, gin.H{"error": "mode must be replace or merge"})
+        return
+    }
+    if doc, err = setPointer(doc, req.Pointer, value); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    content, err := rewriteDocument(original, doc, fileType)
+    if err == nil {
+        err = validateContent(string(content), fileType)
+    }
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    candidate := &SaveCandidate{Filename: filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: content, User: requestUser(c), Ticket: requestTicket(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+    if req.DryRun {
+        c.JSON(200, gin.H{"content": string(content), "summary": changeSummary(candidate)})
+        return
+    }
+    message := req.Message
+    if message == "" {
+        message = fmt.Sprintf("Paste %s#%s into %s#%s", entry.File, entry.Pointer, rel, req.Pointer)
+    }
+    resp, err := storeFile(c.Request.Context(), dir, rel, fullPath, content, message)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, resp)
+}
+
+// Front matter
+
+// FrontMatterEdit sets one value in a Markdown file's front matter.
+type FrontMatterEdit struct {
+    Pointer string      `json:"pointer"`
+    Value   interface{} `json:"value"`
+    DryRun  bool        `json:"dryRun"`
+    Message string      `json:"message"`
+}
+
+// loadedDocument is a data file read for an edit by pointer.
+type loadedDocument struct {
+    dir, rel, full string
+    fileType       string
+    content        []byte
+    doc            interface{}
+}
+
+// loadDocument reads and parses a JSON, YAML, TOML or Markdown file. On
+// failure it also returns the HTTP status to answer with.
+func loadDocument(filename string) (*loadedDocument, int, error) {
+    switch fileType := getFileType(filename); fileType {
+    case "json", "yaml", "yml", "toml", "markdown":
+    default:
+        return nil, 400, fmt.Errorf("%s documents cannot be edited by pointer", fileType)
+    }
+    f, status, err := readDocument(filename)
+    if err != nil {
+        return nil, status, err
+    }
+    if f.doc, err = parseDocument(f.content, f.fileType); err != nil {
+        return nil, 400, err
+    }
+    return f, 200, nil
+}
+
+// readDocument reads a file without parsing it.
+func readDocument(filename string) (*loadedDocument, int, error) {
+    dir, rel, full, err := resolvePath(filename)
+    if err != nil {
+        return nil, 403, err
+    }
+    content, err := fileStore(dir).Read(storageName(rel))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, 404, fmt.Errorf("%s not found", filename)
+    } else if err != nil {
+        return nil, 500, err
+    }
+    return &loadedDocument{dir: dir, rel: rel, full: full, fileType: getFileType(filename), content: content}, 200, nil
+}
+
+// saveDocumentEdit writes doc over a loaded document through validation and
+// the save gates, or with dryRun only reports what would be written.
+func saveDocumentEdit(c *gin.Context, f *loadedDocument, doc interface{}, dryRun bool, message string) {
+    content, err := rewriteDocument(f.content, doc, f.fileType)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    saveDocumentContent(c, f, content, dryRun, message)
+}
+
+// saveDocumentContent is saveDocumentEdit for content already rendered.
+func saveDocumentContent(c *gin.Context, f *loadedDocument, content []byte, dryRun bool, message string) {
+    if err := validateContent(string(content), f.fileType); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    candidate := &SaveCandidate{Filename: c.Param("filename"), Dir: f.dir, Rel: f.rel, FullPath: f.full, FileType: f.fileType, Content: content, User: requestUser(c), Ticket: requestTicket(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+    if dryRun {
+        c.JSON(200, gin.H{"content": string(content), "summary": changeSummary(candidate)})
+        return
+    }
+    if message == "" {
+        message = commitMessage("update", candidate)
+    }
+    resp, err := storeFile(c.Request.Context(), f.dir, f.rel, f.full, content, message)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, resp)
+}
+
+// readFrontMatter is loadDocument for Markdown files only.
+func readFrontMatter(filename string) (*loadedDocument, int, error) {
+    if getFileType(filename) != "markdown" {
+        return nil, 400, fmt.Errorf("%s has no front matter to edit", filename)
+    }
+    return loadDocument(filename)
+}
+
+// getFrontMatter handles GET /api/frontmatter/:filename, the front matter of
+// a Markdown file as JSON.
+func getFrontMatter(c *gin.Context) {
+    f, status, err := readFrontMatter(c.Param("filename"))
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"data": f.doc})
+}
+
+// patchFrontMatter handles PATCH /api/frontmatter/:filename: it sets the
+// value at a pointer inside the front matter, leaving the body byte for byte
+// as it was, and saves through validation and the save gates.
+func patchFrontMatter(c *gin.Context) {
+    f, status, err := readFrontMatter(c.Param("filename"))
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    var req FrontMatterEdit
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if req.Pointer == "" || req.Pointer == "/" {
+        c.JSON(400, gin.H{"error": "pointer must name a value inside the front matter"})
+        return
+    }
+    doc, err := setPointer(f.doc, req.Pointer, req.Value)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    saveDocumentEdit(c, f, doc, req.DryRun, req.Message)
+}
+
+// Embedded documents
+
+// EmbeddedEdit replaces the document embedded in the string at Pointer.
+// Content is the edited sub-document as returned by GET.
+type EmbeddedEdit struct {
+    Pointer string `json:"pointer"`
+    Content string `json:"content"`
+    DryRun  bool   `json:"dryRun"`
+    Message string `json:"message"`
+}
+
+// embeddedAt finds the embedded document in the string at pointer.
+func embeddedAt(doc interface{}, pointer string) (engine.Embedded, string, error) {
+    matches := selectPointer(doc, pointer)
+    if len(matches) != 1 || strings.Contains(pointer, "*") {
+        return engine.Embedded{}, "", fmt.Errorf("%s: no such value", pointer)
+    }
+    s, ok := matches[0].Value.(string)
+    if !ok {
+        return engine.Embedded{}, "", fmt.Errorf("%s is not a string", pointer)
+    }
+    e, ok := engine.Embed(s)
+    if !ok {
+        return engine.Embedded{}, "", fmt.Errorf("%s does not hold a JSON or YAML document", pointer)
+    }
+    e.Pointer = matches[0].Pointer
+    return e, s, nil
+}
+
+// getEmbedded handles GET /api/embedded/:filename. Without a pointer it
+// lists the string values holding JSON or YAML; with ?pointer= it returns
+// that sub-document pretty-printed for editing.
+func getEmbedded(c *gin.Context) {
+    f, status, err := loadDocument(c.Param("filename"))
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    pointer, ok := c.GetQuery("pointer")
+    if !ok {
+        c.JSON(200, gin.H{"embedded": engine.FindEmbedded(f.doc)})
+        return
+    }
+    e, s, err := embeddedAt(f.doc, pointer)
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+    content, err := e.Unfold(s)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    syntax := engine.SyntaxOf(e.Type)
+    c.JSON(200, gin.H{"pointer": e.Pointer, "type": e.Type, "compact": e.Compact, "mode": syntax.Mode, "content": string(content)})
+}
+
+// putEmbedded handles PUT /api/embedded/:filename: the edited sub-document
+// is validated, folded back into its string the way it was written and the
+// file saved through validation and the save gates.
+func putEmbedded(c *gin.Context) {
+    f, status, err := loadDocument(c.Param("filename"))
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    var req EmbeddedEdit
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    e, _, err := embeddedAt(f.doc, req.Pointer)
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+    s, err := e.Fold([]byte(req.Content))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    doc, err := setPointer(f.doc, e.Pointer, s)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    saveDocumentEdit(c, f, doc, req.DryRun, req.Message)
+}
+
+// Tables
+
+// TableRequest parses unsaved content as a table.
+type TableRequest struct {
+    Content string `json:"content"`
+    Type    string `json:"type"` // csv or tsv
+    Header  *bool  `json:"header"`
+}
+
+// TableEdits changes a saved table: Columns and Rows replace it (PUT), or
+// Edits are applied to it (PATCH).
+type TableEdits struct {
+    Columns []string           `json:"columns"`
+    Rows    [][]string         `json:"rows"`
+    Edits   []engine.TableEdit `json:"edits"`
+    DryRun  bool               `json:"dryRun"`
+    Message string             `json:"message"`
+}
+
+// tableHeader reports whether the first record is a header: yes unless
+// ?header=false.
+func tableHeader(c *gin.Context) bool {
+    return c.Query("header") != "false"
+}
+
+// parseTable handles POST /api/table, the table in content that is not
+// saved yet, for previews.
+func parseTable(c *gin.Context) {
+    var req TableRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    t, err := engine.ParseTable([]byte(req.Content), req.Type, req.Header == nil || *req.Header)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, t)
+}
+
+// loadTable reads a CSV or TSV file as a table. It answers the request
+// itself when it fails.
+func loadTable(c *gin.Context) (*loadedDocument, *engine.Table, bool) {
+    filename := c.Param("filename")
+    if !engine.IsTable(getFileType(filename)) {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s is not a CSV or TSV file", filename)})
+        return nil, nil, false
+    }
+    f, status, err := readDocument(filename)
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return nil, nil, false
+    }
+    t, err := engine.ParseTable(f.content, f.fileType, tableHeader(c))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return nil, nil, false
+    }
+    return f, t, true
+}
+
+// getTable handles GET /api/table/:filename, rows and columns of a CSV or
+// TSV file. ?header=false reads the first record as a row.
+func getTable(c *gin.Context) {
+    if _, t, ok := loadTable(c); ok {
+        c.JSON(200, t)
+    }
+}
+
+// putTable handles PUT /api/table/:filename, replacing the whole table.
+func putTable(c *gin.Context) {
+    editTable(c, func(t *engine.Table, req *TableEdits) error {
+        if tableHeader(c) {
+            t.Columns = req.Columns
+        }
+        t.Rows = req.Rows
+        return nil
+    })
+}
+
+// patchTable handles PATCH /api/table/:filename, applying edits in order.
+func patchTable(c *gin.Context) {
+    editTable(c, func(t *engine.Table, req *TableEdits) error {
+        return t.Apply(req.Edits)
+    })
+}
+
+func editTable(c *gin.Context, edit func(*engine.Table, *TableEdits) error) {
+    f, t, ok := loadTable(c)
+    if !ok {
+        return
+    }
+    var req TableEdits
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    err := edit(t, &req)
+    var content []byte
+    if err == nil {
+        content, err = t.Marshal()
+    }
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    saveDocumentContent(c, f, content, req.DryRun, req.Message)
+}
+
+// HCL
+
+// HCLRequest parses unsaved content as HCL.
+type HCLRequest struct {
+    Content string `json:"content"`
+}
+
+// parseHCL handles POST /api/hcl, the structure of content that is not saved
+// yet, for previews.
+func parseHCL(c *gin.Context) {
+    var req HCLRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    body, err := engine.ParseHCL([]byte(req.Content))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, body)
+}
+
+// getHCL handles GET /api/hcl/:filename, the blocks and attributes of a
+// Terraform or other HCL file.
+func getHCL(c *gin.Context) {
+    filename := c.Param("filename")
+    if !engine.IsHCL(getFileType(filename)) {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s is not a Terraform or HCL file", filename)})
+        return
+    }
+    f, status, err := readDocument(filename)
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    body, err := engine.ParseHCL(f.content)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, body)
+}
+
+// Jsonnet
+
+// renderJsonnet evaluates a Jsonnet program as filename, reading its
+// imports from storage. go-jsonnet cannot be interrupted, so the program
+// runs in a worker process (edit3 with jsonnetWorker as its argument) that
+// is killed when it outlives the external check timeout or the request.
+func renderJsonnet(ctx context.Context, filename string, content []byte) ([]byte, error) {
+    exe, err := os.Executable()
+    if err != nil {
+        return nil, err
+    }
+    limit := timeout(config.Timeouts.External, ExternalCheckTimeout)
+    ctx, cancel := context.WithTimeout(ctx, limit)
+    defer cancel()
+    cmd := exec.CommandContext(ctx, exe, jsonnetWorker)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return nil, err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err := cmd.Start(); err != nil {
+        return nil, err
+    }
+    enc, dec := json.NewEncoder(stdin), json.NewDecoder(stdout)
+    err = enc.Encode(jsonnetMessage{Filename: filename, Content: content})
+    for err == nil {
+        var msg jsonnetMessage
+        if err = dec.Decode(&msg); err != nil {
+            break
+        }
+        if msg.Import == "" {
+            stdin.Close()
+            cmd.Wait()
+            if msg.Error != "" {
+                return nil, errors.New(msg.Error)
+            }
+            return msg.Output, nil
+        }
+        reply := jsonnetMessage{}
+        if reply.Content, err = jsonnetImport(msg.Import); err != nil {
+            reply.Error = err.Error()
+        }
+        err = enc.Encode(reply)
+    }
+    cancel()
+    cmd.Wait()
+    switch {
+    case errors.Is(ctx.Err(), context.DeadlineExceeded):
+        return nil, fmt.Errorf("evaluation took longer than %s", limit)
+    case ctx.Err() != nil:
+        return nil, ctx.Err()
+    case stderr.Len() > 0:
+        return nil, fmt.Errorf("evaluation failed: %s", strings.TrimSpace(stderr.String()))
+    }
+    return nil, fmt.Errorf("evaluation failed: %v", err)
+}
+
+// jsonnetImport reads a file a Jsonnet program imports. Files whose
+// secrets are masked cannot be imported, or importstr would reveal them.
+func jsonnetImport(name string) ([]byte, error) {
+    if masksSecrets(name) {
+        return nil, fmt.Errorf("%s holds secrets and cannot be imported", name)
+    }
+    f, _, err := readDocument(name)
+    if err != nil {
+        return nil, err
+    }
+    return f.content, nil
+}
+
+// jsonnetWorker is the argument that makes edit3 evaluate a single Jsonnet
+// program for renderJsonnet instead of starting.
+const jsonnetWorker = "__jsonnet"
+
+// jsonnetMessage is a line of the exchange between renderJsonnet and its
+// worker. The server sends the program, the worker asks for each file it
+// imports by name and the server answers with its content, and the worker
+// ends with the output or the error.
+type jsonnetMessage struct {
+    Filename string `json:"filename,omitempty"`
+    Import   string `json:"import,omitempty"`
+    Content  []byte `json:"content,omitempty"`
+    Output   []byte `json:"output,omitempty"`
+    Error    string `json:"error,omitempty"`
+}
+
+// runJsonnetWorker is the worker side of renderJsonnet, on stdin and stdout.
+func runJsonnetWorker() int {
+    enc, dec := json.NewEncoder(os.Stdout), json.NewDecoder(os.Stdin)
+    var program jsonnetMessage
+    if err := dec.Decode(&program); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    out, err := engine.EvalJsonnet(program.Filename, program.Content, func(name string) ([]byte, error) {
+        if err := enc.Encode(jsonnetMessage{Import: name}); err != nil {
+            return nil, err
+        }
+        var reply jsonnetMessage
+        if err := dec.Decode(&reply); err != nil {
+            return nil, err
+        }
+        if reply.Error != "" {
+            return nil, errors.New(reply.Error)
+        }
+        return reply.Content, nil
+    })
+    result := jsonnetMessage{Output: out}
+    if err != nil {
+        result.Error = err.Error()
+    }
+    if err := enc.Encode(result); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    return 0
+}
+
+// RenderRequest renders unsaved content in place of the file.
+type RenderRequest struct {
+    Content string `json:"content"`
+}
+
+// getRendered handles GET /api/render/:filename, the JSON a Jsonnet file
+// evaluates to. POST renders the content sent in its place, for previews
+// of unsaved edits; imports still come from storage.
+func getRendered(c *gin.Context) {
+    filename := c.Param("filename")
+    if !engine.IsJsonnet(getFileType(filename)) {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s is not a Jsonnet file", filename)})
+        return
+    }
+    var content []byte
+    if c.Request.Method == "POST" {
+        var req RenderRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+        content = []byte(req.Content)
+    } else {
+        f, status, err := readDocument(filename)
+        if err != nil {
+            c.JSON(status, gin.H{"error": err.Error()})
+            return
+        }
+        content = f.content
+    }
+    out, err := renderJsonnet(c.Request.Context(), filename, content)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.Data(200, "application/json; charset=utf-8", out)
+}
+
+// CUE
+
+// CUERequest evaluates unsaved content, or the value at Expression in it.
+type CUERequest struct {
+    Content    string `json:"content"`
+    Expression string `json:"expression"`
+    // Filename, when the content is an edit of a file, places it among the
+    // other files of its package.
+    Filename string `json:"filename"`
+}
+
+// cueDir is the directory of rel that cue loads its package from, or ""
+// where files are not on local disk and rel can only be read alone.
+func cueDir(dir, rel string) string {
+    if !onDisk(fileStore(dir)) {
+        return ""
+    }
+    return filepath.Dir(filepath.Join(dir, rel))
+}
+
+// cueGate checks a CUE file together with the rest of its package, which
+// validation, seeing the file alone, only parses.
+func cueGate(s *SaveCandidate) []Violation {
+    if !engine.IsCUE(s.FileType) {
+        return nil
+    }
+    err := engine.CheckCUE(cueDir(s.Dir, s.Rel), filepath.Base(s.Rel), s.Content)
+    if err == nil {
+        return nil
+    }
+    list, ok := err.(engine.CUEErrors)
+    if !ok {
+        return []Violation{{Policy: "cue", Message: err.Error()}}
+    }
+    var violations []Violation
+    for _, e := range list {
+        v := Violation{Policy: "cue", Message: engine.CUEErrors{e}.Error()}
+        if e.Path != "" {
+            v.Pointer = "/" + strings.ReplaceAll(e.Path, ".", "/")
+        }
+        violations = append(violations, v)
+    }
+    return violations
+}
+
+// cueErrorJSON writes the 400 response for content CUE rejects, with each
+// error and its position when CUE gave them.
+func cueErrorJSON(c *gin.Context, err error) {
+    if list, ok := err.(engine.CUEErrors); ok {
+        c.JSON(400, gin.H{"error": err.Error(), "errors": list})
+        return
+    }
+    c.JSON(400, gin.H{"error": err.Error()})
+}
+
+// evalCUE handles POST /api/cue, the value content evaluates to, for
+// previews.
+func evalCUE(c *gin.Context) {
+    var req CUERequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    dir, name := "", "input.cue"
+    if req.Filename != "" {
+        d, rel, _, err := resolvePath(req.Filename)
+        if err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return
+        }
+        dir, name = cueDir(d, rel), filepath.Base(rel)
+    }
+    value, err := engine.EvalCUE(dir, name, []byte(req.Content), req.Expression)
+    if err != nil {
+        cueErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, gin.H{"value": value})
+}
+
+// getCUE handles GET /api/cue/:filename?expression=, a CUE file evaluated
+// as cue export would.
+func getCUE(c *gin.Context) {
+    filename := c.Param("filename")
+    if !engine.IsCUE(getFileType(filename)) {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s is not a CUE file", filename)})
+        return
+    }
+    f, status, err := readDocument(filename)
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    value, err := engine.EvalCUE(cueDir(f.dir, f.rel), filepath.Base(f.rel), f.content, c.Query("expression"))
+    if err != nil {
+        cueErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, gin.H{"value": value})
+}
+
+// PEM
+
+// masksSecrets reports whether maskSecrets changes files like rel: PEM
+// files always, .env files when env.mask is on.
+func masksSecrets(rel string) bool {
+    switch t := getFileType(rel); {
+    case engine.IsPEM(t):
+        return true
+    case engine.IsEnv(t):
+        return config.Env.Mask
+    }
+    return false
+}
+
+// maskSecrets hides secrets from what is read through the editor: the
+// bodies of PEM private keys, and the values of secret keys in .env files,
+// become engine.MaskedKey.
+func maskSecrets(rel string, content []byte) []byte {
+    if !masksSecrets(rel) {
+        return content
+    }
+    if engine.IsEnv(getFileType(rel)) {
+        return engine.MaskEnv(content, config.Env.secretKeys)
+    }
+    return engine.MaskPEM(content)
+}
+
+// unmaskSecrets restores the secrets maskSecrets hid, from the file as
+// saved, so that editing a file keeps them.
+func unmaskSecrets(dir, rel string, content []byte) ([]byte, error) {
+    if !masksSecrets(rel) || !bytes.Contains(content, []byte(engine.MaskedKey)) {
+        return content, nil
+    }
+    original, err := fileStore(dir).Read(storageName(rel))
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if engine.IsEnv(getFileType(rel)) {
+        return engine.UnmaskEnv(content, original)
+    }
+    return engine.UnmaskPEM(content, original)
+}
+
+// PEMRequest decodes unsaved content.
+type PEMRequest struct {
+    Content string `json:"content"`
+}
+
+// parsePEM handles POST /api/pem, the certificates and keys in content that
+// is not saved yet, for previews.
+func parsePEM(c *gin.Context) {
+    var req PEMRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    blocks, err := engine.DecodePEM([]byte(req.Content))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"blocks": blocks})
+}
+
+// getPEM handles GET /api/pem/:filename, the subject, names and validity of
+// each certificate in a PEM file and what kind each key is.
+func getPEM(c *gin.Context) {
+    filename := c.Param("filename")
+    if !engine.IsPEM(getFileType(filename)) {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s is not a PEM file", filename)})
+        return
+    }
+    f, status, err := readDocument(filename)
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    blocks, err := engine.DecodePEM(f.content)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"blocks": blocks})
+}
+
+// .env
+
+// EnvConfig controls .env files. With Mask, the values of keys matching
+// SecretKeys (a regular expression, DefaultSecretKeys when empty) are
+// masked wherever files are read and put back from the saved file when
+// the masked value is saved unchanged.
+type EnvConfig struct {
+    Mask       bool   `yaml:"mask"`
+    SecretKeys string `yaml:"secret_keys"`
+
+    secretKeys *regexp.Regexp
+}
+
+func (e *EnvConfig) compile() error {
+    keys := e.SecretKeys
+    if keys == "" {
+        keys = DefaultSecretKeys
+    }
+    var err error
+    e.secretKeys, err = regexp.Compile(keys)
+    return err
+}
+
+// EnvRequest parses unsaved content as a .env file.
+type EnvRequest struct {
+    Content string `json:"content"`
+}
+
+// parseEnv handles POST /api/env, the variables of content that is not
+// saved yet, for previews.
+func parseEnv(c *gin.Context) {
+    var req EnvRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    vars, err := engine.ParseEnv([]byte(req.Content))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"variables": vars})
+}
+
+// getEnv handles GET /api/env/:filename, the variables of a .env file, with
+// secret values masked when env.mask is on.
+func getEnv(c *gin.Context) {
+    filename := c.Param("filename")
+    if !engine.IsEnv(getFileType(filename)) {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s is not a .env file", filename)})
+        return
+    }
+    f, status, err := readDocument(filename)
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    vars, err := engine.ParseEnv(maskSecrets(filename, f.content))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"variables": vars})
+}
+
+// JWT
+
+// JWKSource is a JSON Web Key Set tokens are verified against: an http(s)
+// URL, such as an identity provider's jwks_uri, or a file next to the
+// config. With an Issuer it only verifies tokens whose iss claim matches;
+// sources are tried in order.
+type JWKSource struct {
+    Issuer string `yaml:"issuer"`
+    URL    string `yaml:"url"`
+}
+
+func (j JWKSource) remote() bool {
+    return strings.HasPrefix(j.URL, "https://") || strings.HasPrefix(j.URL, "http://")
+}
+
+// JWKSCacheTTL is how long a fetched key set is used before it is fetched
+// again, so that rotated keys are picked up.
+const JWKSCacheTTL = 10 * time.Minute
+
+type cachedJWKS struct {
+    keys    []byte
+    fetched time.Time
+}
+
+var (
+    jwksMu    sync.Mutex
+    jwksCache = make(map[string]cachedJWKS)
+)
+
+// keySet returns the keys of src, from the cache while they are fresh.
+func (j JWKSource) keySet(ctx context.Context) ([]byte, error) {
+    if !j.remote() {
+        return ioutil.ReadFile(j.URL)
+    }
+    jwksMu.Lock()
+    cached, ok := jwksCache[j.URL]
+    jwksMu.Unlock()
+    if ok && time.Since(cached.fetched) < JWKSCacheTTL {
+        return cached.keys, nil
+    }
+    req, err := http.NewRequestWithContext(ctx, "GET", j.URL, nil)
+    if err != nil {
+        return nil, err
+    }
+    client := &http.Client{Timeout: timeout(config.Timeouts.Webhook, WebhookTimeout)}
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != 200 {
+        return nil, fmt.Errorf("%s returned %s", j.URL, resp.Status)
+    }
+    keys, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return nil, err
+    }
+    jwksMu.Lock()
+    jwksCache[j.URL] = cachedJWKS{keys: keys, fetched: time.Now()}
+    jwksMu.Unlock()
+    return keys, nil
+}
+
+// TokenPreview is a decoded token and, when asked for, whether a configured
+// key set verifies its signature. Pointer or Line say where in a file it
+// was found.
+type TokenPreview struct {
+    Pointer string `json:"pointer,omitempty"`
+    Line    int    `json:"line,omitempty"`
+    *engine.JWT
+    Verified    *bool  `json:"verified,omitempty"`
+    KeyID       string `json:"keyId,omitempty"`
+    VerifyError string `json:"verifyError,omitempty"`
+}
+
+// previewToken decodes token and, with verify, checks it against the key
+// sets configured for its issuer, in order, until one verifies it; a set
+// that cannot be fetched or does not verify it passes to the next.
+func previewToken(ctx context.Context, token string, verify bool) (*TokenPreview, error) {
+    t, err := engine.DecodeJWT(token, time.Now())
+    if err != nil {
+        return nil, err
+    }
+    p := &TokenPreview{JWT: t}
+    if !verify {
+        return p, nil
+    }
+    verified := false
+    p.Verified = &verified
+    iss, _ := t.Claims["iss"].(string)
+    var failures []string
+    for _, src := range config.JWKS {
+        if src.Issuer != "" && src.Issuer != iss {
+            continue
+        }
+        keys, err := src.keySet(ctx)
+        if err != nil {
+            failures = append(failures, err.Error())
+            continue
+        }
+        if p.KeyID, err = engine.VerifyJWT(token, keys); err != nil {
+            failures = append(failures, fmt.Sprintf("%s: %v", src.URL, err))
+            continue
+        }
+        verified = true
+        return p, nil
+    }
+    if len(failures) == 0 {
+        p.VerifyError = "no key set is configured for this issuer"
+    } else {
+        p.VerifyError = strings.Join(failures, "; ")
+    }
+    return p, nil
+}
+
+// JWTRequest previews a token pasted by the user.
+type JWTRequest struct {
+    Token  string `json:"token" binding:"required"`
+    Verify bool   `json:"verify"`
+}
+
+// decodeJWT handles POST /api/jwt, the header and claims of a token, so
+// that tokens need not be pasted into websites to be read. With verify the
+// signature is checked against the key sets of the jwks config.
+func decodeJWT(c *gin.Context) {
+    var req JWTRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    p, err := previewToken(c.Request.Context(), req.Token, req.Verify)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, p)
+}
+
+var jwtInText = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+
+// getJWTs handles GET /api/jwt/:filename?verify=1, every token in a file's
+// values (or, for files that are not structured, its lines) decoded.
+func getJWTs(c *gin.Context) {
+    filename := c.Param("filename")
+    f, status, err := readDocument(filename)
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    ctx := c.Request.Context()
+    verify := c.Query("verify") != ""
+    tokens := []*TokenPreview{}
+    add := func(token, pointer string, line int) {
+        if p, err := previewToken(ctx, token, verify); err == nil {
+            p.Pointer, p.Line = pointer, line
+            tokens = append(tokens, p)
+        }
+    }
+    doc, err := parseDocument(f.content, f.fileType)
+    if err != nil || doc == nil {
+        for i, line := range strings.Split(string(f.content), "\n") {
+            for _, token := range jwtInText.FindAllString(line, -1) {
+                add(token, "", i+1)
+            }
+        }
+        c.JSON(200, gin.H{"tokens": tokens})
+        return
+    }
+    var walk func(ptr string, v interface{})
+    walk = func(ptr string, v interface{}) {
+        switch val := v.(type) {
+        case map[string]interface{}:
+            keys := make([]string, 0, len(val))
+            for k := range val {
+                keys = append(keys, k)
+            }
+            sort.Strings(keys)
+            for _, k := range keys {
+                walk(ptr+"/"+escapePointer(k), val[k])
+            }
+        case []interface{}:
+            for i, child := range val {
+                walk(fmt.Sprintf("%s/%d", ptr, i), child)
+            }
+        case string:
+            if engine.LooksLikeJWT(val) {
+                add(val, ptr, 0)
+            }
+        }
+    }
+    walk("", doc)
+    c.JSON(200, gin.H{"tokens": tokens})
+}
+
+// Enums
+
+// EnumAnnotation names an enum of the enums config in a JSON Schema, in
+// place of listing its values.
+const EnumAnnotation = "x-enum"
+
+func inEnum(name, value string) bool {
+    for _, v := range config.Enums[name] {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// expandEnums gives every schema carrying EnumAnnotation the values of its
+// enum as "enum", so that validators and generators that only know the
+// standard keyword use them.
+func expandEnums(schema interface{}) error {
+    switch s := schema.(type) {
+    case map[string]interface{}:
+        if name, ok := s[EnumAnnotation]; ok {
+            values, known := config.Enums[fmt.Sprint(name)]
+            if !known {
+                return fmt.Errorf("%s: unknown enum %q", EnumAnnotation, name)
+            }
+            enum := make([]interface{}, len(values))
+            for i, v := range values {
+                enum[i] = v
+            }
+            s["enum"] = enum
+        }
+        for _, child := range s {
+            if err := expandEnums(child); err != nil {
+                return err
+            }
+        }
+    case []interface{}:
+        for _, child := range s {
+            if err := expandEnums(child); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// schemaEnums records in enums the pointer pattern of every value schema
+// names an enum for, "*" standing for any key or index.
+func schemaEnums(schema interface{}, pointer string, enums map[string]string) {
+    s, ok := schema.(map[string]interface{})
+    if !ok {
+        return
+    }
+    if name, ok := s[EnumAnnotation]; ok {
+        enums[pointer] = fmt.Sprint(name)
+    }
+    if props, ok := s["properties"].(map[string]interface{}); ok {
+        for k, child := range props {
+            schemaEnums(child, pointer+"/"+escapePointer(k), enums)
+        }
+    }
+    for _, key := range []string{"items", "additionalProperties"} {
+        schemaEnums(s[key], pointer+"/*", enums)
+    }
+    if patterns, ok := s["patternProperties"].(map[string]interface{}); ok {
+        for _, child := range patterns {
+            schemaEnums(child, pointer+"/*", enums)
+        }
+    }
+    for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+        if list, ok := s[key].([]interface{}); ok {
+            for _, child := range list {
+                schemaEnums(child, pointer, enums)
+            }
+        }
+    }
+}
+
+// getEnums handles GET /api/enums, the enums of the configuration.
+func getEnums(c *gin.Context) {
+    enums := config.Enums
+    if enums == nil {
+        enums = map[string][]string{}
+    }
+    c.JSON(200, gin.H{"enums": enums})
+}
+
+// Schema versions
+
+// SchemaSidecarExt is appended to a file's name for the sidecar holding its
+// schema version, for files that have no field to hold it.
+const SchemaSidecarExt = ".schema-version"
+
+// SchemaConfig pins matching files to a version of a schema. A file declares
+// its version at Key (a JSON pointer, /schemaVersion by default) or in its
+// sidecar. Versions maps each version to the JSON Schema its files are
+// validated against on save, relative to the configuration; a version
+// without one is only checked for being known. Migrations upgrade files
+// from one version to the next.
+type SchemaConfig struct {
+    Name       string            `yaml:"name"`
+    Paths      []string          `yaml:"paths"`
+    Key        string            `yaml:"key"`
+    Versions   map[string]string `yaml:"versions"`
+    Migrations []SchemaMigration `yaml:"migrations"`
+
+    schemas map[string]*jsonschema.Schema
+    enums   map[string]map[string]string // version -> pointer pattern -> enum
+}
+
+// SchemaMigration turns a document of version From into one of version To.
+// Rename moves values from one pointer to another, Set writes values (such
+// as a field the new version requires) and Remove drops pointers, in that
+// order. Manual maps pointers ("*" matches one segment) a person has to
+// look at after the step to what they should check.
+type SchemaMigration struct {
+    From   string                 `yaml:"from"`
+    To     string                 `yaml:"to"`
+    Rename map[string]string      `yaml:"rename"`
+    Set    map[string]interface{} `yaml:"set"`
+    Remove []string               `yaml:"remove"`
+    Manual map[string]string      `yaml:"manual"`
+}
+
+func (sc *SchemaConfig) compile(base string) error {
+    if sc.Name == "" {
+        sc.Name = strings.Join(sc.Paths, ",")
+    }
+    if len(sc.Paths) == 0 {
+        return fmt.Errorf("schema %s: paths is required", sc.Name)
+    }
+    if sc.Key == "" {
+        sc.Key = "/schemaVersion"
+    }
+    if !strings.HasPrefix(sc.Key, "/") {
+        return fmt.Errorf("schema %s: key must be a JSON pointer", sc.Name)
+    }
+    sc.schemas = make(map[string]*jsonschema.Schema)
+    sc.enums = make(map[string]map[string]string)
+    for version, file := range sc.Versions {
+        if file == "" {
+            continue
+        }
+        if !filepath.IsAbs(file) {
+            file = filepath.Join(base, file)
+        }
+        content, err := ioutil.ReadFile(file)
+        if err != nil {
+            return fmt.Errorf("schema %s: version %s: %v", sc.Name, version, err)
+        }
+        doc, err := parseDocument(content, getFileType(file))
+        if err == nil {
+            sc.enums[version] = make(map[string]string)
+            schemaEnums(doc, "", sc.enums[version])
+            err = expandEnums(doc)
+        }
+        if err != nil {
+            return fmt.Errorf("schema %s: version %s: %v", sc.Name, version, err)
+        }
+        source, _ := json.Marshal(doc)
+        if sc.schemas[version], err = jsonschema.CompileString(file, string(source)); err != nil {
+            return fmt.Errorf("schema %s: version %s: %v", sc.Name, version, err)
+        }
+    }
+    for _, m := range sc.Migrations {
+        if m.From == "" || m.To == "" || m.From == m.To {
+            return fmt.Errorf("schema %s: a migration needs different from and to versions", sc.Name)
+        }
+        for _, v := range []string{m.From, m.To} {
+            if _, ok := sc.Versions[v]; !ok {
+                return fmt.Errorf("schema %s: migration %s -> %s: unknown version %s", sc.Name, m.From, m.To, v)
+            }
+        }
+    }
+    return nil
+}
+
+// schemaFor returns the schema config covering rel, or nil.
+func schemaFor(rel string) *SchemaConfig {
+    for i := range config.Schemas {
+        if pathMatches(config.Schemas[i].Paths, rel) {
+            return &config.Schemas[i]
+        }
+    }
+    return nil
+}
+
+// version reads the schema version doc declares, falling back to the
+// sidecar of rel; sidecar says where it was found.
+func (sc *SchemaConfig) version(dir, rel string, doc interface{}) (version string, sidecar bool) {
+    if matches := selectPointer(doc, sc.Key); len(matches) == 1 && matches[0].Value != nil {
+        return fmt.Sprint(matches[0].Value), false
+    }
+    content, err := fileStore(dir).Read(storageName(rel + SchemaSidecarExt))
+    if err != nil {
+        return "", false
+    }
+    return strings.TrimSpace(string(content)), true
+}
+
+// path returns the migrations leading from version to version to, or with
+// to empty to the last version reachable.
+func (sc *SchemaConfig) path(from, to string) ([]SchemaMigration, error) {
+    var steps []SchemaMigration
+    seen := map[string]bool{from: true}
+    for current := from; current != to; {
+        var next *SchemaMigration
+        for i := range sc.Migrations {
+            if sc.Migrations[i].From == current && !seen[sc.Migrations[i].To] {
+                next = &sc.Migrations[i]
+                break
+            }
+        }
+        if next == nil {
+            if to == "" {
+                break
+            }
+            return nil, fmt.Errorf("no migration leads from version %s to %s", from, to)
+        }
+        steps = append(steps, *next)
+        seen[next.To] = true
+        current = next.To
+    }
+    return steps, nil
+}
+
+// MigrationNote is something a migration could not settle on its own.
+type MigrationNote struct {
+    Step    string `json:"step"`
+    Pointer string `json:"pointer"`
+    Message string `json:"message"`
+}
+
+// apply runs the migration on doc and returns the new document with what
+// needs a person's attention.
+func (m SchemaMigration) apply(doc interface{}) (interface{}, []MigrationNote, error) {
+    step := m.From + " -> " + m.To
+    var notes []MigrationNote
+    for _, from := range sortedKeys(m.Rename) {
+        to := m.Rename[from]
+        matches := selectPointer(doc, from)
+        if len(matches) == 0 {
+            continue
+        }
+        if len(selectPointer(doc, to)) > 0 {
+            notes = append(notes, MigrationNote{Step: step, Pointer: from, Message: fmt.Sprintf("not moved: %s already holds a value", to)})
+            continue
+        }
+        var err error
+        if doc, err = setPointer(doc, to, matches[0].Value); err != nil {
+            return nil, nil, err
+        }
+        removePointer(doc, from)
+    }
+    set := make([]string, 0, len(m.Set))
+    for ptr := range m.Set {
+        set = append(set, ptr)
+    }
+    sort.Strings(set)
+    for _, ptr := range set {
+        var err error
+        if doc, err = setPointer(doc, ptr, m.Set[ptr]); err != nil {
+            return nil, nil, err
+        }
+    }
+    for _, ptr := range m.Remove {
+        removePointer(doc, ptr)
+    }
+    for _, pattern := range sortedKeys(m.Manual) {
+        for _, match := range selectPointer(doc, pattern) {
+            notes = append(notes, MigrationNote{Step: step, Pointer: match.Pointer, Message: m.Manual[pattern]})
+        }
+    }
+    return doc, notes, nil
+}
+
+// sortedKeys returns the keys of m in order, so that migrations run the
+// same way every time.
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// removePointer deletes the value at pointer from doc, if it is there.
+func removePointer(doc interface{}, pointer string) {
+    i := strings.LastIndex(pointer, "/")
+    if i < 0 {
+        return
+    }
+    last := strings.NewReplacer("~1", "/", "~0", "~").Replace(pointer[i+1:])
+    for _, parent := range selectPointer(doc, pointer[:i]) {
+        switch p := parent.Value.(type) {
+        case map[string]interface{}:
+            delete(p, last)
+        case []interface{}:
+            // lists cannot shrink in place; null marks the removed item
+            if n, err := strconv.Atoi(last); err == nil && n >= 0 && n < len(p) {
+                p[n] = nil
+            }
+        }
+    }
+}
+
+// versionValue is to as the value of a version field: a number when the
+// field held one.
+func versionValue(previous interface{}, to string) interface{} {
+    if _, ok := previous.(string); ok {
+        return to
+    }
+    if n, err := strconv.Atoi(to); err == nil {
+        return n
+    }
+    if f, err := strconv.ParseFloat(to, 64); err == nil {
+        return f
+    }
+    return to
+}
+
+func schemaVersionGate(s *SaveCandidate) []Violation {
+    sc := schemaFor(s.Rel)
+    if sc == nil {
+        return nil
+    }
+    doc, err := s.Document()
+    if err != nil || doc == nil {
+        return nil
+    }
+    version := s.SchemaVersion
+    if version == "" {
+        version, _ = sc.version(s.Dir, s.Rel, doc)
+    }
+    if version == "" {
+        return []Violation{{Policy: sc.Name, Pointer: sc.Key, Message: fmt.Sprintf("%s declares no schema version at %s or in %s", s.Rel, sc.Key, path.Base(s.Rel)+SchemaSidecarExt)}}
+    }
+    if _, ok := sc.Versions[version]; !ok {
+        return []Violation{{Policy: sc.Name, Pointer: sc.Key, Message: fmt.Sprintf("unknown schema version %s (known: %s)", version, strings.Join(sortedKeys(sc.Versions), ", "))}}
+    }
+    if schema := sc.schemas[version]; schema != nil {
+        if err := schema.Validate(doc); err != nil {
+            return schemaViolations(sc.Name, err)
+        }
+    }
+    return nil
+}
+
+// Migration is the plan, or the outcome, of upgrading a file.
+type Migration struct {
+    Schema  string          `json:"schema"`
+    From    string          `json:"from"`
+    To      string          `json:"to"`
+    Sidecar bool            `json:"sidecar,omitempty"`
+    Steps   []string        `json:"steps"`
+    Notes   []MigrationNote `json:"notes"`
+    Content string          `json:"content,omitempty"`
+}
+
+// MigrateRequest asks for a file to be upgraded to version To, or the last
+// version its migrations reach.
+type MigrateRequest struct {
+    To      string `json:"to"`
+    DryRun  bool   `json:"dryRun"`
+    Message string `json:"message"`
+}
+
+// planMigration upgrades the document of f in memory. Values the target
+// version's schema rejects are noted, as are the migrations' manual fields.
+func planMigration(f *loadedDocument, to string) (*Migration, interface{}, int, error) {
+    sc := schemaFor(f.rel)
+    if sc == nil {
+        return nil, nil, 404, fmt.Errorf("no schema is configured for %s", f.rel)
+    }
+    from, sidecar := sc.version(f.dir, f.rel, f.doc)
+    if from == "" {
+        return nil, nil, 400, fmt.Errorf("%s declares no schema version", f.rel)
+    }
+    steps, err := sc.path(from, to)
+    if err != nil {
+        return nil, nil, 400, err
+    }
+    m := &Migration{Schema: sc.Name, From: from, To: from, Sidecar: sidecar, Steps: []string{}, Notes: []MigrationNote{}}
+    var previous interface{}
+    if !sidecar {
+        previous = selectPointer(f.doc, sc.Key)[0].Value
+    }
+    doc := f.doc
+    for _, step := range steps {
+        var notes []MigrationNote
+        if doc, notes, err = step.apply(doc); err != nil {
+            return nil, nil, 400, fmt.Errorf("%s -> %s: %v", step.From, step.To, err)
+        }
+        m.Steps = append(m.Steps, step.From+" -> "+step.To)
+        m.Notes = append(m.Notes, notes...)
+        m.To = step.To
+    }
+    if m.To != from && !sidecar {
+        if doc, err = setPointer(doc, sc.Key, versionValue(previous, m.To)); err != nil {
+            return nil, nil, 400, err
+        }
+    }
+    if schema := sc.schemas[m.To]; schema != nil {
+        if err := schema.Validate(doc); err != nil {
+            for _, v := range schemaViolations(sc.Name, err) {
+                m.Notes = append(m.Notes, MigrationNote{Step: m.To, Pointer: v.Pointer, Message: v.Message})
+            }
+        }
+    }
+    return m, doc, 200, nil
+}
+
+// getMigration handles GET /api/migrate/:filename?to=, what upgrading the
+// file would change, without saving.
+func getMigration(c *gin.Context) {
+    f, status, err := loadDocument(c.Param("filename"))
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    m, doc, status, err := planMigration(f, c.Query("to"))
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    if len(m.Steps) > 0 {
+        content, err := rewriteDocument(f.content, doc, f.fileType)
+        if err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+        m.Content = string(content)
+    }
+    c.JSON(200, m)
+}
+
+// migrateFile handles POST /api/migrate/:filename: it upgrades the file
+// through the migrations and saves it, with its sidecar, through
+// validation and the save gates.
+func migrateFile(c *gin.Context) {
+    var req MigrateRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    f, status, err := loadDocument(c.Param("filename"))
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    m, doc, status, err := planMigration(f, req.To)
+    if err != nil {
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    if len(m.Steps) == 0 {
+        c.JSON(200, gin.H{"migration": m, "message": fmt.Sprintf("%s is at version %s already", f.rel, m.From)})
+        return
+    }
+    content, err := rewriteDocument(f.content, doc, f.fileType)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    m.Content = string(content)
+    if req.DryRun {
+        c.JSON(200, gin.H{"migration": m})
+        return
+    }
+    if err := validateContent(m.Content, f.fileType); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    // The sidecar is only written with the file, so the gates are told the
+    // version it will hold
+    ctx := c.Request.Context()
+    candidate := &SaveCandidate{Filename: c.Param("filename"), Dir: f.dir, Rel: f.rel, FullPath: f.full, FileType: f.fileType, Content: content, User: requestUser(c), Ticket: requestTicket(c), Context: ctx}
+    if m.Sidecar {
+        candidate.SchemaVersion = m.To
+    }
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+    message := req.Message
+    if message == "" {
+        message = fmt.Sprintf("Migrate %s from schema version %s to %s", f.rel, m.From, m.To)
+    }
+    files := []PendingFile{{Rel: f.rel, FullPath: f.full, Content: content}}
+    if m.Sidecar {
+        files = append(files, PendingFile{Rel: f.rel + SchemaSidecarExt, FullPath: f.full + SchemaSidecarExt, Content: []byte(m.To + "\n")})
+    }
+    resps, err := storeFiles(ctx, f.dir, files, message)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, gin.H{"migration": m, "save": resps[0]})
+}
+
+// Lookups
+
+// LookupProvider supplies the values a field may take, for completion.
+type LookupProvider interface {
+    Values(ctx context.Context) ([]LookupValue, error)
+}
+
+// LookupValue is one value a field may take; Label describes it.
+type LookupValue struct {
+    Value string `json:"value"`
+    Label string `json:"label,omitempty"`
+}
+
+// LookupConfig offers values for the fields of matching files under keys
+// matching Keys (a regular expression on the key name) or at Pointers.
+// Values lists them, or Enum names an enum of the enums config holding
+// them; URL fetches them from a service instead, as a JSON array of strings
+// or of objects whose Value and Label fields ("value" and "label" by
+// default) are read. Items points at the array when the response wraps it,
+// such as /data. Header values may name environment variables,
+// as in "Bearer ${INVENTORY_TOKEN}". Fetched values are kept for TTL
+// (DefaultLookupTTL when zero).
+type LookupConfig struct {
+    Name     string            `yaml:"name"`
+    Paths    []string          `yaml:"paths"`
+    Keys     string            `yaml:"keys"`
+    Pointers []string          `yaml:"pointers"`
+    Values   []string          `yaml:"values"`
+    Enum     string            `yaml:"enum"`
+    URL      string            `yaml:"url"`
+    Headers  map[string]string `yaml:"headers"`
+    Items    string            `yaml:"items"`
+    Value    string            `yaml:"value"`
+    Label    string            `yaml:"label"`
+    TTL      time.Duration     `yaml:"ttl"`
+
+    keys     *regexp.Regexp
+    provider LookupProvider
+}
+
+const DefaultLookupTTL = 5 * time.Minute
+
+func compileLookup(l *LookupConfig) error {
+    if l.Name == "" {
+        l.Name = l.Keys
+    }
+    if l.Keys == "" && len(l.Pointers) == 0 {
+        return fmt.Errorf("lookup %s: keys or pointers are required", l.Name)
+    }
+    sources := 0
+    for _, given := range []bool{len(l.Values) > 0, l.Enum != "", l.URL != ""} {
+        if given {
+            sources++
+        }
+    }
+    if sources != 1 {
+        return fmt.Errorf("lookup %s: give one of values, enum or url", l.Name)
+    }
+    if l.Enum != "" {
+        if config.Enums[l.Enum] == nil {
+            return fmt.Errorf("lookup %s: unknown enum %q", l.Name, l.Enum)
+        }
+        l.Values = config.Enums[l.Enum]
+    }
+    if l.Keys != "" {
+        keys, err := regexp.Compile(l.Keys)
+        if err != nil {
+            return fmt.Errorf("lookup %s: %v", l.Name, err)
+        }
+        l.keys = keys
+    }
+    if l.URL == "" {
+        values := make(staticLookup, len(l.Values))
+        for i, v := range l.Values {
+            values[i] = LookupValue{Value: v}
+        }
+        l.provider = values
+        return nil
+    }
+    if l.Value == "" {
+        l.Value = "value"
+    }
+    if l.Label == "" {
+        l.Label = "label"
+    }
+    l.provider = &httpLookup{cfg: l}
+    return nil
+}
+
+// matches reports whether the lookup offers values for the field at
+// pointer, or under key when the client only knows the key.
+func (l *LookupConfig) matches(pointer, key string) bool {
+    for _, pattern := range l.Pointers {
+        if pointer != "" && pointerUnder(pattern, pointer) {
+            return true
+        }
+    }
+    return l.keys != nil && key != "" && l.keys.MatchString(key)
+}
+
+// staticLookup is a fixed list of values from the configuration.
+type staticLookup []LookupValue
+
+func (s staticLookup) Values(context.Context) ([]LookupValue, error) {
+    return s, nil
+}
+
+// httpLookup fetches values from a service such as an inventory and keeps
+// them for the lookup's TTL. When a refresh fails the values it had are
+// served on.
+type httpLookup struct {
+    cfg *LookupConfig
+
+    mu      sync.Mutex
+    values  []LookupValue
+    fetched time.Time
+}
+
+func (h *httpLookup) Values(ctx context.Context) ([]LookupValue, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.values != nil && time.Since(h.fetched) < timeout(h.cfg.TTL, DefaultLookupTTL) {
+        return h.values, nil
+    }
+    values, err := h.fetch(ctx)
+    if err != nil {
+        if h.values != nil {
+            log.Printf("lookup %s: %v; serving values from %s", h.cfg.Name, err, h.fetched.Format(time.RFC3339))
+            return h.values, nil
+        }
+        return nil, err
+    }
+    h.values, h.fetched = values, time.Now()
+    return values, nil
+}
+
+func (h *httpLookup) fetch(ctx context.Context) ([]LookupValue, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", h.cfg.URL, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Accept", "application/json")
+    for name, value := range h.cfg.Headers {
+        req.Header.Set(name, os.ExpandEnv(value))
+    }
+    client := &http.Client{Timeout: timeout(config.Timeouts.Webhook, WebhookTimeout)}
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != 200 {
+        return nil, fmt.Errorf("%s returned %s", h.cfg.URL, resp.Status)
+    }
+    var doc interface{}
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&doc); err != nil {
+        return nil, fmt.Errorf("%s: %v", h.cfg.URL, err)
+    }
+    if h.cfg.Items != "" {
+        matches := selectPointer(doc, h.cfg.Items)
+        if len(matches) == 0 {
+            return nil, fmt.Errorf("%s: nothing at %s", h.cfg.URL, h.cfg.Items)
+        }
+        doc = matches[0].Value
+    }
+    items, ok := doc.([]interface{})
+    if !ok {
+        return nil, fmt.Errorf("%s: expected a JSON array of values", h.cfg.URL)
+    }
+    values := make([]LookupValue, 0, len(items))
+    for _, item := range items {
+        switch v := item.(type) {
+        case nil:
+        case map[string]interface{}:
+            if value, ok := v[h.cfg.Value]; ok && value != nil {
+                lv := LookupValue{Value: fmt.Sprint(value)}
+                if label, ok := v[h.cfg.Label]; ok && label != nil {
+                    lv.Label = fmt.Sprint(label)
+                }
+                values = append(values, lv)
+            }
+        default:
+            values = append(values, LookupValue{Value: fmt.Sprint(v)})
+        }
+    }
+    return values, nil
+}
+
+// pointerKey is the key a pointer ends in, skipping array indexes (and the
+// "*" of patterns), so that the items of /regions are looked up as regions.
+func pointerKey(pointer string) string {
+    segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+    for i := len(segments) - 1; i >= 0; i-- {
+        if _, err := strconv.Atoi(segments[i]); err != nil && segments[i] != "*" {
+            return strings.NewReplacer("~1", "/", "~0", "~").Replace(segments[i])
+        }
+    }
+    return ""
+}
+
+// schemaEnumsFor names the enums the schema of rel gives the field at
+// pointer, or under key when the pointer is not known. The version the
+// file declares picks the schema; a file without one gets every version's.
+func schemaEnumsFor(dir, rel, pointer, key string) []string {
+    sc := schemaFor(rel)
+    if sc == nil {
+        return nil
+    }
+    versions := sc.enums
+    if content, err := fileStore(dir).Read(storageName(rel)); err == nil {
+        doc, _ := parseDocument(content, getFileType(rel))
+        if version, _ := sc.version(dir, rel, doc); sc.enums[version] != nil {
+            versions = map[string]map[string]string{version: sc.enums[version]}
+        }
+    }
+    var names []string
+    for _, enums := range versions {
+        for pattern, name := range enums {
+            if pointer != "" && pointerAffects(pattern, pointer) && strings.Count(pattern, "/") == strings.Count(pointer, "/") ||
+                pointer == "" && key != "" && pointerKey(pattern) == key {
+                names = append(names, name)
+            }
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// getCompletions handles GET /api/complete/:filename?pointer=&key=&prefix=,
+// the values the lookups matching a field offer, then those of the enums
+// its schema names with x-enum; only those starting with prefix (ignoring
+// case) when one is given. Editors that cannot tell the pointer under the
+// cursor send the key being edited instead.
+func getCompletions(c *gin.Context) {
+    dir, rel, _, err := resolvePath(c.Param("filename"))
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    pointer, key := c.Query("pointer"), c.Query("key")
+    if key == "" {
+        key = pointerKey(pointer)
+    }
+    prefix := strings.ToLower(c.Query("prefix"))
+    values := []LookupValue{}
+    seen := make(map[string]bool)
+    for i := range config.Lookups {
+        l := &config.Lookups[i]
+        if !pathMatches(l.Paths, rel) || !l.matches(pointer, key) {
+            continue
+        }
+        found, err := l.provider.Values(c.Request.Context())
+        if err != nil {
+            c.JSON(502, gin.H{"error": fmt.Sprintf("lookup %s: %v", l.Name, err)})
+            return
+        }
+        for _, v := range found {
+            if !seen[v.Value] && strings.HasPrefix(strings.ToLower(v.Value), prefix) {
+                seen[v.Value] = true
+                values = append(values, v)
+            }
+        }
+    }
+    for _, name := range schemaEnumsFor(dir, rel, c.Query("pointer"), key) {
+        for _, v := range config.Enums[name] {
+            if !seen[v] && strings.HasPrefix(strings.ToLower(v), prefix) {
+                seen[v] = true
+                values = append(values, LookupValue{Value: v, Label: name})
+            }
+        }
+    }
+    c.JSON(200, gin.H{"values": values})
+}
+
+// mergeValues merges src into dst: objects recursively, anything else is
+// replaced by src.
+func mergeValues(dst, src interface{}) interface{} {
+    d, ok := dst.(map[string]interface{})
+    s, ok2 := src.(map[string]interface{})
+    if !ok || !ok2 {
+        return src
+    }
+    merged := make(map[string]interface{}, len(d)+len(s))
+    for k, v := range d {
+        merged[k] = v
+    }
+    for k, v := range s {
+        merged[k] = mergeValues(merged[k], v)
+    }
+    return merged
+}
+
+// FreezeWindow blocks writes to matching files for Duration after each time
+// Schedule fires. Schedule is a standard five-field cron expression and may
+// start with CRON_TZ=<zone>. Members of OverrideRole may still save.
+type FreezeWindow struct {
+    Name         string   `yaml:"name"`
+    Paths        []string `yaml:"paths"`
+    Schedule     string   `yaml:"schedule"`
+    Duration     string   `yaml:"duration"`
+    OverrideRole string   `yaml:"override_role"`
+    Message      string   `yaml:"message"`
+
+    schedule cron.Schedule
+    duration time.Duration
+}
+
+// FreezeStatus describes an active freeze in getFile responses.
+type FreezeStatus struct {
+    Name         string    `json:"name"`
+    Message      string    `json:"message,omitempty"`
+    Until        time.Time `json:"until"`
+    OverrideRole string    `json:"overrideRole,omitempty"`
+}
+
+func compileFreezeWindow(w *FreezeWindow) error {
+    if w.Name == "" {
+        w.Name = w.Schedule
+    }
+    schedule, err := cron.ParseStandard(w.Schedule)
+    if err != nil {
+        return fmt.Errorf("freeze %s: %v", w.Name, err)
+    }
+    duration, err := time.ParseDuration(w.Duration)
+    if err != nil || duration <= 0 {
+        return fmt.Errorf("freeze %s: invalid duration %q", w.Name, w.Duration)
+    }
+    w.schedule, w.duration = schedule, duration
+    return nil
+}
+
+// activeUntil returns when the window ends if it is in force at t.
+func (w *FreezeWindow) activeUntil(t time.Time) (time.Time, bool) {
+    // The window is open if the schedule fired within the last Duration;
+    // overlapping windows extend the freeze to the latest end.
+    var until time.Time
+    for start := w.schedule.Next(t.Add(-w.duration)); !start.IsZero() && !start.After(t); start = w.schedule.Next(start) {
+        until = start.Add(w.duration)
+    }
+    return until, !until.IsZero()
+}
+
+// activeFreeze returns the first freeze window covering rel right now.
+func activeFreeze(rel string) *FreezeStatus {
+    now := time.Now()
+    for i := range config.Freezes {
+        w := &config.Freezes[i]
+        if !pathMatches(w.Paths, rel) {
+            continue
+        }
+        if until, ok := w.activeUntil(now); ok {
+            return &FreezeStatus{Name: w.Name, Message: w.Message, Until: until, OverrideRole: w.OverrideRole}
+        }
+    }
+    return nil
+}
+
+func freezeGate(s *SaveCandidate) []Violation {
+    freeze := activeFreeze(s.Rel)
+    if freeze == nil {
+        return nil
+    }
+    if freeze.OverrideRole != "" && hasRole(s.User, freeze.OverrideRole) {
+        return nil
+    }
+    message := fmt.Sprintf("%s is frozen until %s", s.Rel, freeze.Until.Format(time.RFC3339))
+    if freeze.Message != "" {
+        message += ": " + freeze.Message
+    }
+    if freeze.OverrideRole != "" {
+        message += fmt.Sprintf(" (override requires the %s role)", freeze.OverrideRole)
+    }
+    return []Violation{{Policy: freeze.Name, Message: message}}
+}
+
+// Scheduled changes
+
+// ScheduledChange is a validated save queued to be committed at At.
+type ScheduledChange struct {
+    ID       string     `json:"id"`
+    Filename string     `json:"filename"`
+    Content  string     `json:"content"`
+    Message  string     `json:"message,omitempty"`
+    User     string     `json:"user,omitempty"`
+    At       time.Time  `json:"at"`
+    Created  time.Time  `json:"created"`
+    Status   string     `json:"status"`
+    Commit   string     `json:"commit,omitempty"`
+    Error    string     `json:"error,omitempty"`
+    Applied  *time.Time `json:"applied,omitempty"`
+}
+
+type ScheduleRequest struct {
+    Content string    `json:"content"`
+    Message string    `json:"message"`
+    At      time.Time `json:"at"`
+}
+
+// Scheduled change states.
+const (
+    SchedulePending   = "pending"
+    ScheduleApplied   = "applied"
+    ScheduleFailed    = "failed"
+    ScheduleCancelled = "cancelled"
+)
+
+// How often the scheduler looks for due changes.
+const ScheduleInterval = 15 * time.Second
+
+var scheduleMu sync.Mutex
+
+func loadSchedule() ([]*ScheduledChange, error) {
+    path, err := metaPath("scheduled.json")
+    if err != nil {
+        return nil, err
+    }
+    var changes []*ScheduledChange
+    content, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return changes, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = json.Unmarshal(content, &changes)
+    return changes, err
+}
+
+func saveSchedule(changes []*ScheduledChange) error {
+    path, err := metaPath("scheduled.json")
+    if err != nil {
+        return err
+    }
+    data, _ := json.MarshalIndent(changes, "", "  ")
+    return writeFileAtomic(path, data, 0600)
+}
+
+// scheduleChange queues new content for filename. The content is validated
+// now and the save gates run again when it is applied.
+func scheduleChange(c *gin.Context) {
+    filename := c.Param("filename")
+    dir, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+
+    var req ScheduleRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if !req.At.After(time.Now()) {
+        c.JSON(400, gin.H{"error": "at must be in the future"})
+        return
+    }
+
+    fileType := getFileType(filename)
+    if err := validateContent(req.Content, fileType); err != nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid %s format: %v", strings.ToUpper(fileType), err)})
+        return
+    }
+    candidate := &SaveCandidate{Filename: filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: []byte(req.Content), User: requestUser(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+
+    change := &ScheduledChange{
+        ID:       randomToken()[:12],
+        Filename: filename,
+        Content:  req.Content,
+        Message:  req.Message,
+        User:     candidate.User,
+        At:       req.At.UTC(),
+        Created:  time.Now().UTC(),
+        Status:   SchedulePending,
+    }
+    scheduleMu.Lock()
+    defer scheduleMu.Unlock()
+    changes, err := loadSchedule()
+    if err == nil {
+        err = saveSchedule(append(changes, change))
+    }
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, change)
+}
+
+// listScheduled returns queued changes, optionally only those for ?file=.
+func listScheduled(c *gin.Context) {
+    scheduleMu.Lock()
+    changes, err := loadSchedule()
+    scheduleMu.Unlock()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    file := c.Query("file")
+    result := []*ScheduledChange{}
+    for _, change := range changes {
+        if file == "" || change.Filename == file {
+            result = append(result, change)
+        }
+    }
+    c.JSON(200, gin.H{"scheduled": result})
+}
+
+func cancelScheduled(c *gin.Context) {
+    scheduleMu.Lock()
+    defer scheduleMu.Unlock()
+    changes, err := loadSchedule()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    for _, change := range changes {
+        if change.ID != c.Param("id") {
+            continue
+        }
+        if change.Status != SchedulePending {
+            c.JSON(409, gin.H{"error": "change is already " + change.Status})
+            return
+        }
+        change.Status = ScheduleCancelled
+        if err := saveSchedule(changes); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(200, change)
+        return
+    }
+    c.JSON(404, gin.H{"error": "no such scheduled change"})
+}
+
+// runScheduler applies due changes until the process exits. Only the
+// leader of a cluster does.
+func runScheduler() {
+    for {
+        if replicas.isLeader() {
+            applyDueChanges(time.Now())
+            remindReviewers(time.Now())
+            sendDigest(time.Now())
+            flagStaleFiles(time.Now())
+            warnExpiring(time.Now())
+        }
+        time.Sleep(ScheduleInterval)
+    }
+}
+
+func applyDueChanges(now time.Time) {
+    scheduleMu.Lock()
+    defer scheduleMu.Unlock()
+    changes, err := loadSchedule()
+    if err != nil {
+        log.Printf("scheduler: %v", err)
+        return
+    }
+    applied := 0
+    for _, change := range changes {
+        if change.Status != SchedulePending || change.At.After(now) {
+            continue
+        }
+        applied++
+        resp, err := applyScheduled(change)
+        t := time.Now().UTC()
+        change.Applied = &t
+        if err != nil {
+            change.Status, change.Error = ScheduleFailed, err.Error()
+            log.Printf("scheduler: %s (%s): %v", change.Filename, change.ID, err)
+            notify("scheduled.failed", change)
+            continue
+        }
+        change.Status, change.Commit = ScheduleApplied, resp.Commit
+        log.Printf("scheduler: applied %s (%s) as %s", change.Filename, change.ID, resp.Commit)
+        notify("scheduled.applied", change)
+    }
+    if applied > 0 {
+        if err := saveSchedule(changes); err != nil {
+            log.Printf("scheduler: %v", err)
+        }
+    }
+}
+
+func applyScheduled(change *ScheduledChange) (SaveResponse, error) {
+    dir, rel, fullPath, err := resolvePath(change.Filename)
+    if err != nil {
+        return SaveResponse{}, err
+    }
+    fileType := getFileType(change.Filename)
+    if err := validateContent(change.Content, fileType); err != nil {
+        return SaveResponse{}, err
+    }
+    candidate := &SaveCandidate{Filename: change.Filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: []byte(change.Content), User: change.User}
+    if err := checkSaveGates(candidate); err != nil {
+        return SaveResponse{}, err
+    }
+    message := change.Message
+    if message == "" {
+        message = fmt.Sprintf("Scheduled update %s (queued %s)", rel, change.Created.Format(time.RFC3339))
+    }
+    return storeFile(context.Background(), dir, rel, fullPath, []byte(change.Content), message)
+}
+
+// NotifyConfig says where edit3 reports events such as saves and landed
+// scheduled changes. Webhook receives a JSON POST per event; MQTT publishes
+// file events to a topic per file path.
+type NotifyConfig struct {
+    Webhook string      `yaml:"webhook"`
+    MQTT    *MQTTConfig `yaml:"mqtt"`
+    // Approvals announce promotions waiting for review, remind reviewers
+    // and escalate when they wait too long.
+    Approvals []ApprovalRule `yaml:"approvals"`
+    // Email sends events to subscribers and approval messages by SMTP.
+    Email *EmailConfig `yaml:"email"`
+    // Digest periodically sums up the changes made.
+    Digest *DigestConfig `yaml:"digest"`
+    // Destinations are the URLs users may subscribe Slack and webhook
+    // channels to: a subscription's URL must start with one of them, e.g.
+    // https://hooks.slack.com/services/. Without any, only email works.
+    Destinations []string `yaml:"destinations"`
+}
+
+// MQTTConfig publishes file events to TopicPrefix/<path>, e.g.
+// edit3/files/devices/gw-12.yaml, with %, + and # in the path
+// percent-encoded. Paths limits which files are published.
+type MQTTConfig struct {
+    Broker         string   `yaml:"broker"`
+    ClientID       string   `yaml:"client_id"`
+    Username       string   `yaml:"username"`
+    Password       string   `yaml:"password"`
+    TopicPrefix    string   `yaml:"topic_prefix"`
+    QoS            byte     `yaml:"qos"`
+    Retain         bool     `yaml:"retain"`
+    IncludeContent bool     `yaml:"include_content"`
+    Paths          []string `yaml:"paths"`
+}
+
+// FileEvent describes a change to one file.
+type FileEvent struct {
+    Path      string `json:"path"`
+    Commit    string `json:"commit,omitempty"`
+    Timestamp string `json:"timestamp"`
+    Summary   string `json:"summary,omitempty"`
+    Content   string `json:"content,omitempty"`
+    // Impacted names the consumers reading values the save changed.
+    Impacted []string `json:"impacted,omitempty"`
+}
+
+// A notifier delivers events somewhere. It must not block.
+type notifier func(event string, data interface{})
+
+var notifiers []notifier
+
+// notify hands an event to every configured notifier.
+func notify(event string, data interface{}) {
+    for _, n := range notifiers {
+        n(event, data)
+    }
+}
+
+// startNotifiers connects the notifiers in config. Only the server calls it,
+// so CLI commands never open broker connections.
+func startNotifiers() error {
+    notifiers = append(notifiers, changeFeed.add)
+    hooks, remote := featureEnabled(FeatureHooks), featureEnabled(FeatureRemoteSync)
+    if hooks && config.Notify.Webhook != "" {
+        notifiers = append(notifiers, webhookNotifier(config.Notify.Webhook))
+    }
+    if hooks && config.Notify.MQTT != nil {
+        n, err := mqttNotifier(config.Notify.MQTT)
+        if err != nil {
+            return fmt.Errorf("mqtt: %v", err)
+        }
+        notifiers = append(notifiers, n)
+    }
+    if remote && config.KV != nil {
+        targets, err := kvTargets(config.KV)
+        if err != nil {
+            return fmt.Errorf("kv: %v", err)
+        }
+        notifiers = append(notifiers, syncNotifier("kv", targets))
+    }
+    if remote && config.AWS != nil {
+        targets, err := awsTargets(config.AWS)
+        if err != nil {
+            return fmt.Errorf("aws: %v", err)
+        }
+        awsSync = targets
+        notifiers = append(notifiers, syncNotifier("aws", targets))
+    }
+    if hooks && config.Grafana != nil {
+        notifiers = append(notifiers, grafanaNotifier(config.Grafana))
+    }
+    if hooks && len(config.Notify.Approvals) > 0 {
+        notifiers = append(notifiers, approvalNotifier)
+    }
+    if hooks {
+        notifiers = append(notifiers, watchNotifier)
+    }
+    if remote && config.Mirror != nil && config.Mirror.URL != "" {
+        if _, ok := historyFor(DataDir).(store.Git); !ok {
+            return errors.New("mirror: history is not kept in git")
+        }
+        notifiers = append(notifiers, primaryMirror.kick)
+    }
+    return nil
+}
+
+func webhookNotifier(url string) notifier {
+    client := &http.Client{Timeout: timeout(config.Timeouts.Webhook, WebhookTimeout)}
+    return func(event string, data interface{}) {
+        if e, ok := data.(FileEvent); ok {
+            e.Content = "" // keep webhook payloads small
+            data = e
+        }
+        body, _ := json.Marshal(gin.H{"event": event, "time": time.Now().UTC(), "data": data})
+        go func() {
+            resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+            if err != nil {
+                log.Printf("notify %s: %v", event, err)
+                return
+            }
+            resp.Body.Close()
+            if resp.StatusCode >= 300 {
+                log.Printf("notify %s: webhook returned %s", event, resp.Status)
+            }
+        }()
+    }
+}
+
+// mqttEscaper percent-encodes the characters of a path that are wildcards
+// (+ and #) or not allowed (NUL) in an MQTT topic, and % itself so
+// subscribers can decode the path back.
+var mqttEscaper = strings.NewReplacer("%", "%25", "+", "%2B", "#", "%23", "\x00", "%00")
+
+func mqttNotifier(cfg *MQTTConfig) (notifier, error) {
+    if cfg.Broker == "" {
+        return nil, errors.New("broker is required")
+    }
+    if cfg.TopicPrefix == "" {
+        cfg.TopicPrefix = "edit3/files"
+    }
+    if cfg.ClientID == "" {
+        host, _ := os.Hostname()
+        cfg.ClientID = fmt.Sprintf("edit3-%s-%d", host, os.Getpid())
+    }
+    opts := mqtt.NewClientOptions().
+        AddBroker(cfg.Broker).
+        SetClientID(cfg.ClientID).
+        SetUsername(cfg.Username).
+        SetPassword(cfg.Password).
+        SetAutoReconnect(true).
+        SetConnectRetry(true).
+        SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+            log.Printf("mqtt: connection lost: %v", err)
+        })
+    client := mqtt.NewClient(opts)
+    // With ConnectRetry the token only completes once connected; publishes
+    // made before then are queued by the client.
+    client.Connect()
+
+    return func(event string, data interface{}) {
+        e, ok := data.(FileEvent)
+        if !ok || !pathMatches(cfg.Paths, e.Path) {
+            return
+        }
+        if cfg.IncludeContent {
+            e.Content = string(maskSecrets(e.Path, []byte(e.Content)))
+        } else {
+            e.Content = ""
+        }
+        payload, _ := json.Marshal(gin.H{"event": event, "data": e})
+        topic := strings.TrimSuffix(cfg.TopicPrefix, "/") + "/" + mqttEscaper.Replace(e.Path)
+        token := client.Publish(topic, cfg.QoS, cfg.Retain, payload)
+        go func() {
+            if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+                log.Printf("mqtt: publish %s: %v", topic, token.Error())
+            }
+        }()
+    }, nil
+}
+
+// KV sync
+
+// KVConfig mirrors selected files, or subtrees of them, into Consul or etcd.
+// Address is the Consul HTTP address or a comma-separated list of etcd
+// endpoints.
+type KVConfig struct {
+    Backend  string      `yaml:"backend"`
+    Address  string      `yaml:"address"`
+    Token    string      `yaml:"token"`
+    Username string      `yaml:"username"`
+    Password string      `yaml:"password"`
+    Mappings []KVMapping `yaml:"mappings"`
+}
+
+// KVMapping ties the value at Pointer in File to Key. In "tree" mode (the
+// default) every leaf becomes its own key below Key, which is what most
+// KV-aware services expect; in "value" mode the whole subtree is stored as
+// JSON under Key itself.
+type KVMapping struct {
+    File    string `yaml:"file"`
+    Pointer string `yaml:"pointer"`
+    Key     string `yaml:"key"`
+    Mode    string `yaml:"mode"`
+}
+
+// kvStore is the part of a KV backend edit3 uses.
+type kvStore interface {
+    List(ctx context.Context, prefix string) (map[string][]byte, error)
+    Put(ctx context.Context, key string, value []byte) error
+    Delete(ctx context.Context, key string) error
+}
+
+// KVTimeout bounds each sync with the KV backend.
+const KVTimeout = 15 * time.Second
+
+func openKVStore(cfg *KVConfig) (kvStore, error) {
+    switch cfg.Backend {
+    case "consul":
+        c := consul.DefaultConfig()
+        if cfg.Address != "" {
+            c.Address = cfg.Address
+        }
+        c.Token = cfg.Token
+        client, err := consul.NewClient(c)
+        if err != nil {
+            return nil, err
+        }
+        return consulStore{client.KV()}, nil
+    case "etcd":
+        client, err := etcd.New(etcd.Config{
+            Endpoints:   strings.Split(cfg.Address, ","),
+            Username:    cfg.Username,
+            Password:    cfg.Password,
+            DialTimeout: 5 * time.Second,
+        })
+        if err != nil {
+            return nil, err
+        }
+        return etcdStore{client}, nil
+    }
+    return nil, fmt.Errorf("unknown kv backend %q (use consul or etcd)", cfg.Backend)
+}
+
+type consulStore struct{ kv *consul.KV }
+
+func (s consulStore) List(ctx context.Context, prefix string) (map[string][]byte, error) {
+    pairs, _, err := s.kv.List(prefix, (&consul.QueryOptions{}).WithContext(ctx))
+    if err != nil {
+        return nil, err
+    }
+    values := make(map[string][]byte, len(pairs))
+    for _, p := range pairs {
+        values[p.Key] = p.Value
+    }
+    return values, nil
+}
+
+func (s consulStore) Put(ctx context.Context, key string, value []byte) error {
+    _, err := s.kv.Put(&consul.KVPair{Key: key, Value: value}, (&consul.WriteOptions{}).WithContext(ctx))
+    return err
+}
+
+func (s consulStore) Delete(ctx context.Context, key string) error {
+    _, err := s.kv.Delete(key, (&consul.WriteOptions{}).WithContext(ctx))
+    return err
+}
+
+type etcdStore struct{ client *etcd.Client }
+
+func (s etcdStore) List(ctx context.Context, prefix string) (map[string][]byte, error) {
+    resp, err := s.client.Get(ctx, prefix, etcd.WithPrefix())
+    if err != nil {
+        return nil, err
+    }
+    values := make(map[string][]byte, len(resp.Kvs))
+    for _, kv := range resp.Kvs {
+        values[string(kv.Key)] = kv.Value
+    }
+    return values, nil
+}
+
+func (s etcdStore) Put(ctx context.Context, key string, value []byte) error {
+    _, err := s.client.Put(ctx, key, string(value))
+    return err
+}
+
+func (s etcdStore) Delete(ctx context.Context, key string) error {
+    _, err := s.client.Delete(ctx, key)
+    return err
+}
+
+// syncTarget is a mapping together with the store it is pushed to. Secret
+// targets hold values that reports must not show.
+type syncTarget struct {
+    Mapping KVMapping
+    Store   kvStore
+    Secret  bool
+}
+
+// syncNotifier pushes saved files to the stores they are mapped to, one
+// push per mapping at a time so that quick saves arrive in order.
+func syncNotifier(name string, targets []syncTarget) notifier {
+    queues := make([]*syncQueue, len(targets))
+    for i := range queues {
+        queues[i] = &syncQueue{}
+    }
+    return func(event string, data interface{}) {
+        e, ok := data.(FileEvent)
+        if event != "file.saved" || !ok {
+            return
+        }
+        for i, t := range targets {
+            if path.Clean(t.Mapping.File) != e.Path {
+                continue
+            }
+            t := t
+            queues[i].push([]byte(e.Content), func(content []byte) {
+                ctx, cancel := context.WithTimeout(context.Background(), KVTimeout)
+                defer cancel()
+                if err := pushKV(ctx, t.Store, t.Mapping, content); err != nil {
+                    log.Printf("%s: %s -> %s: %v", name, t.Mapping.File, t.Mapping.Key, err)
+                }
+            })
+        }
+    }
+}
+
+// syncQueue runs the pushes of one mapping one after another. Content
+// waiting behind a push is replaced by newer content, since only the last
+// save needs to reach the store.
+type syncQueue struct {
+    mu      sync.Mutex
+    next    []byte
+    pending bool
+    running bool
+}
+
+// push sends content with send once the push in progress, if any, is done.
+// It does not block.
+func (q *syncQueue) push(content []byte, send func([]byte)) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.next, q.pending = content, true
+    if q.running {
+        return
+    }
+    q.running = true
+    go func() {
+        for {
+            q.mu.Lock()
+            if !q.pending {
+                q.running = false
+                q.mu.Unlock()
+                return
+            }
+            content := q.next
+            q.next, q.pending = nil, false
+            q.mu.Unlock()
+            send(content)
+        }
+    }()
+}
+
+func kvTargets(cfg *KVConfig) ([]syncTarget, error) {
+    store, err := openKVStore(cfg)
+    if err != nil {
+        return nil, err
+    }
+    var targets []syncTarget
+    for _, m := range cfg.Mappings {
+        targets = append(targets, syncTarget{Mapping: m, Store: store})
+    }
+    return targets, nil
+}
+
+// wantedKV returns the key/value pairs a mapping should hold for content.
+func wantedKV(m KVMapping, content []byte) (map[string][]byte, error) {
+    doc, err := parseDocument(content, getFileType(m.File))
+    if err != nil {
+        return nil, err
+    }
+    if doc == nil {
+        return nil, fmt.Errorf("only JSON and YAML files can be synced")
+    }
+    matches := selectPointer(doc, m.Pointer)
+    if len(matches) != 1 {
+        return nil, fmt.Errorf("pointer %q does not select a single value", m.Pointer)
+    }
+    value := matches[0].Value
+    key := strings.TrimSuffix(m.Key, "/")
+
+    wanted := make(map[string][]byte)
+    if m.Mode == "value" {
+        switch value.(type) {
+        case map[string]interface{}, []interface{}:
+            b, err := json.Marshal(value)
+            if err != nil {
+                return nil, err
+            }
+            wanted[key] = b
+        default:
+            flattenKV(key, value, wanted)
+        }
+        return wanted, nil
+    }
+    flattenKV(key, value, wanted)
+    return wanted, nil
+}
+
+// liveKV reads what a mapping's keys currently hold.
+func liveKV(ctx context.Context, store kvStore, m KVMapping) (map[string][]byte, error) {
+    key := strings.TrimSuffix(m.Key, "/")
+    if m.Mode == "value" {
+        pairs, err := store.List(ctx, key)
+        if err != nil {
+            return nil, err
+        }
+        live := make(map[string][]byte)
+        if v, ok := pairs[key]; ok {
+            live[key] = v
+        }
+        return live, nil
+    }
+    return store.List(ctx, key+"/")
+}
+
+func pushKV(ctx context.Context, store kvStore, m KVMapping, content []byte) error {
+    wanted, err := wantedKV(m, content)
+    if err != nil {
+        return err
+    }
+    existing, err := liveKV(ctx, store, m)
+    if err != nil {
+        return err
+    }
+    for k, v := range wanted {
+        if old, ok := existing[k]; ok && bytes.Equal(old, v) {
+            continue
+        }
+        if err := store.Put(ctx, k, v); err != nil {
+            return err
+        }
+    }
+    for k := range existing {
+        if _, ok := wanted[k]; !ok {
+            if err := store.Delete(ctx, k); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// KVDrift compares a mapped file with its live keys.
+type KVDrift struct {
+    File    string   `json:"file"`
+    Key     string   `json:"key"`
+    Status  string   `json:"status"`
+    Error   string   `json:"error,omitempty"`
+    Changes []Change `json:"changes,omitempty"`
+}
+
+// driftKV reports how the live keys differ from the file: Old is the live
+// value and New the one in the file, so applying the changes means a push.
+func driftKV(ctx context.Context, store kvStore, m KVMapping) KVDrift {
+    d := KVDrift{File: m.File, Key: m.Key}
+    dir, rel, _, err := resolvePath(m.File)
+    var content []byte
+    if err == nil {
+        content, err = fileStore(dir).Read(storageName(rel))
+    }
+    var wanted, live map[string][]byte
+    if err == nil {
+        wanted, err = wantedKV(m, content)
+    }
+    if err == nil {
+        live, err = liveKV(ctx, store, m)
+    }
+    if err != nil {
+        d.Status, d.Error = "error", err.Error()
+        return d
+    }
+
+    keys := make([]string, 0, len(wanted)+len(live))
+    for k := range wanted {
+        keys = append(keys, k)
+    }
+    for k := range live {
+        if _, ok := wanted[k]; !ok {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        want, inFile := wanted[k]
+        have, isLive := live[k]
+        switch {
+        case !isLive:
+            d.Changes = append(d.Changes, Change{Op: "add", Pointer: k, New: string(want)})
+        case !inFile:
+            d.Changes = append(d.Changes, Change{Op: "remove", Pointer: k, Old: string(have)})
+        case !bytes.Equal(want, have):
+            d.Changes = append(d.Changes, Change{Op: "replace", Pointer: k, Old: string(have), New: string(want)})
+        }
+    }
+    switch {
+    case len(live) == 0:
+        d.Status = "missing"
+    case len(d.Changes) > 0:
+        d.Status = "drifted"
+    default:
+        d.Status = "in-sync"
+    }
+    return d
+}
+
+// flattenKV turns a document into key/value pairs: objects and arrays become
+// key segments, strings are stored as-is and other scalars as JSON.
+func flattenKV(key string, v interface{}, out map[string][]byte) {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for k, item := range v {
+            flattenKV(key+"/"+k, item, out)
+        }
+    case []interface{}:
+        for i, item := range v {
+            flattenKV(fmt.Sprintf("%s/%d", key, i), item, out)
+        }
+    case string:
+        out[key] = []byte(v)
+    default:
+        b, _ := json.Marshal(v)
+        out[key] = b
+    }
+}
+
+// unflattenKV is the inverse of flattenKV. Objects whose keys are exactly
+// 0..n-1 come back as arrays; values that parse as JSON scalars are typed.
+func unflattenKV(prefix string, pairs map[string][]byte) interface{} {
+    root := make(map[string]interface{})
+    for k, v := range pairs {
+        rel := strings.TrimPrefix(k, prefix+"/")
+        if rel == "" || rel == k {
+            continue
+        }
+        parts := strings.Split(rel, "/")
+        node := root
+        for _, part := range parts[:len(parts)-1] {
+            child, ok := node[part].(map[string]interface{})
+            if !ok {
+                child = make(map[string]interface{})
+                node[part] = child
+            }
+            node = child
+        }
+        var scalar interface{}
+        if err := json.Unmarshal(v, &scalar); err != nil {
+            scalar = string(v)
+        } else if _, nested := scalar.(map[string]interface{}); nested {
+            scalar = string(v)
+        } else if _, nested := scalar.([]interface{}); nested {
+            scalar = string(v)
+        }
+        node[parts[len(parts)-1]] = scalar
+    }
+    return arraysFromIndexes(root)
+}
+
+func arraysFromIndexes(v interface{}) interface{} {
+    m, ok := v.(map[string]interface{})
+    if !ok {
+        return v
+    }
+    for k, item := range m {
+        m[k] = arraysFromIndexes(item)
+    }
+    list := make([]interface{}, len(m))
+    for i := range list {
+        item, ok := m[strconv.Itoa(i)]
+        if !ok {
+            return m
+        }
+        list[i] = item
+    }
+    if len(list) == 0 {
+        return m
+    }
+    return list
+}
+
+// setPointer stores value at pointer inside doc, creating objects on the way,
+// and returns the (possibly new) root.
+func setPointer(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+    if pointer == "" || pointer == "/" {
+        return value, nil
+    }
+    segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+    root, ok := doc.(map[string]interface{})
+    if !ok {
+        root = make(map[string]interface{})
+    }
+    var node interface{} = root
+    for i, segment := range segments {
+        segment = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+        last := i == len(segments)-1
+        switch n := node.(type) {
+        case map[string]interface{}:
+            if last {
+                n[segment] = value
+                break
+            }
+            if _, ok := n[segment].(map[string]interface{}); !ok {
+                if _, isList := n[segment].([]interface{}); !isList {
+                    n[segment] = make(map[string]interface{})
+                }
+            }
+            node = n[segment]
+        case []interface{}:
+            idx, err := strconv.Atoi(segment)
+            if err != nil || idx < 0 || idx >= len(n) {
+                return nil, fmt.Errorf("%s: no array element %q", pointer, segment)
+            }
+            if last {
+                n[idx] = value
+                break
+            }
+            node = n[idx]
+        default:
+            return nil, fmt.Errorf("%s: cannot descend into a scalar", pointer)
+        }
+    }
+    return root, nil
+}
+
+// marshalDocument renders a plain document in the given file type.
+func marshalDocument(doc interface{}, fileType string) ([]byte, error) {
+    return engine.Marshal(doc, fileType)
+}
+
+// rewriteDocument is marshalDocument for an edit of original: composite
+// documents keep everything outside their structured part, and YAML and
+// TOML keep the comments and layout of what did not change.
+func rewriteDocument(original []byte, doc interface{}, fileType string) ([]byte, error) {
+    return engine.Rewrite(original, doc, fileType)
+}
+
+// kvImportCommand implements "edit3 kv-import": it pulls the mapped keys from
+// the KV store into their files and commits the result.
+func kvImportCommand(flags *flag.FlagSet) func(args []string) int {
+    dryRun := flags.Bool("n", false, "print what would be written instead of saving")
+    return func(args []string) int {
+        configure()
+        if config.KV == nil {
+            fmt.Fprintln(os.Stderr, "edit3: no kv section in the configuration")
+            return 1
+        }
+        store, err := openKVStore(config.KV)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        ensureDataDir()
+        initGit(DataDir)
+        if err := migrateDataDir(context.Background()); err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+
+        status := 0
+        for _, m := range config.KV.Mappings {
+            if len(args) > 0 && !containsString(args, m.File) {
+                continue
+            }
+            if err := importKV(store, m, *dryRun); err != nil {
+                fmt.Fprintf(os.Stderr, "%s: %v\n", m.File, err)
+                status = 1
+            }
+        }
+        return status
+    }
+}
+
+func importKV(store kvStore, m KVMapping, dryRun bool) error {
+    ctx, cancel := context.WithTimeout(context.Background(), KVTimeout)
+    defer cancel()
+    key := strings.TrimSuffix(m.Key, "/")
+
+    var value interface{}
+    if m.Mode == "value" {
+        pairs, err := store.List(ctx, key)
+        if err != nil {
+            return err
+        }
+        raw, ok := pairs[key]
+        if !ok {
+            return fmt.Errorf("key %s not found", key)
+        }
+        if err := json.Unmarshal(raw, &value); err != nil {
+            value = string(raw)
+        }
+    } else {
+        pairs, err := store.List(ctx, key+"/")
+        if err != nil {
+            return err
+        }
+        if len(pairs) == 0 {
+            return fmt.Errorf("no keys under %s/", key)
+        }
+        value = unflattenKV(key, pairs)
+    }
+
+    dir, rel, fullPath, err := resolvePath(m.File)
+    if err != nil {
+        return err
+    }
+    fileType := getFileType(m.File)
+    var doc interface{}
+    current, err := fileStore(dir).Read(storageName(rel))
+    exists := err == nil
+    if exists {
+        if doc, err = parseDocument(current, fileType); err != nil {
+            return err
+        }
+    }
+    if doc, err = setPointer(doc, m.Pointer, value); err != nil {
+        return err
+    }
+    var content []byte
+    if exists {
+        content, err = rewriteDocument(current, doc, fileType)
+    } else {
+        content, err = marshalDocument(doc, fileType)
+    }
+    if err != nil {
+        return err
+    }
+    if dryRun {
+        fmt.Printf("==> %s\n%s", m.File, content)
+        return nil
+    }
+    if err := validateContent(string(content), fileType); err != nil {
+        return fmt.Errorf("%s: %v", m.File, err)
+    }
+    candidate := &SaveCandidate{Filename: m.File, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: content, User: os.Getenv("USER"), Context: context.Background()}
+    if err := checkSaveGates(candidate); err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+        return err
+    }
+    resp, err := storeFile(context.Background(), dir, rel, fullPath, content, fmt.Sprintf("Import %s from %s %s", rel, config.KV.Backend, key))
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(os.Stderr, "%s: imported from %s (%s)\n", m.File, key, resp.Commit)
+    return nil
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// AWSConfig pushes mapped values to SSM Parameter Store or Secrets Manager.
+// Credentials come from the usual AWS chain (environment, profile, role).
+// DriftRole may read the drift report; no one may when it is unset.
+type AWSConfig struct {
+    Region    string       `yaml:"region"`
+    Profile   string       `yaml:"profile"`
+    KMSKeyID  string       `yaml:"kms_key_id"`
+    DriftRole string       `yaml:"drift_role"`
+    Mappings  []AWSMapping `yaml:"mappings"`
+}
+
+// AWSMapping is a KVMapping whose Key is an SSM parameter name (tree mode
+// creates one parameter per leaf below it) or a secret name. Secure stores
+// SSM values as SecureString, encrypted with the configured KMS key.
+type AWSMapping struct {
+    KVMapping `yaml:",inline"`
+    Service   string `yaml:"service"`
+    Secure    bool   `yaml:"secure"`
+}
+
+// awsSync holds the AWS targets once the server has started.
+var awsSync []syncTarget
+
+func awsTargets(cfg *AWSConfig) ([]syncTarget, error) {
+    opts := []func(*awsconfig.LoadOptions) error{}
+    if cfg.Region != "" {
+        opts = append(opts, awsconfig.WithRegion(cfg.Region))
+    }
+    if cfg.Profile != "" {
+        opts = append(opts, awsconfig.WithSharedConfigProfile(cfg.Profile))
+    }
+    awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+    if err != nil {
+        return nil, err
+    }
+    ssmClient := ssm.NewFromConfig(awsCfg)
+    secretsClient := secretsmanager.NewFromConfig(awsCfg)
+
+    var targets []syncTarget
+    for _, m := range cfg.Mappings {
+        var store kvStore
+        switch m.Service {
+        case "", "ssm":
+            store = ssmStore{ssmClient, m.Secure, cfg.KMSKeyID}
+        case "secretsmanager":
+            if m.Mode != "value" {
+                return nil, fmt.Errorf("%s: Secrets Manager mappings must use mode: value", m.File)
+            }
+            store = secretStore{secretsClient, cfg.KMSKeyID}
+        default:
+            return nil, fmt.Errorf("%s: unknown service %q (use ssm or secretsmanager)", m.File, m.Service)
+        }
+        secret := m.Secure || m.Service == "secretsmanager"
+        targets = append(targets, syncTarget{Mapping: m.KVMapping, Store: store, Secret: secret})
+    }
+    return targets, nil
+}
+
+type ssmStore struct {
+    client *ssm.Client
+    secure bool
+    kmsKey string
+}
+
+func (s ssmStore) List(ctx context.Context, prefix string) (map[string][]byte, error) {
+    values := make(map[string][]byte)
+    if !strings.HasSuffix(prefix, "/") {
+        out, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(prefix), WithDecryption: aws.Bool(true)})
+        var notFound *ssmtypes.ParameterNotFound
+        if errors.As(err, &notFound) {
+            return values, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        values[prefix] = []byte(aws.ToString(out.Parameter.Value))
+        return values, nil
+    }
+
+    pages := ssm.NewGetParametersByPathPaginator(s.client, &ssm.GetParametersByPathInput{
+        Path:           aws.String(strings.TrimSuffix(prefix, "/")),
+        Recursive:      aws.Bool(true),
+        WithDecryption: aws.Bool(true),
+    })
+    for pages.HasMorePages() {
+        page, err := pages.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, p := range page.Parameters {
+            values[aws.ToString(p.Name)] = []byte(aws.ToString(p.Value))
+        }
+    }
+    return values, nil
+}
+
+func (s ssmStore) Put(ctx context.Context, key string, value []byte) error {
+    input := &ssm.PutParameterInput{
+        Name:      aws.String(key),
+        Value:     aws.String(string(value)),
+        Type:      ssmtypes.ParameterTypeString,
+        Overwrite: aws.Bool(true),
+    }
+    if s.secure {
+        input.Type = ssmtypes.ParameterTypeSecureString
+        if s.kmsKey != "" {
+            input.KeyId = aws.String(s.kmsKey)
+        }
+    }
+    _, err := s.client.PutParameter(ctx, input)
+    return err
+}
+
+func (s ssmStore) Delete(ctx context.Context, key string) error {
+    _, err := s.client.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(key)})
+    return err
+}
+
+type secretStore struct {
+    client *secretsmanager.Client
+    kmsKey string
+}
+
+func (s secretStore) List(ctx context.Context, prefix string) (map[string][]byte, error) {
+    values := make(map[string][]byte)
+    out, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(prefix)})
+    var notFound *smtypes.ResourceNotFoundException
+    if errors.As(err, &notFound) {
+        return values, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    values[prefix] = []byte(aws.ToString(out.SecretString))
+    return values, nil
+}
+
+func (s secretStore) Put(ctx context.Context, key string, value []byte) error {
+    _, err := s.client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+        SecretId:     aws.String(key),
+        SecretString: aws.String(string(value)),
+    })
+    var notFound *smtypes.ResourceNotFoundException
+    if !errors.As(err, &notFound) {
+        return err
+    }
+    input := &secretsmanager.CreateSecretInput{
+        Name:         aws.String(key),
+        SecretString: aws.String(string(value)),
+    }
+    if s.kmsKey != "" {
+        input.KmsKeyId = aws.String(s.kmsKey)
+    }
+    _, err = s.client.CreateSecret(ctx, input)
+    return err
+}
+
+func (s secretStore) Delete(ctx context.Context, key string) error {
+    return fmt.Errorf("refusing to delete secret %s; remove it in AWS", key)
+}
+
+// awsDrift handles GET /api/aws/drift[?file=]: how the live parameters and
+// secrets differ from the files they are mapped from. SecureString
+// parameters and secrets are reported by key only, never by value.
+func awsDrift(c *gin.Context) {
+    if config.AWS == nil || config.AWS.DriftRole == "" || !hasRole(requestUser(c), config.AWS.DriftRole) {
+        c.JSON(403, gin.H{"error": "reading AWS drift requires the drift role (aws.drift_role)"})
+        return
+    }
+    ctx, cancel := context.WithTimeout(c.Request.Context(), KVTimeout)
+    defer cancel()
+    file := c.Query("file")
+    report := []KVDrift{}
+    for _, t := range awsSync {
+        if file != "" && path.Clean(t.Mapping.File) != path.Clean(file) {
+            continue
+        }
+        d := driftKV(ctx, t.Store, t.Mapping)
+        if t.Secret {
+            for i := range d.Changes {
+                d.Changes[i].Old, d.Changes[i].New = nil, nil
+            }
+        }
+        report = append(report, d)
+    }
+    c.JSON(200, gin.H{"drift": report})
+}
+
+// Ansible profile
+
+// AnsibleConfig turns on Ansible awareness for inventories and playbooks in
+// the data directory. Inventory structure errors always block a save; Strict
+// also blocks playbooks that use undefined variables.
+type AnsibleConfig struct {
+    Inventories []string `yaml:"inventories"`
+    Playbooks   []string `yaml:"playbooks"`
+    Strict      bool     `yaml:"strict"`
+}
+
+var defaultInventoryGlobs = []string{"**/inventory", "**/inventory.*", "**/inventory/*", "**/hosts", "**/hosts.*"}
+var defaultPlaybookGlobs = []string{"**/playbooks/**/*.yml", "**/playbooks/**/*.yaml", "**/site.yml", "**/*playbook*.yml"}
+
+func (a *AnsibleConfig) isInventory(rel string) bool {
+    globs := a.Inventories
+    if len(globs) == 0 {
+        globs = defaultInventoryGlobs
+    }
+    rel = filepath.ToSlash(rel)
+    return pathMatches(globs, rel) && !strings.Contains("/"+rel, "/group_vars/") && !strings.Contains("/"+rel, "/host_vars/")
+}
+
+func (a *AnsibleConfig) isPlaybook(rel string) bool {
+    globs := a.Playbooks
+    if len(globs) == 0 {
+        globs = defaultPlaybookGlobs
+    }
+    return pathMatches(globs, rel)
+}
+
+// Inventory is a parsed Ansible inventory.
+type Inventory struct {
+    Groups map[string]*InventoryGroup `json:"groups"`
+    Hosts  map[string]*InventoryHost  `json:"hosts"`
+}
+
+type InventoryGroup struct {
+    Hosts    []string               `json:"hosts"`
+    Children []string               `json:"children"`
+    Vars     map[string]interface{} `json:"vars"`
+}
+
+type InventoryHost struct {
+    Groups []string               `json:"groups"`
+    Vars   map[string]interface{} `json:"vars"`
+}
+
+func newInventory() *Inventory {
+    inv := &Inventory{Groups: map[string]*InventoryGroup{}, Hosts: map[string]*InventoryHost{}}
+    inv.group("all")
+    inv.group("ungrouped")
+    return inv
+}
+
+func (inv *Inventory) group(name string) *InventoryGroup {
+    g, ok := inv.Groups[name]
+    if !ok {
+        g = &InventoryGroup{Hosts: []string{}, Children: []string{}, Vars: map[string]interface{}{}}
+        inv.Groups[name] = g
+    }
+    return g
+}
+
+func (inv *Inventory) addHost(group, host string, vars map[string]interface{}) {
+    h, ok := inv.Hosts[host]
+    if !ok {
+        h = &InventoryHost{Groups: []string{}, Vars: map[string]interface{}{}}
+        inv.Hosts[host] = h
+    }
+    if !containsString(h.Groups, group) {
+        h.Groups = append(h.Groups, group)
+    }
+    for k, v := range vars {
+        h.Vars[k] = v
+    }
+    g := inv.group(group)
+    if !containsString(g.Hosts, host) {
+        g.Hosts = append(g.Hosts, host)
+    }
+}
+
+func (inv *Inventory) addChild(parent, child string) {
+    inv.group(child)
+    g := inv.group(parent)
+    if !containsString(g.Children, child) {
+        g.Children = append(g.Children, child)
+    }
+}
+
+// inventoryType tells INI and YAML inventories apart; extensionless files
+// are sniffed.
+func inventoryType(rel string, content []byte) string {
+    switch getFileType(rel) {
+    case "yaml", "yml":
+        return "yaml"
+    case "json":
+        return "json"
+    case "ini", "cfg", "":
+        trimmed := strings.TrimSpace(string(content))
+        if strings.HasPrefix(trimmed, "[") || trimmed == "" || strings.Contains(trimmed, "=") || !strings.Contains(trimmed, ":") {
+            return "ini"
+        }
+        return "yaml"
+    }
+    return ""
+}
+
+// parseInventory parses an INI or YAML inventory into inv. Structural
+// problems are returned as violations pointing at the offending line or key.
+func parseInventory(inv *Inventory, rel string, content []byte) []Violation {
+    switch inventoryType(rel, content) {
+    case "ini":
+        return parseINIInventory(inv, content)
+    case "yaml", "json":
+        var doc interface{}
+        if err := yaml.Unmarshal(content, &doc); err != nil {
+            return []Violation{{Policy: "ansible", Message: err.Error()}}
+        }
+        return parseYAMLInventory(inv, normalizeDocument(doc))
+    }
+    return nil
+}
+
+var iniSection = regexp.MustCompile(`^\[([^\]:]+)(?::(vars|children))?\]$`)
+
+func parseINIInventory(inv *Inventory, content []byte) []Violation {
+    var violations []Violation
+    problem := func(line int, format string, args ...interface{}) {
+        violations = append(violations, Violation{Policy: "ansible", Message: fmt.Sprintf("line %d: ", line) + fmt.Sprintf(format, args...)})
+    }
+
+    group, kind := "ungrouped", ""
+    for i, raw := range strings.Split(string(content), "\n") {
+        line := strings.TrimSpace(raw)
+        if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+            continue
+        }
+        if strings.HasPrefix(line, "[") {
+            m := iniSection.FindStringSubmatch(line)
+            if m == nil {
+                problem(i+1, "malformed section header %s", line)
+                continue
+            }
+            group, kind = strings.TrimSpace(m[1]), m[2]
+            if strings.ContainsAny(group, " \t") {
+                problem(i+1, "group name %q contains whitespace", group)
+            }
+            inv.group(group)
+            continue
+        }
+
+        fields, err := splitINIFields(line)
+        if err != nil {
+            problem(i+1, "%v", err)
+            continue
+        }
+        switch kind {
+        case "vars":
+            k, v, ok := splitINIVar(line)
+            if !ok {
+                problem(i+1, "expected key=value in [%s:vars]", group)
+                continue
+            }
+            inv.group(group).Vars[k] = v
+        case "children":
+            if len(fields) != 1 || strings.Contains(fields[0], "=") {
+                problem(i+1, "expected a single group name in [%s:children]", group)
+                continue
+            }
+            inv.addChild(group, fields[0])
+        default:
+            vars := make(map[string]interface{})
+            for _, f := range fields[1:] {
+                k, v, ok := splitINIVar(f)
+                if !ok {
+                    problem(i+1, "host variable %q is not key=value", f)
+                    continue
+                }
+                vars[k] = v
+            }
+            hosts, err := expandHostPattern(fields[0])
+            if err != nil {
+                problem(i+1, "%v", err)
+                continue
+            }
+            for _, host := range hosts {
+                inv.addHost(group, host, vars)
+            }
+        }
+    }
+
+    for name, g := range inv.Groups {
+        for _, child := range g.Children {
+            if child == name {
+                violations = append(violations, Violation{Policy: "ansible", Message: fmt.Sprintf("group %s lists itself as a child", name)})
+            }
+        }
+    }
+    return violations
+}
+
+// splitINIFields splits on whitespace, keeping quoted values together.
+func splitINIFields(line string) ([]string, error) {
+    var fields []string
+    var b strings.Builder
+    var quote rune
+    for _, r := range line {
+        switch {
+        case quote != 0:
+            b.WriteRune(r)
+            if r == quote {
+                quote = 0
+            }
+        case r == '"' || r == '\'':
+            quote = r
+            b.WriteRune(r)
+        case r == ' ' || r == '\t':
+            if b.Len() > 0 {
+                fields = append(fields, b.String())
+                b.Reset()
+            }
+        case r == '#' && b.Len() == 0:
+            // trailing comment
+            return fields, nil
+        default:
+            b.WriteRune(r)
+        }
+    }
+    if quote != 0 {
+        return nil, fmt.Errorf("unterminated %c quote", quote)
+    }
+    if b.Len() > 0 {
+        fields = append(fields, b.String())
+    }
+    return fields, nil
+}
+
+func splitINIVar(s string) (string, interface{}, bool) {
+    i := strings.Index(s, "=")
+    if i <= 0 {
+        return "", nil, false
+    }
+    k, v := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+    if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+        return k, v[1 : len(v)-1], true
+    }
+    var typed interface{}
+    if err := yaml.Unmarshal([]byte(v), &typed); err == nil {
+        if _, isMap := typed.(map[string]interface{}); !isMap {
+            return k, typed, true
+        }
+    }
+    return k, v, true
+}
+
+var hostRange = regexp.MustCompile(`\[([0-9]+|[a-z]):([0-9]+|[a-z])\]`)
+
+// expandHostPattern expands ranges such as web[01:03].example.com.
+func expandHostPattern(pattern string) ([]string, error) {
+    m := hostRange.FindStringSubmatchIndex(pattern)
+    if m == nil {
+        return []string{pattern}, nil
+    }
+    from, to := pattern[m[2]:m[3]], pattern[m[4]:m[5]]
+    prefix, suffix := pattern[:m[0]], pattern[m[1]:]
+    var items []string
+    if a, err := strconv.Atoi(from); err == nil {
+        b, err := strconv.Atoi(to)
+        if err != nil || b < a {
+            return nil, fmt.Errorf("bad host range [%s:%s]", from, to)
+        }
+        format := "%d"
+        if len(from) > 1 && from[0] == '0' {
+            format = fmt.Sprintf("%%0%dd", len(from))
+        }
+        for i := a; i <= b; i++ {
+            items = append(items, fmt.Sprintf(format, i))
+        }
+    } else {
+        if len(to) != 1 || to[0] < from[0] {
+            return nil, fmt.Errorf("bad host range [%s:%s]", from, to)
+        }
+        for c := from[0]; c <= to[0]; c++ {
+            items = append(items, string(c))
+        }
+    }
+    var hosts []string
+    for _, item := range items {
+        rest, err := expandHostPattern(suffix)
+        if err != nil {
+            return nil, err
+        }
+        for _, r := range rest {
+            hosts = append(hosts, prefix+item+r)
+        }
+    }
+    return hosts, nil
+}
+
+func parseYAMLInventory(inv *Inventory, doc interface{}) []Violation {
+    var violations []Violation
+    problem := func(pointer, format string, args ...interface{}) {
+        violations = append(violations, Violation{Policy: "ansible", Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+    }
+    root, ok := doc.(map[string]interface{})
+    if !ok {
+        if doc != nil {
+            problem("", "inventory must be a mapping of group names")
+        }
+        return violations
+    }
+
+    var walk func(name, pointer string, v interface{})
+    walk = func(name, pointer string, v interface{}) {
+        inv.group(name)
+        if v == nil {
+            return
+        }
+        body, ok := v.(map[string]interface{})
+        if !ok {
+            problem(pointer, "group %s must be a mapping with hosts, vars or children", name)
+            return
+        }
+        for key, value := range body {
+            child := pointer + "/" + escapePointer(key)
+            switch key {
+            case "hosts":
+                if value == nil {
+                    continue
+                }
+                hosts, ok := value.(map[string]interface{})
+                if !ok {
+                    problem(child, "hosts of %s must be a mapping of host names", name)
+                    continue
+                }
+                for pattern, hv := range hosts {
+                    vars, ok := hv.(map[string]interface{})
+                    if hv != nil && !ok {
+                        problem(child+"/"+escapePointer(pattern), "variables of host %s must be a mapping", pattern)
+                        continue
+                    }
+                    expanded, err := expandHostPattern(pattern)
+                    if err != nil {
+                        problem(child+"/"+escapePointer(pattern), "%v", err)
+                        continue
+                    }
+                    for _, host := range expanded {
+                        inv.addHost(name, host, vars)
+                    }
+                }
+            case "vars":
+                vars, ok := value.(map[string]interface{})
+                if value != nil && !ok {
+                    problem(child, "vars of %s must be a mapping", name)
+                    continue
+                }
+                for k, v := range vars {
+                    inv.group(name).Vars[k] = v
+                }
+            case "children":
+                if value == nil {
+                    continue
+                }
+                children, ok := value.(map[string]interface{})
+                if !ok {
+                    problem(child, "children of %s must be a mapping of groups", name)
+                    continue
+                }
+                for childName, cv := range children {
+                    inv.addChild(name, childName)
+                    walk(childName, child+"/"+escapePointer(childName), cv)
+                }
+            default:
+                problem(child, "unexpected key %q in group %s (use hosts, vars or children)", key, name)
+            }
+        }
+    }
+    for name, v := range root {
+        walk(name, "/"+escapePointer(name), v)
+    }
+    return violations
+}
+
+// loadAnsibleInventory merges every inventory in the data directory, with
+// variables from group_vars and host_vars.
+func loadAnsibleInventory(only string) (*Inventory, error) {
+    inv := newInventory()
+    err := filepath.Walk(DataDir, func(p string, info os.FileInfo, err error) error {
+        if err != nil {
+            return nil
+        }
+        rel, _ := relativeTo(DataDir, p)
+        if info.IsDir() {
+            if name := info.Name(); name == ".git" || name == MetaDir {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        rel = filepath.ToSlash(rel)
+        switch {
+        case config.Ansible.isInventory(rel):
+            if only != "" && path.Clean(only) != rel {
+                return nil
+            }
+            content, err := ioutil.ReadFile(p)
+            if err == nil {
+                parseInventory(inv, rel, content)
+            }
+        case strings.Contains("/"+rel, "/group_vars/"), strings.Contains("/"+rel, "/host_vars/"):
+            loadAnsibleVarsFile(inv, rel, p)
+        }
+        return nil
+    })
+    for name := range inv.Groups {
+        if name != "all" && !containsString(inv.Groups["all"].Children, name) && !isChildGroup(inv, name) {
+            inv.addChild("all", name)
+        }
+    }
+    return inv, err
+}
+
+func isChildGroup(inv *Inventory, name string) bool {
+    for parent, g := range inv.Groups {
+        if parent != "all" && containsString(g.Children, name) {
+            return true
+        }
+    }
+    return false
+}
+
+// loadAnsibleVarsFile merges group_vars/<group>[.yml] or
+// host_vars/<host>/<file>.yml into the inventory.
+func loadAnsibleVarsFile(inv *Inventory, rel, full string) {
+    switch getFileType(rel) {
+    case "yml", "yaml", "json", "":
+    default:
+        return
+    }
+    parts := strings.Split(rel, "/")
+    var kind, owner string
+    for i, part := range parts[:len(parts)-1] {
+        if part == "group_vars" || part == "host_vars" {
+            kind = part
+            owner = parts[i+1]
+            break
+        }
+    }
+    owner = strings.TrimSuffix(owner, filepath.Ext(owner))
+    content, err := ioutil.ReadFile(full)
+    if err != nil {
+        return
+    }
+    var doc interface{}
+    if yaml.Unmarshal(content, &doc) != nil {
+        return
+    }
+    vars, _ := normalizeDocument(doc).(map[string]interface{})
+    if kind == "group_vars" {
+        for k, v := range vars {
+            inv.group(owner).Vars[k] = v
+        }
+    } else if kind == "host_vars" {
+        for k, v := range vars {
+            if h, ok := inv.Hosts[owner]; ok {
+                h.Vars[k] = v
+            } else {
+                inv.Hosts[owner] = &InventoryHost{Groups: []string{}, Vars: map[string]interface{}{k: v}}
+            }
+        }
+    }
+}
+
+// ansibleInventory handles GET /api/ansible/inventory[?file=&host=&group=].
+func ansibleInventory(c *gin.Context) {
+    if config.Ansible == nil {
+        c.JSON(404, gin.H{"error": "the Ansible profile is not enabled"})
+        return
+    }
+    inv, err := loadAnsibleInventory(c.Query("file"))
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    if host := c.Query("host"); host != "" {
+        h, ok := inv.Hosts[host]
+        if !ok {
+            c.JSON(404, gin.H{"error": "no such host"})
+            return
+        }
+        c.JSON(200, gin.H{"host": host, "groups": h.Groups, "vars": h.Vars})
+        return
+    }
+    if group := c.Query("group"); group != "" {
+        g, ok := inv.Groups[group]
+        if !ok {
+            c.JSON(404, gin.H{"error": "no such group"})
+            return
+        }
+        c.JSON(200, gin.H{"group": group, "hosts": g.Hosts, "children": g.Children, "vars": g.Vars})
+        return
+    }
+    c.JSON(200, inv)
+}
+
+// ansibleMagicVars are always defined when a play runs.
+var ansibleMagicVars = map[string]bool{
+    "hostvars": true, "groups": true, "group_names": true, "inventory_hostname": true,
+    "inventory_hostname_short": true, "inventory_dir": true, "inventory_file": true,
+    "play_hosts": true, "ansible_play_hosts": true, "ansible_play_batch": true,
+    "playbook_dir": true, "role_path": true, "role_name": true, "environment": true,
+    "omit": true, "item": true, "ansible_loop": true, "lookup": true, "query": true,
+    "q": true, "range": true, "dict": true, "lipsum": true, "now": true, "undef": true,
+    "true": true, "false": true, "none": true, "True": true, "False": true, "None": true,
+    "and": true, "or": true, "not": true, "in": true, "is": true, "if": true, "else": true,
+}
+
+var (
+    jinjaExpr    = regexp.MustCompile(`\{\{(.*?)\}\}`)
+    jinjaString  = regexp.MustCompile(`"[^"]*"|'[^']*'`)
+    jinjaIdent   = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+    jinjaGuarded = regexp.MustCompile(`\bis\s+(not\s+)?(defined|undefined|none)\b|\|\s*(default|d)\b`)
+)
+
+// jinjaNames returns the top-level variable names an expression reads.
+// Attribute and filter names are skipped, as is any expression guarded by
+// "is defined" or "| default".
+func jinjaNames(expr string) []string {
+    if jinjaGuarded.MatchString(expr) {
+        return nil
+    }
+    expr = jinjaString.ReplaceAllString(expr, `""`)
+    var names []string
+    for _, loc := range jinjaIdent.FindAllStringIndex(expr, -1) {
+        before := strings.TrimRight(expr[:loc[0]], " ")
+        if strings.HasSuffix(before, ".") || strings.HasSuffix(before, "|") {
+            continue
+        }
+        if strings.HasSuffix(before, " is") || strings.HasSuffix(before, " is not") {
+            continue
+        }
+        name := expr[loc[0]:loc[1]]
+        if name[0] >= '0' && name[0] <= '9' {
+            continue
+        }
+        names = append(names, name)
+    }
+    return names
+}
+
+// Task keys whose values are Jinja expressions without {{ }}.
+var ansibleConditionKeys = map[string]bool{"when": true, "failed_when": true, "changed_when": true, "until": true}
+
+// lintPlaybook reports variables used in a playbook that nothing defines:
+// not the inventory, group_vars/host_vars, role defaults, play vars,
+// registered results, set_fact or loop variables.
+func lintPlaybook(content []byte) ([]Violation, error) {
+    var root yaml.Node
+    if err := yaml.Unmarshal(content, &root); err != nil {
+        return nil, err
+    }
+    if len(root.Content) == 0 {
+        return nil, nil
+    }
+    plays := root.Content[0]
+    if plays.Kind != yaml.SequenceNode {
+        return []Violation{{Policy: "ansible", Message: "a playbook must be a list of plays"}}, nil
+    }
+
+    defined := make(map[string]bool)
+    if inv, err := loadAnsibleInventory(""); err == nil {
+        for _, g := range inv.Groups {
+            for k := range g.Vars {
+                defined[k] = true
+            }
+        }
+        for _, h := range inv.Hosts {
+            for k := range h.Vars {
+                defined[k] = true
+            }
+        }
+    }
+    for _, pattern := range []string{"roles/*/defaults/*", "roles/*/vars/*"} {
+        matches, _ := filepath.Glob(filepath.Join(DataDir, filepath.FromSlash(pattern)))
+        for _, m := range matches {
+            var vars map[string]interface{}
+            if b, err := ioutil.ReadFile(m); err == nil && yaml.Unmarshal(b, &vars) == nil {
+                for k := range vars {
+                    defined[k] = true
+                }
+            }
+        }
+    }
+
+    // First pass: everything the playbook itself defines
+    var collect func(n *yaml.Node)
+    collect = func(n *yaml.Node) {
+        if n.Kind == yaml.MappingNode {
+            for i := 0; i+1 < len(n.Content); i += 2 {
+                key, value := n.Content[i].Value, n.Content[i+1]
+                switch key {
+                case "register":
+                    defined[value.Value] = true
+                case "vars", "set_fact", "ansible.builtin.set_fact", "vars_prompt":
+                    if value.Kind == yaml.MappingNode {
+                        for j := 0; j < len(value.Content); j += 2 {
+                            defined[value.Content[j].Value] = true
+                        }
+                    }
+                    if key == "vars_prompt" && value.Kind == yaml.SequenceNode {
+                        for _, p := range value.Content {
+                            if name := mappingValue(p, "name"); name != nil {
+                                defined[name.Value] = true
+                            }
+                        }
+                    }
+                case "loop_var":
+                    defined[value.Value] = true
+                case "vars_files", "include_vars", "ansible.builtin.include_vars":
+                    // Variables from files are only known at run time
+                    defined["*"] = true
+                }
+            }
+        }
+        for _, child := range n.Content {
+            collect(child)
+        }
+    }
+    collect(plays)
+    if defined["*"] {
+        return nil, nil
+    }
+
+    var violations []Violation
+    seen := make(map[string]bool)
+    report := func(name, pointer string, line int) {
+        if defined[name] || ansibleMagicVars[name] || strings.HasPrefix(name, "ansible_") || seen[name+pointer] {
+            return
+        }
+        seen[name+pointer] = true
+        violations = append(violations, Violation{
+            Policy:  "ansible",
+            Pointer: pointer,
+            Message: fmt.Sprintf("line %d: variable %q is not defined", line, name),
+        })
+    }
+    var check func(n *yaml.Node, pointer string, condition bool)
+    check = func(n *yaml.Node, pointer string, condition bool) {
+        switch n.Kind {
+        case yaml.ScalarNode:
+            exprs := []string{}
+            if condition {
+                exprs = append(exprs, n.Value)
+            }
+            for _, m := range jinjaExpr.FindAllStringSubmatch(n.Value, -1) {
+                exprs = append(exprs, m[1])
+            }
+            for _, expr := range exprs {
+                for _, name := range jinjaNames(expr) {
+                    report(name, pointer, n.Line)
+                }
+            }
+        case yaml.MappingNode:
+            for i := 0; i+1 < len(n.Content); i += 2 {
+                key := n.Content[i].Value
+                check(n.Content[i+1], pointer+"/"+escapePointer(key), ansibleConditionKeys[key])
+            }
+        case yaml.SequenceNode:
+            for i, child := range n.Content {
+                check(child, fmt.Sprintf("%s/%d", pointer, i), condition)
+            }
+        }
+    }
+    check(plays, "", false)
+    return violations, nil
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+    if n.Kind != yaml.MappingNode {
+        return nil
+    }
+    for i := 0; i+1 < len(n.Content); i += 2 {
+        if n.Content[i].Value == key {
+            return n.Content[i+1]
+        }
+    }
+    return nil
+}
+
+// ansibleLint handles GET /api/ansible/lint/:filename.
+func ansibleLint(c *gin.Context) {
+    if config.Ansible == nil {
+        c.JSON(404, gin.H{"error": "the Ansible profile is not enabled"})
+        return
+    }
+    dir, rel, _, err := resolvePath(c.Param("filename"))
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    content, err := fileStore(dir).Read(storageName(rel))
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+    findings := []Violation{}
+    switch {
+    case config.Ansible.isInventory(rel):
+        findings = append(findings, parseInventory(newInventory(), rel, content)...)
+    case config.Ansible.isPlaybook(rel):
+        lint, err := lintPlaybook(content)
+        if err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+        findings = append(findings, lint...)
+    default:
+        c.JSON(400, gin.H{"error": rel + " is neither an inventory nor a playbook"})
+        return
+    }
+    c.JSON(200, gin.H{"findings": findings})
+}
+
+func ansibleGate(s *SaveCandidate) []Violation {
+    if config.Ansible == nil {
+        return nil
+    }
+    switch {
+    case config.Ansible.isInventory(s.Rel):
+        return parseInventory(newInventory(), s.Rel, s.Content)
+    case config.Ansible.Strict && config.Ansible.isPlaybook(s.Rel):
+        violations, err := lintPlaybook(s.Content)
+        if err != nil {
+            return nil // validateContent already reported it
+        }
+        return violations
+    }
+    return nil
+}
+
+// Prometheus rule files and Alertmanager configs are recognised by shape
+// and checked with the upstream parsers, so broken expressions and route
+// trees are caught on save rather than at reload.
+
+// monitoringKind reports whether a document looks like a Prometheus rule
+// file ("rules") or an Alertmanager config ("alertmanager").
+func monitoringKind(doc interface{}) string {
+    m, ok := doc.(map[string]interface{})
+    if !ok {
+        return ""
+    }
+    if groups, ok := m["groups"].([]interface{}); ok && len(groups) > 0 {
+        if g, ok := groups[0].(map[string]interface{}); ok {
+            if _, ok := g["rules"]; ok {
+                return "rules"
+            }
+        }
+    }
+    _, hasRoute := m["route"]
+    _, hasReceivers := m["receivers"]
+    if hasRoute && hasReceivers {
+        return "alertmanager"
+    }
+    return ""
+}
+
+func monitoringGate(s *SaveCandidate) []Violation {
+    if s.FileType != "yaml" && s.FileType != "yml" {
+        return nil
+    }
+    doc, err := s.Document()
+    if err != nil {
+        return nil
+    }
+    var violations []Violation
+    switch monitoringKind(doc) {
+    case "rules":
+        _, errs := rulefmt.Parse(s.Content)
+        for _, err := range errs {
+            violations = append(violations, Violation{Policy: "prometheus", Message: err.Error()})
+        }
+    case "alertmanager":
+        if _, err := amconfig.Load(string(s.Content)); err != nil {
+            violations = append(violations, Violation{Policy: "alertmanager", Message: err.Error()})
+        }
+    }
+    return violations
+}
+
+// Grafana dashboards
+
+// GrafanaConfig enables pushing dashboards to Grafana on save. Paths limits
+// which dashboard files are pushed; FolderUID picks the target folder.
+type GrafanaConfig struct {
+    URL       string   `yaml:"url"`
+    Token     string   `yaml:"token"`
+    FolderUID string   `yaml:"folder_uid"`
+    Paths     []string `yaml:"paths"`
+}
+
+// grafanaDashboardSchema covers the parts of the dashboard model edit3 and
+// Grafana's import both rely on; panels may carry any other options.
+const grafanaDashboardSchema = `{
+    "$schema": "http://json-schema.org/draft-07/schema#",
+    "type": "object",
+    "required": ["title", "panels"],
+    "properties": {
+        "uid": {"type": ["string", "null"], "maxLength": 40},
+        "title": {"type": "string", "minLength": 1},
+        "schemaVersion": {"type": "integer"},
+        "tags": {"type": "array", "items": {"type": "string"}},
+        "time": {
+            "type": "object",
+            "properties": {"from": {"type": "string"}, "to": {"type": "string"}}
+        },
+        "templating": {
+            "type": "object",
+            "properties": {
+                "list": {
+                    "type": "array",
+                    "items": {
+                        "type": "object",
+                        "required": ["name", "type"],
+                        "properties": {"name": {"type": "string"}, "type": {"type": "string"}}
+                    }
+                }
+            }
+        },
+        "panels": {"type": "array", "items": {"$ref": "#/definitions/panel"}}
+    },
+    "definitions": {
+        "panel": {
+            "type": "object",
+            "required": ["type"],
+            "properties": {
+                "id": {"type": "integer"},
+                "type": {"type": "string", "minLength": 1},
+                "title": {"type": "string"},
+                "gridPos": {
+                    "type": "object",
+                    "required": ["h", "w", "x", "y"],
+                    "properties": {
+                        "h": {"type": "integer", "minimum": 1},
+                        "w": {"type": "integer", "minimum": 1, "maximum": 24},
+                        "x": {"type": "integer", "minimum": 0, "maximum": 23},
+                        "y": {"type": "integer", "minimum": 0}
+                    }
+                },
+                "targets": {"type": "array", "items": {"type": "object"}},
+                "panels": {"type": "array", "items": {"$ref": "#/definitions/panel"}}
+            }
+        }
+    }
+}`
+
+var grafanaSchema = jsonschema.MustCompileString("grafana-dashboard.json", grafanaDashboardSchema)
+
+// schemaViolations flattens a jsonschema error into one violation per
+// failing location.
+func schemaViolations(policy string, err error) []Violation {
+    ve, ok := err.(*jsonschema.ValidationError)
+    if !ok {
+        return []Violation{{Policy: policy, Message: err.Error()}}
+    }
+    var violations []Violation
+    var walk func(e *jsonschema.ValidationError)
+    walk = func(e *jsonschema.ValidationError) {
+        if len(e.Causes) == 0 {
+            violations = append(violations, Violation{Policy: policy, Pointer: e.InstanceLocation, Message: e.Message})
+        }
+        for _, cause := range e.Causes {
+            walk(cause)
+        }
+    }
+    walk(ve)
+    return violations
+}
+
+// Sample data
+
+// GenerateRequest asks for Count sample documents for a JSON Schema, given
+// inline or as a file in the data directory. With Output (e.g.
+// "fixtures/user-{n}.json") the documents are saved and committed there,
+// all or none, and never over existing files.
+type GenerateRequest struct {
+    Schema     json.RawMessage `json:"schema"`
+    SchemaFile string          `json:"schemaFile"`
+    Count      int             `json:"count"`
+    Seed       int64           `json:"seed"`
+    Output     string          `json:"output"`
+}
+
+// MaxGenerateCount bounds a single /api/generate call, and MaxSampleItems
+// the arrays in the documents it generates.
+const (
+    MaxGenerateCount = 1000
+    MaxSampleItems   = 100
+)
+
+// sampleGenerator builds documents from a schema with faker-style values.
+type sampleGenerator struct {
+    root map[string]interface{}
+    rnd  *mathrand.Rand
+}
+
+var sampleWords = []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel", "india", "juliet", "kilo", "lima"}
+var sampleNames = []string{"Ada", "Alan", "Barbara", "Dennis", "Edsger", "Grace", "Ken", "Linus", "Margaret", "Rob"}
+
+func (g *sampleGenerator) generate(schema map[string]interface{}, depth int) interface{} {
+    if ref, ok := schema["$ref"].(string); ok && strings.HasPrefix(ref, "#") && depth < 16 {
+        if m := selectPointer(g.root, strings.TrimPrefix(ref, "#")); len(m) == 1 {
+            if target, ok := m[0].Value.(map[string]interface{}); ok {
+                return g.generate(target, depth+1)
+            }
+        }
+        return nil
+    }
+    if v, ok := schema["const"]; ok {
+        return v
+    }
+    if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+        return enum[g.rnd.Intn(len(enum))]
+    }
+    if examples, ok := schema["examples"].([]interface{}); ok && len(examples) > 0 {
+        return examples[g.rnd.Intn(len(examples))]
+    }
+    for _, key := range []string{"oneOf", "anyOf"} {
+        if options, ok := schema[key].([]interface{}); ok && len(options) > 0 {
+            if option, ok := options[g.rnd.Intn(len(options))].(map[string]interface{}); ok {
+                return g.generate(option, depth+1)
+            }
+        }
+    }
+    if all, ok := schema["allOf"].([]interface{}); ok {
+        var merged interface{} = map[string]interface{}{}
+        for _, part := range all {
+            if part, ok := part.(map[string]interface{}); ok {
+                merged = mergeValues(merged, g.generate(part, depth+1))
+            }
+        }
+        return merged
+    }
+
+    typ := schema["type"]
+    if types, ok := typ.([]interface{}); ok && len(types) > 0 {
+        typ = types[0]
+        for _, t := range types {
+            if t != "null" {
+                typ = t
+                break
+            }
+        }
+    }
+    if typ == nil {
+        switch {
+        case schema["properties"] != nil:
+            typ = "object"
+        case schema["items"] != nil:
+            typ = "array"
+        default:
+            typ = "string"
+        }
+    }
+
+    switch typ {
+    case "object":
+        obj := make(map[string]interface{})
+        props, _ := schema["properties"].(map[string]interface{})
+        required := stringList(schema["required"])
+        for name, p := range props {
+            // Optional properties appear most of the time, nested ones less
+            if !containsString(required, name) && (depth > 3 || g.rnd.Intn(4) == 0) {
+                continue
+            }
+            if p, ok := p.(map[string]interface{}); ok {
+                obj[name] = g.generate(p, depth+1)
+            }
+        }
+        return obj
+    case "array":
+        lo, hi := schemaInt(schema, "minItems", 1), schemaInt(schema, "maxItems", 3)
+        if lo < 0 {
+            lo = 0
+        }
+        if hi > MaxSampleItems {
+            hi = MaxSampleItems // a longer minimum fails validation and is reported
+        }
+        items, _ := schema["items"].(map[string]interface{})
+        list := make([]interface{}, g.between(lo, hi))
+        for i := range list {
+            list[i] = g.generate(items, depth+1)
+        }
+        return list
+    case "integer":
+        return g.between(schemaInt(schema, "minimum", 0), schemaInt(schema, "maximum", 1000))
+    case "number":
+        lo, hi := schemaFloat(schema, "minimum", 0), schemaFloat(schema, "maximum", 1000)
+        return math.Round((lo+g.rnd.Float64()*(hi-lo))*100) / 100
+    case "boolean":
+        return g.rnd.Intn(2) == 1
+    case "null":
+        return nil
+    }
+    return g.sampleString(schema)
+}
+
+func (g *sampleGenerator) sampleString(schema map[string]interface{}) string {
+    word := func() string { return sampleWords[g.rnd.Intn(len(sampleWords))] }
+    name := sampleNames[g.rnd.Intn(len(sampleNames))]
+    format, _ := schema["format"].(string)
+    switch format {
+    case "email", "idn-email":
+        return fmt.Sprintf("%s.%s@example.com", strings.ToLower(name), word())
+    case "uuid":
+        b := make([]byte, 16)
+        g.rnd.Read(b)
+        b[6], b[8] = b[6]&0x0f|0x40, b[8]&0x3f|0x80
+        return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+    case "date-time":
+        return g.sampleTime().Format(time.RFC3339)
+    case "date":
+        return g.sampleTime().Format("2006-01-02")
+    case "time":
+        return g.sampleTime().Format("15:04:05")
+    case "uri", "url", "iri":
+        return fmt.Sprintf("https://%s.example.com/%s", word(), word())
+    case "hostname", "idn-hostname":
+        return fmt.Sprintf("%s-%d.example.com", word(), g.rnd.Intn(100))
+    case "ipv4":
+        return fmt.Sprintf("10.%d.%d.%d", g.rnd.Intn(256), g.rnd.Intn(256), 1+g.rnd.Intn(254))
+    case "ipv6":
+        return fmt.Sprintf("fd00::%x:%x", g.rnd.Intn(0x10000), g.rnd.Intn(0x10000))
+    }
+    s := word() + "-" + word()
+    if strings.Contains(strings.ToLower(fmt.Sprint(schema["title"], schema["description"])), "name") {
+        s = name
+    }
+    if min := schemaInt(schema, "minLength", 0); len(s) < min {
+        s += strings.Repeat("x", min-len(s))
+    }
+    if max := schemaInt(schema, "maxLength", 0); max > 0 && len(s) > max {
+        s = s[:max]
+    }
+    return s
+}
+
+func (g *sampleGenerator) sampleTime() time.Time {
+    return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(g.rnd.Int63n(int64(5 * 365 * 24 * time.Hour)))).Truncate(time.Second)
+}
+
+func schemaFloat(schema map[string]interface{}, key string, def float64) float64 {
+    switch v := schema[key].(type) {
+    case float64:
+        return v
+    case int:
+        return float64(v)
+    }
+    return def
+}
+
+func schemaInt(schema map[string]interface{}, key string, def int) int {
+    f := schemaFloat(schema, key, float64(def))
+    switch {
+    case f >= math.MaxInt:
+        return math.MaxInt
+    case f <= math.MinInt:
+        return math.MinInt
+    }
+    return int(f)
+}
+
+// between picks an integer from lo to hi, or lo when the bounds are
+// inverted. Ranges wider than rand can draw from start at lo.
+func (g *sampleGenerator) between(lo, hi int) int {
+    if hi <= lo {
+        return lo
+    }
+    span := uint64(hi) - uint64(lo)
+    if span >= math.MaxInt64 {
+        return lo + int(g.rnd.Int63())
+    }
+    return lo + int(g.rnd.Int63n(int64(span)+1))
+}
+
+// generateSamples handles POST /api/generate. Every document is checked
+// against the schema; ones that do not validate (e.g. an unsupported
+// "pattern") are reported rather than silently returned.
+func generateSamples(c *gin.Context) {
+    var req GenerateRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if req.Count == 0 {
+        req.Count = 1
+    }
+    if req.Count < 0 || req.Count > MaxGenerateCount {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", MaxGenerateCount)})
+        return
+    }
+
+    var schemaDoc interface{}
+    switch {
+    case len(req.Schema) > 0:
+        if err := json.Unmarshal(req.Schema, &schemaDoc); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+    case req.SchemaFile != "":
+        dir, rel, _, err := resolvePath(req.SchemaFile)
+        if err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return
+        }
+        content, err := fileStore(dir).Read(storageName(rel))
+        if err == nil {
+            schemaDoc, err = parseDocument(content, getFileType(req.SchemaFile))
+        }
+        if err != nil {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("%s: %v", req.SchemaFile, err)})
+            return
+        }
+    default:
+        c.JSON(400, gin.H{"error": "schema or schemaFile is required"})
+        return
+    }
+    root, ok := schemaDoc.(map[string]interface{})
+    if !ok {
+        c.JSON(400, gin.H{"error": "schema must be an object"})
+        return
+    }
+    if err := expandEnums(root); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    source, _ := json.Marshal(root)
+    compiled, err := jsonschema.CompileString("generate.json", string(source))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    seed := req.Seed
+    if seed == 0 {
+        seed = time.Now().UnixNano()
+    }
+    g := &sampleGenerator{root: root, rnd: mathrand.New(mathrand.NewSource(seed))}
+    docs := make([]interface{}, req.Count)
+    var violations []Violation
+    for i := range docs {
+        docs[i] = g.generate(root, 0)
+        if err := compiled.Validate(docs[i]); err != nil {
+            for _, v := range schemaViolations("schema", err) {
+                v.Pointer = fmt.Sprintf("/%d%s", i, v.Pointer)
+                violations = append(violations, v)
+            }
+        }
+    }
+    if req.Output == "" {
+        c.JSON(200, gin.H{"seed": seed, "documents": docs, "violations": violations})
+        return
+    }
+    if len(violations) > 0 {
+        c.JSON(422, gin.H{"error": "generated documents do not validate", "violations": violations})
+        return
+    }
+
+    // Check every fixture through the save gates, then store them together;
+    // existing files are never overwritten
+    var dir string
+    var pending []PendingFile
+    var written []string
+    for i, doc := range docs {
+        name := strings.ReplaceAll(req.Output, "{n}", strconv.Itoa(i+1))
+        if req.Count > 1 && name == req.Output {
+            c.JSON(400, gin.H{"error": "output must contain {n} when count > 1"})
+            return
+        }
+        d, rel, fullPath, err := resolvePath(name)
+        if err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return
+        }
+        if dir != "" && d != dir {
+            c.JSON(400, gin.H{"error": "all outputs must be in the same root"})
+            return
+        }
+        if _, err := fileStore(d).Stat(storageName(rel)); err == nil {
+            c.JSON(409, gin.H{"error": fmt.Sprintf("%s already exists", rel)})
+            return
+        }
+        fileType := getFileType(name)
+        content, err := marshalDocument(doc, fileType)
+        if err == nil {
+            err = validateContent(string(content), fileType)
+        }
+        if err != nil {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("%s: %v", name, err)})
+            return
+        }
+        candidate := &SaveCandidate{Filename: name, Dir: d, Rel: rel, FullPath: fullPath, FileType: fileType, Content: content, User: requestUser(c), Ticket: requestTicket(c), Context: c.Request.Context()}
+        if err := checkSaveGates(candidate); err != nil {
+            policyErrorJSON(c, err.(*PolicyError))
+            return
+        }
+        dir = d
+        pending = append(pending, PendingFile{Rel: rel, FullPath: fullPath, Content: content})
+        written = append(written, rel)
+    }
+    from := req.SchemaFile
+    if from == "" {
+        from = "inline schema"
+    }
+    if _, err := storeFiles(c.Request.Context(), dir, pending, fmt.Sprintf("Generate %d sample documents from %s", len(written), from)); err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, gin.H{"seed": seed, "files": written})
+}
+
+// grafanaDashboard returns the dashboard model in doc, unwrapping the
+// {"dashboard": ...} form the HTTP API exports; nil if doc is not one.
+func grafanaDashboard(doc interface{}) map[string]interface{} {
+    m, ok := doc.(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    if inner, ok := m["dashboard"].(map[string]interface{}); ok {
+        m = inner
+    }
+    if _, ok := m["panels"].([]interface{}); !ok {
+        return nil
+    }
+    if _, ok := m["schemaVersion"]; !ok {
+        if _, ok := m["uid"]; !ok {
+            return nil
+        }
+    }
+    return m
+}
+
+func grafanaGate(s *SaveCandidate) []Violation {
+    if s.FileType != "json" {
+        return nil
+    }
+    doc, err := s.Document()
+    if err != nil {
+        return nil
+    }
+    dash := grafanaDashboard(doc)
+    if dash == nil {
+        return nil
+    }
+    var violations []Violation
+    if err := grafanaSchema.Validate(dash); err != nil {
+        violations = append(violations, schemaViolations("grafana", err)...)
+    }
+    ids := make(map[string]string)
+    for _, p := range grafanaPanels(dash) {
+        if p.ID == "" {
+            continue
+        }
+        if other, ok := ids[p.ID]; ok {
+            violations = append(violations, Violation{Policy: "grafana", Pointer: p.Pointer, Message: fmt.Sprintf("panel id %s is also used by %s", p.ID, other)})
+        }
+        ids[p.ID] = p.Pointer
+    }
+    return violations
+}
+
+type grafanaPanel struct {
+    ID      string
+    Title   string
+    Pointer string
+    Value   map[string]interface{}
+}
+
+func (p grafanaPanel) label() string {
+    if p.Title != "" {
+        return fmt.Sprintf("panel %q", p.Title)
+    }
+    return "panel " + p.ID
+}
+
+// grafanaPanels lists panels, including those inside collapsed rows.
+func grafanaPanels(dash map[string]interface{}) []grafanaPanel {
+    var panels []grafanaPanel
+    var walk func(list []interface{}, pointer string)
+    walk = func(list []interface{}, pointer string) {
+        for i, item := range list {
+            m, ok := item.(map[string]interface{})
+            if !ok {
+                continue
+            }
+            p := grafanaPanel{Pointer: fmt.Sprintf("%s/%d", pointer, i), Value: m}
+            if id, ok := m["id"]; ok {
+                p.ID = fmt.Sprint(id)
+            }
+            p.Title, _ = m["title"].(string)
+            panels = append(panels, p)
+            if nested, ok := m["panels"].([]interface{}); ok {
+                walk(nested, p.Pointer+"/panels")
+            }
+        }
+    }
+    list, _ := dash["panels"].([]interface{})
+    walk(list, "/panels")
+    return panels
+}
+
+// grafanaChanges summarises how a dashboard changed panel by panel, e.g.
+// `panel "CPU" query changed`, instead of a line diff of the JSON.
+func grafanaChanges(before, after map[string]interface{}) []string {
+    key := func(p grafanaPanel) string {
+        if p.ID != "" {
+            return "id:" + p.ID
+        }
+        return "title:" + p.Title
+    }
+    old := make(map[string]grafanaPanel)
+    for _, p := range grafanaPanels(before) {
+        old[key(p)] = p
+    }
+
+    var changes []string
+    seen := make(map[string]bool)
+    for _, p := range grafanaPanels(after) {
+        k := key(p)
+        seen[k] = true
+        prev, ok := old[k]
+        if !ok {
+            changes = append(changes, p.label()+" added")
+            continue
+        }
+        var what []string
+        fields := make(map[string]bool)
+        for _, c := range diffDocuments(prev.Value, p.Value) {
+            field := strings.SplitN(strings.TrimPrefix(c.Pointer, "/"), "/", 2)[0]
+            if field == "panels" || fields[field] {
+                continue
+            }
+            fields[field] = true
+            switch field {
+            case "targets":
+                what = append(what, "query changed")
+            case "gridPos":
+                what = append(what, "moved")
+            case "title":
+                what = append(what, fmt.Sprintf("renamed from %q", prev.Title))
+            default:
+                what = append(what, field+" changed")
+            }
+        }
+        if len(what) > 0 {
+            changes = append(changes, p.label()+" "+strings.Join(what, ", "))
+        }
+    }
+    for _, p := range grafanaPanels(before) {
+        if !seen[key(p)] {
+            changes = append(changes, p.label()+" removed")
+        }
+    }
+    for _, field := range []string{"templating", "time", "title", "tags", "annotations"} {
+        if !reflect.DeepEqual(before[field], after[field]) {
+            changes = append(changes, "dashboard "+field+" changed")
+        }
+    }
+    return changes
+}
+
+// grafanaSummary describes a save of a dashboard for the commit message;
+// empty if the candidate is not a dashboard or nothing recognisable changed.
+func grafanaSummary(s *SaveCandidate) string {
+    doc, err := s.Document()
+    if err != nil {
+        return ""
+    }
+    after := grafanaDashboard(doc)
+    if after == nil {
+        return ""
+    }
+    previous, err := s.PreviousDocument()
+    if err != nil {
+        return ""
+    }
+    before := grafanaDashboard(previous)
+    if before == nil {
+        return ""
+    }
+    return strings.Join(grafanaChanges(before, after), "; ")
+}
+
+// grafanaDiff handles GET /api/grafana/diff/:filename?from=&to=, the
+// panel-level summary between two commits (default: the last change).
+func grafanaDiff(c *gin.Context) {
+    dir, rel, _, err := resolvePath(c.Param("filename"))
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    to := c.DefaultQuery("to", "HEAD")
+    from := c.DefaultQuery("from", to+"~1")
+    load := func(rev string) (map[string]interface{}, error) {
+        content, err := fileAtVersion(c.Request.Context(), dir, rel, rev)
+        if err != nil {
+            return nil, fmt.Errorf("%s is not available at %s", rel, rev)
+        }
+        doc, err := parseDocument(content, "json")
+        if err != nil {
+            return nil, err
+        }
+        dash := grafanaDashboard(doc)
+        if dash == nil {
+            return nil, fmt.Errorf("%s at %s is not a Grafana dashboard", rel, rev)
+        }
+        return dash, nil
+    }
+    before, err := load(from)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    after, err := load(to)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"from": from, "to": to, "changes": grafanaChanges(before, after)})
+}
+
+// grafanaNotifier pushes saved dashboards through Grafana's HTTP API.
+func grafanaNotifier(cfg *GrafanaConfig) notifier {
+    client := &http.Client{Timeout: 15 * time.Second}
+    return func(event string, data interface{}) {
+        e, ok := data.(FileEvent)
+        if event != "file.saved" || !ok || getFileType(e.Path) != "json" || !pathMatches(cfg.Paths, e.Path) {
+            return
+        }
+        doc, err := parseDocument([]byte(e.Content), "json")
+        if err != nil {
+            return
+        }
+        dash := grafanaDashboard(doc)
+        if dash == nil {
+            return
+        }
+        // Grafana matches on uid; a stale numeric id from another instance
+        // would make the import fail.
+        dash["id"] = nil
+        body, _ := json.Marshal(gin.H{
+            "dashboard": dash,
+            "folderUid": cfg.FolderUID,
+            "overwrite": true,
+            "message":   fmt.Sprintf("edit3 %s (%s)", e.Path, e.Commit),
+        })
+        go func() {
+            req, _ := http.NewRequest("POST", strings.TrimSuffix(cfg.URL, "/")+"/api/dashboards/db", bytes.NewReader(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+cfg.Token)
+            resp, err := client.Do(req)
+            if err != nil {
+                log.Printf("grafana: push %s: %v", e.Path, err)
+                return
+            }
+            defer resp.Body.Close()
+            if resp.StatusCode >= 300 {
+                msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+                log.Printf("grafana: push %s: %s %s", e.Path, resp.Status, strings.TrimSpace(string(msg)))
+            }
+        }()
+    }
+}
+
+// CI configuration
+
+// githubWorkflowSchema is a trimmed copy of the published GitHub Actions
+// workflow schema (schemastore.org/github-workflow.json): the structure
+// that breaks runs when wrong, without the per-event filter details.
+const githubWorkflowSchema = `{
+    "$schema": "http://json-schema.org/draft-07/schema#",
+    "type": "object",
+    "required": ["on", "jobs"],
+    "properties": {
+        "name": {"type": "string"},
+        "run-name": {"type": "string"},
+        "on": {"type": ["string", "array", "object"]},
+        "permissions": {"type": ["string", "object"]},
+        "env": {"type": "object"},
+        "concurrency": {"type": ["string", "object"]},
+        "defaults": {"type": "object"},
+        "jobs": {
+            "type": "object",
+            "minProperties": 1,
+            "propertyNames": {"pattern": "^[_a-zA-Z][a-zA-Z0-9_-]*$"},
+            "additionalProperties": {"$ref": "#/definitions/job"}
+        }
+    },
+    "additionalProperties": false,
+    "definitions": {
+        "stringOrList": {"type": ["string", "array"], "items": {"type": "string"}},
+        "job": {
+            "type": "object",
+            "anyOf": [{"required": ["runs-on", "steps"]}, {"required": ["uses"]}],
+            "properties": {
+                "name": {"type": "string"},
+                "needs": {"$ref": "#/definitions/stringOrList"},
+                "runs-on": {"type": ["string", "array", "object"]},
+                "uses": {"type": "string"},
+                "with": {"type": "object"},
+                "secrets": {"type": ["string", "object"]},
+                "if": {"type": ["string", "boolean", "number"]},
+                "env": {"type": "object"},
+                "timeout-minutes": {"type": ["number", "string"]},
+                "continue-on-error": {"type": ["boolean", "string"]},
+                "strategy": {"type": "object", "properties": {"matrix": {"type": ["object", "string"]}}},
+                "steps": {
+                    "type": "array",
+                    "minItems": 1,
+                    "items": {
+                        "type": "object",
+                        "anyOf": [{"required": ["uses"]}, {"required": ["run"]}],
+                        "properties": {
+                            "id": {"type": "string"},
+                            "uses": {"type": "string"},
+                            "run": {"type": "string"},
+                            "with": {"type": "object"},
+                            "env": {"type": "object"}
+                        }
+                    }
+                }
+            }
+        }
+    }
+}`
+
+// gitlabCISchema is a trimmed copy of GitLab's published CI schema
+// (gitlab.com/.../ci.json), covering the global keywords and job shape.
+const gitlabCISchema = `{
+    "$schema": "http://json-schema.org/draft-07/schema#",
+    "type": "object",
+    "properties": {
+        "stages": {"type": "array", "items": {"type": "string"}},
+        "variables": {"type": "object"},
+        "include": {"type": ["string", "array", "object"]},
+        "default": {"type": "object"},
+        "workflow": {"type": "object"},
+        "image": {"type": ["string", "object"]},
+        "services": {"type": "array"},
+        "before_script": {"$ref": "#/definitions/script"},
+        "after_script": {"$ref": "#/definitions/script"},
+        "cache": {"type": ["object", "array"]}
+    },
+    "patternProperties": {
+        "^\\.": {}
+    },
+    "additionalProperties": {"$ref": "#/definitions/job"},
+    "definitions": {
+        "script": {"type": ["string", "array"]},
+        "job": {
+            "type": "object",
+            "anyOf": [{"required": ["script"]}, {"required": ["trigger"]}, {"required": ["extends"]}, {"required": ["run"]}],
+            "properties": {
+                "stage": {"type": "string"},
+                "script": {"$ref": "#/definitions/script"},
+                "extends": {"type": ["string", "array"]},
+                "needs": {"type": "array"},
+                "dependencies": {"type": "array", "items": {"type": "string"}},
+                "when": {"enum": ["on_success", "on_failure", "always", "manual", "delayed", "never"]},
+                "rules": {"type": "array"},
+                "only": {"type": ["string", "array", "object"]},
+                "except": {"type": ["string", "array", "object"]},
+                "allow_failure": {"type": ["boolean", "object"]},
+                "timeout": {"type": "string"},
+                "retry": {"type": ["integer", "object"]},
+                "parallel": {"type": ["integer", "object"]}
+            }
+        }
+    }
+}`
+
+var (
+    githubSchema = jsonschema.MustCompileString("github-workflow.json", githubWorkflowSchema)
+    gitlabSchema = jsonschema.MustCompileString("gitlab-ci.json", gitlabCISchema)
+)
+
+// gitlabKeywords are top-level .gitlab-ci.yml keys that are not jobs.
+var gitlabKeywords = map[string]bool{
+    "stages": true, "variables": true, "include": true, "default": true, "workflow": true,
+    "image": true, "services": true, "before_script": true, "after_script": true, "cache": true,
+}
+
+func ciGate(s *SaveCandidate) []Violation {
+    rel := filepath.ToSlash(s.Rel)
+    isGitHub := pathMatches([]string{"**/.github/workflows/*.yml", "**/.github/workflows/*.yaml"}, rel)
+    isGitLab := path.Base(rel) == ".gitlab-ci.yml"
+    if !isGitHub && !isGitLab {
+        return nil
+    }
+    doc, err := s.Document()
+    if err != nil || doc == nil {
+        return nil
+    }
+    if isGitHub {
+        return lintGitHubWorkflow(doc)
+    }
+    return lintGitLabCI(doc)
+}
+
+func lintGitHubWorkflow(doc interface{}) []Violation {
+    var violations []Violation
+    if err := githubSchema.Validate(doc); err != nil {
+        violations = append(violations, schemaViolations("github-actions", err)...)
+    }
+    root, _ := doc.(map[string]interface{})
+    jobs, _ := root["jobs"].(map[string]interface{})
+    for name, j := range jobs {
+        job, _ := j.(map[string]interface{})
+        for i, need := range stringList(job["needs"]) {
+            if _, ok := jobs[need]; !ok {
+                violations = append(violations, Violation{
+                    Policy:  "github-actions",
+                    Pointer: fmt.Sprintf("/jobs/%s/needs/%d", escapePointer(name), i),
+                    Message: fmt.Sprintf("job %s needs %q, which is not defined", name, need),
+                })
+            }
+        }
+    }
+    on, _ := root["on"].(map[string]interface{})
+    schedules, _ := on["schedule"].([]interface{})
+    for i, item := range schedules {
+        entry, _ := item.(map[string]interface{})
+        expr, _ := entry["cron"].(string)
+        if _, err := cron.ParseStandard(expr); err != nil {
+            violations = append(violations, Violation{
+                Policy:  "github-actions",
+                Pointer: fmt.Sprintf("/on/schedule/%d/cron", i),
+                Message: fmt.Sprintf("invalid cron %q: %v", expr, err),
+            })
+        }
+    }
+    return violations
+}
+
+func lintGitLabCI(doc interface{}) []Violation {
+    var violations []Violation
+    if err := gitlabSchema.Validate(doc); err != nil {
+        violations = append(violations, schemaViolations("gitlab-ci", err)...)
+    }
+    root, _ := doc.(map[string]interface{})
+    stages := []string{".pre", "build", "test", "deploy", ".post"}
+    if list, ok := root["stages"]; ok {
+        stages = append([]string{".pre", ".post"}, stringList(list)...)
+    }
+    for name, j := range root {
+        job, ok := j.(map[string]interface{})
+        if !ok || gitlabKeywords[name] || strings.HasPrefix(name, ".") {
+            continue
+        }
+        pointer := "/" + escapePointer(name)
+        if stage, ok := job["stage"].(string); ok && !containsString(stages, stage) {
+            violations = append(violations, Violation{
+                Policy:  "gitlab-ci",
+                Pointer: pointer + "/stage",
+                Message: fmt.Sprintf("job %s uses stage %q, which is not in stages", name, stage),
+            })
+        }
+        needs, _ := job["needs"].([]interface{})
+        for i, n := range needs {
+            need, _ := n.(string)
+            if m, ok := n.(map[string]interface{}); ok {
+                if _, external := m["project"]; external {
+                    continue
+                }
+                need, _ = m["job"].(string)
+            }
+            if _, ok := root[need]; need != "" && !ok {
+                violations = append(violations, Violation{
+                    Policy:  "gitlab-ci",
+                    Pointer: fmt.Sprintf("%s/needs/%d", pointer, i),
+                    Message: fmt.Sprintf("job %s needs %q, which is not defined", name, need),
+                })
+            }
+        }
+        for i, dep := range stringList(job["dependencies"]) {
+            if _, ok := root[dep]; !ok {
+                violations = append(violations, Violation{
+                    Policy:  "gitlab-ci",
+                    Pointer: fmt.Sprintf("%s/dependencies/%d", pointer, i),
+                    Message: fmt.Sprintf("job %s depends on %q, which is not defined", name, dep),
+                })
+            }
+        }
+    }
+    return violations
+}
+
+// stringList accepts a string or a list of strings.
+func stringList(v interface{}) []string {
+    switch v := v.(type) {
+    case string:
+        return []string{v}
+    case []interface{}:
+        var list []string
+        for _, item := range v {
+            if s, ok := item.(string); ok {
+                list = append(list, s)
+            }
+        }
+        return list
+    }
+    return nil
+}
+
+// External syntax checks
+
+// ExternalCheck runs a syntax-checking binary (nginx -t, haproxy -c, ...)
+// against a candidate file in a throwaway directory. In Command {file} is
+// the file to check and {dir} the sandbox. When Standalone is set and does
+// not match, the candidate is a snippet and is checked through Wrapper, a
+// minimal main config that includes {file}. Includes matches the include
+// directives of the format, its first group naming files relative to the
+// candidate, which are copied beside it. Checkers read and run what the
+// config names, so content matching Refuse (directives loading code, or
+// naming paths outside the sandbox) is refused without running them.
+// Checks whose binary is not installed are skipped.
+type ExternalCheck struct {
+    Name       string   `yaml:"name"`
+    Paths      []string `yaml:"paths"`
+    Command    []string `yaml:"command"`
+    Standalone string   `yaml:"standalone"`
+    Wrapper    string   `yaml:"wrapper"`
+    Includes   string   `yaml:"includes"`
+    Refuse     string   `yaml:"refuse"`
+}
+
+// ExternalCheckTimeout bounds a single checker run unless timeouts.external
+// says otherwise.
+const ExternalCheckTimeout = 10 * time.Second
+
+// builtinChecks are the checks config.Checks may turn on by name alone.
+var builtinChecks = []ExternalCheck{
+    {
+        Name:       "nginx",
+        Paths:      []string{"**/nginx.conf", "**/nginx/**/*.conf", "**/conf.d/*.conf", "**/sites-available/*", "**/sites-enabled/*"},
+        Command:    []string{"nginx", "-t", "-q", "-p", "{dir}", "-c", "{file}"},
+        Standalone: `(?m)^\s*(events|http)\s*\{`,
+        Wrapper:    "events {}\nhttp {\n    include {file};\n}\n",
+        Includes:   `(?m)(?:^|[;{}])\s*include\s+["']?([^;"'\s]+)`,
+        Refuse:     `(?m)(^|[;{}])\s*((load_module|perl_\w+|js_\w+)\s|(\w+_log|pid|lock_file|include|ssl_\w+|auth_basic_user_file|\w+_temp_path|working_directory|geoip\w*)\s+["']?(/|\S*\.\./))`,
+    },
+    {
+        Name:    "haproxy",
+        Paths:   []string{"**/haproxy.cfg", "**/haproxy/**/*.cfg"},
+        Command: []string{"haproxy", "-c", "-q", "-f", "{file}"},
+        Refuse:  `(?m)^\s*(lua-\S+|external-check)\s|(^|\s)(crt|crt-list|ca-file|crl-file|ca-base|crt-base|errorfile\s+\d+|server-state-file|pidfile)\s+["']?(/|\S*\.\./)`,
+    },
+}
+
+// externalChecks returns the configured checks, those named after a
+// built-in one taking its settings for the fields they leave out.
+func externalChecks() []ExternalCheck {
+    var checks []ExternalCheck
+    for _, check := range config.Checks {
+        for _, builtin := range builtinChecks {
+            if builtin.Name != check.Name {
+                continue
+            }
+            if len(check.Paths) == 0 {
+                check.Paths = builtin.Paths
+            }
+            if len(check.Command) == 0 {
+                check.Command = builtin.Command
+            }
+            if check.Standalone == "" {
+                check.Standalone, check.Wrapper = builtin.Standalone, builtin.Wrapper
+            }
+            if check.Includes == "" {
+                check.Includes = builtin.Includes
+            }
+            if check.Refuse == "" {
+                check.Refuse = builtin.Refuse
+            }
+        }
+        checks = append(checks, check)
+    }
+    return checks
+}
+
+func externalGate(s *SaveCandidate) []Violation {
+    rel := filepath.ToSlash(s.Rel)
+    var violations []Violation
+    for _, check := range externalChecks() {
+        if len(check.Command) == 0 || !pathMatches(check.Paths, rel) {
+            continue
+        }
+        if _, err := exec.LookPath(check.Command[0]); err != nil {
+            continue
+        }
+        output, err := runExternalCheck(s.ctx(), check, s)
+        if err == nil {
+            continue
+        }
+        if output == "" {
+            output = err.Error()
+        }
+        for _, line := range strings.Split(output, "\n") {
+            if line = strings.TrimSpace(line); line != "" {
+                violations = append(violations, Violation{Policy: check.Name, Message: line})
+            }
+        }
+    }
+    return violations
+}
+
+// Validation profiles, enabled with validation.profiles.
+const (
+    ProfileDockerfile = "dockerfile"
+    ProfileShell      = "shell"
+)
+
+// shellcheck is the shell profile's adapter for shellcheck, used when it is
+// installed. Style notes are left out; warnings and errors refuse the save.
+var shellcheck = ExternalCheck{
+    Name:    "shellcheck",
+    Command: []string{"shellcheck", "--format=gcc", "--severity=warning", "{file}"},
+}
+
+func profileEnabled(name string) bool {
+    return containsString(config.Validation.Profiles, name)
+}
+
+// profileGate runs the enabled profiles: the Dockerfile linter, and for
+// shell scripts the embedded shfmt parser followed by shellcheck.
+func profileGate(s *SaveCandidate) []Violation {
+    var violations []Violation
+    switch s.FileType {
+    case "dockerfile":
+        if !profileEnabled(ProfileDockerfile) {
+            return nil
+        }
+        for _, issue := range engine.LintDockerfile(s.Content) {
+            violations = append(violations, Violation{Policy: ProfileDockerfile, Message: issue.String()})
+        }
+    case "sh", "bash":
+        if !profileEnabled(ProfileShell) {
+            return nil
+        }
+        if err := engine.CheckShell(s.Rel, s.Content); err != nil {
+            // shellcheck would only repeat the syntax error
+            return []Violation{{Policy: ProfileShell, Message: err.Error()}}
+        }
+        if _, err := exec.LookPath(shellcheck.Command[0]); err != nil {
+            return nil
+        }
+        output, err := runExternalCheck(s.ctx(), shellcheck, s)
+        if err == nil {
+            return nil
+        }
+        if output == "" {
+            output = err.Error()
+        }
+        for _, line := range strings.Split(output, "\n") {
+            if line = strings.TrimSpace(line); line != "" {
+                violations = append(violations, Violation{Policy: shellcheck.Name, Message: line})
+            }
+        }
+    }
+    return violations
+}
+
+// runExternalCheck writes the candidate and the files it includes to a
+// temp sandbox, so relative includes resolve, and runs the checker.
+func runExternalCheck(ctx context.Context, check ExternalCheck, s *SaveCandidate) (string, error) {
+    var refuse *regexp.Regexp
+    if check.Refuse != "" {
+        var err error
+        if refuse, err = regexp.Compile(check.Refuse); err != nil {
+            return "", fmt.Errorf("check %s: %v", check.Name, err)
+        }
+    }
+    if refuse != nil {
+        if m := refuse.Find(s.Content); m != nil {
+            return "", fmt.Errorf("%s: %q is not run through the checker", filepath.ToSlash(s.Rel), strings.TrimSpace(string(m)))
+        }
+    }
+    sandbox, err := ioutil.TempDir("", "edit3-check-")
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(sandbox)
+
+    file := filepath.Join(sandbox, filepath.Base(s.FullPath))
+    if err := ioutil.WriteFile(file, s.Content, 0644); err != nil {
+        return "", err
+    }
+    if err := copyIncludes(check, refuse, filepath.Dir(s.FullPath), sandbox, s.Content); err != nil {
+        return "", err
+    }
+    os.MkdirAll(filepath.Join(sandbox, "logs"), 0755)
+
+    if check.Wrapper != "" && check.Standalone != "" {
+        standalone, err := regexp.Compile(check.Standalone)
+        if err != nil {
+            return "", fmt.Errorf("check %s: %v", check.Name, err)
+        }
+        if !standalone.Match(s.Content) {
+            wrapper := filepath.Join(sandbox, ".edit3-wrapper")
+            if err := ioutil.WriteFile(wrapper, []byte(strings.ReplaceAll(check.Wrapper, "{file}", file)), 0644); err != nil {
+                return "", err
+            }
+            file = wrapper
+        }
+    }
+
+    args := make([]string, len(check.Command))
+    for i, arg := range check.Command {
+        args[i] = strings.NewReplacer("{file}", file, "{dir}", sandbox).Replace(arg)
+    }
+    limit := timeout(config.Timeouts.External, ExternalCheckTimeout)
+    ctx, cancel := context.WithTimeout(ctx, limit)
+    defer cancel()
+    cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+    cmd.Dir = sandbox
+    // Stop waiting for output held open by the checker's own children
+    cmd.WaitDelay = time.Second
+    output, err := cmd.CombinedOutput()
+    switch ctx.Err() {
+    case context.DeadlineExceeded:
+        return "", fmt.Errorf("%s timed out after %s", check.Name, limit)
+    case context.Canceled:
+        return "", fmt.Errorf("%s cancelled", check.Name)
+    }
+    return strings.TrimSpace(strings.ReplaceAll(string(output), sandbox+string(filepath.Separator), "")), err
+}
+
+// MaxCheckIncludes bounds the files copied into a check's sandbox.
+const MaxCheckIncludes = 256
+
+// copyIncludes copies the regular files content includes, and those they
+// include in turn, from src into dst. Names leaving src, symlinks and the
+// candidate itself are skipped; a file matching refuse stops the check like
+// the candidate would.
+func copyIncludes(check ExternalCheck, refuse *regexp.Regexp, src, dst string, content []byte) error {
+    if check.Includes == "" {
+        return nil
+    }
+    includes, err := regexp.Compile(check.Includes)
+    if err != nil {
+        return fmt.Errorf("check %s: %v", check.Name, err)
+    }
+    seen := make(map[string]bool)
+    pending := [][]byte{content}
+    for len(pending) > 0 && len(seen) < MaxCheckIncludes {
+        text := pending[0]
+        pending = pending[1:]
+        for _, m := range includes.FindAllSubmatch(text, -1) {
+            if len(m) < 2 || filepath.IsAbs(string(m[1])) {
+                continue
+            }
+            matches, _ := filepath.Glob(filepath.Join(src, filepath.FromSlash(string(m[1]))))
+            for _, p := range matches {
+                rel, err := filepath.Rel(src, p)
+                if err != nil || seen[rel] || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+                    continue
+                }
+                seen[rel] = true
+                target := filepath.Join(dst, rel)
+                info, err := os.Lstat(p)
+                if _, exists := os.Lstat(target); err != nil || !info.Mode().IsRegular() || exists == nil {
+                    continue
+                }
+                data, err := ioutil.ReadFile(p)
+                if err != nil {
+                    return err
+                }
+                if refuse != nil {
+                    if m := refuse.Find(data); m != nil {
+                        return fmt.Errorf("%s: %q is not run through the checker", filepath.ToSlash(rel), strings.TrimSpace(string(m)))
+                    }
+                }
+                if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+                    return err
+                }
+                if err := ioutil.WriteFile(target, data, 0644); err != nil {
+                    return err
+                }
+                pending = append(pending, data)
+            }
+        }
+    }
+    return nil
+}
+
+// serve prepares the data directories and runs the editor for openFile in the
+// given mode: "" for the browser, "gui" for a native window or "tui" for the
+// terminal.
+func serve(openFile, mode string) int {
+    configure()
+    cleanup := func() {}
+    if inMemory {
+        var err error
+        if cleanup, err = useScratchDir(); err != nil {
+            log.Fatalf("edit3: %v", err)
+        }
+        defer cleanup()
+        log.Printf("edit3: in-memory mode, changes are discarded on exit")
+    }
+    if err := startNotifiers(); err != nil {
+        log.Fatalf("edit3: %v", err)
+    }
+
+    // Setup. Creating the repositories and upgrading the data directory
+    // write to git, which only the leader may do: with replicas the
+    // election comes first, and a follower does this once it is elected.
+    ensureDataDir()
+    prepare := func() {
+        initGit(DataDir)
+        for _, root := range roots() {
+            versionRoot(root)
+        }
+        if err := migrateDataDir(context.Background()); err != nil {
+            log.Fatalf("edit3: %v", err)
+        }
+    }
+    if config.Cluster != nil && mode == "" {
+        replicas.elected = prepare
+        if err := replicas.start(); err != nil {
+            log.Printf("cluster: %v", err)
+            return 1
+        }
+    } else {
+        prepare()
+    }
+    if err := changeFeed.open(); err != nil {
+        log.Printf("events: %v", err)
+    }
+
+    if mode == "tui" {
+        if err := runTUI(openFile); err != nil {
+            log.Fatalf("edit3: %v", err)
+        }
+        return 0
+    }
+
+    r := newRouter()
+
+    if mode == "gui" {
+        if err := runGUI(r, openFile); err != nil {
+            log.Fatalf("edit3: %v", err)
+        }
+        return 0
+    }
+
+    // Reuse a server already running for this data directory, unless
+    // replicas are meant to share it
+    if inst := findInstance(); inst != nil && config.Cluster == nil {
+        if err := openInInstance(inst, openFile); err != nil {
+            log.Printf("edit3: %v", err)
+            return 1
+        }
+        return 0
+    }
+
+    // With a certificate the server speaks HTTPS, and HTTP/2 to clients
+    // that negotiate it
+    cert, key := os.Getenv("EDIT3_TLS_CERT"), os.Getenv("EDIT3_TLS_KEY")
+    if (cert == "") != (key == "") {
+        log.Printf("edit3: EDIT3_TLS_CERT and EDIT3_TLS_KEY must be set together")
+        return 1
+    }
+    ln, err := listen(envOr("EDIT3_PORT", Port))
+    if err != nil {
+        log.Printf("edit3: %v", err)
+        return 1
+    }
+    absData, _ := filepath.Abs(DataDir)
+    inst := &instanceInfo{
+        PID:     os.Getpid(),
+        Port:    ln.Addr().(*net.TCPAddr).Port,
+        DataDir: absData,
+        Token:   randomToken(),
+        Version: Version,
+        Started: time.Now().Format(time.RFC3339),
+        TLS:     cert != "",
+    }
+    registerInstanceRoutes(r, inst)
+    if c := config.Cache; c != nil {
+        reads.client = cache.NewRedis(c.Redis, c.Password, c.DB)
+    }
+    go runScheduler()
+    go startIndex()
+    if config.Mirror != nil && config.Mirror.URL != "" && featureEnabled(FeatureRemoteSync) {
+        go primaryMirror.run()
+    }
+    lockPath, err := writeInstance(inst)
+    if err != nil {
+        log.Printf("edit3: cannot write instance lockfile: %v", err)
+    }
+    defer os.Remove(lockPath)
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-sig
+        os.Remove(lockPath)
+        cleanup()
+        os.Exit(0)
+    }()
+
+    fmt.Printf(`
+╔══════════════════════════════════════════╗
+║         Edit3 - Visual Data Editor        ║
+║            Go Gin Edition                 ║
+║                                          ║
+║  Server running on %-22s║
+║                                          ║
+║  Usage:                                  ║
+║  edit3 file.json                        ║
+║  edit3 file.yaml                        ║
+║  edit3 file.xml                         ║
+║  edit3 gui file.json                    ║
+╚══════════════════════════════════════════╝
+    `+"\n", inst.url())
+
+    if openFile != "" {
+        url := inst.url() + "/?file=" + neturl.QueryEscape(openFile)
+        fmt.Println("Editing:", openFile)
+        fmt.Println("Editor running at:", url)
+        go openBrowser(url)
+    }
+
+    if inst.TLS {
+        err = http.ServeTLS(ln, r, cert, key)
+    } else {
+        err = http.Serve(ln, r)
+    }
+    if err != nil {
+        log.Printf("edit3: %v", err)
+        return 1
+    }
+    return 0
+}
+
+// instanceInfo is written to a lockfile while a server runs so later
+// invocations for the same data directory can find it instead of starting
+// another one. Token authenticates those loopback requests.
+type instanceInfo struct {
+    PID     int    `json:"pid"`
+    Port    int    `json:"port"`
+    DataDir string `json:"dataDir"`
+    Token   string `json:"token"`
+    Version string `json:"version"`
+    Started string `json:"started"`
+    TLS     bool   `json:"tls,omitempty"`
+}
+
+func (i *instanceInfo) url() string {
+    if i.TLS {
+        return fmt.Sprintf("https://localhost:%d", i.Port)
+    }
+    return fmt.Sprintf("http://localhost:%d", i.Port)
+}
+
+// instanceLockPath returns the lockfile for the current data directory under
+// the user config dir, e.g. ~/.config/edit3/instances/<hash>.json.
+func instanceLockPath() (string, error) {
+    configDir, err := os.UserConfigDir()
+    if err != nil {
+        return "", err
+    }
+    abs, err := filepath.Abs(DataDir)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256([]byte(abs))
+    return filepath.Join(configDir, "edit3", "instances", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// findInstance returns the running instance serving DataDir, removing the
+// lockfile if its server no longer answers.
+func findInstance() *instanceInfo {
+    path, err := instanceLockPath()
+    if err != nil {
+        return nil
+    }
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil
+    }
+    var info instanceInfo
+    if err := json.Unmarshal(content, &info); err != nil {
+        os.Remove(path)
+        return nil
+    }
+    var status instanceInfo
+    if err := instanceRequest(&info, "GET", "/api/instance", nil, &status); err != nil || status.PID != info.PID {
+        os.Remove(path)
+        return nil
+    }
+    return &info
+}
+
+func instanceRequest(info *instanceInfo, method, path string, body interface{}, out interface{}) error {
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(data)
+    }
+    req, err := http.NewRequest(method, info.url()+path, reader)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Edit3-Token", info.Token)
+    client := &http.Client{Timeout: 3 * time.Second}
+    if info.TLS {
+        // Our own server on loopback, often with a self-signed certificate;
+        // the token is what authenticates it
+        client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+    }
+    if out != nil {
+        return json.NewDecoder(resp.Body).Decode(out)
+    }
+    return nil
+}
+
+func writeInstance(info *instanceInfo) (string, error) {
+    path, err := instanceLockPath()
+    if err != nil {
+        return "", err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return "", err
+    }
+    data, _ := json.MarshalIndent(info, "", "  ")
+    return path, ioutil.WriteFile(path, data, 0600)
+}
+
+// listen binds the configured port, falling back to the next few ports and
+// then to any free one when it is taken.
+func listen(port string) (net.Listener, error) {
+    ln, err := net.Listen("tcp", port)
+    if err == nil {
+        return ln, nil
+    }
+    host, p, splitErr := net.SplitHostPort(port)
+    if splitErr != nil {
+        return nil, err
+    }
+    if n, convErr := strconv.Atoi(p); convErr == nil {
+        for i := 1; i <= 10; i++ {
+            if ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(n+i))); err == nil {
+                return ln, nil
+            }
+        }
+    }
+    return net.Listen("tcp", net.JoinHostPort(host, "0"))
+}
+
+// instanceAuth only lets through requests carrying the lockfile token.
+func instanceAuth(token string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if c.GetHeader("X-Edit3-Token") != token {
+            c.AbortWithStatusJSON(403, gin.H{"error": "invalid instance token"})
+            return
+        }
+        c.Next()
+    }
+}
+
+type instanceOpenRequest struct {
+    Path string `json:"path"`
+}
+
+// registerInstanceRoutes exposes the endpoints later edit3 invocations use to
+// talk to this server.
+func registerInstanceRoutes(r *gin.Engine, info *instanceInfo) {
+    g := r.Group("/api/instance", instanceAuth(info.Token))
+    g.GET("", func(c *gin.Context) {
+        c.JSON(200, info)
+    })
+    g.POST("/roots", func(c *gin.Context) {
+        var req instanceOpenRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+        abs, err := addAllowedRoot(req.Path)
+        if err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+        root, _, _, err := resolvePath(abs)
+        if err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return
+        }
+        versionRoot(root)
+        filesIndex.addRoot(root)
+        c.JSON(200, gin.H{"path": abs})
+    })
+    g.POST("/open", func(c *gin.Context) {
+        var req instanceOpenRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+        if _, _, _, err := resolvePath(req.Path); err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(200, gin.H{"active": opened.push(req.Path)})
+    })
+}
+
+// openInInstance hands openFile to an already running server: extra roots are
+// registered with it and the file opens as a new tab in the editor window
+// that is already open, or in a new browser window if there is none.
+func openInInstance(info *instanceInfo, openFile string) error {
+    if filepath.IsAbs(openFile) {
+        var resp instanceOpenRequest
+        if err := instanceRequest(info, "POST", "/api/instance/roots", instanceOpenRequest{Path: openFile}, &resp); err != nil {
+            return err
+        }
+    }
+    fmt.Printf("Using running edit3 instance (pid %d)\n", info.PID)
+    if openFile != "" {
+        var resp struct {
+            Active bool `json:"active"`
+        }
+        if err := instanceRequest(info, "POST", "/api/instance/open", instanceOpenRequest{Path: openFile}, &resp); err != nil {
+            return err
+        }
+        if resp.Active {
+            fmt.Println("Opened", openFile, "in the existing editor window")
+            return nil
+        }
+    }
+    url := info.url() + "/"
+    if openFile != "" {
+        url += "?file=" + neturl.QueryEscape(openFile)
+    }
+    fmt.Println("Editor running at:", url)
+    openBrowser(url)
+    return nil
+}
+
+func randomToken() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        log.Fatalf("edit3: %v", err)
+    }
+    return hex.EncodeToString(b)
+}
+
+// openRequest asks the browser UI to open a file in a new tab.
+type openRequest struct {
+    ID   int    `json:"id"`
+    File string `json:"file"`
+}
+
+// openQueue hands files opened from the command line to editor pages that
+// long-poll /api/opened, so one server and one window serve many files.
+type openQueue struct {
+    mu       sync.Mutex
+    requests []openRequest
+    nextID   int
+    lastPoll time.Time
+    notify   chan struct{}
+}
+
+var opened = &openQueue{nextID: 1, notify: make(chan struct{})}
+
+// push queues file and reports whether an editor page is currently polling.
+func (q *openQueue) push(file string) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.requests = append(q.requests, openRequest{ID: q.nextID, File: file})
+    q.nextID++
+    if len(q.requests) > 100 {
+        q.requests = q.requests[len(q.requests)-100:]
+    }
+    close(q.notify)
+    q.notify = make(chan struct{})
+    return time.Since(q.lastPoll) < 30*time.Second
+}
+
+func (q *openQueue) since(after int) ([]openRequest, int, chan struct{}) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.lastPoll = time.Now()
+    var pending []openRequest
+    for _, req := range q.requests {
+        if req.ID > after {
+            pending = append(pending, req)
+        }
+    }
+    return pending, q.nextID - 1, q.notify
+}
+
+// Mirroring
+
+// DefaultMirrorInterval is how often a primary checks that its standby has
+// caught up when no saves prompt it.
+const DefaultMirrorInterval = 30 * time.Second
+
+// MirrorConfig replicates the data directory's commits to a standby edit3,
+// kept as a warm failover. On the primary URL is the standby's address;
+// the standby sets only Token, which both sides send as X-Edit3-Token.
+// Commits are pushed as git bundles after every save and, to catch up after
+// downtime, every Interval. The standby must not be edited while it mirrors:
+// diverged histories stop replication until resolved by hand.
+type MirrorConfig struct {
+    URL      string        `yaml:"url"`
+    Token    string        `yaml:"token"`
+    Interval time.Duration `yaml:"interval"`
+}
+
+// MirrorStatus is the primary's view of replication.
+type MirrorStatus struct {
+    URL      string    `json:"url"`
+    Head     string    `json:"head,omitempty"`     // ours
+    Standby  string    `json:"standby,omitempty"`  // theirs, as last seen
+    LastSync time.Time `json:"lastSync,omitempty"` // last time both matched
+    Error    string    `json:"error,omitempty"`
+}
+
+type mirror struct {
+    mu     sync.Mutex
+    status MirrorStatus
+    wake   chan struct{}
+}
+
+var primaryMirror = &mirror{wake: make(chan struct{}, 1)}
+
+// kick is the mirror's notifier: any event may mean a new commit.
+func (m *mirror) kick(event string, data interface{}) {
+    select {
+    case m.wake <- struct{}{}:
+    default:
+    }
+}
+
+// run pushes to the standby whenever kicked or Interval passes.
+func (m *mirror) run() {
+    interval := timeout(config.Mirror.Interval, DefaultMirrorInterval)
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        var err error
+        if replicas.isLeader() {
+            ctx, cancel := context.WithTimeout(context.Background(), timeout(config.Timeouts.Request, RequestTimeout))
+            err = m.sync(ctx)
+            cancel()
+        }
+        m.mu.Lock()
+        if err != nil {
+            if m.status.Error != err.Error() {
+                log.Printf("mirror: %v", err)
+            }
+            m.status.Error = err.Error()
+        } else {
+            m.status.Error = ""
+        }
+        m.mu.Unlock()
+        select {
+        case <-m.wake:
+        case <-ticker.C:
+        }
+    }
+}
+
+// call makes an authenticated request to the standby and returns the head
+// it reports.
+func (m *mirror) call(ctx context.Context, method, path string, body io.Reader) (string, error) {
+    req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(config.Mirror.URL, "/")+path, body)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("X-Edit3-Token", config.Mirror.Token)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    var reply struct {
+        Head  string `json:"head"`
+        Error string `json:"error"`
+    }
+    json.NewDecoder(resp.Body).Decode(&reply)
+    if resp.StatusCode != 200 {
+        if reply.Error == "" {
+            reply.Error = resp.Status
+        }
+        return "", fmt.Errorf("standby: %s", reply.Error)
+    }
+    return reply.Head, nil
+}
+
+// sync brings the standby up to our HEAD, sending only the commits it lacks.
+func (m *mirror) sync(ctx context.Context) error {
+    head, err := store.Head(ctx, DataDir)
+    if err != nil || head == "" {
+        return err
+    }
+    standby, err := m.call(ctx, "GET", "/api/mirror/head", nil)
+    if err != nil {
+        return err
+    }
+    m.mu.Lock()
+    m.status.URL, m.status.Head, m.status.Standby = config.Mirror.URL, head, standby
+    m.mu.Unlock()
+    if standby != "" && !commitHash.MatchString(standby) {
+        return fmt.Errorf("standby reported %q as its head, which is not a commit", standby)
+    }
+    if standby != head {
+        if standby != "" && !store.IsAncestor(ctx, DataDir, standby, head) {
+            return fmt.Errorf("standby is at %s, which is not in this history: %w", shortCommit(standby), store.ErrDiverged)
+        }
+        bundle, err := store.Bundle(ctx, DataDir, standby)
+        if err != nil {
+            return err
+        }
+        if standby, err = m.call(ctx, "POST", "/api/mirror/push", bytes.NewReader(bundle)); err != nil {
+            return err
+        }
+        log.Printf("mirror: standby at %s", shortCommit(standby))
+    }
+    m.mu.Lock()
+    m.status.Standby, m.status.LastSync = standby, time.Now().UTC()
+    m.mu.Unlock()
+    return nil
+}
+
+// getMirrorStatus handles GET /api/mirror/status on a primary.
+func getMirrorStatus(c *gin.Context) {
+    if config.Mirror == nil || config.Mirror.URL == "" {
+        c.JSON(404, gin.H{"error": "this instance does not mirror to a standby"})
+        return
+    }
+    primaryMirror.mu.Lock()
+    defer primaryMirror.mu.Unlock()
+    c.JSON(200, primaryMirror.status)
+}
+
+// registerMirrorRoutes lets a primary replicate into this instance when it
+// is configured as a standby: a mirror token but no URL of its own.
+func registerMirrorRoutes(r *gin.Engine) {
+    if config.Mirror == nil || config.Mirror.Token == "" || config.Mirror.URL != "" {
+        return
+    }
+    g := r.Group("/api/mirror", requireFeature(FeatureRemoteSync), instanceAuth(config.Mirror.Token))
+    g.GET("/head", func(c *gin.Context) {
+        head, err := store.Head(c.Request.Context(), DataDir)
+        if err != nil {
+            storeErrorJSON(c, err)
+            return
+        }
+        c.JSON(200, gin.H{"head": head})
+    })
+    g.POST("/push", func(c *gin.Context) {
+        // the merge must not stop halfway when the primary hangs up
+        ctx, cancel := writeContext(c.Request.Context())
+        defer cancel()
+        head, err := store.Unbundle(ctx, DataDir, c.Request.Body)
+        if errors.Is(err, store.ErrDiverged) {
+            c.JSON(409, gin.H{"error": "this standby has commits the primary does not"})
+            return
+        }
+        if err != nil {
+            storeErrorJSON(c, err)
+            return
+        }
+        notify("mirror.received", gin.H{"head": head})
+        c.JSON(200, gin.H{"head": head})
+    })
+}
+
+// Read cache
+
+// DefaultCacheTTL is how long cached reads live unless configured.
+const DefaultCacheTTL = time.Hour
+
+// CacheDownTime is how long reads bypass Redis after it fails.
+const CacheDownTime = 10 * time.Second
+
+// CacheConfig puts Redis in front of file reads and history. Entries are
+// keyed by a file's size and modification time or by a commit hash, so
+// replicas can share them; as a save can leave a file's size and time as
+// they were, it drops the file's entries. While Redis is unreachable reads
+// go to the volume and git as before.
+type CacheConfig struct {
+    Redis    string        `yaml:"redis"` // host:port
+    Password string        `yaml:"password"`
+    DB       int           `yaml:"db"`
+    Prefix   string        `yaml:"prefix"` // default edit3:
+    TTL      time.Duration `yaml:"ttl"`
+}
+
+type readCache struct {
+    client *cache.Redis
+    mu     sync.Mutex
+    down   time.Time // Redis is skipped until then
+}
+
+var reads = &readCache{}
+
+func (rc *readCache) key(parts ...string) string {
+    prefix := "edit3:"
+    if config.Cache.Prefix != "" {
+        prefix = config.Cache.Prefix
+    }
+    return prefix + strings.Join(parts, ":")
+}
+
+func (rc *readCache) available() bool {
+    if rc.client == nil {
+        return false
+    }
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    return time.Now().After(rc.down)
+}
+
+func (rc *readCache) failed(err error) {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    if time.Now().After(rc.down) {
+        log.Printf("cache: %v; reading without it for %s", err, CacheDownTime)
+    }
+    rc.down = time.Now().Add(CacheDownTime)
+}
+
+// fetch returns the value cached under the key made of parts, or loads and
+// caches it. Errors from load are not cached.
+func (rc *readCache) fetch(ctx context.Context, load func() ([]byte, error), parts ...string) ([]byte, error) {
+    if !rc.available() {
+        return load()
+    }
+    key := rc.key(parts...)
+    value, ok, err := rc.client.Get(ctx, key)
+    if err != nil {
+        rc.failed(err)
+        return load()
+    }
+    if ok {
+        return value, nil
+    }
+    if value, err = load(); err != nil {
+        return nil, err
+    }
+    if err := rc.client.Set(ctx, key, value, timeout(config.Cache.TTL, DefaultCacheTTL)); err != nil {
+        rc.failed(err)
+    }
+    return value, nil
+}
+
+// forget drops the value cached under the key made of parts.
+func (rc *readCache) forget(ctx context.Context, parts ...string) {
+    if !rc.available() {
+        return
+    }
+    if err := rc.client.Delete(ctx, rc.key(parts...)); err != nil {
+        rc.failed(err)
+    }
+}
+
+// fileKey is the cache key of rel as stat described it.
+func fileKey(dir, rel string, info storage.FileInfo) []string {
+    return []string{"file", dir, storageName(rel), strconv.FormatInt(info.ModTime.UnixNano(), 10), strconv.FormatInt(info.Size, 10)}
+}
+
+// readFile reads rel as it was when stat described it, from the cache when
+// another read (on any replica) has seen that version.
+func readFile(ctx context.Context, dir, rel string, info storage.FileInfo) ([]byte, error) {
+    return reads.fetch(ctx, func() ([]byte, error) {
+        return fileStore(dir).Read(storageName(rel))
+    }, fileKey(dir, rel, info)...)
+}
+
+// commitHash matches revisions that name one commit for good.
+var commitHash = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// shortCommit abbreviates a commit hash for messages.
+func shortCommit(hash string) string {
+    if len(hash) > 7 {
+        return hash[:7]
+    }
+    return hash
+}
+
+// Replicas
+
+// DefaultLeaderTTL is how long a leader may go silent before another
+// replica takes over.
+const DefaultLeaderTTL = 15 * time.Second
+
+// ClusterConfig coordinates replicas that share one data directory: one is
+// elected leader and alone writes to git and runs background jobs
+// (scheduled changes, mirroring); the others serve reads and answer writes
+// with 503 and the leader's ID in X-Edit3-Leader. Backend "file" holds a
+// lock on a file in the data directory, "etcd" campaigns for Key with a
+// lease of TTL.
+type ClusterConfig struct {
+    Backend   string        `yaml:"backend"`   // file (default) or etcd
+    Endpoints []string      `yaml:"endpoints"` // etcd
+    Key       string        `yaml:"key"`       // default /edit3/leader
+    TTL       time.Duration `yaml:"ttl"`
+    ID        string        `yaml:"id"` // this replica; default host:pid
+}
+
+// errNotLeader refuses a write on a replica that is not the leader.
+var errNotLeader = errors.New("this replica is not the leader; send writes to the leader")
+
+// cluster tracks whether this replica leads. Without a cluster config there
+// is nobody to share with and it always does.
+type cluster struct {
+    mu     sync.RWMutex
+    id     string
+    leader bool
+    holder string   // the leader's ID, when known
+    lock   *os.File // held by the file backend's leader
+    // elected runs each time the replica wins the election, before it
+    // starts to lead. It is set before start and not changed after.
+    elected func()
+}
+
+var replicas = &cluster{leader: true}
+
+func (r *cluster) isLeader() bool {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.leader
+}
+
+func (r *cluster) leaderID() string {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.holder
+}
+
+func (r *cluster) set(leader bool, holder string) {
+    if leader && r.elected != nil && !r.isLeader() {
+        r.elected()
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if leader && !r.leader {
+        log.Printf("cluster: %s is now the leader", r.id)
+    } else if !leader && holder != "" && holder != r.holder {
+        log.Printf("cluster: %s follows %s", r.id, holder)
+    }
+    r.leader, r.holder = leader, holder
+}
+
+// start joins the election. The replica follows until it wins.
+func (r *cluster) start() error {
+    cfg := config.Cluster
+    r.id = cfg.ID
+    if r.id == "" {
+        host, _ := os.Hostname()
+        r.id = fmt.Sprintf("%s:%d", host, os.Getpid())
+    }
+    r.set(false, "")
+    ttl := timeout(cfg.TTL, DefaultLeaderTTL)
+    switch cfg.Backend {
+    case "etcd":
+        key := cfg.Key
+        if key == "" {
+            key = "/edit3/leader"
+        }
+        client, err := etcd.New(etcd.Config{Endpoints: cfg.Endpoints, DialTimeout: 5 * time.Second})
+        if err != nil {
+            return err
+        }
+        go r.campaignEtcd(client, key, ttl)
+    default:
+        p, err := metaPath("leader.lock")
+        if err != nil {
+            return err
+        }
+        // The first attempt is made here so an unusable lock stops startup
+        if won, err := r.lockFile(p); err != nil {
+            return err
+        } else if !won {
+            go r.campaignFile(p, ttl)
+        }
+    }
+    return nil
+}
+
+// lockFile tries once to take the leader lock at p. The holder writes its ID
+// into the file so followers can name it, and keeps the lock until exit.
+func (r *cluster) lockFile(p string) (bool, error) {
+    f, ok, err := store.TryLock(p)
+    if err != nil || !ok {
+        holder, _ := ioutil.ReadFile(p)
+        r.set(false, strings.TrimSpace(string(holder)))
+        return false, err
+    }
+    f.Truncate(0)
+    f.WriteAt([]byte(r.id), 0)
+    f.Sync()
+    r.lock = f
+    r.set(true, r.id)
+    return true, nil
+}
+
+// campaignFile retries the leader lock every third of ttl until it wins.
+func (r *cluster) campaignFile(p string, ttl time.Duration) {
+    for {
+        time.Sleep(ttl / 3)
+        won, err := r.lockFile(p)
+        if err != nil {
+            log.Printf("cluster: %v", err)
+        }
+        if won {
+            return
+        }
+    }
+}
+
+// campaignEtcd wins the election for key, leads while its lease lives and
+// campaigns again when it is lost.
+func (r *cluster) campaignEtcd(client *etcd.Client, key string, ttl time.Duration) {
+    for {
+        session, err := concurrency.NewSession(client, concurrency.WithTTL(int((ttl+time.Second-1)/time.Second)))
+        if err != nil {
+            log.Printf("cluster: %v", err)
+            time.Sleep(ttl / 3)
+            continue
+        }
+        election := concurrency.NewElection(session, key)
+        ctx, cancel := context.WithCancel(context.Background())
+        go func() {
+            for resp := range election.Observe(ctx) {
+                if len(resp.Kvs) > 0 && string(resp.Kvs[0].Value) != r.id {
+                    r.set(false, string(resp.Kvs[0].Value))
+                }
+            }
+        }()
+        if err := election.Campaign(ctx, r.id); err != nil {
+            log.Printf("cluster: %v", err)
+        } else {
+            r.set(true, r.id)
+            <-session.Done()
+            r.set(false, "")
+        }
+        cancel()
+        session.Close()
+    }
+}
+
+// leaderOnly answers 503 on followers for routes that write.
+func leaderOnly() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !replicas.isLeader() {
+            c.Header("X-Edit3-Leader", replicas.leaderID())
+            c.AbortWithStatusJSON(503, gin.H{"error": errNotLeader.Error(), "leader": replicas.leaderID()})
+            return
+        }
+        c.Next()
+    }
+}
+
+// getCluster handles GET /api/cluster, this replica's part in the election.
+func getCluster(c *gin.Context) {
+    c.JSON(200, gin.H{"id": replicas.id, "leader": replicas.isLeader(), "leaderId": replicas.leaderID(), "clustered": config.Cluster != nil})
+}
+
+// Change feed
+
+// FeedSize is how many events the change feed keeps by default, and the
+// most one poll returns.
+const FeedSize = 1000
+
+// DefaultFeedMaxAge is how long the change feed keeps events by default.
+const DefaultFeedMaxAge = 7 * 24 * time.Hour
+
+// EventsConfig bounds the change feed's log. It is kept in MetaDir, so
+// consumers that reconnect after downtime, of theirs or the server's, can
+// replay what they missed.
+type EventsConfig struct {
+    Retention int           `yaml:"retention"` // events kept; default FeedSize
+    MaxAge    time.Duration `yaml:"max_age"`   // default DefaultFeedMaxAge
+}
+
+// FeedEvent is one event of the change feed. IDs only grow, so a client's
+// cursor is the ID of the last event it has seen.
+type FeedEvent struct {
+    ID    int64       `json:"id"`
+    Event string      `json:"event"`
+    Time  time.Time   `json:"time"`
+    Data  interface{} `json:"data"`
+}
+
+// feed keeps the latest notified events for long-polling clients that
+// cannot hold a WebSocket or event stream open. Once opened it also appends
+// them to a log, which is rewritten with only the retained events when it
+// has grown to twice their number.
+type feed struct {
+    mu     sync.Mutex
+    events []FeedEvent
+    nextID int64
+    notify chan struct{}
+    log    *os.File
+    logged int // events in the log
+}
+
+var changeFeed = &feed{nextID: 1, notify: make(chan struct{})}
+
+func feedPath() (string, error) {
+    return metaPath("events.jsonl")
+}
+
+// open loads the persisted log, so IDs continue where the last run stopped,
+// and starts appending to it.
+func (f *feed) open() error {
+    p, err := feedPath()
+    if err != nil {
+        return err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if content, err := ioutil.ReadFile(p); err == nil {
+        for _, line := range bytes.Split(content, []byte("\n")) {
+            var e FeedEvent
+            if json.Unmarshal(line, &e) != nil {
+                continue // a line cut short by a crash
+            }
+            f.events = append(f.events, e)
+            f.logged++
+            if e.ID >= f.nextID {
+                f.nextID = e.ID + 1
+            }
+        }
+    }
+    f.prune()
+    return f.compact(p)
+}
+
+// prune drops events past the retention limits.
+func (f *feed) prune() {
+    retention, maxAge := config.Events.Retention, config.Events.MaxAge
+    if retention <= 0 {
+        retention = FeedSize
+    }
+    if maxAge <= 0 {
+        maxAge = DefaultFeedMaxAge
+    }
+    if len(f.events) > retention {
+        f.events = f.events[len(f.events)-retention:]
+    }
+    cutoff := time.Now().Add(-maxAge)
+    for len(f.events) > 0 && f.events[0].Time.Before(cutoff) {
+        f.events = f.events[1:]
+    }
+}
+
+// compact rewrites the log with the retained events and reopens it for
+// appending.
+func (f *feed) compact(p string) error {
+    var b bytes.Buffer
+    for _, e := range f.events {
+        line, err := json.Marshal(e)
+        if err != nil {
+            continue
+        }
+        b.Write(line)
+        b.WriteByte('\n')
+    }
+    if f.log != nil {
+        f.log.Close()
+        f.log = nil
+    }
+    if err := writeFileAtomic(p, b.Bytes(), 0644); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+    f.log, f.logged = file, len(f.events)
+    return nil
+}
+
+// add is the feed's notifier. File contents are left out: pollers fetch
+// what they need.
+func (f *feed) add(event string, data interface{}) {
+    if e, ok := data.(FileEvent); ok {
+        e.Content = ""
+        data = e
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    e := FeedEvent{ID: f.nextID, Event: event, Time: time.Now().UTC(), Data: data}
+    f.events = append(f.events, e)
+    f.nextID++
+    f.prune()
+    if f.log != nil {
+        if line, err := json.Marshal(e); err == nil {
+            if _, err := f.log.Write(append(line, '\n')); err != nil {
+                log.Printf("events: %v", err)
+            }
+            f.logged++
+        }
+        if f.logged >= 2*len(f.events) && f.logged > FeedSize {
+            if err := f.compact(f.log.Name()); err != nil {
+                log.Printf("events: %v", err)
+            }
+        }
+    }
+    close(f.notify)
+    f.notify = make(chan struct{})
+}
+
+// last returns the ID of the newest event.
+func (f *feed) last() int64 {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.nextID - 1
+}
+
+// since returns up to limit events after cursor and the cursor to continue
+// from. missed is set when events after cursor were already dropped, or the
+// cursor comes from before a restart.
+func (f *feed) since(cursor int64, limit int) (events []FeedEvent, next int64, missed bool, wait chan struct{}) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if cursor > f.nextID-1 {
+        // IDs restarted: everything kept is new to this client
+        cursor, missed = 0, true
+    }
+    if cursor > 0 && len(f.events) > 0 && cursor < f.events[0].ID-1 {
+        missed = true
+    }
+    events = []FeedEvent{}
+    for _, e := range f.events {
+        if e.ID > cursor && len(events) < limit {
+            events = append(events, e)
+        }
+    }
+    next = cursor
+    if len(events) > 0 {
+        next = events[len(events)-1].ID
+    }
+    return events, next, missed, f.notify
+}
+
+// pollEvents handles GET /api/poll?cursor=<id>: the events after cursor,
+// waiting up to 25s for one when there are none (?wait=0 returns at once).
+// Without a cursor it starts at the newest event. Cursors stay valid across
+// restarts for as long as EventsConfig retains the events; when missed is
+// set the client has lost events and should resync with /api/changes.
+func pollEvents(c *gin.Context) {
+    limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+    if limit <= 0 || limit > FeedSize {
+        limit = FeedSize
+    }
+    var cursor int64
+    if value := c.Query("cursor"); value != "" {
+        var err error
+        if cursor, err = strconv.ParseInt(value, 10, 64); err != nil || cursor < 0 {
+            c.JSON(400, gin.H{"error": "cursor must be an event id"})
+            return
+        }
+    } else {
+        cursor = changeFeed.last()
+    }
+    events, next, missed, wait := changeFeed.since(cursor, limit)
+    if len(events) == 0 && !missed && c.Query("wait") != "0" {
+        select {
+        case <-wait:
+            events, next, missed, _ = changeFeed.since(cursor, limit)
+        case <-time.After(25 * time.Second):
+        case <-c.Request.Context().Done():
+            return
+        }
+    }
+    c.JSON(200, gin.H{"events": events, "cursor": next, "missed": missed})
+}
+
+// getOpened long-polls for files to open: ?after=<id> returns requests newer
+// than id, waiting up to 25s for one to arrive.
+func getOpened(c *gin.Context) {
+    after, _ := strconv.Atoi(c.Query("after"))
+    pending, last, notify := opened.since(after)
+    if len(pending) == 0 && c.Query("wait") != "0" {
+        select {
+        case <-notify:
+            pending, last, _ = opened.since(after)
+        case <-time.After(25 * time.Second):
+        case <-c.Request.Context().Done():
+            return
+        }
+    }
+    if pending == nil {
+        pending = []openRequest{}
+    }
+    c.JSON(200, gin.H{"requests": pending, "last": last})
+}
+
+// command describes a CLI subcommand. setup declares the command's flags and
+// returns the function that runs it once they are parsed; help, shell
+// completions and the man page are all generated from these definitions.
+type command struct {
+    name    string
+    args    string
+    summary string
+    setup   func(flags *flag.FlagSet) func(args []string) int
+}
+
+var commands []command
+
+func init() {
+    commands = []command{
+        {"open", "<path>", "Serve a file or directory outside the data directory and open it in the browser", openCommand("")},
+        {"gui", "<path>", "Open a file in a native window", openCommand("gui")},
+        {"tui", "<path>", "Edit a file in the terminal", openCommand("tui")},
+        {"fmt", "(--stdin | <file>...)", "Format documents", fmtCommand},
+        {"validate", "(--stdin | --staged | <file>...)", "Validate documents", validateCommand},
+        {"watch", "<glob> [--exec <command>]", "Run a command whenever matching files in the data directory change", watchCommand},
+        {"kv-import", "[file...]", "Import mapped Consul/etcd keys into their files", kvImportCommand},
+        {"install-hooks", "[repository]", "Install a pre-commit hook that validates staged files", installHooksCommand},
+        {"self-update", "", "Download and install the latest release", selfUpdateCommand},
+        {"version", "", "Print the version", versionCommand},
+        {"completion", "bash|zsh|fish", "Print a shell completion script", completionCommand},
+        {"man", "", "Print the edit3(1) man page", manCommand},
+        {"help", "", "List commands", helpCommand},
+    }
+}
+
+func findCommand(name string) *command {
+    for i := range commands {
+        if commands[i].name == name {
+            return &commands[i]
+        }
+    }
+    return nil
+}
+
+func (c *command) flags() (*flag.FlagSet, func(args []string) int) {
+    flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+    run := c.setup(flags)
+    flags.Usage = func() {
+        fmt.Fprintf(os.Stderr, "Usage: edit3 %s [flags] %s\n%s\n", c.name, c.args, c.summary)
+        flags.PrintDefaults()
+    }
+    return flags, run
+}
+
+func (c *command) run(args []string) int {
+    flags, run := c.flags()
+    flags.Parse(args)
+    return run(flags.Args())
+}
+
+// openCommand registers the path as an allowed root and starts the editor.
+func openCommand(mode string) func(flags *flag.FlagSet) func(args []string) int {
+    return func(flags *flag.FlagSet) func(args []string) int {
+        return func(args []string) int {
+            if len(args) < 1 {
+                flags.Usage()
+                return 1
+            }
+            abs, err := addAllowedRoot(args[0])
+            if err != nil {
+                log.Fatalf("edit3: %v", err)
+            }
+            return serve(abs, mode)
+        }
+    }
+}
+
+func versionCommand(flags *flag.FlagSet) func(args []string) int {
+    return func(args []string) int {
+        fmt.Println("edit3", Version)
+        return 0
+    }
+}
+
+func helpCommand(flags *flag.FlagSet) func(args []string) int {
+    return func(args []string) int {
+        fmt.Println("Usage: edit3 [file]")
+        fmt.Println("       edit3 <command> [flags] [args]")
+        fmt.Println()
+        fmt.Println("Commands:")
+        for _, c := range commands {
+            fmt.Printf("  %-14s %s\n", c.name, c.summary)
+        }
+        return 0
+    }
+}
+
+// readInputs returns the documents named on the command line, or stdin when
+// useStdin is set. Each input carries the type used to parse it.
+func readInputs(files []string, useStdin bool, fileType string) ([]string, []string, [][]byte, error) {
+    if useStdin {
+        if fileType == "" {
+            return nil, nil, nil, fmt.Errorf("--type is required with --stdin")
+        }
+        content, err := ioutil.ReadAll(os.Stdin)
+        if err != nil {
+            return nil, nil, nil, err
+        }
+        return []string{"<stdin>"}, []string{fileType}, [][]byte{content}, nil
+    }
+
+    var names, types []string
+    var contents [][]byte
+    for _, file := range files {
+        content, err := ioutil.ReadFile(file)
+        if err != nil {
+            return nil, nil, nil, err
+        }
+        t := fileType
+        if t == "" {
+            t = getFileType(file)
+        }
+        names = append(names, file)
+        types = append(types, t)
+        contents = append(contents, content)
+    }
+    return names, types, contents, nil
+}
+
+// readStaged returns the index version of every added or modified file with
+// a supported extension, which is what a pre-commit hook has to check.
+func readStaged() ([]string, []string, [][]byte, error) {
+    output, err := exec.Command("git", "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z").Output()
+    if err != nil {
+        return nil, nil, nil, fmt.Errorf("git diff --cached: %v", err)
+    }
+
+    var names, types []string
+    var contents [][]byte
+    for _, name := range strings.Split(string(output), "\x00") {
+        if name == "" || !supportedFileType(name) {
+            continue
+        }
+        content, err := exec.Command("git", "show", ":"+name).Output()
+        if err != nil {
+            return nil, nil, nil, fmt.Errorf("git show :%s: %v", name, err)
+        }
+        names = append(names, name)
+        types = append(types, getFileType(name))
+        contents = append(contents, content)
+    }
+    return names, types, contents, nil
+}
+
+// fmtCommand implements "edit3 fmt": formatted documents go to stdout, or back to
+// their files with -w.
+func fmtCommand(flags *flag.FlagSet) func(args []string) int {
+    useStdin := flags.Bool("stdin", false, "read the document from stdin")
+    fileType := flags.String("type", "", "document type (json, yaml, xml, toml); defaults to the file extension")
+    write := flags.Bool("w", false, "write the result back to the file instead of stdout")
+    return func(args []string) int {
+        if !*useStdin && len(args) == 0 {
+            flags.Usage()
+            return 2
+        }
+        names, types, contents, err := readInputs(args, *useStdin, *fileType)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 2
+        }
+
+        status := 0
+        for i, name := range names {
+            formatted, err := formatContent(string(contents[i]), types[i])
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "%s: Invalid %s format: %v\n", name, strings.ToUpper(types[i]), err)
+                status = 1
+                continue
+            }
+            if *write && !*useStdin {
+                if formatted != string(contents[i]) {
+                    if err := ioutil.WriteFile(name, []byte(formatted), 0644); err != nil {
+                        fmt.Fprintln(os.Stderr, "edit3:", err)
+                        status = 1
+                    }
+                }
+                continue
+            }
+            fmt.Print(formatted)
+        }
+        return status
+    }
+}
+
+// validateCommand implements "edit3 validate". It prints one line per invalid
+// document to stderr and exits non-zero if any failed, so it can gate hooks.
+func validateCommand(flags *flag.FlagSet) func(args []string) int {
+    useStdin := flags.Bool("stdin", false, "read the document from stdin")
+    fileType := flags.String("type", "", "document type (json, yaml, xml, toml); defaults to the file extension")
+    staged := flags.Bool("staged", false, "validate files staged in the current git repository")
+    quiet := flags.Bool("q", false, "only report failures")
+    consistency := flags.Bool("consistency", false, "warn about values spelled differently only by case or spacing across the files")
+    return func(args []string) int {
+        if !*useStdin && !*staged && len(args) == 0 {
+            flags.Usage()
+            return 2
+        }
+        if *consistency {
+            // for the keys the consistency section narrows the check to
+            if err := loadConfig(); err != nil {
+                fmt.Fprintln(os.Stderr, "edit3: config:", err)
+                return 2
+            }
+        }
+        if !*staged {
+            status := validateStreams(args, *useStdin, *fileType, *quiet)
+            if *consistency && !*useStdin {
+                printInconsistencies(findInconsistencies(args, ioutil.ReadFile))
+            }
+            return status
+        }
+        names, types, contents, err := readStaged()
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 2
+        }
+
+        status := 0
+        for i, name := range names {
+            if err := validateContent(string(contents[i]), types[i]); err != nil {
+                fmt.Fprintf(os.Stderr, "%s: Invalid %s format: %v\n", name, strings.ToUpper(types[i]), err)
+                status = 1
+            } else if !*quiet {
+                fmt.Fprintf(os.Stderr, "%s: OK\n", name)
+            }
+        }
+        if *consistency {
+            staged := make(map[string][]byte, len(names))
+            for i, name := range names {
+                staged[name] = contents[i]
+            }
+            printInconsistencies(findInconsistencies(names, func(name string) ([]byte, error) { return staged[name], nil }))
+        }
+        return status
+    }
+}
+
+// validateStreams validates files, or stdin, without reading them whole, so
+// multi-hundred-megabyte JSON and XML exports can be checked cheaply.
+func validateStreams(files []string, useStdin bool, fileType string, quiet bool) int {
+    if useStdin {
+        if fileType == "" {
+            fmt.Fprintln(os.Stderr, "edit3: --type is required with --stdin")
+            return 2
+        }
+        files = []string{"<stdin>"}
+    }
+    status := 0
+    for _, name := range files {
+        t := fileType
+        if t == "" {
+            t = getFileType(name)
+        }
+        var err error
+        if useStdin {
+            err = validateReader(os.Stdin, t)
+        } else {
+            f, openErr := os.Open(name)
+            if openErr != nil {
+                fmt.Fprintln(os.Stderr, "edit3:", openErr)
+                return 2
+            }
+            err = validateReader(f, t)
+            f.Close()
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s: Invalid %s format: %v\n", name, strings.ToUpper(t), err)
+            status = 1
+        } else if !quiet {
+            fmt.Fprintf(os.Stderr, "%s: OK\n", name)
+        }
+    }
+    return status
+}
+
+// watchCommand implements "edit3 watch <glob> --exec <cmd>": it watches the
+// data directory and runs cmd through the shell whenever matching files
+// change. Bursts of events are batched; the changed paths are passed to the
+// command in EDIT3_FILES, one per line.
+func watchCommand(flags *flag.FlagSet) func(args []string) int {
+    execCmd := flags.String("exec", "", "command to run after matching files change")
+    debounce := flags.Duration("debounce", 300*time.Millisecond, "wait this long for further changes before running")
+    validate := flags.Bool("validate", false, "validate changed files and skip the command if any are invalid")
+    dir := flags.String("dir", "", "directory to watch (default: the data directory)")
+    return func(args []string) int {
+        if len(args) == 0 {
+            flags.Usage()
+            return 2
+        }
+        // Allow flags after the glob too
+        glob := args[0]
+        flags.Parse(args[1:])
+        if flags.NArg() > 0 {
+            flags.Usage()
+            return 2
+        }
+        if *dir == "" {
+            configure()
+            *dir = DataDir
+        }
+
+        fs := fileStore(*dir)
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        events, err := fs.Watch(ctx)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        fmt.Fprintf(os.Stderr, "Watching %s for %s\n", *dir, glob)
+
+        changed := make(map[string]bool)
+        timer := time.NewTimer(time.Hour)
+        timer.Stop()
+        for {
+            select {
+            case event, ok := <-events:
+                if !ok {
+                    return 0
+                }
+                if !pathMatches([]string{glob}, event.Name) {
+                    continue
+                }
+                changed[event.Name] = true
+                timer.Reset(*debounce)
+            case <-timer.C:
+                files := make([]string, 0, len(changed))
+                for rel := range changed {
+                    files = append(files, rel)
+                }
+                sort.Strings(files)
+                changed = make(map[string]bool)
+                runWatchCommand(fs, *dir, files, *execCmd, *validate)
+            }
+        }
+    }
+}
+
+func runWatchCommand(fs storage.Storage, dir string, files []string, execCmd string, validate bool) {
+    for _, rel := range files {
+        fmt.Fprintf(os.Stderr, "changed: %s\n", rel)
+    }
+    if validate {
+        invalid := false
+        for _, rel := range files {
+            content, err := fs.Read(rel)
+            if err != nil {
+                continue // removed
+            }
+            fileType := getFileType(rel)
+            if err := validateContent(string(content), fileType); err != nil {
+                fmt.Fprintf(os.Stderr, "%s: Invalid %s format: %v\n", rel, strings.ToUpper(fileType), err)
+                invalid = true
+            }
+        }
+        if invalid {
+            fmt.Fprintln(os.Stderr, "edit3: not running command, fix the errors above")
+            return
+        }
+    }
+    if execCmd == "" {
+        return
+    }
+
+    var cmd *exec.Cmd
+    if runtime.GOOS == "windows" {
+        cmd = exec.Command("cmd", "/C", execCmd)
+    } else {
+        cmd = exec.Command("sh", "-c", execCmd)
+    }
+    cmd.Dir = dir
+    cmd.Env = append(os.Environ(), "EDIT3_FILES="+strings.Join(files, "\n"))
+    cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, os.Stdout, os.Stderr
+    if err := cmd.Run(); err != nil {
+        fmt.Fprintf(os.Stderr, "edit3: %s: %v\n", execCmd, err)
+    }
+}
+
+// hookMarker identifies hooks written by install-hooks so they can be
+// replaced without --force.
+const hookMarker = "# installed by edit3 install-hooks"
+
+// installHooksCommand implements "edit3 install-hooks": it writes a pre-commit
+// hook into a repository that runs "edit3 validate --staged".
+func installHooksCommand(flags *flag.FlagSet) func(args []string) int {
+    force := flags.Bool("force", false, "overwrite an existing pre-commit hook")
+    return func(args []string) int {
+        repo := "."
+        if len(args) > 0 {
+            repo = args[0]
+        }
+
+        // Honours core.hooksPath and worktrees
+        cmd := exec.Command("git", "rev-parse", "--path-format=absolute", "--git-path", "hooks")
+        cmd.Dir = repo
+        output, err := cmd.Output()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "edit3: %s is not a git repository\n", repo)
+            return 1
+        }
+        hooksDir := strings.TrimSpace(string(output))
+        hookPath := filepath.Join(hooksDir, "pre-commit")
+
+        if existing, err := ioutil.ReadFile(hookPath); err == nil && !*force && !strings.Contains(string(existing), hookMarker) {
+            fmt.Fprintf(os.Stderr, "edit3: %s already exists; use --force to replace it\n", hookPath)
+            return 1
+        }
+
+        binary := "edit3"
+        if exe, err := os.Executable(); err == nil {
+            binary = filepath.ToSlash(exe)
+        }
+        hook := fmt.Sprintf(`#!/bin/sh
+%s
+# Validates staged JSON, YAML and XML files with the same rules the editor
+# enforces on save. Set EDIT3 to override the binary.
+EDIT3="${EDIT3:-%s}"
+if ! command -v "$EDIT3" >/dev/null 2>&1; then
+    EDIT3=edit3
+fi
+exec "$EDIT3" validate --staged -q
+`, hookMarker, binary)
+
+        if err := os.MkdirAll(hooksDir, 0755); err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        if err := ioutil.WriteFile(hookPath, []byte(hook), 0755); err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        fmt.Println("Installed pre-commit hook:", hookPath)
+        return 0
+    }
+}
+
+// Version is stamped at build time with -ldflags "-X main.Version=v1.2.3".
+var Version = "dev"
+
+// ReleasePublicKey is the base64 ed25519 key that signs checksums.txt in
+// each release, stamped at build time like Version. Builds without it only
+// update with --insecure, trusting checksums from the same origin.
+var ReleasePublicKey = ""
+
+// DefaultReleaseURL is the GitHub API endpoint describing the latest release.
+const DefaultReleaseURL = "https://api.github.com/repos/pyfunc/xedit/releases/latest"
+
+type releaseInfo struct {
+    TagName string `json:"tag_name"`
+    Assets  []struct {
+        Name string `json:"name"`
+        URL  string `json:"browser_download_url"`
+    } `json:"assets"`
+}
+
+func (r *releaseInfo) assetURL(name string) string {
+    for _, a := range r.Assets {
+        if a.Name == name {
+            return a.URL
+        }
+    }
+    return ""
+}
+
+func httpGet(url string) ([]byte, error) {
+    client := &http.Client{Timeout: 2 * time.Minute}
+    resp, err := client.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+    }
+    return ioutil.ReadAll(resp.Body)
+}
+
+// selfUpdateCommand implements "edit3 self-update": it downloads the binary
+// for this platform from the latest release, checks it against the release's
+// signed checksums.txt and swaps it in place of the running executable. Only
+// newer versions are installed unless --force is given.
+func selfUpdateCommand(flags *flag.FlagSet) func(args []string) int {
+    check := flags.Bool("check", false, "only report whether an update is available")
+    releaseURL := flags.String("url", envOr("EDIT3_RELEASE_URL", DefaultReleaseURL), "release metadata endpoint")
+    force := flags.Bool("force", false, "install the latest release even if it is not newer")
+    insecure := flags.Bool("insecure", false, "update without a release key, trusting checksums.txt alone")
+    return func(args []string) int {
+        body, err := httpGet(*releaseURL)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        var release releaseInfo
+        if err := json.Unmarshal(body, &release); err != nil {
+            fmt.Fprintln(os.Stderr, "edit3: invalid release metadata:", err)
+            return 1
+        }
+        if release.TagName == Version {
+            fmt.Printf("edit3 %s is up to date\n", Version)
+            return 0
+        }
+        fmt.Printf("Current version: %s, latest: %s\n", Version, release.TagName)
+        if *check {
+            return 0
+        }
+        if err := checkNewer(Version, release.TagName); err != nil && !*force {
+            fmt.Fprintf(os.Stderr, "edit3: %v; use --force to install it anyway\n", err)
+            return 1
+        }
+        if ReleasePublicKey == "" && !*insecure {
+            fmt.Fprintln(os.Stderr, "edit3: this build has no release key to verify updates with; use --insecure to trust checksums.txt alone")
+            return 1
+        }
+
+        asset := fmt.Sprintf("edit3-%s-%s", runtime.GOOS, runtime.GOARCH)
+        if runtime.GOOS == "windows" {
+            asset += ".exe"
+        }
+        binURL := release.assetURL(asset)
+        sumsURL := release.assetURL("checksums.txt")
+        if binURL == "" || sumsURL == "" {
+            fmt.Fprintf(os.Stderr, "edit3: release %s has no %s or checksums.txt\n", release.TagName, asset)
+            return 1
+        }
+
+        sums, err := httpGet(sumsURL)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        if err := verifyChecksums(&release, sums); err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        want := ""
+        for _, line := range strings.Split(string(sums), "\n") {
+            fields := strings.Fields(line)
+            if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == asset {
+                want = fields[0]
+            }
+        }
+        if want == "" {
+            fmt.Fprintf(os.Stderr, "edit3: checksums.txt has no entry for %s\n", asset)
+            return 1
+        }
+
+        binary, err := httpGet(binURL)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "edit3:", err)
+            return 1
+        }
+        sum := sha256.Sum256(binary)
+        if got := hex.EncodeToString(sum[:]); got != want {
+            fmt.Fprintf(os.Stderr, "edit3: checksum mismatch for %s: got %s, want %s\n", asset, got, want)
+            return 1
+        }
+
+        if err := replaceExecutable(binary); err != nil {
+            fmt.Fprintln(os.Stderr, "edit3: cannot replace binary:", err)
+            return 1
+        }
+        fmt.Printf("Updated edit3 to %s\n", release.TagName)
+        return 0
+    }
+}
+
+// checkNewer returns an error unless latest is a newer version than
+// current. Development builds, whose version is not semver, take any
+// release.
+func checkNewer(current, latest string) error {
+    have, err := semver.NewVersion(current)
+    if err != nil {
+        return nil
+    }
+    want, err := semver.NewVersion(latest)
+    if err != nil {
+        return fmt.Errorf("release %s is not a semantic version", latest)
+    }
+    if !want.GreaterThan(have) {
+        return fmt.Errorf("release %s is not newer than %s", latest, current)
+    }
+    return nil
+}
+
+// verifyChecksums checks the ed25519 signature of checksums.txt when a
+// release key was compiled in.
+func verifyChecksums(release *releaseInfo, sums []byte) error {
+    if ReleasePublicKey == "" {
+        fmt.Fprintln(os.Stderr, "warning: this build has no release key; only the checksum is verified")
+        return nil
+    }
+    key, err := base64.StdEncoding.DecodeString(ReleasePublicKey)
+    if err != nil || len(key) != ed25519.PublicKeySize {
+        return fmt.Errorf("invalid release public key")
+    }
+    sigURL := release.assetURL("checksums.txt.sig")
+    if sigURL == "" {
+        return fmt.Errorf("release %s is not signed", release.TagName)
+    }
+    sig, err := httpGet(sigURL)
+    if err != nil {
+        return err
+    }
+    if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err == nil {
+        sig = decoded
+    }
+    if !ed25519.Verify(ed25519.PublicKey(key), sums, sig) {
+        return fmt.Errorf("signature check of checksums.txt failed")
+    }
+    return nil
+}
+
+// replaceExecutable writes the new binary next to the running one and renames
+// it into place. Windows cannot overwrite a running executable, so the old
+// one is moved aside first.
+func replaceExecutable(binary []byte) error {
+    exe, err := os.Executable()
+    if err != nil {
+        return err
+    }
+    if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+        exe = resolved
+    }
+    tmp := exe + ".new"
+    if err := ioutil.WriteFile(tmp, binary, 0755); err != nil {
+        return err
+    }
+    if runtime.GOOS == "windows" {
+        old := exe + ".old"
+        os.Remove(old)
+        if err := os.Rename(exe, old); err != nil {
+            os.Remove(tmp)
+            return err
+        }
+    }
+    if err := os.Rename(tmp, exe); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}
+
+// commandFlag is a flag as seen by the completion and man page generators.
+type commandFlag struct {
+    name   string
+    usage  string
+    isBool bool
+}
+
+func (c *command) flagList() []commandFlag {
+    flags, _ := c.flags()
+    var list []commandFlag
+    flags.VisitAll(func(f *flag.Flag) {
+        b, ok := f.Value.(interface{ IsBoolFlag() bool })
+        list = append(list, commandFlag{f.Name, f.Usage, ok && b.IsBoolFlag()})
+    })
+    return list
+}
+
+// dashed spells a flag the way the help output does: -w, --stdin.
+func (f commandFlag) dashed() string {
+    if len(f.name) == 1 {
+        return "-" + f.name
+    }
+    return "--" + f.name
+}
+
+func completionCommand(flags *flag.FlagSet) func(args []string) int {
+    return func(args []string) int {
+        if len(args) != 1 {
+            flags.Usage()
+            return 2
+        }
+        switch args[0] {
+        case "bash":
+            fmt.Print(bashCompletion())
+        case "zsh":
+            fmt.Print(zshCompletion())
+        case "fish":
+            fmt.Print(fishCompletion())
+        default:
+            fmt.Fprintf(os.Stderr, "edit3: unsupported shell %q\n", args[0])
+            return 2
+        }
+        return 0
+    }
+}
+
+func bashCompletion() string {
+    var b strings.Builder
+    var names []string
+    for _, c := range commands {
+        names = append(names, c.name)
+    }
+    b.WriteString("# bash completion for edit3\n")
+    b.WriteString("_edit3() {\n")
+    b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" flags=\"\"\n")
+    b.WriteString("    if [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+    fmt.Fprintf(&b, "        COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") $(compgen -f -- \"$cur\") )\n", strings.Join(names, " "))
+    b.WriteString("        return\n")
+    b.WriteString("    fi\n")
+    b.WriteString("    case \"${COMP_WORDS[1]}\" in\n")
+    for _, c := range commands {
+        var list []string
+        for _, f := range c.flagList() {
+            list = append(list, f.dashed())
+        }
+        if c.name == "completion" {
+            fmt.Fprintf(&b, "        completion) COMPREPLY=( $(compgen -W \"bash zsh fish\" -- \"$cur\") ); return ;;\n")
+            continue
+        }
+        fmt.Fprintf(&b, "        %s) flags=\"%s\" ;;\n", c.name, strings.Join(list, " "))
+    }
+    b.WriteString("    esac\n")
+    b.WriteString("    if [[ \"$cur\" == -* ]]; then\n")
+    b.WriteString("        COMPREPLY=( $(compgen -W \"$flags\" -- \"$cur\") )\n")
+    b.WriteString("    else\n")
+    b.WriteString("        COMPREPLY=( $(compgen -f -- \"$cur\") )\n")
+    b.WriteString("    fi\n")
+    b.WriteString("}\n")
+    b.WriteString("complete -o filenames -F _edit3 edit3\n")
+    return b.String()
+}
+
+func zshCompletion() string {
+    escape := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+    var b strings.Builder
+    b.WriteString("#compdef edit3\n\n")
+    b.WriteString("_edit3() {\n")
+    b.WriteString("    local -a commands\n")
+    b.WriteString("    commands=(\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, "        '%s:%s'\n", c.name, escape.Replace(c.summary))
+    }
+    b.WriteString("    )\n")
+    b.WriteString("    if (( CURRENT == 2 )); then\n")
+    b.WriteString("        _describe 'command' commands\n")
+    b.WriteString("        _files\n")
+    b.WriteString("        return\n")
+    b.WriteString("    fi\n")
+    b.WriteString("    case $words[2] in\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, "        %s)\n            _arguments \\\n", c.name)
+        for _, f := range c.flagList() {
+            value := ""
+            if !f.isBool {
+                value = ":value:"
+            }
+            fmt.Fprintf(&b, "                '%s[%s]%s' \\\n", f.dashed(), escape.Replace(f.usage), value)
+        }
+        if c.name == "completion" {
+            b.WriteString("                '1:shell:(bash zsh fish)'\n")
+        } else {
+            b.WriteString("                '*:file:_files'\n")
+        }
+        b.WriteString("            ;;\n")
+    }
+    b.WriteString("    esac\n")
+    b.WriteString("}\n\n")
+    b.WriteString("_edit3 \"$@\"\n")
+    return b.String()
+}
+
+func fishCompletion() string {
+    escape := strings.NewReplacer("'", "\\'")
+    var b strings.Builder
+    b.WriteString("# fish completion for edit3\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, "complete -c edit3 -n '__fish_use_subcommand' -a %s -d '%s'\n", c.name, escape.Replace(c.summary))
+    }
+    for _, c := range commands {
+        for _, f := range c.flagList() {
+            opt := "-l " + f.name
+            if len(f.name) == 1 {
+                opt = "-s " + f.name
+            }
+            if !f.isBool {
+                opt += " -r"
+            }
+            fmt.Fprintf(&b, "complete -c edit3 -n '__fish_seen_subcommand_from %s' %s -d '%s'\n", c.name, opt, escape.Replace(f.usage))
+        }
+    }
+    b.WriteString("complete -c edit3 -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'\n")
+    return b.String()
+}
+
+func manCommand(flags *flag.FlagSet) func(args []string) int {
+    return func(args []string) int {
+        fmt.Print(manPage())
+        return 0
+    }
+}
+
+// manPage renders edit3(1) in troff.
+func manPage() string {
+    escape := strings.NewReplacer("\\", "\\e", "-", "\\-")
+    var b strings.Builder
+    b.WriteString(".TH EDIT3 1\n")
+    b.WriteString(".SH NAME\n")
+    b.WriteString("edit3 \\- visual editor for JSON, YAML and XML files with git history\n")
+    b.WriteString(".SH SYNOPSIS\n")
+    b.WriteString(".B edit3\n[\\fB\\-\\-in\\-memory\\fR] [\\fIfile\\fR]\n.br\n")
+    b.WriteString(".B edit3\n\\fIcommand\\fR [\\fIflags\\fR] [\\fIargs\\fR]\n")
+    b.WriteString(".SH DESCRIPTION\n")
+    b.WriteString("Without a command, edit3 serves the editor on http://localhost:3003 and opens \\fIfile\\fR from the data directory in the browser. Every save is validated and committed to git.\n")
+    b.WriteString("With \\fB\\-\\-in\\-memory\\fR the data directory is a fresh scratch repository (on /dev/shm where available) that is deleted when the server exits.\n")
+    b.WriteString(".SH COMMANDS\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, ".TP\n.B %s", escape.Replace(c.name))
+        if c.args != "" {
+            fmt.Fprintf(&b, " \\fI%s\\fR", escape.Replace(c.args))
+        }
+        fmt.Fprintf(&b, "\n%s\n", escape.Replace(c.summary))
+        if list := c.flagList(); len(list) > 0 {
+            b.WriteString(".RS\n")
+            for _, f := range list {
+                fmt.Fprintf(&b, ".TP\n.B %s\n%s\n", escape.Replace(f.dashed()), escape.Replace(f.usage))
+            }
+            b.WriteString(".RE\n")
+        }
+    }
+    b.WriteString(".SH ENVIRONMENT\n")
+    for _, env := range [][2]string{
+        {"EDIT3_DATA_DIR", "Directory served for relative file names (default ./data). May be inside an existing git repository."},
+        {"EDIT3_ALLOWED_ROOTS", "Extra directories, separated by the path list separator, whose files may be opened by absolute path."},
+        {"EDIT3_SYMLINKS", "Symlink policy: follow (default) or deny."},
+        {"EDIT3_CONFIG", "Server configuration file (default ./edit3.yaml) holding save policies."},
+        {"EDIT3_STORAGE", "Where data directory files are kept: a directory (default EDIT3_DATA_DIR), memory: or s3://bucket/prefix. Only local files can be versioned with git."},
+        {"EDIT3_HISTORY", "History backend of the data directory: git (default with local storage) or snapshots (default otherwise), which keeps whole-file versions in the storage itself."},
+        {"EDIT3_PORT", "Address to listen on (default :3003). When it is taken the next free port is used."},
+        {"EDIT3_TLS_CERT", "Certificate file (PEM). With EDIT3_TLS_KEY the server uses HTTPS and HTTP/2."},
+        {"EDIT3_TLS_KEY", "Private key file (PEM) for EDIT3_TLS_CERT."},
+        {"EDIT3_RELEASE_URL", "Release metadata endpoint used by self-update."},
+    } {
+        fmt.Fprintf(&b, ".TP\n.B %s\n%s\n", env[0], escape.Replace(env[1]))
+    }
+    return b.String()
+}
+
+// corsAllowed reports whether pages of origin may call the API; the
+// editor's own pages always may.
+func corsAllowed(origin string) bool {
+    for _, allowed := range config.CORSOrigins {
+        if origin == allowed {
+            return true
+        }
+    }
+    return false
+}
+
+func newRouter() *gin.Engine {
+    // Gin setup
+    gin.SetMode(gin.ReleaseMode)
+    r := gin.Default()
+    origins := cors.DefaultConfig()
+    origins.AllowOriginFunc = corsAllowed
+    origins.AllowHeaders = append(origins.AllowHeaders, "X-Edit3-User", "X-Edit3-Ticket")
+    r.Use(cors.New(origins))
+    r.Use(compressResponses())
+    r.Use(requestTimeout())
+
+    // Absolute paths arrive URL-encoded in a single path segment
+    r.UseRawPath = true
+
+    // Serve HTML
+    r.StaticFile("/", "./static/index.html")
+    r.Static("/static", "./static")
+
+    // API Routes
+    r.GET("/api/file/:filename", getFile)
+    r.POST("/api/file/:filename", leaderOnly(), saveFile)
+    r.GET("/api/history/:filename", getHistory)
+    r.GET("/api/compare/:filename", compareVersions)
+    r.POST("/api/restore/:filename/:hash", leaderOnly(), restoreVersion)
+    r.POST("/api/restore-set", leaderOnly(), restoreSet)
+    r.POST("/api/admin/fsck", leaderOnly(), fsckRepository)
+    r.GET("/api/drift", driftReport)
+    r.GET("/api/digest", getDigest)
+    r.GET("/api/changes", getChanges)
+    r.GET("/api/poll", pollEvents)
+    r.GET("/api/mirror/status", getMirrorStatus)
+    r.GET("/api/cluster", getCluster)
+    registerMirrorRoutes(r)
+    r.GET("/api/report/:filename", fileReport)
+    r.GET("/api/aws/drift", requireFeature(FeatureRemoteSync), awsDrift)
+    r.GET("/api/ansible/inventory", ansibleInventory)
+    r.GET("/api/ansible/lint/:filename", ansibleLint)
+    r.GET("/api/grafana/diff/:filename", grafanaDiff)
+    r.POST("/api/semver/:filename", leaderOnly(), bumpVersion)
+    r.POST("/api/convert", requireFeature(FeatureConversions), convertDocument)
+    r.GET("/api/clipboard", requireFeature(FeatureConversions), getClipboard)
+    r.POST("/api/clipboard", requireFeature(FeatureConversions), copyToClipboard)
+    r.POST("/api/paste/:filename", requireFeature(FeatureConversions), leaderOnly(), pasteSubtree)
+    r.GET("/api/frontmatter/:filename", getFrontMatter)
+    r.PATCH("/api/frontmatter/:filename", leaderOnly(), patchFrontMatter)
+    r.GET("/api/embedded/:filename", getEmbedded)
+    r.PUT("/api/embedded/:filename", leaderOnly(), putEmbedded)
+    r.POST("/api/table", parseTable)
+    r.POST("/api/hcl", parseHCL)
+    r.GET("/api/hcl/:filename", getHCL)
+    r.GET("/api/render/:filename", getRendered)
+    r.POST("/api/render/:filename", getRendered)
+    r.POST("/api/cue", evalCUE)
+    r.GET("/api/cue/:filename", getCUE)
+    r.POST("/api/pem", parsePEM)
+    r.GET("/api/pem/:filename", getPEM)
+    r.POST("/api/env", parseEnv)
+    r.GET("/api/env/:filename", getEnv)
+    r.GET("/api/complete/:filename", getCompletions)
+    r.GET("/api/enums", getEnums)
+    r.GET("/api/migrate/:filename", getMigration)
+    r.POST("/api/migrate/:filename", leaderOnly(), migrateFile)
+    r.POST("/api/jwt", decodeJWT)
+    r.GET("/api/jwt/:filename", getJWTs)
+    r.GET("/api/table/:filename", getTable)
+    r.PUT("/api/table/:filename", leaderOnly(), putTable)
+    r.PATCH("/api/table/:filename", leaderOnly(), patchTable)
+    r.POST("/api/generate", leaderOnly(), generateSamples)
+    r.GET("/api/files", listFiles)
+    r.GET("/api/stats", getStats)
+    r.GET("/api/reviews", getFreshness)
+    r.POST("/api/review/:filename", leaderOnly(), markReviewed)
+    r.GET("/api/capabilities", getCapabilities)
+    r.GET("/api/bootstrap", getBootstrap)
+    r.POST("/api/download", downloadFiles)
+    r.POST("/api/batch/get", batchGet)
+    r.POST("/api/export", exportFiles)
+    r.GET("/api/analysis/duplicates", duplicateAnalysis)
+    r.GET("/api/analysis/unused", unusedAnalysis)
+    r.GET("/api/analysis/budgets", budgetAnalysis)
+    r.GET("/api/analysis/expiring", expiringAnalysis)
+    r.GET("/api/analysis/consistency", consistencyAnalysis)
+    r.GET("/api/opened", getOpened)
+    r.GET("/api/session", requireFeature(FeatureCollaboration), getSession)
+    r.PUT("/api/session", requireFeature(FeatureCollaboration), leaderOnly(), putSession)
+    r.POST("/api/script/:filename", requireFeature(FeatureHooks), leaderOnly(), runFileScript)
+    r.POST("/api/uploads", leaderOnly(), createUpload)
+    r.HEAD("/api/uploads/:id", uploadStatus)
+    r.GET("/api/uploads/:id", uploadStatus)
+    r.PATCH("/api/uploads/:id", leaderOnly(), patchUpload)
+    r.DELETE("/api/uploads/:id", leaderOnly(), cancelUpload)
+    r.POST("/api/schedule/:filename", leaderOnly(), scheduleChange)
+    r.GET("/api/scheduled", listScheduled)
+    r.GET("/api/consumers", listConsumers)
+    r.POST("/api/consumers", leaderOnly(), registerConsumer)
+    r.DELETE("/api/consumers/:name", leaderOnly(), unregisterConsumer)
+    r.DELETE("/api/scheduled/:id", leaderOnly(), cancelScheduled)
+    r.GET("/api/published", listPublished)
+    r.POST("/api/published", leaderOnly(), publishRef)
+    r.DELETE("/api/published/:name", leaderOnly(), unpublish)
+    r.GET("/published/:name/*path", servePublished)
+    r.POST("/api/promote", leaderOnly(), proposePromotion)
+    r.GET("/api/promotions", listPromotions)
+    r.GET("/api/promotions/:id", getPromotion)
+    r.POST("/api/promotions/:id/approve", leaderOnly(), approvePromotion)
+    r.POST("/api/promotions/:id/reject", leaderOnly(), rejectPromotion)
+    r.GET("/api/subscription", requireFeature(FeatureHooks), getSubscription)
+    r.PUT("/api/subscription", requireFeature(FeatureHooks), putSubscription)
+    r.DELETE("/api/subscription", requireFeature(FeatureHooks), deleteSubscription)
+    r.PUT("/api/watch/*path", requireFeature(FeatureHooks), watchFile)
+    r.DELETE("/api/watch/*path", requireFeature(FeatureHooks), unwatchFile)
+
+    return r
+}
+
+// Response compression
+
+// CompressMinSize is the smallest body worth compressing.
+const CompressMinSize = 1024
+
+// compressResponses gzip- or deflate-encodes responses for clients that accept
+// it. Bodies are held back until CompressMinSize bytes so small replies go out
+// as is; already compressed types and partial content pass through.
+func compressResponses() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+        if encoding == "" || c.Request.Method == "HEAD" {
+            c.Next()
+            return
+        }
+        w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+        c.Writer = w
+        c.Header("Vary", "Accept-Encoding")
+        defer w.Close()
+        c.Next()
+    }
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header.
+func negotiateEncoding(header string) string {
+    accepted := make(map[string]bool)
+    for _, part := range strings.Split(header, ",") {
+        fields := strings.Split(part, ";")
+        name := strings.ToLower(strings.TrimSpace(fields[0]))
+        q := 1.0
+        for _, param := range fields[1:] {
+            if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+                q, _ = strconv.ParseFloat(strings.TrimPrefix(v, "q="), 64)
+            }
+        }
+        accepted[name] = q > 0
+    }
+    for _, encoding := range []string{"gzip", "deflate"} {
+        if accepted[encoding] {
+            return encoding
+        }
+    }
+    return ""
+}
+
+func compressible(contentType string) bool {
+    switch {
+    case contentType == "":
+        return true
+    case strings.HasPrefix(contentType, "image/"), strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"):
+        return false
+    }
+    for _, t := range []string{"application/gzip", "application/zip", "application/pdf", "application/x-gzip"} {
+        if strings.HasPrefix(contentType, t) {
+            return false
+        }
+    }
+    return true
+}
+
+type flushWriteCloser interface {
+    io.WriteCloser
+    Flush() error
+}
+
+type compressWriter struct {
+    gin.ResponseWriter
+    encoding string
+    buf      []byte
+    decided  bool
+    enc      flushWriteCloser
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+    if !w.decided {
+        w.buf = append(w.buf, p...)
+        if len(w.buf) >= CompressMinSize {
+            if err := w.decide(true); err != nil {
+                return 0, err
+            }
+        }
+        return len(p), nil
+    }
+    if w.enc != nil {
+        return w.enc.Write(p)
+    }
+    return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+    return w.Write([]byte(s))
+}
+
+// decide commits to compressing (or not) and writes out what was held back.
+func (w *compressWriter) decide(large bool) error {
+    w.decided = true
+    h := w.Header()
+    if large && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+        w.Status() != http.StatusPartialContent && compressible(h.Get("Content-Type")) {
+        h.Set("Content-Encoding", w.encoding)
+        h.Del("Content-Length")
+        if w.encoding == "gzip" {
+            w.enc = gzip.NewWriter(w.ResponseWriter)
+        } else {
+            w.enc, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+        }
+        _, err := w.enc.Write(w.buf)
+        w.buf = nil
+        return err
+    }
+    _, err := w.ResponseWriter.Write(w.buf)
+    w.buf = nil
+    return err
+}
+
+func (w *compressWriter) Flush() {
+    if !w.decided {
+        w.decide(true)
+    }
+    if w.enc != nil {
+        w.enc.Flush()
+    }
+    w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Close() {
+    if !w.decided {
+        if len(w.buf) == 0 {
+            return
+        }
+        w.decide(false)
+    }
+    if w.enc != nil {
+        w.enc.Close()
+    }
+}
+
+// runGUI serves the editor on a random loopback port and shows it in a native
+// window (an app-mode Chrome/Edge/Chromium through lorca). The server stops
+// when the window is closed.
+func runGUI(r *gin.Engine, file string) error {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return err
+    }
+    defer ln.Close()
+    go http.Serve(ln, r)
+
+    url := fmt.Sprintf("http://%s/?file=%s", ln.Addr(), neturl.QueryEscape(file))
+    ui, err := lorca.New(url, "", 1280, 800)
+    if err != nil {
+        return fmt.Errorf("cannot open window (is Chrome or Edge installed?): %v", err)
+    }
+    defer ui.Close()
+
+    // Also stop on Ctrl+C in the terminal that started us
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt)
+    select {
+    case <-ui.Done():
+    case <-sig:
+    }
+    return nil
+}
+
+func openBrowser(url string) {
+    time.Sleep(500 * time.Millisecond)
+    var cmd *exec.Cmd
+    switch runtime.GOOS {
+    case "windows":
+        cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+    case "darwin":
+        cmd = exec.Command("open", url)
+    default:
+        cmd = exec.Command("xdg-open", url)
+    }
+    if err := cmd.Start(); err != nil {
+        fmt.Println("Open manually:", url)
+    }
+}
+
+func getFile(c *gin.Context) {
+    filename := c.Param("filename")
+    dir, rel, filepath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+
+    if asOf := c.Query("asOf"); asOf != "" {
+        getFileAsOf(c, dir, rel, asOf)
+        return
+    }
+
+    // Missing files are only created when configured or asked for
+    fs := fileStore(dir)
+    info, err := fs.Stat(storageName(rel))
+    if errors.Is(err, os.ErrNotExist) {
+        if !config.Create.OnOpen && c.Query("create") == "" {
+            c.JSON(404, gin.H{"error": fmt.Sprintf("%s does not exist", filename), "suggestions": suggestFiles(dir, rel)})
+            return
+        }
+        if _, ok := createFile(c, dir, rel, filepath); !ok {
+            return
+        }
+        info, err = fs.Stat(storageName(rel))
+    }
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+
+    content, err := readFile(c.Request.Context(), dir, rel, info)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    content = maskSecrets(rel, content)
+
+    fileType, syntax := fileHint(rel, content)
+    if err := checkEditable(rel, fileType, content); err != nil {
+        c.JSON(415, gin.H{"error": err.Error()})
+        return
+    }
+    if selection := c.Query("select"); selection != "" {
+        selectFields(c, gin.H{"filename": filename, "type": fileType}, fileType, content, selection)
+        return
+    }
+    resp := FileResponse{
+        Content:  string(content),
+        Filename: filename,
+        Freeze:   activeFreeze(rel),
+        Type:     fileType,
+        Mode:     syntax.Mode,
+        MIME:     syntax.MIME,
+    }
+    if view := c.Query("view"); view != "" {
+        if err := previewFile(&resp, view); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+    }
+    c.JSON(200, resp)
+}
+
+// selectFields answers ?select=, a comma-separated list of JSON pointers
+// ("*" matches one segment), with resp plus the values they select instead
+// of the whole file. Pointers that select nothing are listed as missing.
+func selectFields(c *gin.Context, resp gin.H, fileType string, content []byte, selection string) {
+    doc, err := parseDocument(content, fileType)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if doc == nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("%s documents have no fields to select", fileType)})
+        return
+    }
+    selected := map[string]interface{}{}
+    missing := []string{}
+    for _, pointer := range strings.Split(selection, ",") {
+        pointer = strings.TrimSpace(pointer)
+        if !strings.HasPrefix(pointer, "/") {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("%q is not a JSON pointer", pointer)})
+            return
+        }
+        matches := selectPointer(doc, pointer)
+        if len(matches) == 0 {
+            missing = append(missing, pointer)
+        }
+        for _, m := range matches {
+            selected[m.Pointer] = m.Value
+        }
+    }
+    resp["selected"], resp["missing"] = selected, missing
+    c.JSON(200, resp)
+}
+
+// previewFile turns a file response into a read-only view of it. The only
+// view is "expanded": YAML with anchors, aliases and merge keys resolved.
+func previewFile(resp *FileResponse, view string) error {
+    if view != "expanded" {
+        return fmt.Errorf("unknown view %q", view)
+    }
+    if resp.Type != "yaml" && resp.Type != "yml" {
+        return fmt.Errorf("only YAML files have an expanded view, not %s", resp.Type)
+    }
+    expanded, err := engine.Expand([]byte(resp.Content))
+    if err != nil {
+        return err
+    }
+    resp.Content, resp.View, resp.ReadOnly = string(expanded), view, true
+    return nil
+}
+
+// getFileAsOf serves the version of a file that was current at a moment: the
+// content of the last commit touching it at or before asOf.
+func getFileAsOf(c *gin.Context, dir, rel, asOf string) {
+    at, err := time.Parse(time.RFC3339, asOf)
+    if err != nil {
+        c.JSON(400, gin.H{"error": "asOf must be an RFC 3339 timestamp"})
+        return
+    }
+    lines, err := gitLines(c.Request.Context(), dir, "log", "-1", "--format=%H|%aI", "--before="+at.Format(time.RFC3339), "HEAD", "--", rel)
+    if err != nil || len(lines) == 0 {
+        c.JSON(404, gin.H{"error": fmt.Sprintf("%s has no version at or before %s", rel, asOf)})
+        return
+    }
+    parts := strings.SplitN(lines[0], "|", 2)
+    content, err := fileAtVersion(c.Request.Context(), dir, rel, parts[0])
+    if errors.Is(err, store.ErrNotFound) {
+        c.JSON(404, gin.H{"error": fmt.Sprintf("%s did not exist at %s", rel, asOf)})
+        return
+    }
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    content = maskSecrets(rel, content)
+    fileType, syntax := fileHint(rel, content)
+    if selection := c.Query("select"); selection != "" {
+        selectFields(c, gin.H{"filename": c.Param("filename"), "type": fileType, "commit": parts[0][:7], "date": parts[1]}, fileType, content, selection)
+        return
+    }
+    c.JSON(200, FileResponse{
+        Content:  string(content),
+        Filename: c.Param("filename"),
+        Commit:   parts[0][:7],
+        Date:     parts[1],
+        Type:     fileType,
+        Mode:     syntax.Mode,
+        MIME:     syntax.MIME,
+    })
+}
+
+// Suggestions for unknown files
+
+// MaxSuggestionCandidates bounds how many files suggestFiles looks at.
+const MaxSuggestionCandidates = 5000
+
+// suggestFiles returns up to five existing files whose names are close to
+// rel: a few typos apart, or the same hyphenated words in another order.
+func suggestFiles(dir, rel string) []string {
+    fs := fileStore(dir)
+    var candidates []string
+    var walk func(name string)
+    walk = func(name string) {
+        entries, err := fs.List(name)
+        if err != nil {
+            return
+        }
+        for _, e := range entries {
+            if len(candidates) >= MaxSuggestionCandidates {
+                return
+            }
+            base := path.Base(e.Name)
+            if e.IsDir && base != ".git" && base != MetaDir {
+                walk(e.Name)
+            } else if !e.IsDir && supportedFileType(e.Name) {
+                candidates = append(candidates, e.Name)
+            }
+        }
+    }
+    walk("")
+
+    type scored struct {
+        name  string
+        score int
+    }
+    want := strings.ToLower(storageName(rel))
+    limit := len(path.Base(want))/4 + 1
+    var matches []scored
+    for _, name := range candidates {
+        have := strings.ToLower(name)
+        score := editDistance(want, have)
+        if d := editDistance(path.Base(want), path.Base(have)); path.Dir(want) != path.Dir(have) && d+1 < score {
+            score = d + 1 // right name, wrong directory
+        }
+        if nameWords(want) == nameWords(have) {
+            score = 1
+        }
+        if score <= limit {
+            matches = append(matches, scored{name, score})
+        }
+    }
+    sort.Slice(matches, func(i, j int) bool {
+        if matches[i].score != matches[j].score {
+            return matches[i].score < matches[j].score
+        }
+        return matches[i].name < matches[j].name
+    })
+    suggestions := []string{}
+    for i := 0; i < len(matches) && i < 5; i++ {
+        name := matches[i].name
+        if dir != DataDir {
+            // Files under extra roots are opened by absolute path
+            name = filepath.Join(dir, filepath.FromSlash(name))
+        }
+        suggestions = append(suggestions, name)
+    }
+    return suggestions
+}
+
+// nameWords puts the words of a file name in order, so that
+// "prod-payments.yaml" and "payments_prod.yaml" compare equal.
+func nameWords(name string) string {
+    words := strings.FieldsFunc(name, func(r rune) bool {
+        return r == '-' || r == '_' || r == '.' || r == ' '
+    })
+    sort.Strings(words)
+    return strings.Join(words, " ")
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and swaps of neighbours each cost one.
+func editDistance(a, b string) int {
+    s, t := []rune(a), []rune(b)
+    d := make([][]int, len(s)+1)
+    for i := range d {
+        d[i] = make([]int, len(t)+1)
+        d[i][0] = i
+    }
+    for j := range d[0] {
+        d[0][j] = j
+    }
+    for i := 1; i <= len(s); i++ {
+        for j := 1; j <= len(t); j++ {
+            cost := 1
+            if s[i-1] == t[j-1] {
+                cost = 0
+            }
+            d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+            if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+                d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+            }
+        }
+    }
+    return d[len(s)][len(t)]
+}
+
+// CreateConfig controls how missing files come into existence. By default
+// opening one answers 404 and files are created explicitly with
+// POST /api/file/:name?create=1.
+type CreateConfig struct {
+    // OnOpen creates a missing file when it is opened, from the default
+    // template.
+    OnOpen bool `yaml:"on_open"`
+    // Templates names files, relative to the config file, that new files
+    // can start from with ?template=. A template called "default" replaces
+    // the built-in skeleton.
+    Templates map[string]string `yaml:"templates"`
+}
+
+// templateContent returns what a new file starts with: the named template
+// or, for "default", a small document of the file's type.
+func templateContent(rel, template string) ([]byte, error) {
+    if template == "" {
+        template = "default"
+    }
+    if path, ok := config.Create.Templates[template]; ok {
+        return ioutil.ReadFile(path)
+    }
+    if template != "default" {
+        return nil, fmt.Errorf("unknown template %q", template)
+    }
+    created := time.Now().Format(time.RFC3339)
+    switch getFileType(rel) {
+    case "json":
+        data := map[string]interface{}{
+            "name":    "New File",
+            "created": created,
+        }
+        bytes, _ := json.MarshalIndent(data, "", "  ")
+        return bytes, nil
+
+    case "yaml", "yml":
+        return []byte(fmt.Sprintf("name: New File\ncreated: %s\n", created)), nil
+
+    case "toml":
+        return []byte(fmt.Sprintf("name = \"New File\"\ncreated = %s\n", created)), nil
+
+    case "csv":
+        return []byte(fmt.Sprintf("name,created\nNew File,%s\n", created)), nil
+
+    case "tsv":
+        return []byte(fmt.Sprintf("name\tcreated\nNew File\t%s\n", created)), nil
+
+    case "tf":
+        return []byte(fmt.Sprintf("locals {\n  name    = \"New File\"\n  created = \"%s\"\n}\n", created)), nil
+
+    case "hcl":
+        return []byte(fmt.Sprintf("name    = \"New File\"\ncreated = \"%s\"\n", created)), nil
+
+    case "env":
+        return []byte(fmt.Sprintf("# created %s\nNAME=\"New File\"\n", created)), nil
+
+    case "cue":
+        return []byte(fmt.Sprintf("name:    \"New File\"\ncreated: \"%s\"\n", created)), nil
+
+    case "jsonnet", "libsonnet":
+        return []byte(fmt.Sprintf("{\n  name: 'New File',\n  created: '%s',\n}\n", created)), nil
+
+    case "xml":
+        return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<root>
+  <name>New File</name>
+  <created>%s</created>
+</root>`, created)), nil
+    }
+    return []byte{}, nil
+}
+
+// createFile creates a missing file from the template named by ?template=,
+// through validation and the save gates. When it fails it has already
+// answered the request and returns false.
+func createFile(c *gin.Context, dir, rel, fullPath string) (SaveResponse, bool) {
+    if _, err := fileStore(dir).Stat(storageName(rel)); err == nil {
+        c.JSON(409, gin.H{"error": fmt.Sprintf("%s already exists", rel)})
+        return SaveResponse{}, false
+    }
+    content, err := templateContent(rel, c.Query("template"))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return SaveResponse{}, false
+    }
+    fileType := getFileType(rel)
+    if err := validateContent(string(content), fileType); err != nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("template is not valid %s: %v", strings.ToUpper(fileType), err)})
+        return SaveResponse{}, false
+    }
+    candidate := &SaveCandidate{Filename: c.Param("filename"), Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: content, User: requestUser(c), Ticket: requestTicket(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return SaveResponse{}, false
+    }
+    resp, err := storeFile(c.Request.Context(), dir, rel, fullPath, content, fmt.Sprintf("Initial: %s", rel))
+    if err != nil {
+        storeErrorJSON(c, err)
+        return SaveResponse{}, false
+    }
+    return resp, true
+}
+
+func saveFile(c *gin.Context) {
+    filename := c.Param("filename")
+    dir, rel, filepath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+
+    if c.Query("create") != "" {
+        if resp, ok := createFile(c, dir, rel, filepath); ok {
+            c.JSON(201, resp)
+        }
+        return
+    }
+
+    var req SaveRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    content, err := unmaskSecrets(dir, rel, []byte(req.Content))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    req.Content = string(content)
+
+    // Validate content as its name says; a sniffed type only picks the mode
+    fileType := getFileType(rel)
+    if err := checkEditable(rel, fileType, content); err != nil {
+        c.JSON(415, gin.H{"error": err.Error()})
+        return
+    }
+    if err := validateContent(req.Content, fileType); err != nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid %s format: %v", strings.ToUpper(fileType), err)})
+        return
+    }
+    candidate := &SaveCandidate{Filename: filename, Dir: dir, Rel: rel, FullPath: filepath, FileType: fileType, Content: []byte(req.Content), User: requestUser(c), Ticket: requestTicket(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+
+    // Save file
+    resp, err := storeFile(c.Request.Context(), dir, rel, filepath, []byte(req.Content), commitMessage("update", candidate))
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+
+    c.JSON(200, resp)
+}
+
+// Consumers
+
+// ConsumerImpact is a consumer reading values a save changes.
+type ConsumerImpact struct {
+    Consumer string   `json:"consumer"`
+    Contact  string   `json:"contact,omitempty"`
+    Pointers []string `json:"pointers"`
+}
+
+var consumersMu sync.Mutex
+
+// registeredConsumers are the consumers registered through the API.
+func registeredConsumers() ([]Consumer, error) {
+    path, err := metaPath("consumers.json")
+    if err != nil {
+        return nil, err
+    }
+    consumers := []Consumer{}
+    content, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return consumers, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = json.Unmarshal(content, &consumers)
+    return consumers, err
+}
+
+func saveRegisteredConsumers(consumers []Consumer) error {
+    path, err := metaPath("consumers.json")
+    if err != nil {
+        return err
+    }
+    data, _ := json.MarshalIndent(consumers, "", "  ")
+    return writeFileAtomic(path, data, 0600)
+}
+
+// consumerManifest is the manifest of consumers: the consumers setting, or
+// else the manifest of the unused analysis.
+func consumerManifest() string {
+    if config.Consumers != "" {
+        return config.Consumers
+    }
+    if config.Unused != nil {
+        return config.Unused.Manifest
+    }
+    return ""
+}
+
+// readConsumers returns the consumers registered through the API followed
+// by those of manifest, if any.
+func readConsumers(manifest string) ([]Consumer, error) {
+    consumersMu.Lock()
+    consumers, err := registeredConsumers()
+    consumersMu.Unlock()
+    if err != nil || manifest == "" {
+        return consumers, err
+    }
+    content, err := ioutil.ReadFile(manifest)
+    if err != nil {
+        return consumers, err
+    }
+    var listed []Consumer
+    if err := yaml.Unmarshal(content, &listed); err != nil {
+        return consumers, fmt.Errorf("%s: %v", manifest, err)
+    }
+    for _, consumer := range listed {
+        consumer.Source = filepath.Base(manifest)
+        consumers = append(consumers, consumer)
+    }
+    return consumers, nil
+}
+
+// reads returns the patterns of the values c reads from rel, "" for the
+// whole file; ok is false when c does not read rel.
+func (c Consumer) reads(rel string) (patterns []string, ok bool) {
+    if !pathMatches(c.Files, rel) {
+        return nil, false
+    }
+    if len(c.Pointers) == 0 {
+        return []string{""}, true
+    }
+    return c.Pointers, true
+}
+
+// impactedConsumers lists the consumers reading values among changes to
+// rel, with the changed pointers each one reads.
+func impactedConsumers(rel string, changes []Change) []ConsumerImpact {
+    if len(changes) == 0 {
+        return nil
+    }
+    // A broken manifest must not hold up saves
+    consumers, err := readConsumers(consumerManifest())
+    if err != nil {
+        log.Printf("consumers: %v", err)
+    }
+    var impacts []ConsumerImpact
+    for _, consumer := range consumers {
+        patterns, ok := consumer.reads(rel)
+        if !ok {
+            continue
+        }
+        var pointers []string
+        for _, change := range changes {
+            for _, pattern := range patterns {
+                if pointerAffects(pattern, change.Pointer) {
+                    pointers = append(pointers, change.Pointer)
+                    break
+                }
+            }
+        }
+        if len(pointers) > 0 {
+            impacts = append(impacts, ConsumerImpact{Consumer: consumer.Name, Contact: consumer.Contact, Pointers: pointers})
+        }
+    }
+    return impacts
+}
+
+// saveImpact is impactedConsumers for a save about to replace the file on
+// disk.
+func saveImpact(s *SaveCandidate) []ConsumerImpact {
+    doc, err := s.Document()
+    if err != nil || doc == nil {
+        return nil
+    }
+    previous, err := s.PreviousDocument()
+    if err != nil || previous == nil {
+        return nil
+    }
+    return impactedConsumers(s.Rel, diffDocuments(previous, doc))
+}
+
+// listConsumers handles GET /api/consumers, optionally narrowed to those
+// reading ?file= and, within it, ?pointer= — who uses this setting.
+func listConsumers(c *gin.Context) {
+    rel := c.Query("file")
+    if rel != "" {
+        var err error
+        if _, rel, _, err = resolvePath(rel); err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return
+        }
+    }
+    all, err := readConsumers(consumerManifest())
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    pointer := c.Query("pointer")
+    consumers := []Consumer{}
+    for _, consumer := range all {
+        if rel == "" {
+            consumers = append(consumers, consumer)
+            continue
+        }
+        patterns, ok := consumer.reads(rel)
+        if !ok {
+            continue
+        }
+        for _, pattern := range patterns {
+            if pointer == "" || pointerAffects(pattern, pointer) {
+                consumers = append(consumers, consumer)
+                break
+            }
+        }
+    }
+    c.JSON(200, gin.H{"consumers": consumers})
+}
+
+// registerConsumer handles POST /api/consumers, a Consumer as JSON.
+// Registering a name again replaces what it reads.
+func registerConsumer(c *gin.Context) {
+    var consumer Consumer
+    if err := c.ShouldBindJSON(&consumer); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if consumer.Name == "" || len(consumer.Files) == 0 {
+        c.JSON(400, gin.H{"error": "name and files are required"})
+        return
+    }
+    for _, ptr := range consumer.Pointers {
+        if !strings.HasPrefix(ptr, "/") {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("%q is not a JSON pointer", ptr)})
+            return
+        }
+    }
+    now := time.Now().UTC()
+    consumer.Source, consumer.Registered = "api", &now
+
+    consumersMu.Lock()
+    defer consumersMu.Unlock()
+    consumers, err := registeredConsumers()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    status := 201
+    for i := range consumers {
+        if consumers[i].Name == consumer.Name {
+            consumers = append(consumers[:i], consumers[i+1:]...)
+            status = 200
+            break
+        }
+    }
+    consumers = append(consumers, consumer)
+    if err := saveRegisteredConsumers(consumers); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(status, consumer)
+}
+
+// unregisterConsumer handles DELETE /api/consumers/:name. Consumers listed
+// in the manifest are removed by editing it.
+func unregisterConsumer(c *gin.Context) {
+    name := c.Param("name")
+    consumersMu.Lock()
+    defer consumersMu.Unlock()
+    consumers, err := registeredConsumers()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    for i := range consumers {
+        if consumers[i].Name == name {
+            consumers = append(consumers[:i], consumers[i+1:]...)
+            if err := saveRegisteredConsumers(consumers); err != nil {
+                c.JSON(500, gin.H{"error": err.Error()})
+                return
+            }
+            c.JSON(200, gin.H{"removed": name})
+            return
+        }
+    }
+    c.JSON(404, gin.H{"error": fmt.Sprintf("no consumer %q is registered", name)})
+}
+
+// Resumable uploads
+
+// Upload is a file being sent in pieces, following the tus protocol's core:
+// the client creates an upload, PATCHes bytes at Upload-Offset and, after a
+// dropped connection, asks (HEAD) where to resume. The last piece triggers
+// validation and the usual save.
+type Upload struct {
+    ID       string    `json:"id"`
+    Filename string    `json:"filename"`
+    Size     int64     `json:"size"`
+    Offset   int64     `json:"offset"`
+    Message  string    `json:"message,omitempty"`
+    User     string    `json:"user,omitempty"`
+    Created  time.Time `json:"created"`
+}
+
+type UploadRequest struct {
+    Filename string `json:"filename" binding:"required"`
+    Size     int64  `json:"size"`
+    Message  string `json:"message"`
+}
+
+const (
+    // UploadExpiry is how long an unfinished upload is kept.
+    UploadExpiry = 24 * time.Hour
+    // DefaultMaxUpload is the largest upload accepted unless max_upload
+    // says otherwise. A finished upload is held in memory to be saved.
+    DefaultMaxUpload = 64 << 20
+)
+
+// maxUpload is the configured upload limit.
+func maxUpload() int64 {
+    if config.MaxUpload > 0 {
+        return config.MaxUpload
+    }
+    return DefaultMaxUpload
+}
+
+var uploadLocks sync.Map
+
+func uploadLock(id string) *sync.Mutex {
+    mu, _ := uploadLocks.LoadOrStore(id, new(sync.Mutex))
+    return mu.(*sync.Mutex)
+}
+
+func uploadPaths(id string) (meta, part string, err error) {
+    if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+        return "", "", fmt.Errorf("unknown upload %q", id)
+    }
+    if meta, err = metaPath("uploads", id+".json"); err != nil {
+        return "", "", err
+    }
+    return meta, strings.TrimSuffix(meta, ".json") + ".part", nil
+}
+
+func loadUpload(id string) (*Upload, string, error) {
+    meta, part, err := uploadPaths(id)
+    if err != nil {
+        return nil, "", err
+    }
+    content, err := ioutil.ReadFile(meta)
+    if err != nil {
+        return nil, "", fmt.Errorf("unknown upload %q", id)
+    }
+    var u Upload
+    if err := json.Unmarshal(content, &u); err != nil {
+        return nil, "", err
+    }
+    return &u, part, nil
+}
+
+func saveUpload(u *Upload) error {
+    meta, _, err := uploadPaths(u.ID)
+    if err != nil {
+        return err
+    }
+    data, _ := json.Marshal(u)
+    return writeFileAtomic(meta, data, 0600)
+}
+
+func removeUpload(id string) {
+    if meta, part, err := uploadPaths(id); err == nil {
+        os.Remove(meta)
+        os.Remove(part)
+    }
+    uploadLocks.Delete(id)
+}
+
+// expireUploads drops uploads abandoned for longer than UploadExpiry.
+func expireUploads() {
+    dir, err := metaPath("uploads", "x")
+    if err != nil {
+        return
+    }
+    matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "*.json"))
+    for _, meta := range matches {
+        if info, err := os.Stat(meta); err == nil && time.Since(info.ModTime()) > UploadExpiry {
+            removeUpload(strings.TrimSuffix(filepath.Base(meta), ".json"))
+        }
+    }
+}
+
+// createUpload handles POST /api/uploads.
+func createUpload(c *gin.Context) {
+    var req UploadRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if req.Size <= 0 {
+        c.JSON(400, gin.H{"error": "size must be positive"})
+        return
+    }
+    if req.Size > maxUpload() {
+        c.JSON(413, gin.H{"error": fmt.Sprintf("uploads are limited to %d bytes (max_upload)", maxUpload())})
+        return
+    }
+    if _, _, _, err := resolvePath(req.Filename); err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    expireUploads()
+
+    u := &Upload{ID: randomToken(), Filename: req.Filename, Size: req.Size, Message: req.Message, User: requestUser(c), Created: time.Now().UTC()}
+    _, part, err := uploadPaths(u.ID)
+    if err == nil {
+        err = ioutil.WriteFile(part, nil, 0600)
+    }
+    if err == nil {
+        err = saveUpload(u)
+    }
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.Header("Location", "/api/uploads/"+u.ID)
+    c.Header("Upload-Offset", "0")
+    c.JSON(201, u)
+}
+
+// uploadStatus handles HEAD and GET /api/uploads/:id; Upload-Offset tells the
+// client where to resume.
+func uploadStatus(c *gin.Context) {
+    u, _, err := loadUpload(c.Param("id"))
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+    c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+    c.Header("Upload-Length", strconv.FormatInt(u.Size, 10))
+    c.Header("Cache-Control", "no-store")
+    if c.Request.Method == "HEAD" {
+        c.Status(200)
+        return
+    }
+    c.JSON(200, u)
+}
+
+// patchUpload handles PATCH /api/uploads/:id, appending the body at the
+// Upload-Offset header. Bytes received before a connection drops are kept.
+func patchUpload(c *gin.Context) {
+    id := c.Param("id")
+    mu := uploadLock(id)
+    mu.Lock()
+    defer mu.Unlock()
+
+    u, part, err := loadUpload(id)
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+    offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+    if err != nil {
+        c.JSON(400, gin.H{"error": "Upload-Offset header is required"})
+        return
+    }
+    if offset != u.Offset {
+        c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+        c.JSON(409, gin.H{"error": fmt.Sprintf("upload is at offset %d, not %d", u.Offset, offset)})
+        return
+    }
+
+    f, err := os.OpenFile(part, os.O_WRONLY, 0600)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    // Drop anything past the recorded offset, e.g. from a crash mid-save
+    f.Truncate(u.Offset)
+    f.Seek(u.Offset, io.SeekStart)
+    n, copyErr := io.Copy(f, io.LimitReader(c.Request.Body, u.Size-u.Offset+1))
+    f.Close()
+    if u.Offset+n > u.Size {
+        os.Truncate(part, u.Offset)
+        c.JSON(413, gin.H{"error": fmt.Sprintf("upload is larger than the declared %d bytes", u.Size)})
+        return
+    }
+    u.Offset += n
+    if err := saveUpload(u); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+    if copyErr != nil {
+        c.JSON(400, gin.H{"error": copyErr.Error(), "offset": u.Offset})
+        return
+    }
+    if u.Offset < u.Size {
+        c.JSON(200, gin.H{"offset": u.Offset})
+        return
+    }
+    finishUpload(c, u, part)
+}
+
+// finishUpload validates a complete upload and saves it like any other file.
+// The upload is kept when that fails so the client can inspect or cancel it.
+func finishUpload(c *gin.Context, u *Upload, part string) {
+    // The body may take longer than the request timeout to arrive; the save
+    // itself is still bounded by the git timeout
+    ctx := context.WithoutCancel(c.Request.Context())
+    dir, rel, fullPath, err := resolvePath(u.Filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    if u.Size > maxUpload() {
+        c.JSON(413, gin.H{"error": fmt.Sprintf("uploads are limited to %d bytes (max_upload)", maxUpload())})
+        return
+    }
+    // Validate as the file streams in from disk, so that only a valid
+    // document is read into memory to be saved
+    fileType := getFileType(u.Filename)
+    f, err := os.Open(part)
+    if err == nil {
+        err = validateReader(f, fileType)
+        f.Close()
+    }
+    if err != nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid %s format: %v", strings.ToUpper(fileType), err)})
+        return
+    }
+    content, err := ioutil.ReadFile(part)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    if err := checkEditable(rel, fileType, content); err != nil {
+        c.JSON(415, gin.H{"error": err.Error()})
+        return
+    }
+    candidate := &SaveCandidate{Filename: u.Filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: content, User: u.User, Ticket: requestTicket(c), Context: ctx}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+    message := u.Message
+    if message == "" {
+        message = commitMessage("update", candidate)
+    }
+    if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    resp, err := storeFile(ctx, dir, rel, fullPath, content, message)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    removeUpload(u.ID)
+    c.JSON(200, resp)
+}
+
+// cancelUpload handles DELETE /api/uploads/:id.
+func cancelUpload(c *gin.Context) {
+    id := c.Param("id")
+    if _, _, err := loadUpload(id); err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+    removeUpload(id)
+    c.JSON(200, gin.H{"success": true})
+}
+
+
+// storeFile writes content to disk and commits it, unless .gitignore excludes
+// the path. It is shared by the HTTP handlers and the terminal UI.
+func storeFile(ctx context.Context, dir, rel, fullPath string, content []byte, commitMessage string) (SaveResponse, error) {
+    return storeFileDepth(ctx, dir, rel, fullPath, content, commitMessage, 0)
+}
+
+// storeFileDepth is storeFile for a save triggered depth levels down a chain
+// of derived files.
+func storeFileDepth(ctx context.Context, dir, rel, fullPath string, content []byte, commitMessage string, depth int) (SaveResponse, error) {
+    resps, err := storeFilesDepth(ctx, dir, []PendingFile{{Rel: rel, FullPath: fullPath, Content: content}}, commitMessage, depth)
+    if err != nil {
+        return SaveResponse{}, err
+    }
+    return resps[0], nil
+}
+
+// PendingFile is one file of a storeFiles call.
+type PendingFile struct {
+    Rel      string
+    FullPath string
+    Content  []byte
+}
+
+// storeFiles is storeFile for several files of one root, committed together.
+// Either all of them are written or, when a write fails, none are: the ones
+// written before it are put back as they were.
+func storeFiles(ctx context.Context, dir string, files []PendingFile, commitMessage string) ([]SaveResponse, error) {
+    return storeFilesDepth(ctx, dir, files, commitMessage, 0)
+}
+
+func storeFilesDepth(ctx context.Context, dir string, files []PendingFile, commitMessage string, depth int) ([]SaveResponse, error) {
+    if !replicas.isLeader() {
+        return nil, errNotLeader
+    }
+    ctx, cancel := writeContext(ctx)
+    defer cancel()
+    type save struct {
+        PendingFile
+        changed  bool
+        summary  string
+        impacted []ConsumerImpact
+        breaking []Violation
+        previous []byte // nil when the file is new
+        stat     *storage.FileInfo
+    }
+    saves := make([]save, len(files))
+    rels := make([]string, len(files))
+    for i, f := range files {
+        normalized, err := normalizeContent(f.Rel, getFileType(f.Rel), f.Content)
+        if err != nil {
+            return nil, fmt.Errorf("normalizing %s: %v", f.Rel, err)
+        }
+        sv := save{PendingFile: f, changed: !bytes.Equal(normalized, f.Content)}
+        sv.Content = normalized
+
+        // Summarize against the old version for notifications before replacing it
+        candidate := &SaveCandidate{Dir: dir, Rel: f.Rel, FullPath: f.FullPath, FileType: getFileType(f.Rel), Content: sv.Content}
+        sv.summary = changeSummary(candidate)
+        sv.impacted = saveImpact(candidate)
+        if len(config.Policies.Compat) > 0 {
+            if doc, err := parseDocument(sv.Content, getFileType(f.Rel)); err == nil && doc != nil {
+                sv.breaking = breakingChanges(ctx, dir, f.Rel, getFileType(f.Rel), doc, true)
+            }
+        }
+        saves[i], rels[i] = sv, f.Rel
+    }
+    fs := fileStore(dir)
+    // A write may keep the size and modification time cached reads are
+    // keyed by, so the entries of both versions go
+    forget := func(written []save) {
+        for _, sv := range written {
+            if sv.stat != nil {
+                reads.forget(ctx, fileKey(dir, sv.Rel, *sv.stat)...)
+            }
+            if info, err := fs.Stat(storageName(sv.Rel)); err == nil {
+                reads.forget(ctx, fileKey(dir, sv.Rel, info)...)
+            }
+        }
+    }
+    for i := range saves {
+        sv := &saves[i]
+        if info, err := fs.Stat(storageName(sv.Rel)); err == nil {
+            sv.stat = &info
+        }
+        if len(saves) > 1 {
+            previous, err := fs.Read(storageName(sv.Rel))
+            if err != nil && !errors.Is(err, os.ErrNotExist) {
+                return nil, err
+            }
+            sv.previous = previous
+        }
+        if err := fs.Write(storageName(sv.Rel), sv.Content); err != nil {
+            for _, done := range saves[:i] {
+                if done.previous != nil {
+                    fs.Write(storageName(done.Rel), done.previous)
+                } else {
+                    fs.Remove(storageName(done.Rel))
+                }
+            }
+            forget(saves[:i])
+            return nil, err
+        }
+    }
+    forget(saves)
+
+    // Git commit
+    timestamp := time.Now().Format(time.RFC3339)
+    ignored := ignoredPaths(ctx, dir, rels)
+    var commit []string
+    for _, rel := range rels {
+        if ignored[rel] != ".gitignore" {
+            commit = append(commit, storageName(rel))
+        }
+    }
+    hash := ""
+    if len(commit) > 0 {
+        var err error
+        if hash, err = historyFor(dir).Commit(ctx, commit, commitMessage); err != nil {
+            return nil, fmt.Errorf("%s was written but not committed: %w", strings.Join(rels, ", "), err)
+        }
+    }
+
+    resps := make([]SaveResponse, len(saves))
+    for i, sv := range saves {
+        resp := SaveResponse{
+            Success:    true,
+            Message:    "File saved and committed",
+            Commit:     hash,
+            Timestamp:  timestamp,
+            Normalized: sv.changed,
+        }
+        switch ignored[sv.Rel] {
+        case ".gitignore":
+            // git refuses to add ignored files; keep the save but say so
+            resp.Message, resp.Commit = "File saved", ""
+            resp.Warning = fmt.Sprintf("%s is ignored by .gitignore and was not committed", sv.Rel)
+        case IgnoreFile:
+            resp.Warning = fmt.Sprintf("%s is excluded by %s", sv.Rel, IgnoreFile)
+        }
+        if _, ok := historyFor(dir).(store.Unversioned); ok {
+            resp.Message = "File saved"
+        }
+        filesIndex.refresh(sv.FullPath, resp.Commit)
+        event := FileEvent{Path: filepath.ToSlash(sv.Rel), Commit: resp.Commit, Timestamp: timestamp, Summary: sv.summary, Content: string(sv.Content)}
+        for _, impact := range sv.impacted {
+            event.Impacted = append(event.Impacted, impact.Consumer)
+        }
+        notify("file.saved", event)
+
+        // Rebuild generated files that read this one
+        derived, errs := regenerateDerived(ctx, dir, sv.Rel, depth)
+        resp.Derived = derived
+        for _, err := range errs {
+            log.Printf("derived: %v", err)
+            if resp.Warning != "" {
+                resp.Warning += "; "
+            }
+            resp.Warning += "regenerating " + err.Error()
+        }
+        resp.Budget = checkBudgets(sv.Rel, sv.Content).Violations
+        resp.Breaking = sv.breaking
+        resp.Impacted = sv.impacted
+        resps[i] = resp
+    }
+    return resps, nil
+}
+
+// DerivedFile is generated from a Go text/template and one or more data
+// files, all relative to the data directory. Saving an input or the template
+// regenerates and commits Output. Inside the template each input is available
+// under its base name without extension, e.g. {{range .sites.domains}}.
+type DerivedFile struct {
+    Output   string   `yaml:"output"`
+    Template string   `yaml:"template"`
+    Inputs   []string `yaml:"inputs"`
+}
+
+// MaxDerivedDepth bounds chains of derived files feeding each other.
+const MaxDerivedDepth = 4
+
+var templateFuncs = texttemplate.FuncMap{
+    "json": func(v interface{}) (string, error) {
+        b, err := json.Marshal(v)
+        return string(b), err
+    },
+    "yaml": func(v interface{}) (string, error) {
+        b, err := yaml.Marshal(v)
+        return strings.TrimSuffix(string(b), "\n"), err
+    },
+    "join": func(sep string, items []interface{}) string {
+        parts := make([]string, len(items))
+        for i, item := range items {
+            parts[i] = fmt.Sprint(item)
+        }
+        return strings.Join(parts, sep)
+    },
+    "upper": strings.ToUpper,
+    "lower": strings.ToLower,
+    "default": func(fallback, v interface{}) interface{} {
+        if v == nil || v == "" {
+            return fallback
+        }
+        return v
+    },
+}
+
+// regenerateDerived rebuilds every derived file that depends on rel and
+// returns the outputs it committed. Errors are reported, not fatal: the
+// triggering save has already happened.
+func regenerateDerived(ctx context.Context, dir, rel string, depth int) ([]string, []error) {
+    if len(config.Derived) == 0 || depth >= MaxDerivedDepth {
+        return nil, nil
+    }
+    absDir, _ := filepath.Abs(dir)
+    absData, _ := filepath.Abs(DataDir)
+    if absDir != absData {
+        return nil, nil
+    }
+
+    var outputs []string
+    var errs []error
+    rel = filepath.ToSlash(rel)
+    for _, d := range config.Derived {
+        if !dependsOn(d, rel) {
+            continue
+        }
+        content, err := renderDerived(d)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %v", d.Output, err))
+            continue
+        }
+        outDir, outRel, outPath, err := resolvePath(d.Output)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %v", d.Output, err))
+            continue
+        }
+        if current, err := fileStore(outDir).Read(storageName(outRel)); err == nil && bytes.Equal(current, content) {
+            continue
+        }
+        if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        message := fmt.Sprintf("Regenerate %s from %s", d.Output, d.Template)
+        resp, err := storeFileDepth(ctx, outDir, outRel, outPath, content, message, depth+1)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %v", d.Output, err))
+            continue
+        }
+        outputs = append(outputs, d.Output)
+        outputs = append(outputs, resp.Derived...)
+        if resp.Warning != "" {
+            errs = append(errs, errors.New(resp.Warning))
+        }
+    }
+    return outputs, errs
+}
+
+func dependsOn(d DerivedFile, rel string) bool {
+    if path.Clean(d.Template) == rel {
+        return true
+    }
+    for _, input := range d.Inputs {
+        if path.Clean(input) == rel {
+            return true
+        }
+    }
+    return false
+}
+
+func renderDerived(d DerivedFile) ([]byte, error) {
+    tmplDir, tmplRel, _, err := resolvePath(d.Template)
+    if err != nil {
+        return nil, err
+    }
+    source, err := fileStore(tmplDir).Read(storageName(tmplRel))
+    if err != nil {
+        return nil, err
+    }
+    tmpl, err := texttemplate.New(path.Base(d.Template)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(source))
+    if err != nil {
+        return nil, err
+    }
+
+    data := make(map[string]interface{})
+    for _, input := range d.Inputs {
+        inputDir, inputRel, _, err := resolvePath(input)
+        if err != nil {
+            return nil, err
+        }
+        content, err := fileStore(inputDir).Read(storageName(inputRel))
+        if err != nil {
+            return nil, err
+        }
+        doc, err := parseDocument(content, getFileType(input))
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", input, err)
+        }
+        if doc == nil {
+            // No data model (XML, plain text): expose the raw text
+            doc = string(content)
+        }
+        data[strings.TrimSuffix(path.Base(input), path.Ext(input))] = doc
+    }
+
+    var b bytes.Buffer
+    if err := tmpl.Execute(&b, data); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+func getHistory(c *gin.Context) {
+    filename := c.Param("filename")
+    dir, rel, _, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.JSON(200, HistoryResponse{History: fileHistory(c.Request.Context(), dir, rel)})
+}
+
+// fileHistory returns the 20 most recent commits touching rel. In git the
+// log is cached per HEAD.
+func fileHistory(ctx context.Context, dir, rel string) []HistoryItem {
+    h := historyFor(dir)
+    load := func() ([]byte, error) {
+        history, err := h.Log(ctx, storageName(rel), 20)
+        if err != nil {
+            return nil, err
+        }
+        return json.Marshal(history)
+    }
+    var data []byte
+    var err error
+    if _, ok := h.(store.Git); ok && reads.available() {
+        var head string
+        if head, err = store.Head(ctx, dir); err == nil {
+            data, err = reads.fetch(ctx, load, "log", dir, head, storageName(rel))
+        }
+    } else {
+        data, err = load()
+    }
+    var history []HistoryItem
+    if err == nil {
+        err = json.Unmarshal(data, &history)
+    }
+    if err != nil || history == nil {
+        if err != nil {
+            log.Printf("history %s: %v", rel, err)
+        }
+        return []HistoryItem{}
+    }
+    return history
+}
+
+// fileAtVersion returns the content of rel as of the given commit, cached
+// when the commit is named by its hash.
+func fileAtVersion(ctx context.Context, dir, rel, hash string) ([]byte, error) {
+    show := func() ([]byte, error) {
+        return historyFor(dir).Show(ctx, storageName(rel), hash)
+    }
+    if _, ok := historyFor(dir).(store.Git); !ok || !commitHash.MatchString(hash) {
+        return show()
+    }
+    return reads.fetch(ctx, show, "show", dir, hash, storageName(rel))
+}
+
+// CompareResponse is a side-by-side diff of a file between two refs.
+type CompareResponse struct {
+    File  string     `json:"file"`
+    From  string     `json:"from"`
+    To    string     `json:"to"`
+    Hunks []DiffHunk `json:"hunks"`
+}
+
+type DiffHunk struct {
+    OldStart int       `json:"oldStart"`
+    OldLines int       `json:"oldLines"`
+    NewStart int       `json:"newStart"`
+    NewLines int       `json:"newLines"`
+    Rows     []DiffRow `json:"rows"`
+}
+
+// DiffRow is one aligned row: context has both sides equal, change pairs a
+// removed line with the added line replacing it, delete and add have one side.
+type DiffRow struct {
+    Kind  string    `json:"kind"`
+    Left  *DiffLine `json:"left,omitempty"`
+    Right *DiffLine `json:"right,omitempty"`
+}
+
+type DiffLine struct {
+    Number   int           `json:"number"`
+    Text     string        `json:"text"`
+    Segments []DiffSegment `json:"segments,omitempty"`
+}
+
+// DiffSegment is a run of words within a changed line.
+type DiffSegment struct {
+    Text    string `json:"text"`
+    Changed bool   `json:"changed,omitempty"`
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// compareVersions handles GET /api/compare/:filename?from=&to=&context=.
+func compareVersions(c *gin.Context) {
+    dir, rel, _, err := resolvePath(c.Param("filename"))
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    to := c.DefaultQuery("to", "HEAD")
+    from := c.DefaultQuery("from", to+"~1")
+    unified, err := strconv.Atoi(c.DefaultQuery("context", "3"))
+    if err != nil || unified < 0 {
+        c.JSON(400, gin.H{"error": "context must be a non-negative number"})
+        return
+    }
+    for _, rev := range []string{from, to} {
+        if strings.HasPrefix(rev, "-") {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("invalid revision %q", rev)})
+            return
+        }
+        if _, ok := historyFor(dir).(store.Git); !ok {
+            continue
+        }
+        if _, err := resolveRestorePoint(c.Request.Context(), dir, rev, ""); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+    }
+    var output string
+    if masksSecrets(rel) {
+        output, err = maskedDiff(c.Request.Context(), dir, rel, from, to, unified)
+    } else {
+        output, err = historyFor(dir).Diff(c.Request.Context(), storageName(rel), from, to, unified)
+    }
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, CompareResponse{File: rel, From: from, To: to, Hunks: parseUnifiedDiff(output)})
+}
+
+// maskedDiff diffs two versions of a file with maskSecrets applied to both,
+// so that comparing versions does not reveal secrets either.
+func maskedDiff(ctx context.Context, dir, rel, from, to string, unified int) (string, error) {
+    tmp, err := ioutil.TempDir("", "edit3-diff")
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tmp)
+    var paths []string
+    for _, rev := range []string{from, to} {
+        content, err := fileAtVersion(ctx, dir, rel, rev)
+        if errors.Is(err, store.ErrNotFound) {
+            content, err = nil, nil // added or deleted in between
+        }
+        if err != nil {
+            return "", err
+        }
+        p := filepath.Join(tmp, fmt.Sprintf("%d", len(paths)))
+        if err := ioutil.WriteFile(p, maskSecrets(rel, content), 0600); err != nil {
+            return "", err
+        }
+        paths = append(paths, p)
+    }
+    output, err := exec.CommandContext(ctx, "git", "diff", "--no-index", "--no-color", fmt.Sprintf("-U%d", unified), paths[0], paths[1]).Output()
+    if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+        err = nil // the files differ
+    }
+    return string(output), err
+}
+
+// parseUnifiedDiff turns git's unified diff into aligned side-by-side hunks.
+func parseUnifiedDiff(diff string) []DiffHunk {
+    hunks := []DiffHunk{}
+    var hunk *DiffHunk
+    var removed, added []DiffLine
+    oldLine, newLine := 0, 0
+
+    flush := func() {
+        for i := 0; i < len(removed) || i < len(added); i++ {
+            row := DiffRow{}
+            if i < len(removed) {
+                row.Left = &removed[i]
+            }
+            if i < len(added) {
+                row.Right = &added[i]
+            }
+            switch {
+            case row.Left != nil && row.Right != nil:
+                row.Kind = "change"
+                row.Left.Segments, row.Right.Segments = wordDiff(row.Left.Text, row.Right.Text)
+            case row.Left != nil:
+                row.Kind = "delete"
+            default:
+                row.Kind = "add"
+            }
+            hunk.Rows = append(hunk.Rows, row)
+        }
+        removed, added = nil, nil
+    }
+
+    for _, line := range strings.Split(diff, "\n") {
+        if m := hunkHeader.FindStringSubmatch(line); m != nil {
+            if hunk != nil {
+                flush()
+            }
+            hunks = append(hunks, DiffHunk{})
+            hunk = &hunks[len(hunks)-1]
+            hunk.OldStart, _ = strconv.Atoi(m[1])
+            hunk.NewStart, _ = strconv.Atoi(m[3])
+            hunk.OldLines, hunk.NewLines = 1, 1
+            if m[2] != "" {
+                hunk.OldLines, _ = strconv.Atoi(m[2])
+            }
+            if m[4] != "" {
+                hunk.NewLines, _ = strconv.Atoi(m[4])
+            }
+            oldLine, newLine = hunk.OldStart, hunk.NewStart
+            continue
+        }
+        if hunk == nil || line == "" {
+            continue
+        }
+        switch line[0] {
+        case '-':
+            removed = append(removed, DiffLine{Number: oldLine, Text: line[1:]})
+            oldLine++
+        case '+':
+            added = append(added, DiffLine{Number: newLine, Text: line[1:]})
+            newLine++
+        case ' ':
+            flush()
+            hunk.Rows = append(hunk.Rows, DiffRow{
+                Kind:  "context",
+                Left:  &DiffLine{Number: oldLine, Text: line[1:]},
+                Right: &DiffLine{Number: newLine, Text: line[1:]},
+            })
+            oldLine++
+            newLine++
+        }
+    }
+    if hunk != nil {
+        flush()
+    }
+    return hunks
+}
+
+var wordToken = regexp.MustCompile(`\w+|\s+|[^\w\s]`)
+
+// MaxWordDiffCells bounds the LCS table for intraline diffs; longer line
+// pairs are marked as changed as a whole.
+const MaxWordDiffCells = 40000
+
+// wordDiff splits two versions of a line into segments, marking the words
+// not in their longest common subsequence as changed.
+func wordDiff(a, b string) ([]DiffSegment, []DiffSegment) {
+    x, y := wordToken.FindAllString(a, -1), wordToken.FindAllString(b, -1)
+    if len(x)*len(y) > MaxWordDiffCells {
+        return []DiffSegment{{Text: a, Changed: true}}, []DiffSegment{{Text: b, Changed: true}}
+    }
+    lcs := make([][]int, len(x)+1)
+    for i := range lcs {
+        lcs[i] = make([]int, len(y)+1)
+    }
+    for i := len(x) - 1; i >= 0; i-- {
+        for j := len(y) - 1; j >= 0; j-- {
+            if x[i] == y[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+
+    var left, right []DiffSegment
+    add := func(segments []DiffSegment, text string, changed bool) []DiffSegment {
+        if n := len(segments); n > 0 && segments[n-1].Changed == changed {
+            segments[n-1].Text += text
+            return segments
+        }
+        return append(segments, DiffSegment{Text: text, Changed: changed})
+    }
+    i, j := 0, 0
+    for i < len(x) || j < len(y) {
+        switch {
+        case i < len(x) && j < len(y) && x[i] == y[j]:
+            left, right = add(left, x[i], false), add(right, y[j], false)
+            i++
+            j++
+        case j < len(y) && (i == len(x) || lcs[i][j+1] >= lcs[i+1][j]):
+            right = add(right, y[j], true)
+            j++
+        default:
+            left = add(left, x[i], true)
+            i++
+        }
+    }
+    return left, right
+}
+
+func restoreVersion(c *gin.Context) {
+    filename := c.Param("filename")
+    hash := c.Param("hash")
+    dir, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+
+    // Get file content at specific commit
+    output, err := fileAtVersion(c.Request.Context(), dir, rel, hash)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+
+    // A restore is a save like any other and passes the same gates
+    candidate := &SaveCandidate{Filename: filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: getFileType(rel), Content: output, User: requestUser(c), Ticket: requestTicket(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+
+    // Save as current version and commit the restore
+    if _, err := storeFile(c.Request.Context(), dir, rel, fullPath, output, fmt.Sprintf("Restored to version %s", hash)); err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+
+    c.JSON(200, gin.H{
+        "success": true,
+        "content": string(maskSecrets(rel, output)),
+        "message": fmt.Sprintf("Restored to version %s", hash),
+    })
+}
+
+// RestoreSetRequest restores every file matching Glob to how it was at Ref
+// (a tag, branch or commit) or, if Ref is empty, at time At (anything
+// "git log --before" accepts).
+type RestoreSetRequest struct {
+    Glob    string `json:"glob"`
+    Ref     string `json:"ref"`
+    At      string `json:"at"`
+    Message string `json:"message"`
+}
+
+// restoreSet rolls a group of files in the data directory back to a point in
+// time in one commit. Files that did not exist then are removed.
+func restoreSet(c *gin.Context) {
+    ctx := c.Request.Context()
+    var req RestoreSetRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if req.Glob == "" || (req.Ref == "") == (req.At == "") {
+        c.JSON(400, gin.H{"error": "glob and exactly one of ref or at are required"})
+        return
+    }
+
+    commit, err := resolveRestorePoint(ctx, DataDir, req.Ref, req.At)
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    then, err := gitLines(ctx, DataDir, "ls-tree", "-r", "--name-only", commit)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    now, err := gitLines(ctx, DataDir, "ls-files")
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    existed := make(map[string]bool)
+    for _, rel := range then {
+        existed[rel] = true
+    }
+
+    var rels []string
+    seen := make(map[string]bool)
+    for _, rel := range append(then, now...) {
+        if seen[rel] || !supportedFileType(rel) || !pathMatches([]string{req.Glob}, rel) {
+            continue
+        }
+        seen[rel] = true
+        if _, _, _, err := resolvePath(rel); err != nil {
+            continue
+        }
+        rels = append(rels, rel)
+    }
+    ignored := ignoredPaths(ctx, DataDir, rels)
+
+    type pending struct {
+        rel, full string
+        content   []byte
+    }
+    var writes []pending
+    var removed, changed []string
+    var violations []Violation
+    for _, rel := range rels {
+        if _, ok := ignored[rel]; ok {
+            continue
+        }
+        dir, rel, full, _ := resolvePath(rel)
+        current, currentErr := fileStore(dir).Read(storageName(rel))
+        if !existed[filepath.ToSlash(rel)] {
+            if currentErr == nil {
+                removed = append(removed, rel)
+                changed = append(changed, rel)
+            }
+            continue
+        }
+        content, err := fileAtVersion(ctx, dir, rel, commit)
+        if err != nil {
+            storeErrorJSON(c, fmt.Errorf("%s: %w", rel, err))
+            return
+        }
+        if currentErr == nil && bytes.Equal(current, content) {
+            continue
+        }
+        candidate := &SaveCandidate{Filename: rel, Dir: dir, Rel: rel, FullPath: full, FileType: getFileType(rel), Content: content, User: requestUser(c), Context: ctx}
+        if err := checkSaveGates(candidate); err != nil {
+            violations = append(violations, err.(*PolicyError).Violations...)
+        }
+        writes = append(writes, pending{rel, full, content})
+        changed = append(changed, rel)
+    }
+    if len(violations) > 0 {
+        policyErrorJSON(c, &PolicyError{Violations: violations})
+        return
+    }
+
+    restored := []string{}
+    for _, w := range writes {
+        if err := os.MkdirAll(filepath.Dir(w.full), 0755); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        if err := ioutil.WriteFile(w.full, w.content, 0644); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        restored = append(restored, w.rel)
+    }
+    for _, rel := range removed {
+        if err := os.Remove(filepath.Join(DataDir, rel)); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+    }
+    if len(changed) == 0 {
+        c.JSON(200, gin.H{"success": true, "message": "Files already match " + commit[:7], "restored": restored, "removed": []string{}})
+        return
+    }
+
+    message := req.Message
+    if message == "" {
+        point := req.Ref
+        if point == "" {
+            point = req.At
+        }
+        message = fmt.Sprintf("Restore %s to %s (%s)", req.Glob, point, commit[:7])
+    }
+    if err := commitFiles(ctx, DataDir, changed, message); err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    hash, _ := gitLines(ctx, DataDir, "rev-parse", "--short=7", "HEAD")
+    if removed == nil {
+        removed = []string{}
+    }
+    c.JSON(200, gin.H{
+        "success":  true,
+        "message":  message,
+        "commit":   strings.Join(hash, ""),
+        "restored": restored,
+        "removed":  removed,
+    })
+}
+
+// fsckRepository checks the git repository of the data directory and, with
+// ?repair=true, repairs it, so a stale lock left by a crashed git no longer
+// blocks every save. ?force=true also takes the steps that may throw work
+// away: removing locks that may still be held and aborting interrupted
+// merges and rebases. It takes the admin role.
+func fsckRepository(c *gin.Context) {
+    if config.AdminRole == "" || !hasRole(requestUser(c), config.AdminRole) {
+        c.JSON(403, gin.H{"error": "checking the repository requires the admin role (admin_role)"})
+        return
+    }
+    dir := DataDir
+    if _, ok := historyFor(dir).(store.Git); !ok {
+        c.JSON(409, gin.H{"error": "history is not kept in git"})
+        return
+    }
+    repair := c.Query("repair") == "true"
+    problems, err := store.Fsck(c.Request.Context(), dir, repair, c.Query("force") == "true")
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    healthy := true
+    for _, p := range problems {
+        healthy = healthy && p.Repaired
+        log.Printf("fsck %s: %s %s: %s (repaired: %v)", dir, p.Kind, p.Path, p.Detail, p.Repaired)
+    }
+    c.JSON(200, gin.H{"healthy": healthy, "repair": repair, "problems": problems})
+}
+
+// resolveRestorePoint turns a ref or a date into a commit hash.
+func resolveRestorePoint(ctx context.Context, dir, ref, at string) (string, error) {
+    if ref != "" {
+        if strings.HasPrefix(ref, "-") {
+            return "", fmt.Errorf("unknown ref %q", ref)
+        }
+        lines, err := gitLines(ctx, dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+        if err != nil || len(lines) == 0 {
+            return "", fmt.Errorf("unknown ref %q", ref)
+        }
+        return lines[0], nil
+    }
+    lines, err := gitLines(ctx, dir, "rev-list", "-1", "--before="+at, "HEAD")
+    if err != nil || len(lines) == 0 {
+        return "", fmt.Errorf("no commit at or before %q", at)
+    }
+    return lines[0], nil
+}
+
+// gitLines runs git in dir and returns its non-empty output lines.
+func gitLines(ctx context.Context, dir string, args ...string) ([]string, error) {
+    return store.Lines(ctx, dir, args...)
+}
+
+// Publishing
+
+// Publication is a commit of the data directory whose files are served
+// read-only under /published/<name>/. A name stands for one commit until it
+// is unpublished, after which it may be published again at another.
+type Publication struct {
+    Name      string    `json:"name"`
+    Ref       string    `json:"ref"` // as given when publishing
+    Commit    string    `json:"commit"`
+    User      string    `json:"user,omitempty"`
+    Published time.Time `json:"published"`
+}
+
+type PublishRequest struct {
+    Name string `json:"name"` // default: ref
+    Ref  string `json:"ref"`
+}
+
+var (
+    publishMu       sync.Mutex
+    publicationName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+func loadPublications() ([]*Publication, error) {
+    path, err := metaPath("published.json")
+    if err != nil {
+        return nil, err
+    }
+    publications := []*Publication{}
+    content, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return publications, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = json.Unmarshal(content, &publications)
+    return publications, err
+}
+
+func savePublications(publications []*Publication) error {
+    path, err := metaPath("published.json")
+    if err != nil {
+        return err
+    }
+    data, _ := json.MarshalIndent(publications, "", "  ")
+    return writeFileAtomic(path, data, 0644)
+}
+
+// findPublication returns the publication called name, or nil.
+func findPublication(name string) (*Publication, error) {
+    publishMu.Lock()
+    defer publishMu.Unlock()
+    publications, err := loadPublications()
+    if err != nil {
+        return nil, err
+    }
+    for _, p := range publications {
+        if p.Name == name {
+            return p, nil
+        }
+    }
+    return nil, nil
+}
+
+func listPublished(c *gin.Context) {
+    publishMu.Lock()
+    publications, err := loadPublications()
+    publishMu.Unlock()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"published": publications})
+}
+
+// publishRef handles POST /api/published: it resolves a ref (branch, tag or
+// commit) of the data directory and publishes that commit under a name.
+// Names cannot be moved; unpublish first to reuse one.
+func publishRef(c *gin.Context) {
+    var req PublishRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if req.Name == "" {
+        req.Name = req.Ref
+    }
+    if req.Ref == "" || !publicationName.MatchString(req.Name) {
+        c.JSON(400, gin.H{"error": "a ref and a name of letters, digits, '.', '_' and '-' are required"})
+        return
+    }
+    if _, ok := historyFor(DataDir).(store.Git); !ok {
+        c.JSON(409, gin.H{"error": "history is not kept in git"})
+        return
+    }
+    commit, err := resolveRestorePoint(c.Request.Context(), DataDir, req.Ref, "")
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+
+    publishMu.Lock()
+    defer publishMu.Unlock()
+    publications, err := loadPublications()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    for _, p := range publications {
+        if p.Name == req.Name {
+            c.JSON(409, gin.H{"error": fmt.Sprintf("%s is already published at %s", p.Name, p.Commit[:7]), "published": p})
+            return
+        }
+    }
+    p := &Publication{Name: req.Name, Ref: req.Ref, Commit: commit, User: requestUser(c), Published: time.Now().UTC()}
+    if err := savePublications(append(publications, p)); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    notify("published", p)
+    c.JSON(201, p)
+}
+
+func unpublish(c *gin.Context) {
+    publishMu.Lock()
+    defer publishMu.Unlock()
+    publications, err := loadPublications()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    for i, p := range publications {
+        if p.Name != c.Param("name") {
+            continue
+        }
+        if err := savePublications(append(publications[:i:i], publications[i+1:]...)); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(200, p)
+        return
+    }
+    c.JSON(404, gin.H{"error": fmt.Sprintf("%s is not published", c.Param("name"))})
+}
+
+// servePublished handles GET /published/<name>/<path>: the file as of the
+// published commit, or the list of its files when path is empty. The commit
+// is the ETag; since a name can be republished, caches keep responses for
+// PublishedMaxAge only and revalidate them after.
+func servePublished(c *gin.Context) {
+    p, err := findPublication(c.Param("name"))
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    if p == nil {
+        c.JSON(404, gin.H{"error": fmt.Sprintf("%s is not published", c.Param("name"))})
+        return
+    }
+    rel := strings.TrimPrefix(path.Clean("/"+c.Param("path")), "/")
+
+    etag := `"` + p.Commit + `"`
+    if c.GetHeader("If-None-Match") == etag {
+        c.Status(304)
+        return
+    }
+    ctx := c.Request.Context()
+    if rel == "" {
+        files, err := gitLines(ctx, DataDir, "ls-tree", "-r", "--name-only", p.Commit, "--", ".")
+        if err != nil {
+            storeErrorJSON(c, err)
+            return
+        }
+        publishedHeaders(c, etag)
+        c.JSON(200, gin.H{"name": p.Name, "commit": p.Commit, "files": files})
+        return
+    }
+    content, err := fileAtVersion(ctx, DataDir, rel, p.Commit)
+    if errors.Is(err, store.ErrNotFound) {
+        c.JSON(404, gin.H{"error": fmt.Sprintf("%s has no file %s", p.Name, rel)})
+        return
+    }
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    publishedHeaders(c, etag)
+    c.Data(200, engine.SyntaxOf(getFileType(rel)).MIME, maskSecrets(rel, content))
+}
+
+// PublishedMaxAge is how long caches may serve a published file without
+// asking whether its name still stands for the same commit.
+const PublishedMaxAge = time.Minute
+
+func publishedHeaders(c *gin.Context, etag string) {
+    c.Header("ETag", etag)
+    c.Header("Cache-Control", fmt.Sprintf("max-age=%d", int(PublishedMaxAge.Seconds())))
+}
+
+// Promotion
+
+// Environment is a directory of the data directory, such as envs/prod.
+type Environment struct {
+    Path string `yaml:"path"`
+    // ApproveRole may approve promotions into the environment; without it
+    // anyone but the proposer may.
+    ApproveRole string `yaml:"approve_role"`
+}
+
+// Promotion proposes copying files from one environment to another as they
+// were at a commit of the source. It is applied as one commit when someone
+// other than the proposer approves it, and only if the target files are
+// still as they were when it was proposed.
+type Promotion struct {
+    ID       string         `json:"id"`
+    From     string         `json:"from"`
+    To       string         `json:"to"`
+    Ref      string         `json:"ref"`
+    Source   string         `json:"source"` // commit the files are taken from
+    Files    []PromotedFile `json:"files"`
+    Message  string         `json:"message,omitempty"`
+    User     string         `json:"user,omitempty"`
+    Created  time.Time      `json:"created"`
+    Status   string         `json:"status"`
+    Reviewer string         `json:"reviewer,omitempty"`
+    Reviewed *time.Time     `json:"reviewed,omitempty"`
+    Reason   string         `json:"reason,omitempty"`
+    Commit   string         `json:"commit,omitempty"`
+    Error    string         `json:"error,omitempty"`
+    // Reminded and Escalated record the last reminder and the escalation
+    // sent while the promotion waits.
+    Reminded  *time.Time `json:"reminded,omitempty"`
+    Escalated *time.Time `json:"escalated,omitempty"`
+}
+
+// PromotedFile is one file of a promotion. Base is the SHA-256 of the
+// target file when proposed, empty when it did not exist.
+type PromotedFile struct {
+    Path   string `json:"path"`   // relative to the environments
+    Status string `json:"status"` // added, modified
+    Diff   string `json:"diff"`
+    Base   string `json:"base,omitempty"`
+}
+
+type PromoteRequest struct {
+    From    string   `json:"from"`
+    To      string   `json:"to"`
+    Files   []string `json:"files"`
+    Glob    string   `json:"glob"` // alternatively, every source file matching it
+    Ref     string   `json:"ref"`  // tag, branch or commit of the source; default HEAD
+    Message string   `json:"message"`
+}
+
+// Promotion states.
+const (
+    PromotionPending  = "pending"
+    PromotionApplied  = "applied"
+    PromotionRejected = "rejected"
+    PromotionFailed   = "failed"
+)
+
+var promotionMu sync.Mutex
+
+func loadPromotions() ([]*Promotion, error) {
+    path, err := metaPath("promotions.json")
+    if err != nil {
+        return nil, err
+    }
+    promotions := []*Promotion{}
+    content, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return promotions, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = json.Unmarshal(content, &promotions)
+    return promotions, err
+}
+
+func savePromotions(promotions []*Promotion) error {
+    path, err := metaPath("promotions.json")
+    if err != nil {
+        return err
+    }
+    data, _ := json.MarshalIndent(promotions, "", "  ")
+    return writeFileAtomic(path, data, 0600)
+}
+
+// envFile returns the data directory name of file in environment env.
+func envFile(env, file string) string {
+    return path.Join(filepath.ToSlash(config.Environments[env].Path), file)
+}
+
+// promotedPath cleans a promotion entry, which names a file inside both
+// environments and so must not be absolute or climb out with "..".
+func promotedPath(file string) (string, error) {
+    clean := path.Clean(filepath.ToSlash(file))
+    if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+        return "", fmt.Errorf("%s: not a path inside the environment", file)
+    }
+    return clean, nil
+}
+
+func contentHash(content []byte) string {
+    sum := sha256.Sum256(content)
+    return hex.EncodeToString(sum[:])
+}
+
+// proposePromotion handles POST /api/promote. It diffs the source files at
+// the ref against the target and queues the files that differ for review.
+func proposePromotion(c *gin.Context) {
+    ctx := c.Request.Context()
+    var req PromoteRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    for _, env := range []string{req.From, req.To} {
+        if _, ok := config.Environments[env]; !ok {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("unknown environment %q", env)})
+            return
+        }
+    }
+    if req.From == req.To || (len(req.Files) == 0) == (req.Glob == "") {
+        c.JSON(400, gin.H{"error": "two different environments and either files or glob are required"})
+        return
+    }
+    if _, ok := historyFor(DataDir).(store.Git); !ok {
+        c.JSON(409, gin.H{"error": "history is not kept in git"})
+        return
+    }
+    if req.Ref == "" {
+        req.Ref = "HEAD"
+    }
+    source, err := resolveRestorePoint(ctx, DataDir, req.Ref, "")
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+
+    files := req.Files
+    if req.Glob != "" {
+        root := filepath.ToSlash(filepath.Clean(config.Environments[req.From].Path))
+        listed, err := gitLines(ctx, DataDir, "ls-tree", "-r", "--name-only", source, "--", root)
+        if err != nil {
+            storeErrorJSON(c, err)
+            return
+        }
+        for _, name := range listed {
+            if rel := strings.TrimPrefix(name, root+"/"); pathMatches([]string{req.Glob}, rel) {
+                files = append(files, rel)
+            }
+        }
+    }
+
+    p := &Promotion{
+        ID:      randomToken()[:12],
+        From:    req.From,
+        To:      req.To,
+        Ref:     req.Ref,
+        Source:  source,
+        Files:   []PromotedFile{},
+        Message: req.Message,
+        User:    requestUser(c),
+        Created: time.Now().UTC(),
+        Status:  PromotionPending,
+    }
+    for _, file := range files {
+        file, err := promotedPath(file)
+        if err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+        dir, rel, _, err := resolvePath(envFile(req.To, file))
+        if err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return
+        }
+        content, err := fileAtVersion(ctx, DataDir, envFile(req.From, file), source)
+        if errors.Is(err, store.ErrNotFound) {
+            c.JSON(404, gin.H{"error": fmt.Sprintf("%s has no %s at %s", req.From, file, req.Ref)})
+            return
+        }
+        if err != nil {
+            storeErrorJSON(c, err)
+            return
+        }
+        current, err := fileStore(dir).Read(storageName(rel))
+        f := PromotedFile{Path: file, Status: "modified"}
+        switch {
+        case os.IsNotExist(err):
+            f.Status = "added"
+        case err != nil:
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        case bytes.Equal(current, content):
+            continue
+        default:
+            f.Base = contentHash(current)
+        }
+        f.Diff = store.UnifiedDiff(storageName(rel), string(maskSecrets(rel, current)), string(maskSecrets(rel, content)), 3)
+        p.Files = append(p.Files, f)
+    }
+    if len(p.Files) == 0 {
+        c.JSON(409, gin.H{"error": fmt.Sprintf("%s already matches %s at %s", req.To, req.From, req.Ref)})
+        return
+    }
+
+    promotionMu.Lock()
+    defer promotionMu.Unlock()
+    promotions, err := loadPromotions()
+    if err == nil {
+        err = savePromotions(append(promotions, p))
+    }
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    notify("promotion.proposed", p)
+    c.JSON(201, p)
+}
+
+// listPromotions returns promotions, optionally only those with ?status=.
+func listPromotions(c *gin.Context) {
+    promotionMu.Lock()
+    promotions, err := loadPromotions()
+    promotionMu.Unlock()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    result := []*Promotion{}
+    for _, p := range promotions {
+        if status := c.Query("status"); status == "" || p.Status == status {
+            result = append(result, p)
+        }
+    }
+    c.JSON(200, gin.H{"promotions": result})
+}
+
+func getPromotion(c *gin.Context) {
+    promotionMu.Lock()
+    promotions, err := loadPromotions()
+    promotionMu.Unlock()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    for _, p := range promotions {
+        if p.ID == c.Param("id") {
+            c.JSON(200, p)
+            return
+        }
+    }
+    c.JSON(404, gin.H{"error": "no such promotion"})
+}
+
+// reviewPromotion finds the pending promotion of the request and checks the
+// requester may review it. It writes the error response itself; the caller
+// holds promotionMu and saves promotions after changing p.
+func reviewPromotion(c *gin.Context) (promotions []*Promotion, p *Promotion, ok bool) {
+    promotions, err := loadPromotions()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return nil, nil, false
+    }
+    for _, candidate := range promotions {
+        if candidate.ID == c.Param("id") {
+            p = candidate
+        }
+    }
+    if p == nil {
+        c.JSON(404, gin.H{"error": "no such promotion"})
+        return nil, nil, false
+    }
+    user := requestUser(c)
+    role := config.Environments[p.To].ApproveRole
+    switch {
+    case p.Status != PromotionPending:
+        c.JSON(409, gin.H{"error": "promotion is " + p.Status})
+    case user == p.User:
+        c.JSON(403, gin.H{"error": "a promotion must be reviewed by someone other than its proposer"})
+    case role != "" && !hasRole(user, role):
+        c.JSON(403, gin.H{"error": fmt.Sprintf("reviewing promotions into %s requires the %s role", p.To, role)})
+    default:
+        now := time.Now().UTC()
+        p.Reviewer, p.Reviewed = user, &now
+        return promotions, p, true
+    }
+    return nil, nil, false
+}
+
+// approvePromotion applies a pending promotion in one commit whose message
+// records where the files came from and who proposed and approved them.
+func approvePromotion(c *gin.Context) {
+    ctx := c.Request.Context()
+    promotionMu.Lock()
+    defer promotionMu.Unlock()
+    promotions, p, ok := reviewPromotion(c)
+    if !ok {
+        return
+    }
+
+    var writes []PendingFile
+    var violations []Violation
+    fail := func(status int, err error) {
+        p.Status, p.Error = PromotionFailed, err.Error()
+        savePromotions(promotions)
+        notify("promotion.failed", p)
+        c.JSON(status, gin.H{"error": p.Error, "promotion": p})
+    }
+    for _, f := range p.Files {
+        if _, err := promotedPath(f.Path); err != nil {
+            fail(400, err)
+            return
+        }
+        dir, rel, full, err := resolvePath(envFile(p.To, f.Path))
+        if err != nil {
+            fail(403, err)
+            return
+        }
+        if dir != DataDir {
+            fail(403, fmt.Errorf("%s: not in the data directory", f.Path))
+            return
+        }
+        base := ""
+        if current, err := fileStore(dir).Read(storageName(rel)); err == nil {
+            base = contentHash(current)
+        }
+        if base != f.Base {
+            fail(409, fmt.Errorf("%s changed in %s since the promotion was proposed", f.Path, p.To))
+            return
+        }
+        content, err := fileAtVersion(ctx, DataDir, envFile(p.From, f.Path), p.Source)
+        if err != nil {
+            fail(500, err)
+            return
+        }
+        candidate := &SaveCandidate{Filename: rel, Dir: dir, Rel: rel, FullPath: full, FileType: getFileType(rel), Content: content, User: p.Reviewer, Context: ctx}
+        if err := checkSaveGates(candidate); err != nil {
+            violations = append(violations, err.(*PolicyError).Violations...)
+        }
+        writes = append(writes, PendingFile{Rel: rel, FullPath: full, Content: content})
+    }
+    if len(violations) > 0 {
+        // Policies may change before a retry; the promotion stays pending
+        policyErrorJSON(c, &PolicyError{Violations: violations})
+        return
+    }
+
+    message := p.Message
+    if message == "" {
+        message = fmt.Sprintf("Promote %d file(s) from %s to %s", len(p.Files), p.From, p.To)
+    }
+    message += fmt.Sprintf("\n\nPromoted-From: %s@%s (%s)\nPromotion: %s\nProposed-By: %s\nApproved-By: %s", p.From, shortCommit(p.Source), p.Ref, p.ID, p.User, p.Reviewer)
+    // storeFiles puts back what it wrote when any file fails
+    resps, err := storeFiles(ctx, DataDir, writes, message)
+    if err != nil {
+        p.Status, p.Error = PromotionFailed, err.Error()
+        savePromotions(promotions)
+        storeErrorJSON(c, err)
+        return
+    }
+    p.Status, p.Commit = PromotionApplied, shortCommit(resps[0].Commit)
+    if err := savePromotions(promotions); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    notify("promotion.applied", p)
+    c.JSON(200, p)
+}
+
+// rejectPromotion closes a pending promotion with an optional reason.
+func rejectPromotion(c *gin.Context) {
+    var req struct {
+        Reason string `json:"reason"`
+    }
+    c.ShouldBindJSON(&req)
+    promotionMu.Lock()
+    defer promotionMu.Unlock()
+    promotions, p, ok := reviewPromotion(c)
+    if !ok {
+        return
+    }
+    p.Status, p.Reason = PromotionRejected, req.Reason
+    if err := savePromotions(promotions); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    notify("promotion.rejected", p)
+    c.JSON(200, p)
+}
+
+// Approval notifications
+
+// ApprovalRule sends promotions into Environments (all when empty) to its
+// channels when proposed and resolved. While one is pending, reviewers are
+// reminded every RemindEvery, and after EscalateAfter the Escalate
+// channels (or the rule's own) are told once.
+type ApprovalRule struct {
+    Environments    []string `yaml:"environments"`
+    ApprovalChannel `yaml:",inline"`
+    RemindEvery     time.Duration   `yaml:"remind_every"`
+    EscalateAfter   time.Duration   `yaml:"escalate_after"`
+    Escalate        ApprovalChannel `yaml:"escalate"`
+}
+
+// ApprovalChannel is where approval messages go: a Slack incoming webhook
+// gets text, a plain webhook the event as JSON, email addresses a mail.
+type ApprovalChannel struct {
+    Slack   string   `yaml:"slack"`
+    Webhook string   `yaml:"webhook"`
+    Email   []string `yaml:"email"`
+}
+
+func (ch ApprovalChannel) empty() bool {
+    return ch.Slack == "" && ch.Webhook == "" && len(ch.Email) == 0
+}
+
+func (r ApprovalRule) matches(p *Promotion) bool {
+    if len(r.Environments) == 0 {
+        return true
+    }
+    for _, env := range r.Environments {
+        if env == p.To {
+            return true
+        }
+    }
+    return false
+}
+
+// approvalNotifier announces proposed and resolved promotions.
+func approvalNotifier(event string, data interface{}) {
+    p, ok := data.(*Promotion)
+    text := describeEvent(event, data)
+    if !ok || text == "" {
+        return
+    }
+    for _, rule := range config.Notify.Approvals {
+        if rule.matches(p) {
+            sendApproval(rule.ApprovalChannel, event, text, p)
+        }
+    }
+}
+
+// promotionText describes a promotion event for people.
+func promotionText(event string, p *Promotion) string {
+    switch event {
+    case "promotion.proposed":
+        return fmt.Sprintf("%s proposes promoting %s from %s to %s; review it with id %s", orSomeone(p.User), promotedFiles(p), p.From, p.To, p.ID)
+    case "promotion.applied":
+        return fmt.Sprintf("%s approved promoting %s from %s to %s (commit %s)", orSomeone(p.Reviewer), promotedFiles(p), p.From, p.To, p.Commit)
+    case "promotion.rejected":
+        text := fmt.Sprintf("%s rejected promoting %s from %s to %s", orSomeone(p.Reviewer), promotedFiles(p), p.From, p.To)
+        if p.Reason != "" {
+            text += ": " + p.Reason
+        }
+        return text
+    case "promotion.failed":
+        return fmt.Sprintf("Promoting %s from %s to %s failed: %s", promotedFiles(p), p.From, p.To, p.Error)
+    }
+    return ""
+}
+
+// remindReviewers sends due reminders and escalations for pending
+// promotions.
+func remindReviewers(now time.Time) {
+    if len(config.Notify.Approvals) == 0 || !featureEnabled(FeatureHooks) {
+        return
+    }
+    promotionMu.Lock()
+    defer promotionMu.Unlock()
+    promotions, err := loadPromotions()
+    if err != nil {
+        log.Printf("approvals: %v", err)
+        return
+    }
+    changed := false
+    for _, p := range promotions {
+        if p.Status != PromotionPending {
+            continue
+        }
+        waited := now.Sub(p.Created)
+        for _, rule := range config.Notify.Approvals {
+            if !rule.matches(p) {
+                continue
+            }
+            if rule.EscalateAfter > 0 && waited >= rule.EscalateAfter && p.Escalated == nil {
+                to := rule.Escalate
+                if to.empty() {
+                    to = rule.ApprovalChannel
+                }
+                text := fmt.Sprintf("Escalation: promoting %s from %s to %s has waited %s for review (id %s, proposed by %s)", promotedFiles(p), p.From, p.To, waited.Round(time.Second), p.ID, orSomeone(p.User))
+                sendApproval(to, "promotion.escalated", text, p)
+                p.Escalated = &now
+                changed = true
+            }
+            last := p.Created
+            if p.Reminded != nil {
+                last = *p.Reminded
+            }
+            if rule.RemindEvery > 0 && now.Sub(last) >= rule.RemindEvery {
+                text := fmt.Sprintf("Reminder: promoting %s from %s to %s has waited %s for review (id %s)", promotedFiles(p), p.From, p.To, waited.Round(time.Second), p.ID)
+                sendApproval(rule.ApprovalChannel, "promotion.reminder", text, p)
+                p.Reminded = &now
+                changed = true
+            }
+        }
+    }
+    if changed {
+        if err := savePromotions(promotions); err != nil {
+            log.Printf("approvals: %v", err)
+        }
+    }
+}
+
+func promotedFiles(p *Promotion) string {
+    names := make([]string, 0, len(p.Files))
+    for _, f := range p.Files {
+        names = append(names, f.Path)
+    }
+    if len(names) > 3 {
+        return fmt.Sprintf("%s and %d more", strings.Join(names[:3], ", "), len(names)-3)
+    }
+    return strings.Join(names, ", ")
+}
+
+func orSomeone(user string) string {
+    if user == "" {
+        return "someone"
+    }
+    return user
+}
+
+// sendApproval posts a message to a channel without blocking.
+func sendApproval(ch ApprovalChannel, event, text string, p *Promotion) {
+    ch.send(event, text, p, eventPaths(p))
+}
+
+// send delivers a message about paths to every destination of the channel
+// without blocking: Slack gets the text, the webhook the event as JSON.
+func (ch ApprovalChannel) send(event, text string, data interface{}, paths []string) {
+    if ch.Slack != "" {
+        body, _ := json.Marshal(gin.H{"text": text})
+        postEvent(event, ch.Slack, body)
+    }
+    if ch.Webhook != "" {
+        body, _ := json.Marshal(gin.H{"event": event, "time": time.Now().UTC(), "text": text, "data": data})
+        postEvent(event, ch.Webhook, body)
+    }
+    if len(ch.Email) > 0 {
+        sendEmail(ch.Email, EmailMessage{Event: event, Text: text, Paths: paths, Data: data})
+    }
+}
+
+// postEvent posts a JSON body to url in the background.
+func postEvent(event, url string, body []byte) {
+    client := &http.Client{Timeout: timeout(config.Timeouts.Webhook, WebhookTimeout)}
+    go func() {
+        resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+        if err != nil {
+            log.Printf("notify %s: %v", event, err)
+            return
+        }
+        resp.Body.Close()
+        if resp.StatusCode >= 300 {
+            log.Printf("notify %s: %s returned %s", event, url, resp.Status)
+        }
+    }()
+}
+
+// Email notifications
+
+// EmailConfig is the SMTP server notifications are sent through. TLS is
+// "starttls" (the default, port 587), "implicit" (port 465) or "none".
+// Subject and Body are text/templates over an EmailMessage.
+type EmailConfig struct {
+    Host     string `yaml:"host"`
+    Port     int    `yaml:"port"`
+    TLS      string `yaml:"tls"`
+    Username string `yaml:"username"`
+    Password string `yaml:"password"`
+    From     string `yaml:"from"`
+    Subject  string `yaml:"subject"`
+    Body     string `yaml:"body"`
+
+    subject *texttemplate.Template
+    body    *texttemplate.Template
+}
+
+const (
+    DefaultEmailSubject = `[edit3] {{.Event}}{{if .Paths}} {{index .Paths 0}}{{end}}`
+    DefaultEmailBody    = "{{.Text}}\n{{range .Paths}}\n  {{.}}{{end}}\n\nSent by edit3 at {{.Time.Format \"2006-01-02 15:04 MST\"}}.\n"
+)
+
+// EmailMessage is what the subject and body templates see.
+type EmailMessage struct {
+    Event string
+    Time  time.Time
+    Text  string   // one line describing the event
+    Paths []string // files it concerns
+    Data  interface{}
+}
+
+func (e *EmailConfig) compile() error {
+    if e.Host == "" || e.From == "" {
+        return errors.New("host and from are required")
+    }
+    if _, err := mail.ParseAddress(e.From); err != nil {
+        return fmt.Errorf("from: %v", err)
+    }
+    switch e.TLS {
+    case "", "starttls", "implicit", "none":
+    default:
+        return fmt.Errorf("unknown tls %q (use starttls, implicit or none)", e.TLS)
+    }
+    if e.Port == 0 {
+        e.Port = 587
+        if e.TLS == "implicit" {
+            e.Port = 465
+        }
+    }
+    subject, body := e.Subject, e.Body
+    if subject == "" {
+        subject = DefaultEmailSubject
+    }
+    if body == "" {
+        body = DefaultEmailBody
+    }
+    var err error
+    if e.subject, err = texttemplate.New("subject").Funcs(templateFuncs).Parse(subject); err != nil {
+        return err
+    }
+    e.body, err = texttemplate.New("body").Funcs(templateFuncs).Parse(body)
+    return err
+}
+
+// Subscription is one user's choice of which events about which files to
+// receive, and where: by email (the default), to a Slack incoming webhook or
+// to a webhook of their own at URL.
+type Subscription struct {
+    Channel string   `json:"channel,omitempty"`
+    Email   string   `json:"email,omitempty"`
+    URL     string   `json:"url,omitempty"`
+    Paths   []string `json:"paths"`            // globs; empty for every file
+    Events  []string `json:"events,omitempty"` // e.g. file.saved; empty for all
+    Updated string   `json:"updated,omitempty"`
+}
+
+// check reports what keeps the subscription from being delivered.
+func (s Subscription) check() error {
+    switch s.Channel {
+    case "", "email":
+        if config.Notify.Email == nil {
+            return errors.New("email is not configured on this server")
+        }
+        if _, err := mail.ParseAddress(s.Email); err != nil {
+            return fmt.Errorf("email: %v", err)
+        }
+    case "slack", "webhook":
+        if u, err := neturl.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("%s needs an http(s) url", s.Channel)
+        }
+        if !allowedDestination(s.URL) {
+            return fmt.Errorf("%s is not among the destinations configured on this server", s.URL)
+        }
+    default:
+        return fmt.Errorf("unknown channel %q (use email, slack or webhook)", s.Channel)
+    }
+    for _, pattern := range s.Paths {
+        if _, err := path.Match(pattern, ""); err != nil {
+            return fmt.Errorf("path %q: %v", pattern, err)
+        }
+    }
+    return nil
+}
+
+// allowedDestination reports whether raw is under one of the configured
+// notify destinations: same scheme and host, and a path below the
+// destination's.
+func allowedDestination(raw string) bool {
+    u, err := neturl.Parse(raw)
+    if err != nil || u.User != nil {
+        return false
+    }
+    for _, dest := range config.Notify.Destinations {
+        d, err := neturl.Parse(dest)
+        if err != nil || d.Scheme != u.Scheme || !strings.EqualFold(d.Host, u.Host) {
+            continue
+        }
+        prefix := d.Path
+        if u.Path == prefix || strings.HasPrefix(u.Path, strings.TrimSuffix(prefix, "/")+"/") {
+            return true
+        }
+    }
+    return false
+}
+
+var subscriptionMu sync.Mutex
+
+func (s Subscription) wants(event string, paths []string) bool {
+    if len(s.Events) > 0 {
+        found := false
+        for _, e := range s.Events {
+            found = found || e == event
+        }
+        if !found {
+            return false
+        }
+    }
+    for _, p := range paths {
+        if len(s.Paths) == 0 || pathMatches(s.Paths, p) {
+            return true
+        }
+    }
+    return false
+}
+
+// loadSubscription returns the subscription of the request's user, empty
+// when there is none.
+func loadSubscription(c *gin.Context) (Subscription, error) {
+    sub := Subscription{Paths: []string{}}
+    file, err := metaPath("subscriptions", sessionUser(c)+".json")
+    if err != nil {
+        return sub, err
+    }
+    content, err := ioutil.ReadFile(file)
+    if os.IsNotExist(err) {
+        return sub, nil
+    }
+    if err == nil {
+        err = json.Unmarshal(content, &sub)
+    }
+    return sub, err
+}
+
+func saveSubscription(c *gin.Context, sub Subscription) error {
+    file, err := metaPath("subscriptions", sessionUser(c)+".json")
+    if err != nil {
+        return err
+    }
+    if sub.Paths == nil {
+        sub.Paths = []string{}
+    }
+    data, _ := json.MarshalIndent(sub, "", "  ")
+    return writeFileAtomic(file, data, 0600)
+}
+
+func getSubscription(c *gin.Context) {
+    subscriptionMu.Lock()
+    sub, err := loadSubscription(c)
+    subscriptionMu.Unlock()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, sub)
+}
+
+func putSubscription(c *gin.Context) {
+    var sub Subscription
+    if err := c.ShouldBindJSON(&sub); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if err := sub.check(); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    sub.Updated = time.Now().Format(time.RFC3339)
+    subscriptionMu.Lock()
+    defer subscriptionMu.Unlock()
+    if err := saveSubscription(c, sub); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, sub)
+}
+
+func deleteSubscription(c *gin.Context) {
+    file, err := metaPath("subscriptions", sessionUser(c)+".json")
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    subscriptionMu.Lock()
+    defer subscriptionMu.Unlock()
+    if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"success": true})
+}
+
+// WatchRequest optionally sets the channel while adding a watch.
+type WatchRequest struct {
+    Channel string   `json:"channel"`
+    Email   string   `json:"email"`
+    URL     string   `json:"url"`
+    Events  []string `json:"events"`
+}
+
+// watchFile handles PUT /api/watch/:path: the user is notified of changes
+// to the file or glob from now on, through the channel of their
+// subscription or the one given.
+func watchFile(c *gin.Context) {
+    var req WatchRequest
+    if c.Request.ContentLength != 0 {
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+    }
+    pattern := strings.TrimPrefix(c.Param("path"), "/")
+    subscriptionMu.Lock()
+    defer subscriptionMu.Unlock()
+    sub, err := loadSubscription(c)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    if req.Channel != "" || req.Email != "" || req.URL != "" {
+        sub.Channel, sub.Email, sub.URL = req.Channel, req.Email, req.URL
+    }
+    if req.Events != nil {
+        sub.Events = req.Events
+    }
+    watched := false
+    for _, p := range sub.Paths {
+        watched = watched || p == pattern
+    }
+    if !watched {
+        sub.Paths = append(sub.Paths, pattern)
+    }
+    if err := sub.check(); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    sub.Updated = time.Now().Format(time.RFC3339)
+    if err := saveSubscription(c, sub); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, sub)
+}
+
+// unwatchFile handles DELETE /api/watch/:path. Removing the last path
+// removes the subscription, which would otherwise match every file.
+func unwatchFile(c *gin.Context) {
+    pattern := strings.TrimPrefix(c.Param("path"), "/")
+    subscriptionMu.Lock()
+    defer subscriptionMu.Unlock()
+    sub, err := loadSubscription(c)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    paths := []string{}
+    for _, p := range sub.Paths {
+        if p != pattern {
+            paths = append(paths, p)
+        }
+    }
+    if len(paths) == len(sub.Paths) {
+        c.JSON(404, gin.H{"error": fmt.Sprintf("%s is not watched", pattern)})
+        return
+    }
+    sub.Paths, sub.Updated = paths, time.Now().Format(time.RFC3339)
+    if len(paths) == 0 {
+        file, _ := metaPath("subscriptions", sessionUser(c)+".json")
+        err = os.Remove(file)
+    } else {
+        err = saveSubscription(c, sub)
+    }
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, sub)
+}
+
+// loadSubscriptions returns every user's subscription.
+func loadSubscriptions() []Subscription {
+    dir, err := metaPath("subscriptions", "x")
+    if err != nil {
+        return nil
+    }
+    subscriptionMu.Lock()
+    defer subscriptionMu.Unlock()
+    files, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "*.json"))
+    var subs []Subscription
+    for _, file := range files {
+        var sub Subscription
+        if content, err := ioutil.ReadFile(file); err == nil && json.Unmarshal(content, &sub) == nil {
+            subs = append(subs, sub)
+        }
+    }
+    return subs
+}
+
+// eventPaths returns the files an event is about.
+func eventPaths(data interface{}) []string {
+    switch d := data.(type) {
+    case FileEvent:
+        return []string{d.Path}
+    case *ScheduledChange:
+        return []string{filepath.ToSlash(d.Filename)}
+    case *Freshness:
+        return []string{d.Path}
+    case *ExpiringValue:
+        return []string{d.File}
+    case *Promotion:
+        var paths []string
+        for _, f := range d.Files {
+            paths = append(paths, envFile(d.To, f.Path))
+        }
+        return paths
+    }
+    return nil
+}
+
+// describeEvent is a line of text about an event for people, or "" for
+// events that are not about files.
+func describeEvent(event string, data interface{}) string {
+    switch d := data.(type) {
+    case FileEvent:
+        text := d.Path + " was saved"
+        if d.Commit != "" {
+            text += " in commit " + d.Commit
+        }
+        if d.Summary != "" {
+            text += ": " + d.Summary
+        }
+        return text
+    case *ScheduledChange:
+        if d.Status == ScheduleFailed {
+            return fmt.Sprintf("The change to %s scheduled for %s failed: %s", d.Filename, d.At.Format(time.RFC3339), d.Error)
+        }
+        return fmt.Sprintf("The change to %s scheduled for %s was applied in commit %s", d.Filename, d.At.Format(time.RFC3339), d.Commit)
+    case *Promotion:
+        return promotionText(event, d)
+    case *ExpiringValue:
+        what := "The date at " + d.Pointer
+        if d.Kind == "certificate" {
+            what = fmt.Sprintf("The certificate for %s at %s", d.Subject, orSomeone(d.Pointer))
+        }
+        if d.Expired {
+            return fmt.Sprintf("%s in %s expired on %s", what, d.File, d.NotAfter.Format("2006-01-02"))
+        }
+        return fmt.Sprintf("%s in %s expires on %s, in %d days", what, d.File, d.NotAfter.Format("2006-01-02"), d.Days)
+    case *Freshness:
+        if event == "file.reviewed" {
+            return fmt.Sprintf("%s was marked reviewed by %s; next review is due %s", d.Path, orSomeone(d.Reviewed.User), d.Due.Format("2006-01-02"))
+        }
+        return fmt.Sprintf("%s has not been changed or reviewed since %s and was due for review on %s", d.Path, d.Due.Add(-d.rule.Within).Format("2006-01-02"), d.Due.Format("2006-01-02"))
+    }
+    return ""
+}
+
+// watchNotifier tells subscribers about events touching their paths, one
+// message per subscriber through their channel.
+func watchNotifier(event string, data interface{}) {
+    paths := eventPaths(data)
+    text := describeEvent(event, data)
+    if len(paths) == 0 || text == "" {
+        return
+    }
+    // subscribers get the event, not the content of files or diffs of it
+    switch d := data.(type) {
+    case FileEvent:
+        d.Content = ""
+        data = d
+    case *Promotion:
+        p := *d
+        p.Files = make([]PromotedFile, len(d.Files))
+        for i, f := range d.Files {
+            f.Diff = ""
+            p.Files[i] = f
+        }
+        data = &p
+    }
+    for _, sub := range loadSubscriptions() {
+        if !sub.wants(event, paths) {
+            continue
+        }
+        switch sub.Channel {
+        case "", "email":
+            sendEmail([]string{sub.Email}, EmailMessage{Event: event, Text: text, Paths: paths, Data: data})
+        case "slack":
+            body, _ := json.Marshal(gin.H{"text": text})
+            postEvent(event, sub.URL, body)
+        case "webhook":
+            body, _ := json.Marshal(gin.H{"event": event, "time": time.Now().UTC(), "text": text, "data": data})
+            postEvent(event, sub.URL, body)
+        }
+    }
+}
+
+// sendEmail renders msg and sends it in the background.
+func sendEmail(to []string, msg EmailMessage) {
+    cfg := config.Notify.Email
+    if cfg == nil {
+        return
+    }
+    msg.Time = time.Now()
+    var subject, body bytes.Buffer
+    if err := cfg.subject.Execute(&subject, msg); err != nil {
+        log.Printf("notify %s: email subject: %v", msg.Event, err)
+        return
+    }
+    if err := cfg.body.Execute(&body, msg); err != nil {
+        log.Printf("notify %s: email body: %v", msg.Event, err)
+        return
+    }
+    go func() {
+        if err := deliverEmail(cfg, to, strings.TrimSpace(subject.String()), body.Bytes()); err != nil {
+            log.Printf("notify %s: email to %s: %v", msg.Event, strings.Join(to, ", "), err)
+        }
+    }()
+}
+
+// deliverEmail sends one plain-text message over SMTP.
+func deliverEmail(cfg *EmailConfig, to []string, subject string, body []byte) error {
+    addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+    tlsConfig := &tls.Config{ServerName: cfg.Host}
+    dialer := &net.Dialer{Timeout: timeout(config.Timeouts.Webhook, WebhookTimeout)}
+    var conn net.Conn
+    var err error
+    if cfg.TLS == "implicit" {
+        conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+    } else {
+        conn, err = dialer.Dial("tcp", addr)
+    }
+    if err != nil {
+        return err
+    }
+    conn.SetDeadline(time.Now().Add(timeout(config.Timeouts.Webhook, WebhookTimeout)))
+    client, err := smtp.NewClient(conn, cfg.Host)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    defer client.Close()
+    if cfg.TLS == "" || cfg.TLS == "starttls" {
+        if err := client.StartTLS(tlsConfig); err != nil {
+            return err
+        }
+    }
+    if cfg.Username != "" {
+        if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+            return err
+        }
+    }
+    from, _ := mail.ParseAddress(cfg.From)
+    if err := client.Mail(from.Address); err != nil {
+        return err
+    }
+    // RCPT takes the bare address; the header gets the parsed, re-encoded
+    // form so nothing from the configuration lands in it verbatim
+    var headers []string
+    for _, rcpt := range to {
+        addr, err := mail.ParseAddress(rcpt)
+        if err != nil {
+            return fmt.Errorf("%s: %v", rcpt, err)
+        }
+        if err := client.Rcpt(addr.Address); err != nil {
+            return err
+        }
+        headers = append(headers, addr.String())
+    }
+    w, err := client.Data()
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", from, strings.Join(headers, ", "), mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z))
+    fmt.Fprintf(w, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+    qp := quotedprintable.NewWriter(w)
+    qp.Write(body)
+    qp.Close()
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return client.Quit()
+}
+
+// Incremental sync
+
+// emptyTree is git's hash of a tree with nothing in it.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// ChangedFile is a file committed differently at Head than at From. Blob is
+// its git object hash at Head; Content is only sent with ?content=true,
+// masked as reads are.
+type ChangedFile struct {
+    Path    string  `json:"path"`
+    Status  string  `json:"status"` // added, modified, deleted
+    Blob    string  `json:"blob,omitempty"`
+    Content *string `json:"content,omitempty"`
+}
+
+// ChangesResponse lists what changed since a commit. Pollers pass Head back
+// as since on their next call.
+type ChangesResponse struct {
+    Since   string        `json:"since"`
+    From    string        `json:"from"`
+    Head    string        `json:"head"`
+    Changes []ChangedFile `json:"changes"`
+}
+
+// getChanges handles GET /api/changes?since=<commit|RFC 3339 time>&glob=
+// &content=true, the committed files of the data directory that differ
+// between since and HEAD. A commit that no longer exists answers 410 with
+// the current head, telling the poller to sync everything again.
+func getChanges(c *gin.Context) {
+    if _, ok := historyFor(DataDir).(store.Git); !ok {
+        c.JSON(409, gin.H{"error": "history is not kept in git"})
+        return
+    }
+    ctx := c.Request.Context()
+    since := c.Query("since")
+    if since == "" {
+        c.JSON(400, gin.H{"error": "since is required"})
+        return
+    }
+    head, _ := gitLines(ctx, DataDir, "rev-parse", "--verify", "--quiet", "HEAD")
+    if len(head) == 0 {
+        c.JSON(200, ChangesResponse{Since: since, Changes: []ChangedFile{}})
+        return
+    }
+    from := ""
+    if at, err := time.Parse(time.RFC3339, since); err == nil {
+        // Nothing committed yet at that time: everything is new
+        from = emptyTree
+        if commit, err := resolveRestorePoint(ctx, DataDir, "", at.Format(time.RFC3339)); err == nil {
+            from = commit
+        }
+    } else if commit, err := resolveRestorePoint(ctx, DataDir, since, ""); err == nil {
+        from = commit
+    } else {
+        c.JSON(410, gin.H{"error": err.Error(), "head": head[0]})
+        return
+    }
+
+    resp := ChangesResponse{Since: since, From: from, Head: head[0], Changes: []ChangedFile{}}
+    lines, err := gitLines(ctx, DataDir, "diff", "--name-status", "--no-renames", "--relative", from, head[0])
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    var patterns []string
+    if glob := c.Query("glob"); glob != "" {
+        patterns = []string{glob}
+    }
+    var present []string
+    for _, line := range lines {
+        status, rel, ok := strings.Cut(line, "\t")
+        if !ok || !pathMatches(patterns, rel) {
+            continue
+        }
+        change := ChangedFile{Path: rel, Status: "modified"}
+        switch status {
+        case "A":
+            change.Status = "added"
+        case "D":
+            change.Status = "deleted"
+        }
+        if change.Status != "deleted" {
+            present = append(present, rel)
+        }
+        resp.Changes = append(resp.Changes, change)
+    }
+    if len(present) == 0 {
+        c.JSON(200, resp)
+        return
+    }
+
+    blobs := make(map[string]string)
+    tree, err := gitLines(ctx, DataDir, append([]string{"ls-tree", head[0], "--"}, present...)...)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    for _, line := range tree {
+        // <mode> blob <hash>\t<path>
+        if meta, rel, ok := strings.Cut(line, "\t"); ok {
+            if fields := strings.Fields(meta); len(fields) == 3 {
+                blobs[rel] = fields[2]
+            }
+        }
+    }
+    withContent := c.Query("content") == "true"
+    for i := range resp.Changes {
+        change := &resp.Changes[i]
+        if change.Status == "deleted" {
+            continue
+        }
+        change.Blob = blobs[change.Path]
+        if withContent {
+            content, err := fileAtVersion(ctx, DataDir, change.Path, head[0])
+            if err != nil {
+                storeErrorJSON(c, err)
+                return
+            }
+            text := string(maskSecrets(change.Path, content))
+            change.Content = &text
+        }
+    }
+    c.JSON(200, resp)
+}
+
+// DriftEntry is one file that differs between a ref and the data directory.
+type DriftEntry struct {
+    Path    string   `json:"path"`
+    Status  string   `json:"status"`
+    Changes []Change `json:"changes,omitempty"`
+}
+
+// DriftReport compares the data directory with a tag, branch or commit.
+type DriftReport struct {
+    Ref       string         `json:"ref"`
+    Commit    string         `json:"commit"`
+    Glob      string         `json:"glob,omitempty"`
+    Generated time.Time      `json:"generated"`
+    Summary   map[string]int `json:"summary"`
+    Files     []DriftEntry   `json:"files"`
+}
+
+// driftReport handles GET /api/drift?ref=&glob=&format=json|html.
+func driftReport(c *gin.Context) {
+    ref := c.Query("ref")
+    if ref == "" {
+        c.JSON(400, gin.H{"error": "ref is required"})
+        return
+    }
+    report, err := buildDriftReport(c.Request.Context(), DataDir, ref, c.Query("glob"))
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+
+    switch c.DefaultQuery("format", "json") {
+    case "json":
+        c.JSON(200, report)
+    case "html":
+        var b bytes.Buffer
+        if err := driftTemplate.Execute(&b, report); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        c.Data(200, "text/html; charset=utf-8", b.Bytes())
+    default:
+        c.JSON(400, gin.H{"error": "format must be json or html"})
+    }
+}
+
+func buildDriftReport(ctx context.Context, dir, ref, glob string) (*DriftReport, error) {
+    commit, err := resolveRestorePoint(ctx, dir, ref, "")
+    if err != nil {
+        return nil, err
+    }
+    then, err := gitLines(ctx, dir, "ls-tree", "-r", "--name-only", commit)
+    if err != nil {
+        return nil, err
+    }
+    now, err := gitLines(ctx, dir, "ls-files", "--cached", "--others", "--exclude-standard")
+    if err != nil {
+        return nil, err
+    }
+
+    report := &DriftReport{
+        Ref:       ref,
+        Commit:    commit,
+        Glob:      glob,
+        Generated: time.Now().UTC(),
+        Summary:   map[string]int{"added": 0, "removed": 0, "modified": 0},
+        Files:     []DriftEntry{},
+    }
+    existed := make(map[string]bool)
+    for _, rel := range then {
+        existed[rel] = true
+    }
+    var patterns []string
+    if glob != "" {
+        patterns = []string{glob}
+    }
+    seen := make(map[string]bool)
+    all := append(then, now...)
+    sort.Strings(all)
+    for _, rel := range all {
+        if seen[rel] || !supportedFileType(rel) || !pathMatches(patterns, rel) {
+            continue
+        }
+        seen[rel] = true
+        if _, _, _, err := resolvePath(rel); err != nil {
+            continue
+        }
+
+        current, currentErr := fileStore(dir).Read(storageName(rel))
+        entry := DriftEntry{Path: rel}
+        switch {
+        case !existed[rel] && currentErr == nil:
+            entry.Status = "added"
+        case existed[rel] && currentErr != nil:
+            entry.Status = "removed"
+        case existed[rel]:
+            old, err := fileAtVersion(ctx, dir, rel, commit)
+            if err != nil {
+                return nil, err
+            }
+            if bytes.Equal(old, current) {
+                continue
+            }
+            entry.Status = "modified"
+            oldDoc, errOld := parseDocument(old, getFileType(rel))
+            newDoc, errNew := parseDocument(current, getFileType(rel))
+            if errOld == nil && errNew == nil && (oldDoc != nil || newDoc != nil) {
+                entry.Changes = diffDocuments(oldDoc, newDoc)
+            }
+        default:
+            continue
+        }
+        report.Summary[entry.Status]++
+        report.Files = append(report.Files, entry)
+    }
+    return report, nil
+}
+
+var driftTemplate = template.Must(template.New("drift").Funcs(template.FuncMap{
+    "json": func(v interface{}) string {
+        b, _ := json.Marshal(v)
+        return string(b)
+    },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>Drift report: {{.Ref}}</title>
+<style>
+    body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; margin: 2em; color: #333; }
+    h1 { font-size: 1.4em; }
+    .meta { color: #666; margin-bottom: 1.5em; }
+    .summary span { display: inline-block; padding: 4px 10px; border-radius: 4px; margin-right: 8px; color: white; }
+    .added { background: #27ae60; } .removed { background: #e74c3c; } .modified { background: #f39c12; }
+    table { border-collapse: collapse; width: 100%; margin-top: 0.5em; }
+    th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; font-family: 'Consolas', 'Monaco', monospace; font-size: 13px; }
+    h2 { font-size: 1.1em; margin-top: 1.5em; }
+    h2 .badge { font-size: 0.8em; padding: 2px 8px; border-radius: 4px; color: white; }
+</style>
+</head>
+<body>
+<h1>Drift report</h1>
+<div class="meta">
+    Data directory compared with <b>{{.Ref}}</b> ({{printf "%.7s" .Commit}}){{if .Glob}}, files matching <code>{{.Glob}}</code>{{end}}.
+    Generated {{.Generated.Format "2006-01-02 15:04 MST"}}.
+</div>
+<div class="summary">
+    <span class="added">{{index .Summary "added"}} added</span>
+    <span class="removed">{{index .Summary "removed"}} removed</span>
+    <span class="modified">{{index .Summary "modified"}} modified</span>
+</div>
+{{range .Files}}
+<h2><span class="badge {{.Status}}">{{.Status}}</span> {{.Path}}</h2>
+{{if .Changes}}
+<table>
+    <tr><th>Change</th><th>Pointer</th><th>Before</th><th>After</th></tr>
+    {{range .Changes}}
+    <tr><td>{{.Op}}</td><td>{{.Pointer}}</td><td>{{if ne .Op "add"}}{{json .Old}}{{end}}</td><td>{{if ne .Op "remove"}}{{json .New}}{{end}}</td></tr>
+    {{end}}
+</table>
+{{end}}
+{{else}}
+<p>No drift.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// FileReport is the audit report for a single file.
+type FileReport struct {
+    Filename        string        `json:"filename"`
+    Type            string        `json:"type"`
+    Generated       time.Time     `json:"generated"`
+    Content         string        `json:"content"`
+    Valid           bool          `json:"valid"`
+    ValidationError string        `json:"validationError,omitempty"`
+    Violations      []Violation   `json:"violations"`
+    History         []HistoryItem `json:"history"`
+}
+
+// fileReport handles GET /api/report/:filename?format=html|pdf, a
+// self-contained snapshot of a file, whether it passes validation and the
+// content policies, and its recent history.
+func fileReport(c *gin.Context) {
+    filename := c.Param("filename")
+    dir, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    content, err := fileStore(dir).Read(storageName(rel))
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+
+    report := &FileReport{
+        Filename:   filename,
+        Type:       getFileType(filename),
+        Generated:  time.Now().UTC(),
+        Content:    string(maskSecrets(rel, content)),
+        Valid:      true,
+        Violations: []Violation{},
+        History:    fileHistory(c.Request.Context(), dir, rel),
+    }
+    if err := validateContent(string(content), report.Type); err != nil {
+        report.Valid = false
+        report.ValidationError = fmt.Sprintf("Invalid %s format: %v", strings.ToUpper(report.Type), err)
+    }
+    candidate := &SaveCandidate{Filename: filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: report.Type, Content: content}
+    for _, gate := range contentGates {
+        report.Violations = append(report.Violations, gate(candidate)...)
+    }
+
+    base := strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel)) + "-report"
+    switch c.DefaultQuery("format", "html") {
+    case "html":
+        var b bytes.Buffer
+        if err := reportTemplate.Execute(&b, report); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        c.Data(200, "text/html; charset=utf-8", b.Bytes())
+    case "pdf":
+        var b bytes.Buffer
+        if err := writeReportPDF(&b, report); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base+".pdf"))
+        c.Data(200, "application/pdf", b.Bytes())
+    case "json":
+        c.JSON(200, report)
+    default:
+        c.JSON(400, gin.H{"error": "format must be html, pdf or json"})
+    }
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>Report: {{.Filename}}</title>
+<style>
+    body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; margin: 2em; color: #333; }
+    h1 { font-size: 1.4em; }
+    h2 { font-size: 1.1em; margin-top: 1.5em; }
+    .meta { color: #666; }
+    .status { display: inline-block; padding: 4px 10px; border-radius: 4px; color: white; }
+    .ok { background: #27ae60; } .fail { background: #e74c3c; }
+    pre { background: #f8f8f8; border: 1px solid #ddd; padding: 1em; font-family: 'Consolas', 'Monaco', monospace; font-size: 13px; white-space: pre-wrap; }
+    table { border-collapse: collapse; width: 100%; }
+    th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; font-size: 13px; }
+    @media print { pre { border: none; } }
+</style>
+</head>
+<body>
+<h1>{{.Filename}}</h1>
+<div class="meta">{{.Type}} file, report generated {{.Generated.Format "2006-01-02 15:04 MST"}}</div>
+
+<h2>Validation</h2>
+{{if .Valid}}<span class="status ok">Valid</span>{{else}}<span class="status fail">Invalid</span> {{.ValidationError}}{{end}}
+{{if .Violations}}
+<ul>
+{{range .Violations}}<li><b>{{.Policy}}</b>{{if .Pointer}} at <code>{{.Pointer}}</code>{{end}}: {{.Message}}</li>
+{{end}}
+</ul>
+{{else}}<span class="status ok">No policy violations</span>{{end}}
+
+<h2>Recent history</h2>
+<table>
+    <tr><th>Commit</th><th>Date</th><th>Message</th></tr>
+    {{range .History}}<tr><td><code>{{.Hash}}</code></td><td>{{.Timestamp}}</td><td>{{.Message}}</td></tr>
+    {{end}}
+</table>
+
+<h2>Content</h2>
+<pre>{{.Content}}</pre>
+</body>
+</html>
+`))
+
+func writeReportPDF(w io.Writer, report *FileReport) error {
+    pdf := gofpdf.New("P", "mm", "A4", "")
+    tr := pdf.UnicodeTranslatorFromDescriptor("")
+    pdf.SetTitle(report.Filename, true)
+    pdf.AddPage()
+
+    pdf.SetFont("Helvetica", "B", 16)
+    pdf.CellFormat(0, 10, tr(report.Filename), "", 1, "", false, 0, "")
+    pdf.SetFont("Helvetica", "", 9)
+    pdf.SetTextColor(102, 102, 102)
+    pdf.CellFormat(0, 6, fmt.Sprintf("%s file, report generated %s", report.Type, report.Generated.Format("2006-01-02 15:04 MST")), "", 1, "", false, 0, "")
+    pdf.SetTextColor(51, 51, 51)
+
+    heading := func(text string) {
+        pdf.Ln(4)
+        pdf.SetFont("Helvetica", "B", 12)
+        pdf.CellFormat(0, 8, text, "", 1, "", false, 0, "")
+        pdf.SetFont("Helvetica", "", 10)
+    }
+
+    heading("Validation")
+    if report.Valid {
+        pdf.MultiCell(0, 5, "Valid", "", "", false)
+    } else {
+        pdf.MultiCell(0, 5, tr("Invalid: "+report.ValidationError), "", "", false)
+    }
+    if len(report.Violations) == 0 {
+        pdf.MultiCell(0, 5, "No policy violations", "", "", false)
+    }
+    for _, v := range report.Violations {
+        line := v.Policy
+        if v.Pointer != "" {
+            line += " at " + v.Pointer
+        }
+        pdf.MultiCell(0, 5, tr("- "+line+": "+v.Message), "", "", false)
+    }
+
+    heading("Recent history")
+    pdf.SetFont("Helvetica", "", 9)
+    for _, h := range report.History {
+        pdf.CellFormat(20, 5, h.Hash, "", 0, "", false, 0, "")
+        pdf.CellFormat(45, 5, h.Timestamp, "", 0, "", false, 0, "")
+        pdf.MultiCell(0, 5, tr(h.Message), "", "", false)
+    }
+
+    heading("Content")
+    pdf.SetFont("Courier", "", 8)
+    pdf.MultiCell(0, 4, tr(strings.Replace(report.Content, "\t", "    ", -1)), "", "", false)
+
+    return pdf.Output(w)
+}
+
+// listable hides directory entries the symlink policy would refuse to serve,
+// and binary files plain text mode would not open.
+func listable(root string, file os.FileInfo) bool {
+    if !engine.SupportedType(getFileType(file.Name())) && !textFile(filepath.Join(root, file.Name())) {
+        return false
+    }
+    if file.Mode()&os.ModeSymlink == 0 {
+        return true
+    }
+    _, _, _, err := checkSymlinks(root, filepath.Join(root, file.Name()))
+    return err == nil
+}
+
+func listFiles(c *gin.Context) {
+    if fs := fileStore(DataDir); !onDisk(fs) {
+        listStorage(c, fs)
+        return
+    }
+    if list, ok := filesIndex.list(); ok {
+        names := make([]string, len(list))
+        for i, e := range list {
+            names[i] = e.Name
+        }
+        c.JSON(200, gin.H{"files": names})
+        return
+    }
+
+    files, err := ioutil.ReadDir(DataDir)
+    if err != nil {
+        c.JSON(200, gin.H{"files": []string{}})
+        return
+    }
+
+    var fileList []string
+    var names []string
+    for _, file := range files {
+        if !file.IsDir() {
+            if supportedFileType(file.Name()) && listable(DataDir, file) {
+                names = append(names, file.Name())
+            }
+        }
+    }
+    ignored := ignoredPaths(c.Request.Context(), DataDir, names)
+    for _, name := range names {
+        if _, ok := ignored[name]; !ok {
+            fileList = append(fileList, name)
+        }
+    }
+
+    // Files under extra roots are listed by absolute path
+    for _, root := range roots() {
+        entries, err := ioutil.ReadDir(root)
+        if err != nil {
+            continue
+        }
+        names = names[:0]
+        for _, file := range entries {
+            if !file.IsDir() && supportedFileType(file.Name()) && listable(root, file) {
+                names = append(names, file.Name())
+            }
+        }
+        ignored := ignoredPaths(c.Request.Context(), root, names)
+        for _, name := range names {
+            if _, ok := ignored[name]; !ok {
+                fileList = append(fileList, filepath.Join(root, name))
+            }
+        }
+    }
+
+    c.JSON(200, gin.H{"files": fileList})
+}
+
+// listStorage lists the supported files at the top of a non-local data
+// directory. The file index only covers local disk.
+func listStorage(c *gin.Context, fs storage.Storage) {
+    entries, err := fs.List("")
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    names := []string{}
+    for _, e := range entries {
+        if !e.IsDir && supportedFileType(e.Name) {
+            names = append(names, e.Name)
+        }
+    }
+    c.JSON(200, gin.H{"files": names})
+}
+
+// Digests
+
+// Digest sums up what was committed between Since and Until: who changed
+// which files, and whether those files still pass validation and the
+// content policies.
+type Digest struct {
+    Since     time.Time      `json:"since"`
+    Until     time.Time      `json:"until"`
+    Generated time.Time      `json:"generated"`
+    Commits   []DigestCommit `json:"commits"`
+    Authors   []DigestAuthor `json:"authors"`
+    Files     []DigestFile   `json:"files"`
+    Issues    int            `json:"issues"` // files that fail validation or a policy
+    Stale     []*Freshness   `json:"stale"`  // files overdue for review now
+}
+
+type DigestCommit struct {
+    Hash    string    `json:"hash"`
+    Author  string    `json:"author"`
+    Time    time.Time `json:"time"`
+    Summary string    `json:"summary"`
+    Files   []string  `json:"files"`
+}
+
+type DigestAuthor struct {
+    Name    string `json:"name"`
+    Commits int    `json:"commits"`
+    Files   int    `json:"files"`
+}
+
+// DigestFile is a file changed in the period, checked as it stands now.
+type DigestFile struct {
+    Path            string      `json:"path"`
+    Changes         int         `json:"changes"`
+    Authors         []string    `json:"authors"`
+    Deleted         bool        `json:"deleted,omitempty"`
+    ValidationError string      `json:"validationError,omitempty"`
+    Violations      []Violation `json:"violations,omitempty"`
+}
+
+// DigestConfig sends a digest of the changes since the previous one each
+// time Schedule fires: a standard cron expression or @daily, @weekly. Paths
+// limits which files count; a period without changes or files overdue for
+// review sends nothing.
+type DigestConfig struct {
+    Schedule        string   `yaml:"schedule"`
+    Paths           []string `yaml:"paths"`
+    ApprovalChannel `yaml:",inline"`
+
+    schedule cron.Schedule
+}
+
+// contentGates judge a file at rest for reports and digests; freezes and
+// diff limits only judge a change, and external checks, which start a
+// program on the content, only run on save.
+var contentGates = []saveGate{ansibleGate, monitoringGate, grafanaGate, ciGate, regoGate, celGate, valueGate, schemaVersionGate}
+
+func buildDigest(ctx context.Context, dir string, since, until time.Time, paths []string) (*Digest, error) {
+    d := &Digest{
+        Since:     since,
+        Until:     until,
+        Generated: time.Now().UTC(),
+        Commits:   []DigestCommit{},
+        Authors:   []DigestAuthor{},
+        Files:     []DigestFile{},
+        Stale:     staleFiles(ctx, paths),
+    }
+    if head, _ := gitLines(ctx, dir, "rev-parse", "--verify", "--quiet", "HEAD"); len(head) == 0 {
+        return d, nil
+    }
+    // Names relative to dir, which may be inside a larger repository
+    lines, err := gitLines(ctx, dir, "log", "--no-renames", "--name-only", "--relative", "--format=%x1e%H%x1f%an%x1f%aI%x1f%s",
+        "--since="+since.Format(time.RFC3339), "--until="+until.Format(time.RFC3339), "--", ".")
+    if err != nil {
+        return nil, err
+    }
+
+    files := make(map[string]*DigestFile)
+    authors := make(map[string]*DigestAuthor)
+    touched := make(map[string]map[string]bool) // author -> files
+    var commit *DigestCommit
+    flush := func() {
+        if commit != nil && len(commit.Files) > 0 {
+            d.Commits = append(d.Commits, *commit)
+        }
+    }
+    for _, line := range lines {
+        if strings.HasPrefix(line, "\x1e") {
+            flush()
+            f := strings.SplitN(line[1:], "\x1f", 4)
+            if len(f) < 4 {
+                commit = nil
+                continue
+            }
+            t, _ := time.Parse(time.RFC3339, f[2])
+            commit = &DigestCommit{Hash: f[0], Author: f[1], Time: t, Summary: f[3], Files: []string{}}
+            continue
+        }
+        rel := line
+        if commit == nil || !supportedFileType(rel) || !pathMatches(paths, rel) {
+            continue
+        }
+        if _, _, _, err := resolvePath(rel); err != nil {
+            continue
+        }
+        commit.Files = append(commit.Files, rel)
+        file := files[rel]
+        if file == nil {
+            file = &DigestFile{Path: rel, Authors: []string{}}
+            files[rel] = file
+        }
+        file.Changes++
+        if !touched[commit.Author][rel] {
+            if touched[commit.Author] == nil {
+                touched[commit.Author] = make(map[string]bool)
+            }
+            touched[commit.Author][rel] = true
+            file.Authors = append(file.Authors, commit.Author)
+        }
+    }
+    flush()
+
+    for _, c := range d.Commits {
+        a := authors[c.Author]
+        if a == nil {
+            a = &DigestAuthor{Name: c.Author, Files: len(touched[c.Author])}
+            authors[c.Author] = a
+        }
+        a.Commits++
+    }
+    for _, a := range authors {
+        d.Authors = append(d.Authors, *a)
+    }
+    sort.Slice(d.Authors, func(i, j int) bool {
+        if d.Authors[i].Commits != d.Authors[j].Commits {
+            return d.Authors[i].Commits > d.Authors[j].Commits
+        }
+        return d.Authors[i].Name < d.Authors[j].Name
+    })
+
+    for _, file := range files {
+        _, rel, fullPath, _ := resolvePath(file.Path)
+        content, err := fileStore(dir).Read(storageName(rel))
+        if err != nil {
+            file.Deleted = true
+            d.Files = append(d.Files, *file)
+            continue
+        }
+        fileType := getFileType(file.Path)
+        if err := validateContent(string(content), fileType); err != nil {
+            file.ValidationError = err.Error()
+        }
+        candidate := &SaveCandidate{Filename: file.Path, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: content}
+        for _, gate := range contentGates {
+            file.Violations = append(file.Violations, gate(candidate)...)
+        }
+        if file.ValidationError != "" || len(file.Violations) > 0 {
+            d.Issues++
+        }
+        d.Files = append(d.Files, *file)
+    }
+    sort.Slice(d.Files, func(i, j int) bool { return d.Files[i].Path < d.Files[j].Path })
+    return d, nil
+}
+
+// getDigest handles GET /api/digest?period=day|week&since=&until=&glob=
+// &format=json|markdown|html. Since and until are RFC 3339 times or dates
+// and default to the period up to now.
+func getDigest(c *gin.Context) {
+    if _, ok := historyFor(DataDir).(store.Git); !ok {
+        c.JSON(409, gin.H{"error": "history is not kept in git"})
+        return
+    }
+    until := time.Now()
+    if s := c.Query("until"); s != "" {
+        t, err := parseDigestTime(s)
+        if err != nil {
+            c.JSON(400, gin.H{"error": "until: " + err.Error()})
+            return
+        }
+        until = t
+    }
+    var since time.Time
+    switch period := c.DefaultQuery("period", "day"); {
+    case c.Query("since") != "":
+        t, err := parseDigestTime(c.Query("since"))
+        if err != nil {
+            c.JSON(400, gin.H{"error": "since: " + err.Error()})
+            return
+        }
+        since = t
+    case period == "day":
+        since = until.AddDate(0, 0, -1)
+    case period == "week":
+        since = until.AddDate(0, 0, -7)
+    default:
+        c.JSON(400, gin.H{"error": "period must be day or week"})
+        return
+    }
+    if !since.Before(until) {
+        c.JSON(400, gin.H{"error": "since must be before until"})
+        return
+    }
+    var paths []string
+    if glob := c.Query("glob"); glob != "" {
+        paths = []string{glob}
+    }
+    digest, err := buildDigest(c.Request.Context(), DataDir, since, until, paths)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+
+    var b bytes.Buffer
+    switch c.DefaultQuery("format", "json") {
+    case "json":
+        c.JSON(200, digest)
+    case "markdown":
+        if err := digestMarkdown.Execute(&b, digest); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        c.Data(200, "text/markdown; charset=utf-8", b.Bytes())
+    case "html":
+        if err := digestTemplate.Execute(&b, digest); err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        c.Data(200, "text/html; charset=utf-8", b.Bytes())
+    default:
+        c.JSON(400, gin.H{"error": "format must be json, markdown or html"})
+    }
+}
+
+func parseDigestTime(s string) (time.Time, error) {
+    if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+        return t, nil
+    }
+    return time.Parse(time.RFC3339, s)
+}
+
+var digestFuncs = texttemplate.FuncMap{"join": strings.Join}
+
+var digestMarkdown = texttemplate.Must(texttemplate.New("digest").Funcs(digestFuncs).Parse(
+    `# Changes from {{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "2006-01-02 15:04 MST"}}
+
+{{len .Commits}} commits by {{len .Authors}} authors changed {{len .Files}} files{{if .Issues}}; {{.Issues}} need attention{{end}}.{{if .Stale}} {{len .Stale}} files are overdue for review.{{end}}
+{{if .Authors}}
+## Authors
+
+{{range .Authors}}- {{.Name}}: {{.Commits}} commits, {{.Files}} files
+{{end}}{{end}}{{if .Files}}
+## Files
+
+{{range .Files}}- ` + "`{{.Path}}`" + ` {{.Changes}} changes by {{join .Authors ", "}}{{if .Deleted}}, deleted{{end}}{{if .ValidationError}}
+  - invalid: {{.ValidationError}}{{end}}{{range .Violations}}
+  - {{.Policy}}: {{.Message}}{{end}}
+{{end}}{{end}}{{if .Commits}}
+## Commits
+
+{{range .Commits}}- ` + "`{{printf \"%.7s\" .Hash}}`" + ` {{.Summary}} ({{.Author}}, {{.Time.Format "Jan 2 15:04"}})
+{{end}}{{end}}{{if .Stale}}
+## Overdue for review
+
+{{range .Stale}}- ` + "`{{.Path}}`" + ` due {{.Due.Format "2006-01-02"}}, changed {{.Changed.Format "2006-01-02"}}{{with .Reviewed}}{{if .User}}, last reviewed by {{.User}}{{end}}{{end}}
+{{end}}{{end}}`))
+
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{"join": strings.Join}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>Changes {{.Since.Format "2006-01-02"}} to {{.Until.Format "2006-01-02"}}</title>
+<style>
+    body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; margin: 2em; color: #333; }
+    h1 { font-size: 1.4em; }
+    h2 { font-size: 1.1em; margin-top: 1.5em; }
+    .meta { color: #666; }
+    .status { display: inline-block; padding: 2px 8px; border-radius: 4px; color: white; font-size: 12px; }
+    .ok { background: #27ae60; } .fail { background: #e74c3c; } .deleted { background: #999; }
+    table { border-collapse: collapse; width: 100%; }
+    th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; font-size: 13px; vertical-align: top; }
+    code { font-family: 'Consolas', 'Monaco', monospace; }
+</style>
+</head>
+<body>
+<h1>Changes from {{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "2006-01-02 15:04 MST"}}</h1>
+<div class="meta">{{len .Commits}} commits by {{len .Authors}} authors changed {{len .Files}} files{{if .Issues}}; {{.Issues}} need attention{{end}}. Generated {{.Generated.Format "2006-01-02 15:04 MST"}}.</div>
+
+{{if .Authors}}<h2>Authors</h2>
+<table>
+    <tr><th>Author</th><th>Commits</th><th>Files</th></tr>
+    {{range .Authors}}<tr><td>{{.Name}}</td><td>{{.Commits}}</td><td>{{.Files}}</td></tr>
+    {{end}}
+</table>{{end}}
+
+{{if .Files}}<h2>Files</h2>
+<table>
+    <tr><th>File</th><th>Changes</th><th>Authors</th><th>Status</th></tr>
+    {{range .Files}}<tr><td><code>{{.Path}}</code></td><td>{{.Changes}}</td><td>{{join .Authors ", "}}</td><td>
+        {{if .Deleted}}<span class="status deleted">Deleted</span>{{else if or .ValidationError .Violations}}<span class="status fail">Needs attention</span>{{else}}<span class="status ok">Valid</span>{{end}}
+        {{if .ValidationError}}<div>{{.ValidationError}}</div>{{end}}
+        {{range .Violations}}<div><b>{{.Policy}}</b>: {{.Message}}</div>{{end}}
+    </td></tr>
+    {{end}}
+</table>{{end}}
+
+{{if .Commits}}<h2>Commits</h2>
+<table>
+    <tr><th>Commit</th><th>Date</th><th>Author</th><th>Summary</th></tr>
+    {{range .Commits}}<tr><td><code>{{printf "%.7s" .Hash}}</code></td><td>{{.Time.Format "2006-01-02 15:04"}}</td><td>{{.Author}}</td><td>{{.Summary}}</td></tr>
+    {{end}}
+</table>{{end}}
+
+{{if .Stale}}<h2>Overdue for review</h2>
+<table>
+    <tr><th>File</th><th>Due</th><th>Changed</th><th>Last reviewed</th></tr>
+    {{range .Stale}}<tr><td><code>{{.Path}}</code></td><td>{{.Due.Format "2006-01-02"}}</td><td>{{.Changed.Format "2006-01-02"}}</td><td>{{with .Reviewed}}{{if .User}}{{.User}}, {{.At.Format "2006-01-02"}}{{end}}{{end}}</td></tr>
+    {{end}}
+</table>{{end}}
+</body>
+</html>
+`))
+
+var digestMu sync.Mutex
+
+// sendDigest sends the digest of each period that ended since the last one
+// was sent. The first run only notes the time, so a new deployment does not
+// report history it never watched.
+func sendDigest(now time.Time) {
+    cfg := config.Notify.Digest
+    if cfg == nil || !featureEnabled(FeatureHooks) {
+        return
+    }
+    if _, ok := historyFor(DataDir).(store.Git); !ok {
+        return
+    }
+    digestMu.Lock()
+    defer digestMu.Unlock()
+    file, err := metaPath("digest.json")
+    if err != nil {
+        log.Printf("digest: %v", err)
+        return
+    }
+    var state struct {
+        Last time.Time `json:"last"`
+    }
+    if content, err := ioutil.ReadFile(file); err == nil {
+        json.Unmarshal(content, &state)
+    }
+    var until time.Time
+    if !state.Last.IsZero() {
+        for next := cfg.schedule.Next(state.Last); !next.IsZero() && !next.After(now); next = cfg.schedule.Next(next) {
+            until = next
+        }
+        if until.IsZero() {
+            return
+        }
+    }
+    if !state.Last.IsZero() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+        digest, err := buildDigest(ctx, DataDir, state.Last, until, cfg.Paths)
+        cancel()
+        if err != nil {
+            log.Printf("digest: %v", err)
+            return
+        }
+        if len(digest.Commits) > 0 || len(digest.Stale) > 0 {
+            var text bytes.Buffer
+            digestMarkdown.Execute(&text, digest)
+            paths := make([]string, len(digest.Files))
+            for i, f := range digest.Files {
+                paths[i] = f.Path
+            }
+            cfg.send("digest", text.String(), digest, paths)
+            log.Printf("digest: sent %d commits from %s to %s", len(digest.Commits), state.Last.Format(time.RFC3339), until.Format(time.RFC3339))
+        }
+    } else {
+        until = now
+    }
+    state.Last = until
+    data, _ := json.MarshalIndent(state, "", "  ")
+    if err := writeFileAtomic(file, data, 0644); err != nil {
+        log.Printf("digest: %v", err)
+    }
+}
+
+// Reviews
+
+// ReviewRule asks for files matching Paths to be changed or marked reviewed
+// at least every Within, so lists that are only useful while current
+// (certificates, allowlists) do not quietly go out of date. Role, when set,
+// is who may mark them reviewed. Overdue files are announced once per lapse
+// as file.stale events and on the rule's channel, if it has one.
+type ReviewRule struct {
+    Paths           []string      `yaml:"paths"`
+    Within          time.Duration `yaml:"within"`
+    Role            string        `yaml:"role"`
+    ApprovalChannel `yaml:",inline"`
+}
+
+// Review records who last confirmed that a file is still right.
+type Review struct {
+    User    string     `json:"user,omitempty"`
+    At      time.Time  `json:"at"`
+    Note    string     `json:"note,omitempty"`
+    Flagged *time.Time `json:"flagged,omitempty"` // last reported overdue
+}
+
+// Freshness is where a file stands against its review window: it is due
+// Within after it was last changed or reviewed, whichever is later.
+type Freshness struct {
+    Path     string    `json:"path"`
+    Within   string    `json:"within"`
+    Changed  time.Time `json:"changed"` // last commit, or modification
+    Reviewed *Review   `json:"reviewed,omitempty"`
+    Due      time.Time `json:"due"`
+    Stale    bool      `json:"stale"`
+
+    rule *ReviewRule
+}
+
+// StaleCheckInterval is how often the scheduler looks for overdue files.
+const StaleCheckInterval = 10 * time.Minute
+
+var (
+    reviewMu       sync.Mutex
+    lastStaleCheck time.Time
+)
+
+// reviewRule returns the first review rule covering rel, or nil.
+func reviewRule(rel string) *ReviewRule {
+    for i := range config.Reviews {
+        if pathMatches(config.Reviews[i].Paths, rel) {
+            return &config.Reviews[i]
+        }
+    }
+    return nil
+}
+
+func loadReviews() (map[string]*Review, error) {
+    path, err := metaPath("reviews.json")
+    if err != nil {
+        return nil, err
+    }
+    reviews := make(map[string]*Review)
+    content, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return reviews, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = json.Unmarshal(content, &reviews)
+    return reviews, err
+}
+
+func saveReviews(reviews map[string]*Review) error {
+    path, err := metaPath("reviews.json")
+    if err != nil {
+        return err
+    }
+    data, _ := json.MarshalIndent(reviews, "", "  ")
+    return writeFileAtomic(path, data, 0644)
+}
+
+// lastChangedCache holds what lastChanged found at a HEAD; until HEAD moves
+// the answer is the same.
+var lastChangedCache struct {
+    sync.Mutex
+    head    string
+    changed map[string]time.Time
+}
+
+// lastChanged returns when each file of the data directory was last
+// committed, from a single git log that is only run again once HEAD has
+// moved. The map is shared and must not be changed.
+func lastChanged(ctx context.Context) map[string]time.Time {
+    if _, ok := historyFor(DataDir).(store.Git); !ok {
+        return map[string]time.Time{}
+    }
+    head, err := gitLines(ctx, DataDir, "rev-parse", "--verify", "--quiet", "HEAD")
+    if err != nil || len(head) == 0 {
+        return map[string]time.Time{}
+    }
+    lastChangedCache.Lock()
+    defer lastChangedCache.Unlock()
+    if lastChangedCache.head == head[0] {
+        return lastChangedCache.changed
+    }
+    // Names relative to DataDir, which may be inside a larger repository
+    lines, err := gitLines(ctx, DataDir, "log", "--no-renames", "--name-only", "--relative", "--format=%x1e%cI", head[0], "--", ".")
+    if err != nil {
+        return map[string]time.Time{}
+    }
+    changed := make(map[string]time.Time)
+    var at time.Time
+    for _, line := range lines {
+        if strings.HasPrefix(line, "\x1e") {
+            at, _ = time.Parse(time.RFC3339, line[1:])
+        } else if _, ok := changed[line]; !ok {
+            changed[line] = at
+        }
+    }
+    lastChangedCache.head, lastChangedCache.changed = head[0], changed
+    return changed
+}
+
+// freshness reports every file covered by a review rule, most overdue
+// first. The caller holds reviewMu.
+func freshness(ctx context.Context, now time.Time, reviews map[string]*Review) ([]*Freshness, error) {
+    var files []string
+    err := filepath.Walk(DataDir, func(p string, info os.FileInfo, err error) error {
+        if err != nil {
+            return nil
+        }
+        rel, _ := filepath.Rel(DataDir, p)
+        if info.IsDir() {
+            if rel != "." && strings.HasPrefix(info.Name(), ".") {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if supportedFileType(rel) && reviewRule(rel) != nil {
+            files = append(files, filepath.ToSlash(rel))
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    commits := lastChanged(ctx)
+    list := []*Freshness{}
+    for _, rel := range files {
+        rule := reviewRule(rel)
+        f := &Freshness{Path: rel, Within: rule.Within.String(), Changed: commits[rel], rule: rule}
+        if r := reviews[rel]; r != nil && !r.At.IsZero() {
+            f.Reviewed = r
+        }
+        if f.Changed.IsZero() {
+            if info, err := os.Stat(filepath.Join(DataDir, rel)); err == nil {
+                f.Changed = info.ModTime()
+            }
+        }
+        last := f.Changed
+        if f.Reviewed != nil && f.Reviewed.At.After(last) {
+            last = f.Reviewed.At
+        }
+        f.Due = last.Add(rule.Within)
+        f.Stale = now.After(f.Due)
+        list = append(list, f)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Due.Before(list[j].Due) })
+    return list, nil
+}
+
+// staleFiles returns the files overdue for review, for stats and digests.
+func staleFiles(ctx context.Context, paths []string) []*Freshness {
+    stale := []*Freshness{}
+    if len(config.Reviews) == 0 {
+        return stale
+    }
+    reviewMu.Lock()
+    defer reviewMu.Unlock()
+    reviews, err := loadReviews()
+    if err != nil {
+        log.Printf("reviews: %v", err)
+        return stale
+    }
+    list, err := freshness(ctx, time.Now(), reviews)
+    if err != nil {
+        log.Printf("reviews: %v", err)
+        return stale
+    }
+    for _, f := range list {
+        if f.Stale && pathMatches(paths, f.Path) {
+            stale = append(stale, f)
+        }
+    }
+    return stale
+}
+
+// getFreshness handles GET /api/reviews?stale=true&glob=, the review status
+// of every file a review rule covers.
+func getFreshness(c *gin.Context) {
+    reviewMu.Lock()
+    reviews, err := loadReviews()
+    var list []*Freshness
+    if err == nil {
+        list, err = freshness(c.Request.Context(), time.Now(), reviews)
+    }
+    reviewMu.Unlock()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    var patterns []string
+    if glob := c.Query("glob"); glob != "" {
+        patterns = []string{glob}
+    }
+    files := []*Freshness{}
+    for _, f := range list {
+        if pathMatches(patterns, f.Path) && (c.Query("stale") != "true" || f.Stale) {
+            files = append(files, f)
+        }
+    }
+    c.JSON(200, gin.H{"files": files})
+}
+
+// markReviewed handles POST /api/review/:filename: the user confirms the
+// file is still right as it is, which restarts its review window.
+func markReviewed(c *gin.Context) {
+    filename := c.Param("filename")
+    _, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
+    rel = filepath.ToSlash(rel)
+    rule := reviewRule(rel)
+    if rule == nil {
+        c.JSON(400, gin.H{"error": fmt.Sprintf("no review rule covers %s", rel)})
+        return
+    }
+    user := requestUser(c)
+    if rule.Role != "" && !hasRole(user, rule.Role) {
+        c.JSON(403, gin.H{"error": fmt.Sprintf("marking %s reviewed requires the %s role", rel, rule.Role)})
+        return
+    }
+    if _, err := os.Stat(fullPath); err != nil {
+        c.JSON(404, gin.H{"error": fmt.Sprintf("%s does not exist", filename)})
+        return
+    }
+    var req struct {
+        Note string `json:"note"`
+    }
+    if c.Request.ContentLength != 0 {
+        if err := c.ShouldBindJSON(&req); err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
+            return
+        }
+    }
+
+    reviewMu.Lock()
+    defer reviewMu.Unlock()
+    reviews, err := loadReviews()
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    reviews[rel] = &Review{User: user, At: time.Now().UTC(), Note: req.Note}
+    if err := saveReviews(reviews); err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    list, err := freshness(c.Request.Context(), time.Now(), reviews)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    for _, f := range list {
+        if f.Path == rel {
+            notify("file.reviewed", f)
+            c.JSON(200, f)
+            return
+        }
+    }
+    c.JSON(200, gin.H{"path": rel})
+}
+
+// flagStaleFiles reports files that became overdue since the last check,
+// once until they are changed or reviewed again.
+func flagStaleFiles(now time.Time) {
+    if len(config.Reviews) == 0 || now.Sub(lastStaleCheck) < StaleCheckInterval {
+        return
+    }
+    lastStaleCheck = now
+    reviewMu.Lock()
+    defer reviewMu.Unlock()
+    reviews, err := loadReviews()
+    if err != nil {
+        log.Printf("reviews: %v", err)
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    list, err := freshness(ctx, now, reviews)
+    cancel()
+    if err != nil {
+        log.Printf("reviews: %v", err)
+        return
+    }
+    changed := false
+    for _, f := range list {
+        r := reviews[f.Path]
+        if !f.Stale || (r != nil && r.Flagged != nil && r.Flagged.After(f.Due)) {
+            continue
+        }
+        if r == nil {
+            r = &Review{}
+            reviews[f.Path] = r
+        }
+        t := now.UTC()
+        r.Flagged, changed = &t, true
+        log.Printf("reviews: %s is overdue since %s", f.Path, f.Due.Format(time.RFC3339))
+        notify("file.stale", f)
+        if !f.rule.empty() {
+            f.rule.send("file.stale", describeEvent("file.stale", f), f, []string{f.Path})
+        }
+    }
+    if changed {
+        if err := saveReviews(reviews); err != nil {
+            log.Printf("reviews: %v", err)
+        }
+    }
+}
+
+// File index
+
+// IndexEntry is what the file index knows about one listed file. Name is as
+// listFiles reports it: relative for the data directory, absolute for files
+// under extra roots.
+type IndexEntry struct {
+    Name    string    `json:"name"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"modTime"`
+    Commit  string    `json:"commit,omitempty"`
+    Valid   bool      `json:"valid"`
+    Error   string    `json:"error,omitempty"`
+
+    root int
+}
+
+// fileIndex caches the listing of the data directory and extra roots so that
+// listFiles and stats do not stat and parse every file on each call. It is
+// built at startup, persisted in MetaDir, and kept current by saves and a
+// directory watcher.
+type fileIndex struct {
+    mu      sync.RWMutex
+    entries map[string]*IndexEntry // by absolute path
+    ready   bool
+    scanned time.Time
+    dirty   bool
+    watcher *fsnotify.Watcher // nil until startIndex runs
+}
+
+var filesIndex = &fileIndex{entries: make(map[string]*IndexEntry)}
+
+// IndexFlushInterval is how often a changed index is written back to disk.
+const IndexFlushInterval = 30 * time.Second
+
+// listingRoots are the directories listFiles shows, in listing order.
+func listingRoots() []string {
+    return append([]string{DataDir}, roots()...)
+}
+
+// listingName maps an absolute path to its root and listed name; ok is false
+// for paths listFiles would not show.
+func listingName(full string) (root int, name string, ok bool) {
+    if !supportedFileType(full) || !engine.SupportedType(getFileType(full)) && !textFile(full) {
+        return 0, "", false
+    }
+    for i, dir := range listingRoots() {
+        abs, _ := filepath.Abs(dir)
+        if filepath.Dir(full) != abs {
+            continue
+        }
+        if i == 0 {
+            return i, filepath.Base(full), true
+        }
+        return i, filepath.Join(dir, filepath.Base(full)), true
+    }
+    return 0, "", false
+}
+
+func indexPath() (string, error) {
+    return metaPath("index.json")
+}
+
+// startIndex loads the persisted index, rescans in the background and then
+// follows changes. It returns once the watcher is running.
+func startIndex() {
+    if p, err := indexPath(); err == nil {
+        if content, err := ioutil.ReadFile(p); err == nil {
+            var saved map[string]*IndexEntry
+            if json.Unmarshal(content, &saved) == nil {
+                filesIndex.mu.Lock()
+                filesIndex.entries = saved
+                filesIndex.mu.Unlock()
+            }
+        }
+    }
+    filesIndex.scan()
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        log.Printf("index: %v", err)
+        return
+    }
+    for _, dir := range listingRoots() {
+        if err := watcher.Add(dir); err != nil {
+            log.Printf("index: watch %s: %v", dir, err)
+        }
+    }
+    filesIndex.mu.Lock()
+    filesIndex.watcher = watcher
+    filesIndex.mu.Unlock()
+    go func() {
+        flush := time.NewTicker(IndexFlushInterval)
+        defer flush.Stop()
+        for {
+            select {
+            case ev, ok := <-watcher.Events:
+                if !ok {
+                    return
+                }
+                filesIndex.refresh(ev.Name, "")
+            case err, ok := <-watcher.Errors:
+                if !ok {
+                    return
+                }
+                log.Printf("index: %v", err)
+            case <-flush.C:
+                filesIndex.persist()
+            }
+        }
+    }()
+}
+
+// addRoot starts indexing and watching a root added while serving.
+func (ix *fileIndex) addRoot(dir string) {
+    ix.mu.RLock()
+    watcher := ix.watcher
+    ix.mu.RUnlock()
+    if watcher == nil {
+        return
+    }
+    if err := watcher.Add(dir); err != nil {
+        log.Printf("index: watch %s: %v", dir, err)
+    }
+    go ix.scan()
+}
+
+// scan rebuilds the index with a bounded pool of workers. Files whose size
+// and modification time match the previous index are not read again.
+func (ix *fileIndex) scan() {
+    type job struct {
+        full  string
+        entry *IndexEntry
+    }
+    ix.mu.RLock()
+    previous := ix.entries
+    ix.mu.RUnlock()
+
+    fresh := make(map[string]*IndexEntry)
+    var jobs []job
+    commits := make(map[string]map[string]string)
+    for i, dir := range listingRoots() {
+        infos, err := ioutil.ReadDir(dir)
+        if err != nil {
+            continue
+        }
+        var names []string
+        byName := make(map[string]os.FileInfo)
+        for _, info := range infos {
+            if !info.IsDir() && supportedFileType(info.Name()) && listable(dir, info) {
+                names = append(names, info.Name())
+                byName[info.Name()] = info
+            }
+        }
+        ignored := ignoredPaths(context.Background(), dir, names)
+        abs, _ := filepath.Abs(dir)
+        for _, name := range names {
+            if _, ok := ignored[name]; ok {
+                continue
+            }
+            full := filepath.Join(abs, name)
+            info := byName[name]
+            listed := name
+            if i > 0 {
+                listed = filepath.Join(dir, name)
+            }
+            if old, ok := previous[full]; ok && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+                old.Name, old.root = listed, i
+                fresh[full] = old
+                continue
+            }
+            if commits[dir] == nil {
+                commits[dir] = lastCommits(context.Background(), dir)
+            }
+            jobs = append(jobs, job{full, &IndexEntry{Name: listed, Size: info.Size(), ModTime: info.ModTime(), Commit: commits[dir][name], root: i}})
+        }
+    }
+
+    queue := make(chan job)
+    var wg sync.WaitGroup
+    for w := 0; w < runtime.NumCPU(); w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := range queue {
+                validateIndexEntry(j.full, j.entry)
+            }
+        }()
+    }
+    for _, j := range jobs {
+        queue <- j
+    }
+    close(queue)
+    wg.Wait()
+    for _, j := range jobs {
+        fresh[j.full] = j.entry
+    }
+
+    ix.mu.Lock()
+    ix.entries, ix.ready, ix.scanned, ix.dirty = fresh, true, time.Now().UTC(), true
+    ix.mu.Unlock()
+    ix.persist()
+}
+
+// lastCommits maps the top-level files of dir to the commit that last
+// touched them, from a single git log.
+func lastCommits(ctx context.Context, dir string) map[string]string {
+    commits := make(map[string]string)
+    lines, err := gitLines(ctx, dir, "log", "--format=commit %h", "--name-only", "--relative", "--", ":(glob)*")
+    if err != nil {
+        return commits
+    }
+    hash := ""
+    for _, line := range lines {
+        if strings.HasPrefix(line, "commit ") {
+            hash = strings.TrimPrefix(line, "commit ")
+        } else if _, seen := commits[line]; !seen {
+            commits[line] = hash
+        }
+    }
+    return commits
+}
+
+func validateIndexEntry(full string, e *IndexEntry) {
+    f, err := os.Open(full)
+    if err == nil {
+        err = validateReader(f, getFileType(full))
+        f.Close()
+    }
+    e.Valid = err == nil
+    e.Error = ""
+    if err != nil {
+        e.Error = err.Error()
+    }
+}
+
+// refresh updates the entry for one path after a save or a filesystem event.
+// commit, if known, saves a git call.
+func (ix *fileIndex) refresh(path, commit string) {
+    full, err := filepath.Abs(path)
+    if err != nil {
+        return
+    }
+    root, name, ok := listingName(full)
+    if !ok {
+        return
+    }
+    info, err := os.Lstat(full)
+    gone := err != nil || info.IsDir() || !listable(filepath.Dir(full), info)
+    if !gone {
+        _, gone = ignoredPaths(context.Background(), filepath.Dir(full), []string{info.Name()})[info.Name()]
+    }
+    if gone {
+        ix.mu.Lock()
+        if _, ok := ix.entries[full]; ok {
+            delete(ix.entries, full)
+            ix.dirty = true
+        }
+        ix.mu.Unlock()
+        return
+    }
+    if info.Mode()&os.ModeSymlink != 0 {
+        if info, err = os.Stat(full); err != nil {
+            return
+        }
+    }
+    if commit == "" {
+        if lines, err := gitLines(context.Background(), filepath.Dir(full), "log", "-1", "--format=%h", "--", info.Name()); err == nil && len(lines) > 0 {
+            commit = lines[0]
+        }
+    }
+    entry := &IndexEntry{Name: name, Size: info.Size(), ModTime: info.ModTime(), Commit: commit, root: root}
+    validateIndexEntry(full, entry)
+    ix.mu.Lock()
+    ix.entries[full] = entry
+    ix.dirty = true
+    ix.mu.Unlock()
+}
+
+// persist writes the index to MetaDir if it changed.
+func (ix *fileIndex) persist() {
+    ix.mu.Lock()
+    if !ix.dirty {
+        ix.mu.Unlock()
+        return
+    }
+    content, err := json.Marshal(ix.entries)
+    ix.dirty = false
+    ix.mu.Unlock()
+    if err != nil {
+        return
+    }
+    if p, err := indexPath(); err == nil {
+        if err := writeFileAtomic(p, content, 0644); err != nil {
+            log.Printf("index: %v", err)
+        }
+    }
+}
+
+// list returns the indexed entries in listing order, or false before the
+// first scan has finished.
+func (ix *fileIndex) list() ([]IndexEntry, bool) {
+    ix.mu.RLock()
+    defer ix.mu.RUnlock()
+    if !ix.ready {
+        return nil, false
+    }
+    list := make([]IndexEntry, 0, len(ix.entries))
+    for _, e := range ix.entries {
+        list = append(list, *e)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        if list[i].root != list[j].root {
+            return list[i].root < list[j].root
+        }
+        return list[i].Name < list[j].Name
+    })
+    return list, true
+}
+
+// getStats handles GET /api/stats, a summary of the file index and, with
+// review rules, the files overdue for review.
+func getStats(c *gin.Context) {
+    list, ok := filesIndex.list()
+    if !ok {
+        c.JSON(503, gin.H{"error": "the file index is still being built"})
+        return
+    }
+    var size int64
+    invalid := []IndexEntry{}
+    for _, e := range list {
+        size += e.Size
+        if !e.Valid {
+            invalid = append(invalid, e)
+        }
+    }
+    filesIndex.mu.RLock()
+    scanned := filesIndex.scanned
+    filesIndex.mu.RUnlock()
+    stats := gin.H{"files": len(list), "bytes": size, "invalid": invalid, "scanned": scanned}
+    if len(config.Reviews) > 0 {
+        stats["stale"] = staleFiles(c.Request.Context(), nil)
+    }
+    c.JSON(200, stats)
+}
+
+// DownloadRequest selects files for a bundle: explicit paths, a glob over the
+// data directory, or both.
+type DownloadRequest struct {
+    Paths []string `json:"paths"`
+    Glob  string   `json:"glob"`
+}
+
+// archiveEntry is one file of a bundle. Content, when set, replaces what is
+// on disk (e.g. a redacted copy).
+type archiveEntry struct {
+    name, full string
+    info       os.FileInfo
+    content    []byte
+}
+
+// downloadFiles handles POST /api/download, streaming the selected files as
+// a tar.gz. Files excluded by .gitignore are never matched by the glob.
+func downloadFiles(c *gin.Context) {
+    entries, ok := selectArchiveEntries(c)
+    if !ok {
+        return
+    }
+    streamArchive(c, "edit3", entries)
+}
+
+// selectArchiveEntries binds a DownloadRequest and resolves it to files. It
+// responds with an error itself and returns false if the request is bad.
+func selectArchiveEntries(c *gin.Context) ([]archiveEntry, bool) {
+    var req DownloadRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return nil, false
+    }
+    if len(req.Paths) == 0 && req.Glob == "" {
+        c.JSON(400, gin.H{"error": "paths or glob is required"})
+        return nil, false
+    }
+
+    var entries []archiveEntry
+    seen := make(map[string]bool)
+    add := func(name string, explicit bool) bool {
+        if seen[name] {
+            return true
+        }
+        seen[name] = true
+        _, _, full, err := resolvePath(name)
+        if err != nil {
+            c.JSON(403, gin.H{"error": err.Error()})
+            return false
+        }
+        info, err := os.Stat(full)
+        if err != nil || !info.Mode().IsRegular() {
+            if explicit {
+                c.JSON(404, gin.H{"error": fmt.Sprintf("%s not found", name)})
+                return false
+            }
+            return true
+        }
+        entry := archiveEntry{name: name, full: full, info: info}
+        if masksSecrets(name) {
+            content, err := ioutil.ReadFile(full)
+            if err != nil {
+                c.JSON(500, gin.H{"error": err.Error()})
+                return false
+            }
+            entry.content = maskSecrets(name, content)
+        }
+        entries = append(entries, entry)
+        return true
+    }
+
+    for _, name := range req.Paths {
+        if !add(name, true) {
+            return nil, false
+        }
+    }
+    if req.Glob != "" {
+        files, err := gitLines(c.Request.Context(), DataDir, "ls-files", "--cached", "--others", "--exclude-standard")
+        if err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return nil, false
+        }
+        for _, rel := range files {
+            if pathMatches([]string{req.Glob}, rel) && !add(rel, false) {
+                return nil, false
+            }
+        }
+    }
+    if len(entries) == 0 {
+        c.JSON(404, gin.H{"error": "no files match"})
+        return nil, false
+    }
+    return entries, true
+}
+
+// Batch reads
+
+// MaxBatchFiles caps how many files one batch get returns.
+const MaxBatchFiles = 1000
+
+// BatchFile is one file of a batch get: what GET /api/file returns for it,
+// or the reason it could not be read.
+type BatchFile struct {
+    FileResponse
+    Size     int64     `json:"size"`
+    Modified time.Time `json:"modified"`
+    Error    string    `json:"error,omitempty"`
+}
+
+// batchGet handles POST /api/batch/get: the contents and metadata of the
+// files named in paths and matched by glob (a DownloadRequest), in one
+// response. Files that cannot be read carry an error instead of failing the
+// batch; Commit is the last commit touching each file.
+func batchGet(c *gin.Context) {
+    var req DownloadRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if len(req.Paths) == 0 && req.Glob == "" {
+        c.JSON(400, gin.H{"error": "paths or glob is required"})
+        return
+    }
+    names := append([]string(nil), req.Paths...)
+    if req.Glob != "" {
+        files, err := gitLines(c.Request.Context(), DataDir, "ls-files", "--cached", "--others", "--exclude-standard")
+        if err != nil {
+            c.JSON(500, gin.H{"error": err.Error()})
+            return
+        }
+        for _, rel := range files {
+            if pathMatches([]string{req.Glob}, rel) && supportedFileType(rel) {
+                names = append(names, rel)
+            }
+        }
+    }
+
+    files := make([]BatchFile, 0, len(names))
+    rels := make(map[string][]string) // read files by directory
+    read := make(map[int][2]string)   // index in files -> directory, rel
+    seen := make(map[string]bool)
+    for _, name := range names {
+        if seen[name] {
+            continue
+        }
+        seen[name] = true
+        if len(files) == MaxBatchFiles {
+            c.JSON(400, gin.H{"error": fmt.Sprintf("more than %d files requested", MaxBatchFiles)})
+            return
+        }
+        f := BatchFile{FileResponse: FileResponse{Filename: name}}
+        dir, rel, _, err := resolvePath(name)
+        if err != nil {
+            f.Error = err.Error()
+            files = append(files, f)
+            continue
+        }
+        fs := fileStore(dir)
+        info, err := fs.Stat(storageName(rel))
+        if err == nil && info.IsDir {
+            err = fmt.Errorf("%s is a directory", name)
+        }
+        var content []byte
+        if err == nil {
+            content, err = fs.Read(storageName(rel))
+        }
+        if errors.Is(err, os.ErrNotExist) {
+            f.Error = fmt.Sprintf("%s does not exist", name)
+        } else if err != nil {
+            f.Error = err.Error()
+        } else {
+            content = maskSecrets(rel, content)
+            fileType, syntax := fileHint(rel, content)
+            f.Content, f.Type, f.Mode, f.MIME = string(content), fileType, syntax.Mode, syntax.MIME
+            f.Freeze = activeFreeze(rel)
+            f.Size, f.Modified = info.Size, info.ModTime
+            rels[dir] = append(rels[dir], storageName(rel))
+            read[len(files)] = [2]string{dir, storageName(rel)}
+        }
+        files = append(files, f)
+    }
+
+    commits := make(map[string]map[string]string)
+    for dir, list := range rels {
+        commits[dir] = pathCommits(c.Request.Context(), dir, list)
+    }
+    for i, at := range read {
+        files[i].Commit = commits[at[0]][at[1]]
+    }
+    c.JSON(200, gin.H{"files": files})
+}
+
+// pathCommits is lastCommits for the given files, which may sit in
+// subdirectories, with a single git log.
+func pathCommits(ctx context.Context, dir string, rels []string) map[string]string {
+    commits := make(map[string]string)
+    args := append([]string{"log", "--format=commit %h", "--name-only", "--relative", "--"}, rels...)
+    lines, err := gitLines(ctx, dir, args...)
+    if err != nil {
+        return commits
+    }
+    hash := ""
+    for _, line := range lines {
+        if strings.HasPrefix(line, "commit ") {
+            hash = strings.TrimPrefix(line, "commit ")
+        } else if _, seen := commits[line]; !seen && line != "" {
+            commits[line] = hash
+        }
+    }
+    return commits
+}
+
+// streamArchive writes entries as a tar.gz attachment named after prefix.
+// Everything is resolved beforehand so errors can still get a status code.
+func streamArchive(c *gin.Context, prefix string, entries []archiveEntry) {
+    c.Header("Content-Type", "application/gzip")
+    c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.tar.gz"`, prefix, time.Now().UTC().Format("20060102-150405")))
+    c.Status(200)
+    gz := gzip.NewWriter(c.Writer)
+    tw := tar.NewWriter(gz)
+    for _, e := range entries {
+        if err := writeTarEntry(tw, e); err != nil {
+            // Headers are gone; a truncated archive is all we can signal
+            log.Printf("download %s: %v", e.name, err)
+            return
+        }
+    }
+    tw.Close()
+    gz.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, e archiveEntry) error {
+    hdr, err := tar.FileInfoHeader(e.info, "")
+    if err != nil {
+        return err
+    }
+    hdr.Name = strings.TrimLeft(filepath.ToSlash(strings.TrimPrefix(e.name, filepath.VolumeName(e.name))), "/")
+    if e.content != nil {
+        hdr.Size = int64(len(e.content))
+        if err := tw.WriteHeader(hdr); err != nil {
+            return err
+        }
+        _, err = tw.Write(e.content)
+        return err
+    }
+
+    f, err := os.Open(e.full)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    if err := tw.WriteHeader(hdr); err != nil {
+        return err
+    }
+    _, err = io.Copy(tw, f)
+    return err
+}
+
+// Redacted export
+
+// RedactRule replaces sensitive values in exported copies. A value is
+// redacted when it sits at one of Pointers ("*" matches a segment), under a
+// key matching Keys, or is a string matching Values. Replace picks the
+// substitute: "placeholder" (Placeholder, default "<redacted>"), "email"
+// (a stable fake address), or "hash" (a stable short digest), so equal
+// inputs stay equal across files.
+type RedactRule struct {
+    Name        string   `yaml:"name"`
+    Paths       []string `yaml:"paths"`
+    Pointers    []string `yaml:"pointers"`
+    Keys        string   `yaml:"keys"`
+    Values      string   `yaml:"values"`
+    Replace     string   `yaml:"replace"`
+    Placeholder string   `yaml:"placeholder"`
+
+    keys, values *regexp.Regexp
+}
+
+// DefaultSecretKeys matches the keys whose values are secrets unless the
+// configuration says otherwise.
+const DefaultSecretKeys = `(?i)(pass(word|wd)?|secret|token|api[_-]?key|private[_-]?key|credential)`
+
+// defaultRedactRules apply when the configuration has no redact section.
+var defaultRedactRules = []RedactRule{
+    {Name: "secrets", Keys: DefaultSecretKeys},
+    {Name: "emails", Values: `^[^@\s]+@[^@\s]+\.[a-zA-Z]{2,}$`, Replace: "email"},
+}
+
+func compileRedactRule(r *RedactRule) error {
+    var err error
+    if r.Keys != "" {
+        if r.keys, err = regexp.Compile(r.Keys); err != nil {
+            return fmt.Errorf("redact %s: %v", r.Name, err)
+        }
+    }
+    if r.Values != "" {
+        if r.values, err = regexp.Compile(r.Values); err != nil {
+            return fmt.Errorf("redact %s: %v", r.Name, err)
+        }
+    }
+    switch r.Replace {
+    case "", "placeholder", "email", "hash":
+    default:
+        return fmt.Errorf("redact %s: replace must be placeholder, email or hash", r.Name)
+    }
+    return nil
+}
+
+func redactRules() []RedactRule {
+    if len(config.Redact) > 0 {
+        return config.Redact
+    }
+    rules := append([]RedactRule(nil), defaultRedactRules...)
+    for i := range rules {
+        compileRedactRule(&rules[i])
+    }
+    return rules
+}
+
+func (r *RedactRule) substitute(v interface{}) interface{} {
+    sum := sha256.Sum256([]byte(fmt.Sprint(v)))
+    digest := hex.EncodeToString(sum[:])[:10]
+    switch r.Replace {
+    case "email":
+        return "user-" + digest + "@example.com"
+    case "hash":
+        return digest
+    }
+    if r.Placeholder != "" {
+        return r.Placeholder
+    }
+    return "<redacted>"
+}
+
+// redactDocument rewrites the leaves of doc that the rules select.
+func redactDocument(doc interface{}, rel string, rules []RedactRule) interface{} {
+    var active []*RedactRule
+    for i := range rules {
+        if pathMatches(rules[i].Paths, rel) {
+            active = append(active, &rules[i])
+        }
+    }
+    var walk func(ptr, key string, v interface{}, hit *RedactRule) interface{}
+    walk = func(ptr, key string, v interface{}, hit *RedactRule) interface{} {
+        if hit == nil {
+            for _, r := range active {
+                if r.keys != nil && key != "" && r.keys.MatchString(key) {
+                    hit = r
+                    break
+                }
+                for _, pattern := range r.Pointers {
+                    if pointerUnder(pattern, ptr) {
+                        hit = r
+                        break
+                    }
+                }
+                if hit != nil {
+                    break
+                }
+            }
+        }
+        switch val := v.(type) {
+        case map[string]interface{}:
+            out := make(map[string]interface{}, len(val))
+            for k, child := range val {
+                out[k] = walk(ptr+"/"+escapePointer(k), k, child, hit)
+            }
+            return out
+        case []interface{}:
+            out := make([]interface{}, len(val))
+            for i, child := range val {
+                out[i] = walk(fmt.Sprintf("%s/%d", ptr, i), "", child, hit)
+            }
+            return out
+        case nil:
+            return nil
+        }
+        if hit != nil {
+            return hit.substitute(v)
+        }
+        if s, ok := v.(string); ok {
+            for _, r := range active {
+                if r.values != nil && r.values.MatchString(s) {
+                    return r.substitute(s)
+                }
+            }
+        }
+        return v
+    }
+    return walk("", "", doc, nil)
+}
+
+// exportFiles handles POST /api/export: like /api/download, but every file
+// is a redacted copy. Files edit3 cannot parse (XML, plain text) are left
+// out rather than risk leaking them; X-Edit3-Skipped lists them.
+func exportFiles(c *gin.Context) {
+    entries, ok := selectArchiveEntries(c)
+    if !ok {
+        return
+    }
+    rules := redactRules()
+    var kept []archiveEntry
+    var skipped []string
+    for _, e := range entries {
+        fileType := getFileType(e.name)
+        content, err := ioutil.ReadFile(e.full)
+        var doc interface{}
+        if err == nil {
+            doc, err = parseDocument(content, fileType)
+        }
+        if err == nil && doc != nil {
+            e.content, err = marshalDocument(redactDocument(doc, filepath.ToSlash(e.name), rules), fileType)
+        }
+        if err != nil || doc == nil {
+            skipped = append(skipped, e.name)
+            continue
+        }
+        kept = append(kept, e)
+    }
+    if len(kept) == 0 {
+        c.JSON(422, gin.H{"error": "none of the selected files can be redacted", "skipped": skipped})
+        return
+    }
+    if len(skipped) > 0 {
+        c.Header("X-Edit3-Skipped", strings.Join(skipped, ","))
+    }
+    streamArchive(c, "edit3-export", kept)
+}
+
+// Analysis
+
+// Location names a value inside a file.
+type Location struct {
+    File    string `json:"file"`
+    Pointer string `json:"pointer"`
+}
+
+type DuplicateGroup struct {
+    Hash        string     `json:"hash"`
+    Leaves      int        `json:"leaves"`
+    Occurrences []Location `json:"occurrences"`
+}
+
+type SimilarPair struct {
+    A          Location `json:"a"`
+    B          Location `json:"b"`
+    Similarity float64  `json:"similarity"`
+}
+
+type DuplicateReport struct {
+    Files    [][]string       `json:"files"`
+    Subtrees []DuplicateGroup `json:"subtrees"`
+    Similar  []SimilarPair    `json:"similar"`
+}
+
+// MaxSimilarityCandidates caps the subtrees compared pairwise.
+const MaxSimilarityCandidates = 2000
+
+// analysisFiles lists the structured files in the data directory matching
+// glob (all when empty), honouring .gitignore.
+func analysisFiles(ctx context.Context, glob string) ([]string, error) {
+    files, err := gitLines(ctx, DataDir, "ls-files", "--cached", "--others", "--exclude-standard")
+    if err != nil {
+        return nil, err
+    }
+    var selected []string
+    for _, rel := range files {
+        if supportedFileType(rel) && (glob == "" || pathMatches([]string{glob}, rel)) {
+            if _, err := os.Stat(filepath.Join(DataDir, rel)); err == nil {
+                selected = append(selected, rel)
+            }
+        }
+    }
+    sort.Strings(selected)
+    return selected, nil
+}
+
+// leafPairs flattens a subtree into "relative-pointer=value" strings.
+func leafPairs(v interface{}, ptr string, out map[string]bool) {
+    switch val := v.(type) {
+    case map[string]interface{}:
+        for k, child := range val {
+            leafPairs(child, ptr+"/"+escapePointer(k), out)
+        }
+    case []interface{}:
+        for i, child := range val {
+            leafPairs(child, fmt.Sprintf("%s/%d", ptr, i), out)
+        }
+    default:
+        b, _ := json.Marshal(val)
+        out[ptr+"="+string(b)] = true
+    }
+}
+
+func underLocation(parent, child Location) bool {
+    return parent.File == child.File && (parent.Pointer == child.Pointer || strings.HasPrefix(child.Pointer, parent.Pointer+"/"))
+}
+
+// findDuplicates reports identical files, identical subtrees of at least
+// minLeaves values, and object pairs whose leaves overlap by at least
+// threshold (Jaccard similarity).
+func findDuplicates(files []string, minLeaves int, threshold float64) DuplicateReport {
+    report := DuplicateReport{Files: [][]string{}, Subtrees: []DuplicateGroup{}, Similar: []SimilarPair{}}
+
+    type subtree struct {
+        loc    Location
+        hash   string
+        leaves map[string]bool
+    }
+    var subtrees []subtree
+    byContent := make(map[string][]string)
+    for _, rel := range files {
+        content, err := fileStore(DataDir).Read(storageName(rel))
+        if err != nil {
+            continue
+        }
+        sum := sha256.Sum256(content)
+        byContent[hex.EncodeToString(sum[:])] = append(byContent[hex.EncodeToString(sum[:])], rel)
+
+        doc, err := parseDocument(content, getFileType(rel))
+        if err != nil || doc == nil {
+            continue
+        }
+        var walk func(ptr string, v interface{})
+        walk = func(ptr string, v interface{}) {
+            switch val := v.(type) {
+            case map[string]interface{}:
+                for k, child := range val {
+                    walk(ptr+"/"+escapePointer(k), child)
+                }
+            case []interface{}:
+                for i, child := range val {
+                    walk(fmt.Sprintf("%s/%d", ptr, i), child)
+                }
+            default:
+                return
+            }
+            leaves := make(map[string]bool)
+            leafPairs(v, "", leaves)
+            if len(leaves) < minLeaves {
+                return
+            }
+            b, _ := json.Marshal(v)
+            sum := sha256.Sum256(b)
+            subtrees = append(subtrees, subtree{Location{rel, ptr}, hex.EncodeToString(sum[:8]), leaves})
+        }
+        walk("", doc)
+    }
+
+    for _, group := range byContent {
+        if len(group) > 1 {
+            report.Files = append(report.Files, group)
+        }
+    }
+    sort.Slice(report.Files, func(i, j int) bool { return report.Files[i][0] < report.Files[j][0] })
+
+    // Identical subtrees, largest first, dropping groups nested in one
+    // already reported
+    groups := make(map[string]*DuplicateGroup)
+    for _, s := range subtrees {
+        g := groups[s.hash]
+        if g == nil {
+            g = &DuplicateGroup{Hash: s.hash, Leaves: len(s.leaves)}
+            groups[s.hash] = g
+        }
+        g.Occurrences = append(g.Occurrences, s.loc)
+    }
+    var sorted []*DuplicateGroup
+    for _, g := range groups {
+        if len(g.Occurrences) > 1 {
+            occ := g.Occurrences
+            sort.Slice(occ, func(i, j int) bool {
+                return occ[i].File < occ[j].File || occ[i].File == occ[j].File && occ[i].Pointer < occ[j].Pointer
+            })
+            sorted = append(sorted, g)
+        }
+    }
+    sort.Slice(sorted, func(i, j int) bool {
+        if sorted[i].Leaves != sorted[j].Leaves {
+            return sorted[i].Leaves > sorted[j].Leaves
+        }
+        return sorted[i].Hash < sorted[j].Hash
+    })
+    var covered []Location
+    for _, g := range sorted {
+        nested := true
+        for _, occ := range g.Occurrences {
+            inside := false
+            for _, c := range covered {
+                if underLocation(c, occ) {
+                    inside = true
+                    break
+                }
+            }
+            if !inside {
+                nested = false
+                break
+            }
+        }
+        if nested {
+            continue
+        }
+        covered = append(covered, g.Occurrences...)
+        report.Subtrees = append(report.Subtrees, *g)
+    }
+
+    // Near-identical subtrees
+    if len(subtrees) > MaxSimilarityCandidates {
+        subtrees = subtrees[:MaxSimilarityCandidates]
+    }
+    for i := 0; i < len(subtrees); i++ {
+        for j := i + 1; j < len(subtrees); j++ {
+            a, b := subtrees[i], subtrees[j]
+            if a.hash == b.hash || underLocation(a.loc, b.loc) || underLocation(b.loc, a.loc) {
+                continue
+            }
+            small, large := len(a.leaves), len(b.leaves)
+            if small > large {
+                small, large = large, small
+            }
+            if float64(small)/float64(large) < threshold {
+                continue
+            }
+            shared := 0
+            for leaf := range a.leaves {
+                if b.leaves[leaf] {
+                    shared++
+                }
+            }
+            similarity := float64(shared) / float64(len(a.leaves)+len(b.leaves)-shared)
+            if similarity >= threshold {
+                report.Similar = append(report.Similar, SimilarPair{a.loc, b.loc, math.Round(similarity*1000) / 1000})
+            }
+        }
+    }
+    sort.Slice(report.Similar, func(i, j int) bool { return report.Similar[i].Similarity > report.Similar[j].Similarity })
+    return report
+}
+
+// duplicateAnalysis handles GET /api/analysis/duplicates?glob=&minLeaves=&threshold=.
+func duplicateAnalysis(c *gin.Context) {
+    minLeaves, err := strconv.Atoi(c.DefaultQuery("minLeaves", "4"))
+    if err != nil || minLeaves < 1 {
+        c.JSON(400, gin.H{"error": "minLeaves must be a positive number"})
+        return
+    }
+    threshold, err := strconv.ParseFloat(c.DefaultQuery("threshold", "0.8"), 64)
+    if err != nil || threshold <= 0 || threshold > 1 {
+        c.JSON(400, gin.H{"error": "threshold must be in (0, 1]"})
+        return
+    }
+    files, err := analysisFiles(c.Request.Context(), c.Query("glob"))
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, findDuplicates(files, minLeaves, threshold))
+}
+
+// UnusedConfig drives the unused-key analysis. Keys of files matching Paths
+// count as used when a consumer in Manifest claims them or their name occurs
+// in any file matching Search (globs relative to the configuration file).
+type UnusedConfig struct {
+    Paths    []string `yaml:"paths"`
+    Manifest string   `yaml:"manifest"`
+    Search   []string `yaml:"search"`
+
+    base string
+}
+
+// Consumer is a manifest entry or a consumer registered through
+// /api/consumers: a service and the values it reads, the whole of its
+// files when it names no pointers.
+type Consumer struct {
+    Name       string     `yaml:"name" json:"name"`
+    Contact    string     `yaml:"contact" json:"contact,omitempty"`
+    Files      []string   `yaml:"files" json:"files"`
+    Pointers   []string   `yaml:"pointers" json:"pointers"`
+    Source     string     `yaml:"-" json:"source,omitempty"` // "api" or the manifest
+    Registered *time.Time `yaml:"-" json:"registered,omitempty"`
+}
+
+type UnusedKey struct {
+    File    string `json:"file"`
+    Pointer string `json:"pointer"`
+    Key     string `json:"key"`
+}
+
+// MaxSearchFileSize skips large files (binaries, bundles) when grepping.
+const MaxSearchFileSize = 1 << 20
+
+// searchCorpus reads the files the unused analysis greps through.
+func searchCorpus(u *UnusedConfig) ([]string, error) {
+    var corpus []string
+    if len(u.Search) == 0 {
+        return nil, nil
+    }
+    // The config files themselves mention every key; never search them
+    data, _ := filepath.Abs(DataDir)
+    err := filepath.Walk(u.base, func(p string, info os.FileInfo, err error) error {
+        if err != nil {
+            return nil
+        }
+        if info.IsDir() {
+            abs, _ := filepath.Abs(p)
+            if p != u.base && strings.HasPrefix(info.Name(), ".") || abs == data {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        rel, _ := filepath.Rel(u.base, p)
+        if info.Size() > MaxSearchFileSize || !pathMatches(u.Search, rel) {
+            return nil
+        }
+        if content, err := ioutil.ReadFile(p); err == nil {
+            corpus = append(corpus, string(content))
+        }
+        return nil
+    })
+    return corpus, err
+}
+
+// findUnusedKeys lists the leaf keys of files that no consumer claims and
+// no search target mentions. Array elements are judged by their parent key.
+func findUnusedKeys(u *UnusedConfig, files []string) ([]UnusedKey, error) {
+    consumers, err := readConsumers(u.Manifest)
+    if err != nil {
+        return nil, err
+    }
+    corpus, err := searchCorpus(u)
+    if err != nil {
+        return nil, err
+    }
+    mentioned := make(map[string]bool)
+    isMentioned := func(key string) bool {
+        if used, ok := mentioned[key]; ok {
+            return used
+        }
+        for _, text := range corpus {
+            if strings.Contains(text, key) {
+                mentioned[key] = true
+                return true
+            }
+        }
+        mentioned[key] = false
+        return false
+    }
+
+    unused := []UnusedKey{}
+    for _, rel := range files {
+        if !pathMatches(u.Paths, rel) {
+            continue
+        }
+        content, err := fileStore(DataDir).Read(storageName(rel))
+        if err != nil {
+            continue
+        }
+        doc, err := parseDocument(content, getFileType(rel))
+        if err != nil || doc == nil {
+            continue
+        }
+        var claims []string
+        for _, consumer := range consumers {
+            if pathMatches(consumer.Files, rel) {
+                claims = append(claims, consumer.Pointers...)
+            }
+        }
+
+        var walk func(ptr, key string, v interface{})
+        walk = func(ptr, key string, v interface{}) {
+            if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+                for k, child := range m {
+                    walk(ptr+"/"+escapePointer(k), k, child)
+                }
+                return
+            }
+            if key == "" {
+                return
+            }
+            for _, claim := range claims {
+                if pointerUnder(claim, ptr) {
+                    return
+                }
+            }
+            if isMentioned(key) {
+                return
+            }
+            unused = append(unused, UnusedKey{File: rel, Pointer: ptr, Key: key})
+        }
+        walk("", "", doc)
+    }
+    sort.Slice(unused, func(i, j int) bool {
+        return unused[i].File < unused[j].File || unused[i].File == unused[j].File && unused[i].Pointer < unused[j].Pointer
+    })
+    return unused, nil
+}
+
+// unusedAnalysis handles GET /api/analysis/unused?glob=.
+func unusedAnalysis(c *gin.Context) {
+    if config.Unused == nil {
+        c.JSON(400, gin.H{"error": "no unused section in the configuration"})
+        return
+    }
+    files, err := analysisFiles(c.Request.Context(), c.Query("glob"))
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    unused, err := findUnusedKeys(config.Unused, files)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"unused": unused})
+}
+
+// Budget caps the size and complexity of matching files. Exceeding it does
+// not block a save; it shows up as a warning and in the budget report.
+type Budget struct {
+    Name     string   `yaml:"name"`
+    Paths    []string `yaml:"paths"`
+    MaxSize  int      `yaml:"max_size"`
+    MaxDepth int      `yaml:"max_depth"`
+    MaxKeys  int      `yaml:"max_keys"`
+}
+
+// FileMetrics measures a file for budgets. Depth counts nested objects and
+// arrays; Keys counts object keys at every level.
+type FileMetrics struct {
+    File       string      `json:"file"`
+    Size       int         `json:"size"`
+    Depth      int         `json:"depth"`
+    Keys       int         `json:"keys"`
+    Violations []Violation `json:"violations,omitempty"`
+}
+
+func measureDocument(doc interface{}) (depth, keys int) {
+    switch v := doc.(type) {
+    case map[string]interface{}:
+        for _, child := range v {
+            d, k := measureDocument(child)
+            if d > depth {
+                depth = d
+            }
+            keys += k + 1
+        }
+        return depth + 1, keys
+    case []interface{}:
+        for _, child := range v {
+            d, k := measureDocument(child)
+            if d > depth {
+                depth = d
+            }
+            keys += k
+        }
+        return depth + 1, keys
+    }
+    return 0, 0
+}
+
+// checkBudgets measures content and compares it to the budgets for rel.
+func checkBudgets(rel string, content []byte) FileMetrics {
+    m := FileMetrics{File: filepath.ToSlash(rel), Size: len(content)}
+    if doc, err := parseDocument(content, getFileType(rel)); err == nil {
+        m.Depth, m.Keys = measureDocument(doc)
+    }
+    for _, b := range config.Budgets {
+        if !pathMatches(b.Paths, rel) {
+            continue
+        }
+        if b.MaxSize > 0 && m.Size > b.MaxSize {
+            m.Violations = append(m.Violations, Violation{Policy: b.Name, Message: fmt.Sprintf("size %d bytes exceeds the budget of %d", m.Size, b.MaxSize)})
+        }
+        if b.MaxDepth > 0 && m.Depth > b.MaxDepth {
+            m.Violations = append(m.Violations, Violation{Policy: b.Name, Message: fmt.Sprintf("nesting depth %d exceeds the budget of %d", m.Depth, b.MaxDepth)})
+        }
+        if b.MaxKeys > 0 && m.Keys > b.MaxKeys {
+            m.Violations = append(m.Violations, Violation{Policy: b.Name, Message: fmt.Sprintf("%d keys exceed the budget of %d", m.Keys, b.MaxKeys)})
+        }
+    }
+    return m
+}
+
+// budgetAnalysis handles GET /api/analysis/budgets?glob=&all=1, listing the
+// files over budget (every file with all=1), largest first.
+func budgetAnalysis(c *gin.Context) {
+    files, err := analysisFiles(c.Request.Context(), c.Query("glob"))
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    all := c.Query("all") != ""
+    report := []FileMetrics{}
+    for _, rel := range files {
+        content, err := fileStore(DataDir).Read(storageName(rel))
+        if err != nil {
+            continue
+        }
+        if m := checkBudgets(rel, content); all || len(m.Violations) > 0 {
+            report = append(report, m)
+        }
+    }
+    sort.SliceStable(report, func(i, j int) bool { return report[i].Size > report[j].Size })
+    c.JSON(200, gin.H{"files": report})
+}
+
+// ConsistencyConfig narrows the consistency analysis to files matching
+// Paths and values under keys matching Keys (a regular expression; all keys
+// when empty).
+type ConsistencyConfig struct {
+    Paths []string `yaml:"paths"`
+    Keys  string   `yaml:"keys"`
+
+    keys *regexp.Regexp
+}
+
+// MaxConsistencyValue skips long strings, which are prose rather than
+// names, in the consistency analysis.
+const MaxConsistencyValue = 100
+
+// Variant is one spelling of a value and where it is used.
+type Variant struct {
+    Value       string     `json:"value"`
+    Occurrences []Location `json:"occurrences"`
+}
+
+// Inconsistency is a value spelled more than one way, differing only in
+// case or whitespace, such as "Prod" and "prod ". Variants come most used
+// first.
+type Inconsistency struct {
+    Normalized string    `json:"normalized"`
+    Variants   []Variant `json:"variants"`
+}
+
+// normalizeSpelling folds case and runs of whitespace.
+func normalizeSpelling(s string) string {
+    return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// findInconsistencies groups the string values of files by their
+// normalized spelling and returns the groups spelled more than one way.
+func findInconsistencies(files []string, read func(name string) ([]byte, error)) []Inconsistency {
+    spellings := make(map[string]map[string][]Location)
+    for _, name := range files {
+        content, err := read(name)
+        if err != nil {
+            continue
+        }
+        var doc interface{}
+        if t := getFileType(name); engine.IsEnv(t) {
+            doc = envDocument(content)
+        } else if doc, err = parseDocument(content, t); err != nil {
+            continue
+        }
+        var walk func(ptr, key string, v interface{})
+        walk = func(ptr, key string, v interface{}) {
+            switch val := v.(type) {
+            case map[string]interface{}:
+                for k, child := range val {
+                    walk(ptr+"/"+escapePointer(k), k, child)
+                }
+            case []interface{}:
+                for i, child := range val {
+                    walk(fmt.Sprintf("%s/%d", ptr, i), key, child)
+                }
+            case string:
+                keys := config.Consistency.keys
+                if len(val) > MaxConsistencyValue || !strings.ContainsFunc(val, unicode.IsLetter) || (keys != nil && !keys.MatchString(key)) {
+                    return
+                }
+                n := normalizeSpelling(val)
+                if spellings[n] == nil {
+                    spellings[n] = make(map[string][]Location)
+                }
+                spellings[n][val] = append(spellings[n][val], Location{File: name, Pointer: ptr})
+            }
+        }
+        walk("", "", doc)
+    }
+    found := []Inconsistency{}
+    for n, variants := range spellings {
+        if len(variants) < 2 {
+            continue
+        }
+        inc := Inconsistency{Normalized: n}
+        for value, locations := range variants {
+            sort.Slice(locations, func(i, j int) bool {
+                if locations[i].File != locations[j].File {
+                    return locations[i].File < locations[j].File
+                }
+                return locations[i].Pointer < locations[j].Pointer
+            })
+            inc.Variants = append(inc.Variants, Variant{Value: value, Occurrences: locations})
+        }
+        sort.Slice(inc.Variants, func(i, j int) bool {
+            a, b := inc.Variants[i], inc.Variants[j]
+            if len(a.Occurrences) != len(b.Occurrences) {
+                return len(a.Occurrences) > len(b.Occurrences)
+            }
+            return a.Value < b.Value
+        })
+        found = append(found, inc)
+    }
+    sort.Slice(found, func(i, j int) bool { return found[i].Normalized < found[j].Normalized })
+    return found
+}
+
+// consistencyAnalysis handles GET /api/analysis/consistency?glob=, the
+// string values spelled differently across files only by case or spacing.
+func consistencyAnalysis(c *gin.Context) {
+    files, err := analysisFiles(c.Request.Context(), c.Query("glob"))
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    var selected []string
+    for _, rel := range files {
+        if pathMatches(config.Consistency.Paths, rel) {
+            selected = append(selected, rel)
+        }
+    }
+    // Secrets are masked before they are compared, so that none is quoted
+    read := func(rel string) ([]byte, error) {
+        content, err := fileStore(DataDir).Read(storageName(rel))
+        return maskSecrets(rel, content), err
+    }
+    c.JSON(200, gin.H{"inconsistencies": findInconsistencies(selected, read)})
+}
+
+// printInconsistencies writes the lint warnings of validate --consistency:
+// one per spelling other than the most used one.
+func printInconsistencies(found []Inconsistency) {
+    for _, inc := range found {
+        usual := inc.Variants[0]
+        for _, v := range inc.Variants[1:] {
+            for _, at := range v.Occurrences {
+                first := usual.Occurrences[0]
+                fmt.Fprintf(os.Stderr, "%s: %s: warning: %q differs from %q (%s: %s) only in case or spacing\n",
+                    at.File, dottedPath(at.Pointer), v.Value, usual.Value, first.File, dottedPath(first.Pointer))
+            }
+        }
+    }
+}
+
+// ExpiryConfig tunes the expiring values analysis. Certificates are found
+// by their PEM armour; dates only under keys matching one of Keys (regular
+// expressions, DefaultExpiryKeys when empty), since most dates in config
+// are not deadlines. Values due within Within (DefaultExpiryWindow when
+// zero) are announced as value.expiring and, once past, value.expired
+// events, and on the channel if one is given. Paths limits which files are
+// checked.
+type ExpiryConfig struct {
+    Within          time.Duration `yaml:"within"`
+    Keys            []string      `yaml:"keys"`
+    Paths           []string      `yaml:"paths"`
+    ApprovalChannel `yaml:",inline"`
+
+    keys []*regexp.Regexp
+}
+
+const (
+    DefaultExpiryWindow = 30 * 24 * time.Hour
+    DefaultExpiryKeys   = `(?i)expir|not_?after|valid_?(until|to)|until$|deadline|renew|end_?of_?life|sunset|end_?date`
+    // ExpiryCheckInterval is how often the scheduler looks for values
+    // coming due.
+    ExpiryCheckInterval = time.Hour
+)
+
+func (e *ExpiryConfig) compile() error {
+    if e.Within <= 0 {
+        e.Within = DefaultExpiryWindow
+    }
+    keys := e.Keys
+    if len(keys) == 0 {
+        keys = []string{DefaultExpiryKeys}
+    }
+    e.keys = nil
+    for _, k := range keys {
+        re, err := regexp.Compile(k)
+        if err != nil {
+            return fmt.Errorf("key %q: %v", k, err)
+        }
+        e.keys = append(e.keys, re)
+    }
+    return nil
+}
+
+// ExpiringValue is a certificate or date found in a file.
+type ExpiringValue struct {
+    File     string    `json:"file"`
+    Pointer  string    `json:"pointer"`
+    Kind     string    `json:"kind"`              // certificate or date
+    Subject  string    `json:"subject,omitempty"` // of a certificate
+    NotAfter time.Time `json:"notAfter"`
+    Days     int       `json:"days"` // left; negative once expired
+    Expired  bool      `json:"expired"`
+}
+
+var expiryLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// expiryDate reads an ISO 8601 date or date and time.
+func expiryDate(s string) (time.Time, bool) {
+    if len(s) < 10 || len(s) > 40 || s[4] != '-' {
+        return time.Time{}, false
+    }
+    for _, layout := range expiryLayouts {
+        if t, err := time.Parse(layout, s); err == nil {
+            return t, true
+        }
+    }
+    return time.Time{}, false
+}
+
+// pemCertificates decodes the certificates armoured in s.
+func pemCertificates(s string) []*x509.Certificate {
+    var certs []*x509.Certificate
+    rest := []byte(s)
+    for {
+        var block *pem.Block
+        block, rest = pem.Decode(rest)
+        if block == nil {
+            return certs
+        }
+        if block.Type != "CERTIFICATE" {
+            continue
+        }
+        if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+            certs = append(certs, cert)
+        }
+    }
+}
+
+// expiringValues lists the certificates and expiry dates in a file, due or
+// not. Structured files are searched value by value; others only for
+// certificates.
+func expiringValues(rel string, content []byte) []ExpiringValue {
+    var found []ExpiringValue
+    addCerts := func(pointer, s string) {
+        for _, cert := range pemCertificates(s) {
+            subject := cert.Subject.CommonName
+            if subject == "" {
+                subject = cert.Subject.String()
+            }
+            found = append(found, ExpiringValue{File: rel, Pointer: pointer, Kind: "certificate", Subject: subject, NotAfter: cert.NotAfter})
+        }
+    }
+    doc, err := parseDocument(content, getFileType(rel))
+    if err != nil || doc == nil {
+        if bytes.Contains(content, []byte("-----BEGIN CERTIFICATE-----")) {
+            addCerts("", string(content))
+        }
+        return found
+    }
+    var walk func(ptr, key string, v interface{})
+    walk = func(ptr, key string, v interface{}) {
+        switch val := v.(type) {
+        case map[string]interface{}:
+            for k, child := range val {
+                walk(ptr+"/"+escapePointer(k), k, child)
+            }
+            return
+        case []interface{}:
+            for i, child := range val {
+                walk(fmt.Sprintf("%s/%d", ptr, i), key, child)
+            }
+            return
+        }
+        s, ok := v.(string)
+        if stringer, isStringer := v.(fmt.Stringer); !ok && isStringer {
+            s, ok = stringer.String(), true // TOML dates
+        }
+        if !ok {
+            return
+        }
+        if strings.Contains(s, "-----BEGIN CERTIFICATE-----") {
+            addCerts(ptr, s)
+            return
+        }
+        for _, re := range config.Expiry.keys {
+            if re.MatchString(key) {
+                if t, ok := expiryDate(strings.TrimSpace(s)); ok {
+                    found = append(found, ExpiringValue{File: rel, Pointer: ptr, Kind: "date", NotAfter: t})
+                }
+                break
+            }
+        }
+    }
+    walk("", "", doc)
+    return found
+}
+
+// findExpiring lists the values in files due within the window (all of
+// them with all), soonest first.
+func findExpiring(files []string, now time.Time, within time.Duration, all bool) []ExpiringValue {
+    list := []ExpiringValue{}
+    for _, rel := range files {
+        if !pathMatches(config.Expiry.Paths, rel) {
+            continue
+        }
+        content, err := fileStore(DataDir).Read(storageName(rel))
+        if err != nil {
+            continue
+        }
+        for _, v := range expiringValues(rel, content) {
+            v.Expired = !v.NotAfter.After(now)
+            v.Days = int(math.Floor(v.NotAfter.Sub(now).Hours() / 24))
+            if all || v.NotAfter.Before(now.Add(within)) {
+                list = append(list, v)
+            }
+        }
+    }
+    sort.SliceStable(list, func(i, j int) bool { return list[i].NotAfter.Before(list[j].NotAfter) })
+    return list
+}
+
+// expiringAnalysis handles GET /api/analysis/expiring?within=&glob=&all=1,
+// the certificates and expiry dates due within the window (as a duration
+// such as 720h), including those already past.
+func expiringAnalysis(c *gin.Context) {
+    within := config.Expiry.Within
+    if s := c.Query("within"); s != "" {
+        d, err := time.ParseDuration(s)
+        if err != nil || d <= 0 {
+            c.JSON(400, gin.H{"error": "within must be a positive duration such as 720h"})
+            return
+        }
+        within = d
+    }
+    files, err := analysisFiles(c.Request.Context(), c.Query("glob"))
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(200, gin.H{"within": within.String(), "values": findExpiring(files, time.Now(), within, c.Query("all") != "")})
+}
+
+var lastExpiryCheck time.Time
+
+// warnExpiring announces each value once when it comes within the window
+// and once more when it expires. What was announced is kept in
+// .edit3/expiry.json, keyed by the value and its date so a renewed
+// certificate starts afresh.
+func warnExpiring(now time.Time) {
+    if now.Sub(lastExpiryCheck) < ExpiryCheckInterval {
+        return
+    }
+    lastExpiryCheck = now
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    files, err := analysisFiles(ctx, "")
+    cancel()
+    if err != nil {
+        log.Printf("expiry: %v", err)
+        return
+    }
+    file, err := metaPath("expiry.json")
+    if err != nil {
+        log.Printf("expiry: %v", err)
+        return
+    }
+    warned := make(map[string]string)
+    if content, err := ioutil.ReadFile(file); err == nil {
+        json.Unmarshal(content, &warned)
+    }
+    current := make(map[string]string)
+    for _, v := range findExpiring(files, now, config.Expiry.Within, false) {
+        v := v
+        key := v.File + "#" + v.Pointer + "@" + v.NotAfter.UTC().Format(time.RFC3339)
+        state := "expiring"
+        if v.Expired {
+            state = "expired"
+        }
+        current[key] = state
+        if warned[key] == state {
+            continue
+        }
+        event := "value." + state
+        notify(event, &v)
+        if !config.Expiry.empty() {
+            config.Expiry.send(event, describeEvent(event, &v), &v, []string{v.File})
+        }
+    }
+    data, _ := json.MarshalIndent(current, "", "  ")
+    if err := writeFileAtomic(file, data, 0644); err != nil {
+        log.Printf("expiry: %v", err)
+    }
+}
+
+// marshalNodeJSON renders a parsed document as indented JSON, keeping the key
+// order of the source instead of Go's sorted map order.
+func marshalNodeJSON(n *yaml.Node) ([]byte, error) {
+    var b strings.Builder
+    if err := writeNodeJSON(&b, n, ""); err != nil {
+        return nil, err
+    }
+    b.WriteString("\n")
+    return []byte(b.String()), nil
+}
+
+func writeNodeJSON(b *strings.Builder, n *yaml.Node, indent string) error {
+    switch n.Kind {
+    case yaml.DocumentNode:
+        if len(n.Content) == 0 {
+            b.WriteString("null")
+            return nil
+        }
+        return writeNodeJSON(b, n.Content[0], indent)
+
+    case yaml.AliasNode:
+        return writeNodeJSON(b, n.Alias, indent)
+
+    case yaml.MappingNode:
+        if len(n.Content) == 0 {
+            b.WriteString("{}")
+            return nil
+        }
+        b.WriteString("{\n")
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            key, _ := json.Marshal(n.Content[i].Value)
+            b.WriteString(indent + "  ")
+            b.Write(key)
+            b.WriteString(": ")
+            if err := writeNodeJSON(b, n.Content[i+1], indent+"  "); err != nil {
+                return err
+            }
+            if i+2 < len(n.Content) {
+                b.WriteString(",")
+            }
+            b.WriteString("\n")
+        }
+        b.WriteString(indent + "}")
+
+    case yaml.SequenceNode:
+        if len(n.Content) == 0 {
+            b.WriteString("[]")
+            return nil
+        }
+        b.WriteString("[\n")
+        for i, item := range n.Content {
+            b.WriteString(indent + "  ")
+            if err := writeNodeJSON(b, item, indent+"  "); err != nil {
+                return err
+            }
+            if i < len(n.Content)-1 {
+                b.WriteString(",")
+            }
+            b.WriteString("\n")
+        }
+        b.WriteString(indent + "]")
+
+    case yaml.ScalarNode:
+        var v interface{}
+        if err := n.Decode(&v); err != nil {
+            return err
+        }
+        var buf strings.Builder
+        enc := json.NewEncoder(&buf)
+        enc.SetEscapeHTML(false)
+        if err := enc.Encode(v); err != nil {
+            return err
+        }
+        b.WriteString(strings.TrimSuffix(buf.String(), "\n"))
+    }
+    return nil
+}
+
+// Scripted edits
+
+// Limits for /api/script. Starlark has no file, network or clock access of its
+// own, so bounding steps, wall time, memory and size is enough to sandbox it.
+const (
+    MaxScriptSize   = 64 << 10
+    MaxScriptSteps  = 10000000
+    ScriptTimeout   = 5 * time.Second
+    MaxScriptOutput = 100
+    MaxScriptMemory = 512 << 20
+)
+
+type ScriptRequest struct {
+    Script  string `json:"script"`
+    Save    bool   `json:"save"`
+    Message string `json:"message"`
+}
+
+// runScript executes a Starlark script defining transform(doc) against a
+// parsed document and returns the document it produces. Starlark does not
+// account for memory, so the script runs in a worker process (edit3 with
+// scriptWorker as its argument) whose memory is capped and that is killed
+// when it outlives the script timeout or the request.
+func runScript(ctx context.Context, script string, doc *yaml.Node) (*yaml.Node, []string, error) {
+    document, err := yaml.Marshal(doc)
+    if err != nil {
+        return nil, nil, err
+    }
+    request, err := json.Marshal(scriptMessage{Script: script, Document: document})
+    if err != nil {
+        return nil, nil, err
+    }
+    exe, err := os.Executable()
+    if err != nil {
+        return nil, nil, err
+    }
+    limit := timeout(config.Timeouts.Script, ScriptTimeout)
+    ctx, cancel := context.WithTimeout(ctx, limit)
+    defer cancel()
+    cmd := exec.CommandContext(ctx, exe, scriptWorker)
+    var stderr bytes.Buffer
+    cmd.Stdin, cmd.Stderr = bytes.NewReader(request), &stderr
+    out, err := cmd.Output()
+    var result scriptMessage
+    if err == nil {
+        err = json.Unmarshal(out, &result)
+    }
+    switch {
+    case errors.Is(ctx.Err(), context.DeadlineExceeded):
+        return nil, nil, errors.New("script timed out")
+    case ctx.Err() != nil:
+        return nil, nil, errors.New("request cancelled")
+    case err != nil && strings.Contains(stderr.String(), "out of memory"):
+        return nil, nil, fmt.Errorf("script used more than %d MiB of memory", MaxScriptMemory>>20)
+    case err != nil && stderr.Len() > 0:
+        first, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+        return nil, nil, fmt.Errorf("script failed: %s", first)
+    case err != nil:
+        return nil, nil, fmt.Errorf("script failed: %v", err)
+    case result.Error != "":
+        return nil, result.Output, errors.New(result.Error)
+    }
+    var node yaml.Node
+    if err := yaml.Unmarshal(result.Document, &node); err != nil {
+        return nil, result.Output, err
+    }
+    return &node, result.Output, nil
+}
+
+// scriptWorker is the argument that makes edit3 run a single script for
+// runScript instead of starting.
+const scriptWorker = "__script"
+
+// scriptMessage is the request runScript sends its worker, the script and
+// the document as YAML, and the worker's answer, the document it produced
+// with what the script printed, or the error.
+type scriptMessage struct {
+    Script   string   `json:"script,omitempty"`
+    Document []byte   `json:"document,omitempty"`
+    Output   []string `json:"output,omitempty"`
+    Error    string   `json:"error,omitempty"`
+}
+
+// runScriptWorker is the worker side of runScript, on stdin and stdout.
+func runScriptWorker() int {
+    if err := engine.LimitMemory(MaxScriptMemory); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    var req scriptMessage
+    if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    var doc yaml.Node
+    var result scriptMessage
+    var node *yaml.Node
+    err := yaml.Unmarshal(req.Document, &doc)
+    if err == nil {
+        node, result.Output, err = evalScript(req.Script, &doc)
+    }
+    if err == nil {
+        result.Document, err = yaml.Marshal(node)
+    }
+    if err != nil {
+        result.Error = err.Error()
+    }
+    if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    return 0
+}
+
+// evalScript is runScript inside the worker.
+func evalScript(script string, doc *yaml.Node) (*yaml.Node, []string, error) {
+    var output []string
+    thread := &starlark.Thread{
+        Name: "edit3-script",
+        Print: func(_ *starlark.Thread, msg string) {
+            if len(output) < MaxScriptOutput {
+                output = append(output, msg)
+            }
+        },
+        Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+            return nil, fmt.Errorf("load() is not available in scripts")
+        },
+    }
+    thread.SetMaxExecutionSteps(MaxScriptSteps)
+
+    globals, err := starlark.ExecFile(thread, "script.star", script, nil)
+    if err != nil {
+        return nil, output, err
+    }
+    transform, ok := globals["transform"].(starlark.Callable)
+    if !ok {
+        return nil, output, fmt.Errorf("script must define transform(doc)")
+    }
+
+    input, err := nodeToStarlark(doc)
+    if err != nil {
+        return nil, output, err
+    }
+    result, err := starlark.Call(thread, transform, starlark.Tuple{input}, nil)
+    if err != nil {
+        return nil, output, err
+    }
+    node, err := starlarkToNode(result)
+    if err != nil {
+        return nil, output, err
+    }
+    return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}}, output, nil
+}
+
+func nodeToStarlark(n *yaml.Node) (starlark.Value, error) {
+    switch n.Kind {
+    case yaml.DocumentNode:
+        if len(n.Content) == 0 {
+            return starlark.None, nil
+        }
+        return nodeToStarlark(n.Content[0])
+    case yaml.AliasNode:
+        return nodeToStarlark(n.Alias)
+    case yaml.MappingNode:
+        dict := starlark.NewDict(len(n.Content) / 2)
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            key, err := nodeToStarlark(n.Content[i])
+            if err != nil {
+                return nil, err
+            }
+            value, err := nodeToStarlark(n.Content[i+1])
+            if err != nil {
+                return nil, err
+            }
+            if err := dict.SetKey(key, value); err != nil {
+                return nil, err
+            }
+        }
+        return dict, nil
+    case yaml.SequenceNode:
+        items := make([]starlark.Value, 0, len(n.Content))
+        for _, item := range n.Content {
+            value, err := nodeToStarlark(item)
+            if err != nil {
+                return nil, err
+            }
+            items = append(items, value)
+        }
+        return starlark.NewList(items), nil
+    }
+
+    var v interface{}
+    if err := n.Decode(&v); err != nil {
+        return nil, err
+    }
+    switch v := v.(type) {
+    case nil:
+        return starlark.None, nil
+    case bool:
+        return starlark.Bool(v), nil
+    case int:
+        return starlark.MakeInt(v), nil
+    case int64:
+        return starlark.MakeInt64(v), nil
+    case uint64:
+        return starlark.MakeUint64(v), nil
+    case float64:
+        return starlark.Float(v), nil
+    case string:
+        return starlark.String(v), nil
+    }
+    // Timestamps and other tagged scalars are handed over as their text
+    return starlark.String(n.Value), nil
+}
+
+func starlarkToNode(v starlark.Value) (*yaml.Node, error) {
+    scalar := func(tag, value string) *yaml.Node {
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+    }
+    switch v := v.(type) {
+    case starlark.NoneType:
+        return scalar("!!null", "null"), nil
+    case starlark.Bool:
+        return scalar("!!bool", strconv.FormatBool(bool(v))), nil
+    case starlark.Int:
+        return scalar("!!int", v.String()), nil
+    case starlark.Float:
+        return scalar("!!float", strconv.FormatFloat(float64(v), 'g', -1, 64)), nil
+    case starlark.String:
+        return scalar("!!str", string(v)), nil
+    case *starlark.Dict:
+        node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+        for _, item := range v.Items() {
+            key, err := starlarkToNode(item[0])
+            if err != nil {
+                return nil, err
+            }
+            value, err := starlarkToNode(item[1])
+            if err != nil {
+                return nil, err
+            }
+            node.Content = append(node.Content, key, value)
+        }
+        return node, nil
+    case *starlark.List, starlark.Tuple:
+        node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+        iter := v.(starlark.Iterable).Iterate()
+        defer iter.Done()
+        var item starlark.Value
+        for iter.Next(&item) {
+            child, err := starlarkToNode(item)
+            if err != nil {
+                return nil, err
+            }
+            node.Content = append(node.Content, child)
+        }
+        return node, nil
+    }
+    return nil, fmt.Errorf("transform returned unsupported value of type %s", v.Type())
+}
 
-    cmd = exec.Command("git", "commit", "-m", fmt.Sprintf("Initial: %s", filename))
-    cmd.Dir = DataDir
-    cmd.Run()
+// renderNode serialises a document in the format of fileType.
+func renderNode(doc *yaml.Node, fileType string) ([]byte, error) {
+    if fileType == "json" {
+        return marshalNodeJSON(doc)
+    }
+    var buf bytes.Buffer
+    enc := yaml.NewEncoder(&buf)
+    enc.SetIndent(2)
+    if err := enc.Encode(doc); err != nil {
+        return nil, err
+    }
+    enc.Close()
+    return buf.Bytes(), nil
 }
 
-func saveFile(c *gin.Context) {
+// runFileScript applies a script to a JSON or YAML file. The result is
+// returned for preview, and validated and committed when save is set.
+func runFileScript(c *gin.Context) {
     filename := c.Param("filename")
-    filepath := filepath.Join(DataDir, filename)
+    dir, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        c.JSON(403, gin.H{"error": err.Error()})
+        return
+    }
 
-    var req SaveRequest
+    var req ScriptRequest
     if err := c.ShouldBindJSON(&req); err != nil {
         c.JSON(400, gin.H{"error": err.Error()})
         return
     }
-
-    // Validate content
+    if len(req.Script) > MaxScriptSize {
+        c.JSON(400, gin.H{"error": "script is too large"})
+        return
+    }
     fileType := getFileType(filename)
-    if err := validateContent(req.Content, fileType); err != nil {
+    if fileType != "json" && fileType != "yaml" && fileType != "yml" {
+        c.JSON(400, gin.H{"error": "scripts support JSON and YAML files only"})
+        return
+    }
+
+    content, err := fileStore(dir).Read(storageName(rel))
+    if err != nil {
+        c.JSON(404, gin.H{"error": err.Error()})
+        return
+    }
+    var doc yaml.Node
+    if err := yaml.Unmarshal(content, &doc); err != nil {
         c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid %s format: %v", strings.ToUpper(fileType), err)})
         return
     }
 
-    // Save file
-    if err := ioutil.WriteFile(filepath, []byte(req.Content), 0644); err != nil {
-        c.JSON(500, gin.H{"error": err.Error()})
+    result, output, err := runScript(c.Request.Context(), req.Script, &doc)
+    if err != nil {
+        c.JSON(400, gin.H{"error": "Script error: " + err.Error(), "output": output})
+        return
+    }
+    rendered, err := renderNode(result, fileType)
+    if err == nil {
+        err = validateContent(string(rendered), fileType)
+    }
+    if err != nil {
+        c.JSON(400, gin.H{"error": err.Error(), "output": output})
         return
     }
 
-    // Git commit
-    timestamp := time.Now().Format(time.RFC3339)
+    if !req.Save {
+        c.JSON(200, gin.H{"content": string(rendered), "output": output})
+        return
+    }
+    candidate := &SaveCandidate{Filename: filename, Dir: dir, Rel: rel, FullPath: fullPath, FileType: fileType, Content: rendered, User: requestUser(c), Ticket: requestTicket(c), Context: c.Request.Context()}
+    if err := checkSaveGates(candidate); err != nil {
+        policyErrorJSON(c, err.(*PolicyError))
+        return
+    }
+    message := req.Message
+    if message == "" {
+        message = commitMessage("script", candidate)
+    }
+    resp, err := storeFile(c.Request.Context(), dir, rel, fullPath, rendered, message)
+    if err != nil {
+        storeErrorJSON(c, err)
+        return
+    }
+    c.JSON(200, gin.H{"content": string(rendered), "output": output, "commit": resp.Commit, "warning": resp.Warning})
+}
 
-    cmd := exec.Command("git", "add", filename)
-    cmd.Dir = DataDir
-    cmd.Run()
+// Terminal UI
 
-    cmd = exec.Command("git", "commit", "-m", fmt.Sprintf("Update %s: %s", filename, timestamp))
-    cmd.Dir = DataDir
-    cmd.Run()
+type tuiRow struct {
+    depth int
+    label string
+    node  *yaml.Node
+}
 
-    // Get commit hash
-    cmd = exec.Command("git", "rev-parse", "HEAD")
-    cmd.Dir = DataDir
-    output, _ := cmd.Output()
-    hash := strings.TrimSpace(string(output))[:7]
+type tuiModel struct {
+    filename string
+    dir      string
+    rel      string
+    fullPath string
+    fileType string
 
-    c.JSON(200, SaveResponse{
-        Success:   true,
-        Message:   "File saved and committed",
-        Commit:    hash,
-        Timestamp: timestamp,
-    })
-}
+    doc    *yaml.Node
+    rows   []tuiRow
+    cursor int
+    offset int
+    height int
 
-func getHistory(c *gin.Context) {
-    filename := c.Param("filename")
+    // tree, edit, history, confirm, reload or quit
+    mode    string
+    input   textinput.Model
+    history []HistoryItem
+    hcursor int
 
-    cmd := exec.Command("git", "log", "--pretty=format:%h|%ai|%s", "-n", "20", "--", filename)
-    cmd.Dir = DataDir
-    output, err := cmd.Output()
+    dirty  bool
+    status string
+}
 
-    if err != nil || len(output) == 0 {
-        c.JSON(200, HistoryResponse{History: []HistoryItem{}})
-        return
+func runTUI(filename string) error {
+    dir, rel, fullPath, err := resolvePath(filename)
+    if err != nil {
+        return err
+    }
+    m := &tuiModel{
+        filename: filename,
+        dir:      dir,
+        rel:      rel,
+        fullPath: fullPath,
+        fileType: getFileType(filename),
+        mode:     "tree",
+        height:   24,
+        input:    textinput.New(),
     }
+    if err := m.load(); err != nil {
+        return err
+    }
+    _, err = tea.NewProgram(m, tea.WithAltScreen()).Run()
+    return err
+}
 
-    lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-    history := make([]HistoryItem, 0)
+func (m *tuiModel) load() error {
+    content, err := ioutil.ReadFile(m.fullPath)
+    if err != nil {
+        return err
+    }
+    m.doc = nil
+    m.rows = nil
+    m.dirty = false
 
-    for _, line := range lines {
-        parts := strings.Split(line, "|")
-        if len(parts) == 3 {
-            history = append(history, HistoryItem{
-                Hash:      parts[0],
-                Timestamp: parts[1],
-                Message:   parts[2],
-            })
+    // XML has no tree model here yet; show it line by line, read-only
+    if m.fileType == "xml" {
+        for _, line := range strings.Split(string(content), "\n") {
+            m.rows = append(m.rows, tuiRow{label: line})
         }
+        return nil
     }
 
-    c.JSON(200, HistoryResponse{History: history})
+    var doc yaml.Node
+    if err := yaml.Unmarshal(content, &doc); err != nil {
+        return fmt.Errorf("cannot parse %s: %v", m.filename, err)
+    }
+    m.doc = &doc
+    m.buildRows()
+    return nil
 }
 
-func restoreVersion(c *gin.Context) {
-    filename := c.Param("filename")
-    hash := c.Param("hash")
-    filepath := filepath.Join(DataDir, filename)
+func (m *tuiModel) buildRows() {
+    m.rows = nil
+    if len(m.doc.Content) > 0 {
+        m.addRows(m.doc.Content[0], 0, "")
+    }
+    if m.cursor >= len(m.rows) {
+        m.cursor = len(m.rows) - 1
+    }
+    if m.cursor < 0 {
+        m.cursor = 0
+    }
+}
 
-    // Get file content at specific commit
-    cmd := exec.Command("git", "show", fmt.Sprintf("%s:%s", hash, filename))
-    cmd.Dir = DataDir
-    output, err := cmd.Output()
+func (m *tuiModel) addRows(n *yaml.Node, depth int, label string) {
+    switch n.Kind {
+    case yaml.MappingNode:
+        if label != "" {
+            m.rows = append(m.rows, tuiRow{depth: depth, label: label + " {}"})
+            depth++
+        }
+        for i := 0; i+1 < len(n.Content); i += 2 {
+            m.addRows(n.Content[i+1], depth, n.Content[i].Value)
+        }
+    case yaml.SequenceNode:
+        if label != "" {
+            m.rows = append(m.rows, tuiRow{depth: depth, label: label + " []"})
+            depth++
+        }
+        for i, item := range n.Content {
+            m.addRows(item, depth, fmt.Sprintf("[%d]", i))
+        }
+    case yaml.AliasNode:
+        m.rows = append(m.rows, tuiRow{depth: depth, label: label + ": *" + n.Value})
+    case yaml.ScalarNode:
+        m.rows = append(m.rows, tuiRow{depth: depth, label: label, node: n})
+    }
+}
 
+func (m *tuiModel) render() ([]byte, error) {
+    return renderNode(m.doc, m.fileType)
+}
+
+func (m *tuiModel) save() {
+    content, err := m.render()
+    if err == nil {
+        err = validateContent(string(content), m.fileType)
+    }
+    candidate := &SaveCandidate{Filename: m.filename, Dir: m.dir, Rel: m.rel, FullPath: m.fullPath, FileType: m.fileType, Content: content, User: os.Getenv("USER")}
+    if err == nil {
+        err = checkSaveGates(candidate)
+    }
     if err != nil {
-        c.JSON(500, gin.H{"error": err.Error()})
+        m.status = "Error: " + err.Error()
         return
     }
-
-    // Save as current version
-    if err := ioutil.WriteFile(filepath, output, 0644); err != nil {
-        c.JSON(500, gin.H{"error": err.Error()})
+    resp, err := storeFile(context.Background(), m.dir, m.rel, m.fullPath, content, commitMessage("update", candidate))
+    if err != nil {
+        m.status = "Error: " + err.Error()
         return
     }
+    m.dirty = false
+    m.status = fmt.Sprintf("Saved (%s)", resp.Commit)
+    if resp.Warning != "" {
+        m.status += " - " + resp.Warning
+    }
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+    return nil
+}
 
-    // Commit the restore
-    cmd = exec.Command("git", "add", filename)
-    cmd.Dir = DataDir
-    cmd.Run()
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+    switch msg := msg.(type) {
+    case tea.WindowSizeMsg:
+        m.height = msg.Height
+        return m, nil
 
-    cmd = exec.Command("git", "commit", "-m", fmt.Sprintf("Restored to version %s", hash))
-    cmd.Dir = DataDir
-    cmd.Run()
+    case tea.KeyMsg:
+        switch m.mode {
+        case "edit":
+            switch msg.String() {
+            case "enter":
+                m.applyEdit(m.input.Value())
+                m.mode = "tree"
+            case "esc":
+                m.mode = "tree"
+            default:
+                var cmd tea.Cmd
+                m.input, cmd = m.input.Update(msg)
+                return m, cmd
+            }
 
-    c.JSON(200, gin.H{
-        "success": true,
-        "content": string(output),
-        "message": fmt.Sprintf("Restored to version %s", hash),
-    })
+        case "history":
+            switch msg.String() {
+            case "up", "k":
+                if m.hcursor > 0 {
+                    m.hcursor--
+                }
+            case "down", "j":
+                if m.hcursor < len(m.history)-1 {
+                    m.hcursor++
+                }
+            case "enter":
+                if len(m.history) > 0 {
+                    m.mode = "confirm"
+                }
+            case "esc", "h", "q":
+                m.mode = "tree"
+            }
+
+        case "confirm":
+            if msg.String() == "y" {
+                m.restore(m.history[m.hcursor].Hash)
+            }
+            m.mode = "tree"
+
+        case "reload":
+            if msg.String() == "y" {
+                m.reload()
+            }
+            m.mode = "tree"
+
+        case "quit":
+            switch msg.String() {
+            case "y", "ctrl+c":
+                return m, tea.Quit
+            case "s":
+                if m.save(); !m.dirty {
+                    return m, tea.Quit
+                }
+            }
+            m.mode = "tree"
+
+        default:
+            switch msg.String() {
+            case "ctrl+c", "q":
+                // Edits live only in the model until saved
+                if m.dirty {
+                    m.mode = "quit"
+                    return m, nil
+                }
+                return m, tea.Quit
+            case "up", "k":
+                if m.cursor > 0 {
+                    m.cursor--
+                }
+            case "down", "j":
+                if m.cursor < len(m.rows)-1 {
+                    m.cursor++
+                }
+            case "enter", "e":
+                if m.doc == nil {
+                    m.status = "XML is read-only in the terminal UI"
+                } else if len(m.rows) > 0 && m.rows[m.cursor].node != nil {
+                    m.input.SetValue(m.rows[m.cursor].node.Value)
+                    m.input.CursorEnd()
+                    m.input.Focus()
+                    m.mode = "edit"
+                }
+            case "ctrl+s", "s":
+                if m.doc != nil {
+                    m.save()
+                }
+            case "h":
+                m.history = fileHistory(context.Background(), m.dir, m.rel)
+                m.hcursor = 0
+                m.mode = "history"
+            case "r":
+                if m.dirty {
+                    m.mode = "reload"
+                    return m, nil
+                }
+                m.reload()
+            }
+        }
+    }
+    return m, nil
 }
 
-func listFiles(c *gin.Context) {
-    files, err := ioutil.ReadDir(DataDir)
+// applyEdit replaces the selected scalar, re-resolving its type so "5" stays
+// a number and "true" a boolean; quote the value to force a string.
+func (m *tuiModel) applyEdit(value string) {
+    node := m.rows[m.cursor].node
+    var parsed yaml.Node
+    if err := yaml.Unmarshal([]byte(value), &parsed); err == nil &&
+        len(parsed.Content) == 1 && parsed.Content[0].Kind == yaml.ScalarNode {
+        node.Value = parsed.Content[0].Value
+        node.Tag = parsed.Content[0].Tag
+        node.Style = parsed.Content[0].Style
+    } else {
+        node.Value = value
+        node.Tag = "!!str"
+        node.Style = yaml.DoubleQuotedStyle
+    }
+    m.dirty = true
+    m.status = "Modified - press s to save"
+}
+
+func (m *tuiModel) reload() {
+    if err := m.load(); err != nil {
+        m.status = "Error: " + err.Error()
+    } else {
+        m.status = "Reloaded"
+    }
+}
+
+func (m *tuiModel) restore(hash string) {
+    content, err := fileAtVersion(context.Background(), m.dir, m.rel, hash)
+    if err == nil {
+        _, err = storeFile(context.Background(), m.dir, m.rel, m.fullPath, content, fmt.Sprintf("Restored to version %s", hash))
+    }
+    if err == nil {
+        err = m.load()
+    }
     if err != nil {
-        c.JSON(200, gin.H{"files": []string{}})
+        m.status = "Error: " + err.Error()
         return
     }
+    m.status = "Restored to version " + hash
+}
 
-    validExtensions := map[string]bool{
-        ".json": true,
-        ".yaml": true,
-        ".yml":  true,
-        ".xml":  true,
+func (m *tuiModel) View() string {
+    var b strings.Builder
+    title := "Edit3 - " + m.filename
+    if m.dirty {
+        title += " [modified]"
+    }
+    b.WriteString(title + "\n\n")
+    visible := m.height - 5
+    if visible < 1 {
+        visible = 1
     }
 
-    var fileList []string
-    for _, file := range files {
-        if !file.IsDir() {
-            ext := filepath.Ext(file.Name())
-            if validExtensions[ext] {
-                fileList = append(fileList, file.Name())
+    switch m.mode {
+    case "history", "confirm":
+        if len(m.history) == 0 {
+            b.WriteString("No history available\n")
+        }
+        for i, item := range m.history {
+            prefix := "  "
+            if i == m.hcursor {
+                prefix = "> "
             }
+            fmt.Fprintf(&b, "%s%s  %s  %s\n", prefix, item.Hash, item.Timestamp, item.Message)
         }
+        if m.mode == "confirm" && m.dirty {
+            b.WriteString("\nDiscard unsaved changes and restore this version? (y/n)")
+        } else if m.mode == "confirm" {
+            b.WriteString("\nRestore this version? (y/n)")
+        } else {
+            b.WriteString("\nenter restore • esc back")
+        }
+        return b.String()
     }
 
-    c.JSON(200, gin.H{"files": fileList})
+    if m.cursor < m.offset {
+        m.offset = m.cursor
+    } else if m.cursor >= m.offset+visible {
+        m.offset = m.cursor - visible + 1
+    }
+    for i := m.offset; i < len(m.rows) && i < m.offset+visible; i++ {
+        row := m.rows[i]
+        prefix := "  "
+        if i == m.cursor {
+            prefix = "> "
+        }
+        line := strings.Repeat("  ", row.depth) + row.label
+        if row.node != nil {
+            if m.mode == "edit" && i == m.cursor {
+                line += ": " + m.input.View()
+            } else {
+                line += ": " + row.node.Value
+            }
+        }
+        b.WriteString(prefix + line + "\n")
+    }
+
+    b.WriteString("\n")
+    switch m.mode {
+    case "quit":
+        b.WriteString("Discard unsaved changes and quit? (y/n, s to save and quit)")
+        return b.String()
+    case "reload":
+        b.WriteString("Discard unsaved changes and reload? (y/n)")
+        return b.String()
+    }
+    if m.status != "" {
+        b.WriteString(m.status + "\n")
+    }
+    b.WriteString("↑/↓ move • enter edit • s save • h history • r reload • q quit")
+    return b.String()
 }
 
 // go.mod
 /*
 module edit3
 
-go 1.21
+go 1.24
 
 require (
+    cuelang.org/go v0.10.0
+    github.com/Masterminds/semver/v3 v3.4.0
+    github.com/aws/aws-sdk-go-v2 v1.41.1
+    github.com/aws/aws-sdk-go-v2/config v1.31.17
+    github.com/aws/aws-sdk-go-v2/service/s3 v1.96.0
+    github.com/aws/aws-sdk-go-v2/service/secretsmanager v1.41.1
+    github.com/aws/aws-sdk-go-v2/service/ssm v1.44.7
+    github.com/charmbracelet/bubbles v0.21.0
+    github.com/charmbracelet/bubbletea v1.3.6
+    github.com/eclipse/paho.mqtt.golang v1.5.1
+    github.com/fsnotify/fsnotify v1.9.0
     github.com/gin-gonic/gin v1.9.1
     github.com/gin-contrib/cors v1.4.0
+    github.com/go-jose/go-jose/v4 v4.0.5
+    github.com/google/cel-go v0.26.0
+    github.com/google/go-jsonnet v0.20.0
+    github.com/hashicorp/consul/api v1.29.4
+    github.com/hashicorp/hcl/v2 v2.21.0
+    github.com/jung-kurt/gofpdf v1.16.2
+    github.com/open-policy-agent/opa v0.68.0
+    github.com/pelletier/go-toml/v2 v2.2.2
+    github.com/prometheus/alertmanager v0.27.0
+    github.com/prometheus/prometheus v0.54.1
+    github.com/robfig/cron/v3 v3.0.1
+    github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+    github.com/zclconf/go-cty v1.14.4
+    github.com/zserge/lorca v0.1.10
+    go.etcd.io/etcd/client/v3 v3.6.8
+    go.starlark.net v0.0.0-20231121155337-90ade8b19d09
     gopkg.in/yaml.v3 v3.0.1
+    mvdan.cc/sh/v3 v3.12.0
 )
 */
 
+// Makefile
+/*
+VERSION ?= dev
+LDFLAGS  = -s -w -X main.Version=$(VERSION) -X main.ReleasePublicKey=$(RELEASE_PUBLIC_KEY)
+
+build:
+	go build -ldflags "$(LDFLAGS)" -o edit3 .
+
+install:
+	go install -ldflags "$(LDFLAGS)" .
+
+# Cross-compiled binaries; edit3.exe needs only git on the PATH
+dist:
+	GOOS=linux   GOARCH=amd64 CGO_ENABLED=0 go build -ldflags "$(LDFLAGS)" -o dist/edit3-linux-amd64 .
+	GOOS=darwin  GOARCH=arm64 CGO_ENABLED=0 go build -ldflags "$(LDFLAGS)" -o dist/edit3-darwin-arm64 .
+	GOOS=windows GOARCH=amd64 CGO_ENABLED=0 go build -ldflags "$(LDFLAGS)" -o dist/edit3-windows-amd64.exe .
+	cd dist && sha256sum edit3-* > checksums.txt
+
+windows:
+	GOOS=windows GOARCH=amd64 CGO_ENABLED=0 go build -ldflags "$(LDFLAGS)" -o edit3.exe .
+
+.PHONY: build install dist windows
+*/
+
 // Dockerfile
 /*
-FROM golang:1.21-alpine AS builder
+FROM golang:1.24-alpine AS builder
 
 # Install git
 RUN apk add --no-cache git
@@ -449,6 +17075,24 @@ const HTML_CONTENT = `<!DOCTYPE html>
             gap: 1rem;
         }
         
+        .tabs {
+            display: flex;
+            gap: 0.5rem;
+            padding: 0.5rem 2rem 0;
+            overflow-x: auto;
+        }
+        
+        .tab {
+            padding: 0.4rem 1rem;
+            border-radius: 10px 10px 0 0;
+            font-size: 0.85rem;
+            white-space: nowrap;
+        }
+        
+        .tab.active {
+            background: rgba(255, 255, 255, 0.25);
+        }
+        
         button {
             background: rgba(255, 255, 255, 0.1);
             backdrop-filter: blur(10px);
@@ -532,6 +17176,22 @@ const HTML_CONTENT = `<!DOCTYPE html>
             font-weight: bold;
         }
         
+        .table-view {
+            border-collapse: collapse;
+            font-size: 13px;
+        }
+        
+        .table-view th, .table-view td {
+            border: 1px solid rgba(255, 255, 255, 0.2);
+            padding: 0.3rem 0.6rem;
+            text-align: left;
+            white-space: nowrap;
+        }
+        
+        .table-view th {
+            color: #00C9FF;
+        }
+        
         .tree-value {
             color: #92FE9D;
         }
@@ -681,11 +17341,16 @@ const HTML_CONTENT = `<!DOCTYPE html>
         <div class="controls">
             <button onclick="saveFile()" class="save-btn">💾 Save & Commit</button>
             <button onclick="showHistory()">📜 History</button>
+            <button onclick="openReport()">📄 Report</button>
             <button onclick="formatCode()">✨ Format</button>
+            <button onclick="convertFile()">🔁 Convert</button>
+            <button onclick="toggleExpanded()">🔗 Expanded</button>
             <button onclick="reloadFile()">🔄 Reload</button>
         </div>
     </div>
     
+    <div class="tabs" id="tabs"></div>
+    
     <div class="container">
         <div class="panel">
             <div class="panel-header">🖊️ Ace Editor</div>
@@ -717,15 +17382,39 @@ const HTML_CONTENT = `<!DOCTYPE html>
         let currentFile = '';
         let fileType = '';
         
+        let tabs = [];
+        let session = { openFiles: [], positions: {}, drafts: {} };
+        let savedContent = '';
+        let fileView = '';
+        // Unsaved edits of the tabs not shown, by file
+        let buffers = {};
+        
         // Get filename from URL
         const urlParams = new URLSearchParams(window.location.search);
         currentFile = urlParams.get('file') || 'example.json';
         document.getElementById('fileName').textContent = currentFile;
+        fileType = detectType(currentFile);
+        tabs.push(currentFile);
         
         // Detect file type
-        if (currentFile.endsWith('.json')) fileType = 'json';
-        else if (currentFile.endsWith('.yaml') || currentFile.endsWith('.yml')) fileType = 'yaml';
-        else if (currentFile.endsWith('.xml')) fileType = 'xml';
+        function detectType(file) {
+            if (file.endsWith('.json')) return 'json';
+            if (file.endsWith('.yaml') || file.endsWith('.yml')) return 'yaml';
+            if (file.endsWith('.xml')) return 'xml';
+            if (file.endsWith('.toml')) return 'toml';
+            if (file.endsWith('.csv')) return 'csv';
+            if (file.endsWith('.tsv')) return 'tsv';
+            if (file.endsWith('.tf')) return 'tf';
+            if (file.endsWith('.hcl')) return 'hcl';
+            if (file.endsWith('.pem')) return 'pem';
+            if (file.endsWith('.crt')) return 'crt';
+            if (file.endsWith('.cue')) return 'cue';
+            if (file.endsWith('.jsonnet')) return 'jsonnet';
+            if (file.endsWith('.libsonnet')) return 'libsonnet';
+            const base = file.split('/').pop();
+            if (base.endsWith('.env') || base.startsWith('.env.')) return 'env';
+            return '';
+        }
         
         // Initialize Ace Editor
         editor = ace.edit("editor");
@@ -739,11 +17428,158 @@ const HTML_CONTENT = `<!DOCTYPE html>
             wrap: true
         });
         
+        // Completion offers the values the server's lookups and schema enums
+        // know for the key being edited, such as regions from an inventory
+        // service.
+        ace.require('ace/ext/language_tools').addCompleter({
+            getCompletions: async (ed, session, pos, prefix, callback) => {
+                let text = session.getLine(pos.row).slice(0, pos.column).trim();
+                if (text.startsWith('export ')) text = text.slice(7);
+                const seps = [text.indexOf(':'), text.indexOf('=')].filter(i => i > 0);
+                if (!seps.length) {
+                    callback(null, []);
+                    return;
+                }
+                const key = text.slice(0, Math.min(...seps)).split('"').join('').trim();
+                try {
+                    const response = await fetch('/api/complete/' + encodeURIComponent(currentFile) +
+                        '?key=' + encodeURIComponent(key) + '&prefix=' + encodeURIComponent(prefix));
+                    const data = await response.json();
+                    callback(null, (data.values || []).map(v => ({ caption: v.value, value: v.value, meta: v.label || 'lookup', score: 1000 })));
+                } catch (error) {
+                    callback(null, []);
+                }
+            }
+        });
+        
         // Load file
-        loadFile();
+        let bootstrap = null;
+        let capabilities = { features: {} };
+        start();
+        pollOpened(null);
+        
+        // Ask what the server has turned on before using optional features
+        async function start() {
+            try {
+                const response = await fetch('/api/bootstrap');
+                bootstrap = await response.json();
+                capabilities = bootstrap.capabilities;
+            } catch (error) {
+                console.error('Error loading bootstrap:', error);
+            }
+            if (capabilities.features.collaboration === false) {
+                loadFile();
+                renderTabs();
+                return;
+            }
+            restoreSession();
+        }
+        
+        // Restore tabs, cursor positions and unsaved drafts from the server
+        async function restoreSession() {
+            try {
+                const response = await fetch('/api/session');
+                session = await response.json();
+                session.positions = session.positions || {};
+                session.drafts = session.drafts || {};
+                (session.openFiles || []).forEach(file => {
+                    if (!tabs.includes(file)) tabs.push(file);
+                });
+                if (!urlParams.get('file') && session.activeFile) {
+                    switchTab(session.activeFile);
+                    return;
+                }
+            } catch (error) {
+                console.error('Error loading session:', error);
+            }
+            loadFile();
+            renderTabs();
+        }
+        
+        function rememberPosition() {
+            if (!currentFile) return;
+            const cursor = editor.getCursorPosition();
+            session.positions[currentFile] = {
+                row: cursor.row,
+                column: cursor.column,
+                scrollTop: editor.session.getScrollTop()
+            };
+        }
+        
+        const storeSession = debounce(async function() {
+            if (capabilities.features.collaboration === false) return;
+            rememberPosition();
+            const content = editor.getValue();
+            if (content !== savedContent) {
+                session.drafts[currentFile] = { content: content, updated: new Date().toISOString() };
+            } else {
+                delete session.drafts[currentFile];
+            }
+            session.openFiles = tabs;
+            session.activeFile = currentFile;
+            try {
+                await fetch('/api/session', {
+                    method: 'PUT',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(session)
+                });
+            } catch (error) {
+                console.error('Error saving session:', error);
+            }
+        }, 1000);
+        
+        function renderTabs() {
+            const tabsDiv = document.getElementById('tabs');
+            tabsDiv.innerHTML = '';
+            tabs.forEach(file => {
+                const button = document.createElement('button');
+                button.className = 'tab' + (file === currentFile ? ' active' : '');
+                button.textContent = file.split('/').pop() + (buffers[file] !== undefined ? ' •' : '');
+                button.title = file;
+                button.onclick = () => switchTab(file);
+                tabsDiv.appendChild(button);
+            });
+        }
+        
+        function switchTab(file) {
+            rememberPosition();
+            // Keep the edits of the tab being left for when it is shown again
+            const content = editor.getValue();
+            if (currentFile && !editor.getReadOnly() && content !== savedContent) {
+                buffers[currentFile] = content;
+                session.drafts[currentFile] = { content: content, updated: new Date().toISOString() };
+            }
+            if (!tabs.includes(file)) tabs.push(file);
+            currentFile = file;
+            fileType = detectType(file);
+            fileView = '';
+            document.getElementById('fileName').textContent = file;
+            history.replaceState(null, '', '?file=' + encodeURIComponent(file));
+            editor.session.setMode("ace/mode/" + fileType);
+            renderTabs();
+            loadFile();
+        }
+        
+        // Files opened with "edit3 <file>" while this page is open arrive here
+        async function pollOpened(after) {
+            try {
+                // The first call only learns the current position
+                const first = after === null;
+                const response = await fetch('/api/opened?after=' + (first ? 0 : after) + (first ? '&wait=0' : ''));
+                const data = await response.json();
+                if (!first) {
+                    data.requests.forEach(req => switchTab(req.file));
+                }
+                setTimeout(() => pollOpened(data.last), 0);
+            } catch (error) {
+                setTimeout(() => pollOpened(after), 5000);
+            }
+        }
         
         // Update visual on change
         editor.on('change', debounce(updateVisual, 500));
+        editor.on('change', () => storeSession());
+        editor.session.selection.on('changeCursor', () => storeSession());
         
         function debounce(func, wait) {
             let timeout;
@@ -759,10 +17595,51 @@ const HTML_CONTENT = `<!DOCTYPE html>
         
         async function loadFile() {
             try {
-                const response = await fetch('/api/file/' + currentFile);
+                const view = fileView ? '?view=' + fileView : '';
+                const response = await fetch('/api/file/' + encodeURIComponent(currentFile) + view);
                 const data = await response.json();
+                if (response.status === 404 && !fileView) {
+                    const suggestion = (data.suggestions || [])[0];
+                    if (suggestion && confirm(currentFile + ' does not exist. Did you mean ' + suggestion + '?')) {
+                        return switchTab(suggestion);
+                    }
+                    if (confirm(currentFile + ' does not exist. Create it?')) {
+                        const created = await fetch('/api/file/' + encodeURIComponent(currentFile) + '?create=1', { method: 'POST' });
+                        if (created.ok) return loadFile();
+                    }
+                }
+                if (data.error) {
+                    showToast('❌ ' + data.error);
+                    return;
+                }
+                if (data.type) {
+                    fileType = data.type;
+                    editor.session.setMode("ace/mode/" + data.mode);
+                }
+                editor.setReadOnly(!!data.readOnly);
+                savedContent = data.content;
                 editor.setValue(data.content, -1);
+                const draft = session.drafts[currentFile];
+                if (!data.readOnly && buffers[currentFile] !== undefined) {
+                    editor.setValue(buffers[currentFile], -1);
+                    delete buffers[currentFile];
+                    renderTabs();
+                } else if (!data.readOnly && draft && draft.content !== data.content &&
+                    confirm('Restore unsaved changes from ' + draft.updated + '?')) {
+                    editor.setValue(draft.content, -1);
+                }
+                const position = session.positions[currentFile];
+                if (position) {
+                    editor.moveCursorTo(position.row, position.column);
+                    editor.session.setScrollTop(position.scrollTop);
+                }
                 updateVisual();
+                storeSession();
+                if (data.freeze) {
+                    showToast('❄️ ' + data.freeze.name + ': changes frozen until ' +
+                        new Date(data.freeze.until).toLocaleString() +
+                        (data.freeze.overrideRole ? ' (' + data.freeze.overrideRole + ' may override)' : ''));
+                }
             } catch (error) {
                 console.error('Error loading file:', error);
             }
@@ -782,6 +17659,24 @@ const HTML_CONTENT = `<!DOCTYPE html>
                     html = '<div class="tree-view"><pre>' + escapeHtml(content) + '</pre></div>';
                 } else if (fileType === 'xml') {
                     html = '<div class="tree-view"><pre>' + highlightXML(content) + '</pre></div>';
+                } else if (fileType === 'csv' || fileType === 'tsv') {
+                    renderTable(content);
+                    return;
+                } else if (fileType === 'tf' || fileType === 'hcl') {
+                    renderHCL(content);
+                    return;
+                } else if (fileType === 'pem' || fileType === 'crt') {
+                    renderPEM(content);
+                    return;
+                } else if (fileType === 'env') {
+                    renderEnv(content);
+                    return;
+                } else if (fileType === 'cue') {
+                    renderCUE(content);
+                    return;
+                } else if (fileType === 'jsonnet' || fileType === 'libsonnet') {
+                    renderJsonnet(content);
+                    return;
                 }
                 
                 visualDiv.innerHTML = html;
@@ -790,6 +17685,151 @@ const HTML_CONTENT = `<!DOCTYPE html>
             }
         }
         
+        // Tables are parsed by the server so the preview shows exactly the
+        // rows and columns a save would accept.
+        async function renderTable(content) {
+            const visualDiv = document.getElementById('visualEditor');
+            const response = await fetch('/api/table', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content, type: fileType })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                visualDiv.innerHTML = '<div class="error-box">⚠️ Parse Error: ' + escapeHtml(data.error) + '</div>';
+                return;
+            }
+            const cells = (row, tag) => '<tr>' + row.map(v => '<' + tag + '>' + escapeHtml(v) + '</' + tag + '>').join('') + '</tr>';
+            visualDiv.innerHTML = '<table class="table-view">' +
+                (data.columns ? '<thead>' + cells(data.columns, 'th') + '</thead>' : '') +
+                '<tbody>' + data.rows.map(row => cells(row, 'td')).join('') + '</tbody></table>';
+        }
+        
+        // HCL is parsed by the server too; constant values are shown as
+        // values, anything else as the expression written.
+        async function renderHCL(content) {
+            const visualDiv = document.getElementById('visualEditor');
+            const response = await fetch('/api/hcl', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                visualDiv.innerHTML = '<div class="error-box">⚠️ Parse Error: ' + escapeHtml(data.error) + '</div>';
+                return;
+            }
+            const lines = [];
+            const walk = (body, depth) => {
+                const pad = 'margin-left:' + (depth * 1.5) + 'em';
+                body.attributes.forEach(a => {
+                    const value = a.value !== undefined ? renderJSON(a.value, depth) : '<span class="tree-value">' + escapeHtml(a.expr) + '</span>';
+                    lines.push('<div style="' + pad + '"><span class="tree-key">' + escapeHtml(a.name) + '</span> = ' + value + '</div>');
+                });
+                body.blocks.forEach(b => {
+                    const labels = b.labels.map(l => ' <span class="tree-string">"' + escapeHtml(l) + '"</span>').join('');
+                    lines.push('<div style="' + pad + '"><span class="tree-key">' + escapeHtml(b.type) + '</span>' + labels + ' {</div>');
+                    walk(b.body, depth + 1);
+                    lines.push('<div style="' + pad + '">}</div>');
+                });
+            };
+            walk(data, 0);
+            visualDiv.innerHTML = '<div class="tree-view">' + lines.join('') + '</div>';
+        }
+        
+        // Certificates are decoded by the server; keys arrive masked and are
+        // only described.
+        async function renderPEM(content) {
+            const visualDiv = document.getElementById('visualEditor');
+            const response = await fetch('/api/pem', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                visualDiv.innerHTML = '<div class="error-box">⚠️ Parse Error: ' + escapeHtml(data.error) + '</div>';
+                return;
+            }
+            const row = (k, v) => '<tr><th>' + k + '</th><td>' + escapeHtml(String(v)) + '</td></tr>';
+            const now = new Date();
+            visualDiv.innerHTML = data.blocks.map(b => {
+                let rows = '';
+                if (b.certificate) {
+                    const cert = b.certificate;
+                    const expired = new Date(cert.notAfter) < now;
+                    const names = [].concat(cert.dnsNames || [], cert.ipAddresses || [], cert.emailAddresses || [], cert.uris || []);
+                    rows = row('Subject', cert.subject) + row('Issuer', cert.issuer) +
+                        (names.length ? row('Names', names.join(', ')) : '') +
+                        row('Valid from', new Date(cert.notBefore).toLocaleString()) +
+                        row('Valid until', new Date(cert.notAfter).toLocaleString() + (expired ? ' (expired)' : '')) +
+                        row('Key', cert.keyAlgorithm + (cert.isCA ? ', CA' : '')) +
+                        row('Serial', cert.serialNumber) + row('SHA-256', cert.sha256);
+                } else if (b.key) {
+                    const k = b.key;
+                    rows = row('Key', k.masked ? 'hidden' : k.encrypted ? 'encrypted' : ((k.algorithm || 'unknown') + (k.bits ? ' ' + k.bits + ' bits' : '')));
+                }
+                return '<table class="table-view"><thead><tr><th colspan="2">' + escapeHtml(b.type) + ' (line ' + b.line + ')</th></tr></thead><tbody>' + rows + '</tbody></table><br>';
+            }).join('') || '<div class="tree-view">No PEM blocks</div>';
+        }
+        
+        // Jsonnet is evaluated by the server in place of the saved file, so
+        // imports resolve as they will once it is saved.
+        async function renderJsonnet(content) {
+            const visualDiv = document.getElementById('visualEditor');
+            const response = await fetch('/api/render/' + encodeURIComponent(currentFile), {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                visualDiv.innerHTML = '<div class="error-box"><pre>⚠️ ' + escapeHtml(data.error) + '</pre></div>';
+                return;
+            }
+            visualDiv.innerHTML = '<div class="tree-view">' + renderJSON(data, 0) + '</div>';
+        }
+        
+        // CUE is evaluated by the server; the preview is what cue export
+        // would write, or every error with its position.
+        async function renderCUE(content) {
+            const visualDiv = document.getElementById('visualEditor');
+            const response = await fetch('/api/cue', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content, filename: currentFile })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                const errors = data.errors || [{ message: data.error }];
+                visualDiv.innerHTML = errors.map(e => '<div class="error-box">⚠️ ' +
+                    (e.line ? 'Line ' + e.line + ', column ' + e.column + ': ' : '') +
+                    (e.path ? escapeHtml(e.path) + ': ' : '') + escapeHtml(e.message) + '</div>').join('');
+                return;
+            }
+            visualDiv.innerHTML = '<div class="tree-view">' + renderJSON(data.value, 0) + '</div>';
+        }
+        
+        // .env files are parsed by the server, which unquotes values the
+        // way the tools reading them do.
+        async function renderEnv(content) {
+            const visualDiv = document.getElementById('visualEditor');
+            const response = await fetch('/api/env', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                visualDiv.innerHTML = '<div class="error-box">⚠️ Parse Error: ' + escapeHtml(data.error) + '</div>';
+                return;
+            }
+            visualDiv.innerHTML = '<table class="table-view"><thead><tr><th>Line</th><th>Variable</th><th>Value</th></tr></thead><tbody>' +
+                data.variables.map(v => '<tr><td>' + v.line + '</td><td>' + (v.export ? 'export ' : '') + escapeHtml(v.key) + '</td><td>' +
+                    (v.value === 'edit3:masked' ? '<em>hidden</em>' : escapeHtml(v.value)) + '</td></tr>').join('') +
+                '</tbody></table>';
+        }
+        
         function renderJSON(obj, indent) {
             let html = '';
             const spaces = '  '.repeat(indent);
@@ -847,10 +17887,21 @@ const HTML_CONTENT = `<!DOCTYPE html>
             return text.replace(/[&<>"']/g, m => map[m]);
         }
         
+        // Toggles the read-only preview of YAML with anchors and merge keys
+        // expanded.
+        async function toggleExpanded() {
+            fileView = fileView ? '' : 'expanded';
+            await loadFile();
+        }
+
         async function saveFile() {
+            if (fileView) {
+                showToast('👁️ Leave the expanded view to save');
+                return;
+            }
             try {
                 const content = editor.getValue();
-                const response = await fetch('/api/file/' + currentFile, {
+                const response = await fetch('/api/file/' + encodeURIComponent(currentFile), {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
                     body: JSON.stringify({ content })
@@ -859,7 +17910,19 @@ const HTML_CONTENT = `<!DOCTYPE html>
                 const data = await response.json();
                 
                 if (data.success) {
-                    showToast('✅ File saved and committed!');
+                    savedContent = content;
+                    if (data.normalized) {
+                        // The server rewrote it; show what was stored
+                        await loadFile();
+                    }
+                    storeSession();
+                    showToast(data.warning ? '⚠️ ' + data.warning : '✅ File saved and committed!' +
+                        (data.derived ? ' Regenerated ' + data.derived.join(', ') : '') +
+                        (data.budget ? ' ⚠️ Over budget: ' + data.budget.map(v => v.message).join('; ') : '') +
+                        (data.impacted ? ' 📣 Read by ' + data.impacted.map(i => i.consumer).join(', ') : ''));
+                } else if (data.violations) {
+                    alert('Save denied by policy:\n' + data.violations.map(v =>
+                        '• ' + (v.pointer ? v.pointer + ': ' : '') + v.message).join('\n'));
                 } else {
                     alert('Error: ' + (data.error || 'Unknown error'));
                 }
@@ -868,12 +17931,16 @@ const HTML_CONTENT = `<!DOCTYPE html>
             }
         }
         
+        function openReport() {
+            window.open('/api/report/' + encodeURIComponent(currentFile), '_blank');
+        }
+        
         async function showHistory() {
             const modal = document.getElementById('historyModal');
             modal.classList.add('show');
             
             try {
-                const response = await fetch('/api/history/' + currentFile);
+                const response = await fetch('/api/history/' + encodeURIComponent(currentFile));
                 const data = await response.json();
                 
                 const listDiv = document.getElementById('historyList');
@@ -906,12 +17973,13 @@ const HTML_CONTENT = `<!DOCTYPE html>
         async function restoreVersion(hash) {
             if (confirm('Restore this version? Current changes will be saved as a new commit.')) {
                 try {
-                    const response = await fetch('/api/restore/' + currentFile + '/' + hash, {
+                    const response = await fetch('/api/restore/' + encodeURIComponent(currentFile) + '/' + hash, {
                         method: 'POST'
                     });
                     const data = await response.json();
                     
                     if (data.success) {
+                        savedContent = data.content;
                         editor.setValue(data.content, -1);
                         updateVisual();
                         hideHistory();
@@ -941,6 +18009,39 @@ const HTML_CONTENT = `<!DOCTYPE html>
             }
         }
         
+        // Converting saves a new file beside the current one, which is left
+        // as it is, and opens it
+        async function convertFile() {
+            const to = prompt('Convert ' + currentFile + ' to (json, yaml, xml, toml):', fileType === 'json' ? 'yaml' : 'json');
+            if (!to) return;
+            const target = prompt('Save as:', currentFile.replace(/[.][^./]*$/, '') + '.' + to);
+            if (!target) return;
+            const response = await fetch('/api/convert', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content: editor.getValue(), from: fileType, to })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                showToast('❌ ' + data.error);
+                return;
+            }
+            const existing = await fetch('/api/file/' + encodeURIComponent(target));
+            if (existing.ok && !confirm(target + ' exists. Overwrite it?')) return;
+            const saved = await fetch('/api/file/' + encodeURIComponent(target), {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ content: data.content })
+            });
+            const result = await saved.json();
+            if (!result.success) {
+                showToast('❌ ' + result.error);
+                return;
+            }
+            switchTab(target);
+            showToast('🔁 Converted to ' + target);
+        }
+        
         function reloadFile() {
             loadFile();
             showToast('🔄 File reloaded!');
@@ -967,14 +18068,14 @@ FILE=$1
 
 if [ -z "$FILE" ]; then
     echo "Usage: edit3 <filename>"
-    echo "Supported formats: .json, .yaml, .yml, .xml"
+    echo "Supported formats: .json, .yaml, .yml, .xml, .toml, .csv, .tsv, .tf, .hcl, .pem, .crt, .env, .cue, .jsonnet, .libsonnet"
     exit 1
 fi
 
 # Check file extension
-if [[ ! "$FILE" =~ \.(json|yaml|yml|xml)$ ]]; then
+if [[ ! "$FILE" =~ \.(json|yaml|yml|xml|toml|csv|tsv|tf|hcl|pem|crt|env|cue|jsonnet|libsonnet)$ ]]; then
     echo "Error: Unsupported file format"
-    echo "Supported formats: .json, .yaml, .yml, .xml"
+    echo "Supported formats: .json, .yaml, .yml, .xml, .toml, .csv, .tsv, .tf, .hcl, .pem, .crt, .env, .cue, .jsonnet, .libsonnet"
     exit 1
 fi
 
@@ -0,0 +1,146 @@
+package storage
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "github.com/fsnotify/fsnotify"
+)
+
+// Local stores files in a directory on disk. It is the default driver and
+// the only one whose files git can version.
+type Local struct {
+    Root string
+}
+
+func (l Local) path(name string) (string, error) {
+    name, err := clean(name)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(l.Root, filepath.FromSlash(name)), nil
+}
+
+func (l Local) Read(name string) ([]byte, error) {
+    p, err := l.path(name)
+    if err != nil {
+        return nil, err
+    }
+    return ioutil.ReadFile(p)
+}
+
+func (l Local) Write(name string, data []byte) error {
+    p, err := l.path(name)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(p, data, 0644)
+}
+
+func (l Local) Remove(name string) error {
+    p, err := l.path(name)
+    if err != nil {
+        return err
+    }
+    return os.Remove(p)
+}
+
+func (l Local) List(dir string) ([]FileInfo, error) {
+    p := l.Root
+    if dir != "" {
+        var err error
+        if p, err = l.path(dir); err != nil {
+            return nil, err
+        }
+    }
+    entries, err := ioutil.ReadDir(p)
+    if err != nil {
+        return nil, err
+    }
+    list := make([]FileInfo, 0, len(entries))
+    for _, e := range entries {
+        list = append(list, FileInfo{Name: strings.TrimPrefix(dir+"/"+e.Name(), "/"), Size: e.Size(), ModTime: e.ModTime(), IsDir: e.IsDir()})
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list, nil
+}
+
+func (l Local) Stat(name string) (FileInfo, error) {
+    p, err := l.path(name)
+    if err != nil {
+        return FileInfo{}, err
+    }
+    info, err := os.Stat(p)
+    if err != nil {
+        return FileInfo{}, err
+    }
+    return FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+// Watch follows the whole tree with fsnotify, skipping hidden directories
+// such as .git.
+func (l Local) Watch(ctx context.Context) (<-chan Event, error) {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return nil, err
+    }
+    if err := l.watchTree(watcher, l.Root); err != nil {
+        watcher.Close()
+        return nil, err
+    }
+    events := make(chan Event)
+    go func() {
+        defer close(events)
+        defer watcher.Close()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case e, ok := <-watcher.Events:
+                if !ok {
+                    return
+                }
+                info, statErr := os.Stat(e.Name)
+                if statErr == nil && info.IsDir() {
+                    if e.Has(fsnotify.Create) {
+                        l.watchTree(watcher, e.Name)
+                    }
+                    continue
+                }
+                rel, err := filepath.Rel(l.Root, e.Name)
+                if err != nil || strings.HasPrefix(rel, "..") {
+                    continue
+                }
+                select {
+                case events <- Event{Name: filepath.ToSlash(rel), Removed: os.IsNotExist(statErr)}:
+                case <-ctx.Done():
+                    return
+                }
+            case _, ok := <-watcher.Errors:
+                if !ok {
+                    return
+                }
+            }
+        }
+    }()
+    return events, nil
+}
+
+func (l Local) watchTree(watcher *fsnotify.Watcher, dir string) error {
+    return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+        if err != nil || !info.IsDir() {
+            return nil
+        }
+        if p != dir && strings.HasPrefix(info.Name(), ".") {
+            return filepath.SkipDir
+        }
+        return watcher.Add(p)
+    })
+}
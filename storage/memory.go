@@ -0,0 +1,145 @@
+package storage
+
+import (
+    "context"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Memory keeps files in process memory. Nothing survives a restart; it
+// suits demos and tests.
+type Memory struct {
+    mu       sync.RWMutex
+    files    map[string]memoryFile
+    watchers map[chan Event]struct{}
+}
+
+type memoryFile struct {
+    data    []byte
+    modTime time.Time
+}
+
+func NewMemory() *Memory {
+    return &Memory{files: make(map[string]memoryFile), watchers: make(map[chan Event]struct{})}
+}
+
+func (m *Memory) Read(name string) ([]byte, error) {
+    name, err := clean(name)
+    if err != nil {
+        return nil, err
+    }
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    f, ok := m.files[name]
+    if !ok {
+        return nil, notExist("read", name)
+    }
+    return append([]byte(nil), f.data...), nil
+}
+
+func (m *Memory) Write(name string, data []byte) error {
+    name, err := clean(name)
+    if err != nil {
+        return err
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.files[name] = memoryFile{data: append([]byte(nil), data...), modTime: time.Now()}
+    for ch := range m.watchers {
+        select {
+        case ch <- Event{Name: name}:
+        default: // a slow watcher misses events rather than blocking saves
+        }
+    }
+    return nil
+}
+
+func (m *Memory) Remove(name string) error {
+    name, err := clean(name)
+    if err != nil {
+        return err
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if _, ok := m.files[name]; !ok {
+        return notExist("remove", name)
+    }
+    delete(m.files, name)
+    for ch := range m.watchers {
+        select {
+        case ch <- Event{Name: name, Removed: true}:
+        default:
+        }
+    }
+    return nil
+}
+
+// List synthesizes directories from the names below dir.
+func (m *Memory) List(dir string) ([]FileInfo, error) {
+    prefix := ""
+    if dir != "" {
+        d, err := clean(dir)
+        if err != nil {
+            return nil, err
+        }
+        prefix = d + "/"
+    }
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    seen := make(map[string]bool)
+    var list []FileInfo
+    for name, f := range m.files {
+        if !strings.HasPrefix(name, prefix) {
+            continue
+        }
+        rest := strings.TrimPrefix(name, prefix)
+        if i := strings.Index(rest, "/"); i >= 0 {
+            if sub := prefix + rest[:i]; !seen[sub] {
+                seen[sub] = true
+                list = append(list, FileInfo{Name: sub, IsDir: true})
+            }
+            continue
+        }
+        list = append(list, FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime})
+    }
+    if list == nil && prefix != "" {
+        return nil, notExist("list", dir)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list, nil
+}
+
+func (m *Memory) Stat(name string) (FileInfo, error) {
+    name, err := clean(name)
+    if err != nil {
+        return FileInfo{}, err
+    }
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    if f, ok := m.files[name]; ok {
+        return FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+    }
+    for other := range m.files {
+        if strings.HasPrefix(other, name+"/") {
+            return FileInfo{Name: name, IsDir: true}, nil
+        }
+    }
+    return FileInfo{}, notExist("stat", name)
+}
+
+func (m *Memory) Watch(ctx context.Context) (<-chan Event, error) {
+    ch := make(chan Event, 64)
+    m.mu.Lock()
+    m.watchers[ch] = struct{}{}
+    m.mu.Unlock()
+    go func() {
+        <-ctx.Done()
+        m.mu.Lock()
+        delete(m.watchers, ch)
+        close(ch)
+        m.mu.Unlock()
+    }()
+    return ch, nil
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io/ioutil"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+    awsconfig "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3 stores files as objects under a key prefix. Credentials and region come
+// from the usual AWS environment, shared config and instance roles.
+type S3 struct {
+    Client *s3.Client
+    Bucket string
+    Prefix string
+    // PollInterval is how often Watch lists the bucket for changes.
+    PollInterval time.Duration
+}
+
+// S3PollInterval is the default S3.PollInterval.
+const S3PollInterval = 10 * time.Second
+
+// S3Timeout bounds each request.
+const S3Timeout = 30 * time.Second
+
+func NewS3(ctx context.Context, bucket, prefix string) (*S3, error) {
+    cfg, err := awsconfig.LoadDefaultConfig(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return &S3{Client: s3.NewFromConfig(cfg), Bucket: bucket, Prefix: prefix, PollInterval: S3PollInterval}, nil
+}
+
+func (s *S3) key(name string) (string, error) {
+    name, err := clean(name)
+    if err != nil {
+        return "", err
+    }
+    if s.Prefix == "" {
+        return name, nil
+    }
+    return s.Prefix + "/" + name, nil
+}
+
+func (s *S3) name(key string) string {
+    if s.Prefix == "" {
+        return key
+    }
+    return strings.TrimPrefix(key, s.Prefix+"/")
+}
+
+func isNotFound(err error) bool {
+    var re *awshttp.ResponseError
+    return errors.As(err, &re) && re.HTTPStatusCode() == 404
+}
+
+func (s *S3) Read(name string) ([]byte, error) {
+    key, err := s.key(name)
+    if err != nil {
+        return nil, err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), S3Timeout)
+    defer cancel()
+    out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(key)})
+    if isNotFound(err) {
+        return nil, notExist("read", name)
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer out.Body.Close()
+    return ioutil.ReadAll(out.Body)
+}
+
+// Write puts the object; directories need no creating.
+func (s *S3) Write(name string, data []byte) error {
+    key, err := s.key(name)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), S3Timeout)
+    defer cancel()
+    _, err = s.Client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(key), Body: bytes.NewReader(data)})
+    return err
+}
+
+// Remove deletes the object. S3 does not report deleting a missing one.
+func (s *S3) Remove(name string) error {
+    key, err := s.key(name)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), S3Timeout)
+    defer cancel()
+    _, err = s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(key)})
+    return err
+}
+
+// List uses "/" as the delimiter, so common prefixes come back as
+// directories.
+func (s *S3) List(dir string) ([]FileInfo, error) {
+    prefix := s.Prefix
+    if dir != "" {
+        key, err := s.key(dir)
+        if err != nil {
+            return nil, err
+        }
+        prefix = key
+    }
+    if prefix != "" {
+        prefix += "/"
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), S3Timeout)
+    defer cancel()
+    var list []FileInfo
+    pages := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{Bucket: aws.String(s.Bucket), Prefix: aws.String(prefix), Delimiter: aws.String("/")})
+    for pages.HasMorePages() {
+        page, err := pages.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, p := range page.CommonPrefixes {
+            list = append(list, FileInfo{Name: strings.TrimSuffix(s.name(aws.ToString(p.Prefix)), "/"), IsDir: true})
+        }
+        for _, o := range page.Contents {
+            list = append(list, FileInfo{Name: s.name(aws.ToString(o.Key)), Size: aws.ToInt64(o.Size), ModTime: aws.ToTime(o.LastModified)})
+        }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list, nil
+}
+
+func (s *S3) Stat(name string) (FileInfo, error) {
+    key, err := s.key(name)
+    if err != nil {
+        return FileInfo{}, err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), S3Timeout)
+    defer cancel()
+    out, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(key)})
+    if isNotFound(err) {
+        return FileInfo{}, notExist("stat", name)
+    }
+    if err != nil {
+        return FileInfo{}, err
+    }
+    return FileInfo{Name: name, Size: aws.ToInt64(out.ContentLength), ModTime: aws.ToTime(out.LastModified)}, nil
+}
+
+// Watch polls the bucket and compares ETags; S3 event notifications need
+// infrastructure (SQS, SNS) the editor cannot assume.
+func (s *S3) Watch(ctx context.Context) (<-chan Event, error) {
+    seen, err := s.etags(ctx)
+    if err != nil {
+        return nil, err
+    }
+    interval := s.PollInterval
+    if interval <= 0 {
+        interval = S3PollInterval
+    }
+    events := make(chan Event)
+    go func() {
+        defer close(events)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+            }
+            now, err := s.etags(ctx)
+            if err != nil {
+                continue
+            }
+            var changed []Event
+            for name, tag := range now {
+                if seen[name] != tag {
+                    changed = append(changed, Event{Name: name})
+                }
+            }
+            for name := range seen {
+                if _, ok := now[name]; !ok {
+                    changed = append(changed, Event{Name: name, Removed: true})
+                }
+            }
+            seen = now
+            for _, e := range changed {
+                select {
+                case events <- e:
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }
+    }()
+    return events, nil
+}
+
+// etags maps every object under the prefix to its ETag.
+func (s *S3) etags(ctx context.Context) (map[string]string, error) {
+    prefix := s.Prefix
+    if prefix != "" {
+        prefix += "/"
+    }
+    tags := make(map[string]string)
+    pages := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{Bucket: aws.String(s.Bucket), Prefix: aws.String(prefix)})
+    for pages.HasMorePages() {
+        page, err := pages.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, o := range page.Contents {
+            tags[s.name(aws.ToString(o.Key))] = aws.ToString(o.ETag)
+        }
+    }
+    return tags, nil
+}
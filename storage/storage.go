@@ -0,0 +1,82 @@
+// Package storage abstracts where the editor's files live. Handlers read and
+// write through a Storage, so a new backend (SMB, GCS, Azure, ...) is one
+// more driver here rather than a change to every handler. Names are
+// slash-separated and relative to the driver's root; a missing file is
+// reported with an error satisfying errors.Is(err, os.ErrNotExist).
+package storage
+
+import (
+    "context"
+    "fmt"
+    "net/url"
+    "os"
+    "path"
+    "strings"
+    "time"
+)
+
+// Storage is a tree of files.
+type Storage interface {
+    Read(name string) ([]byte, error)
+    // Write creates or replaces name, creating parent directories.
+    Write(name string, data []byte) error
+    // Remove deletes the file name.
+    Remove(name string) error
+    // List returns the direct children of dir ("" for the root), sorted by
+    // name.
+    List(dir string) ([]FileInfo, error)
+    Stat(name string) (FileInfo, error)
+    // Watch reports changes until ctx is done. Drivers without change
+    // notifications poll.
+    Watch(ctx context.Context) (<-chan Event, error)
+}
+
+type FileInfo struct {
+    Name    string // relative to the root
+    Size    int64
+    ModTime time.Time
+    IsDir   bool
+}
+
+// Event is a change to one file. Removed is set when it no longer exists.
+type Event struct {
+    Name    string
+    Removed bool
+}
+
+// Open returns the driver for spec: "memory:" for a process-local tree,
+// "s3://bucket/prefix" for an S3 bucket, and a directory (optionally as a
+// file:// URL) for local disk.
+func Open(ctx context.Context, spec string) (Storage, error) {
+    switch {
+    case spec == "memory:":
+        return NewMemory(), nil
+    case strings.HasPrefix(spec, "s3://"):
+        u, err := url.Parse(spec)
+        if err != nil {
+            return nil, err
+        }
+        if u.Host == "" {
+            return nil, fmt.Errorf("%s: missing bucket", spec)
+        }
+        return NewS3(ctx, u.Host, strings.Trim(u.Path, "/"))
+    case strings.HasPrefix(spec, "file://"):
+        return Local{Root: strings.TrimPrefix(spec, "file://")}, nil
+    case strings.Contains(spec, "://"):
+        return nil, fmt.Errorf("unsupported storage %q", spec)
+    }
+    return Local{Root: spec}, nil
+}
+
+// clean validates a name and returns it in canonical form.
+func clean(name string) (string, error) {
+    cleaned := path.Clean("/" + name)[1:]
+    if cleaned == "" {
+        return "", fmt.Errorf("invalid name %q", name)
+    }
+    return cleaned, nil
+}
+
+func notExist(op, name string) error {
+    return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+    "fmt"
+    "strings"
+)
+
+// MaxDiffCells bounds the line-matching table; larger inputs are shown as
+// one replaced block.
+const MaxDiffCells = 4000000
+
+// UnifiedDiff renders the changes from a to b in the unified format git
+// prints, so backends without git produce output readers of git diffs
+// already understand.
+func UnifiedDiff(name, a, b string, context int) string {
+    if a == b {
+        return ""
+    }
+    ops := diffLines(splitLines(a), splitLines(b))
+
+    var out strings.Builder
+    fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+    for start := 0; start < len(ops); {
+        // Find the next change and the hunk around it
+        for start < len(ops) && ops[start].kind == ' ' {
+            start++
+        }
+        if start == len(ops) {
+            break
+        }
+        lo := start - context
+        if lo < 0 {
+            lo = 0
+        }
+        hi, quiet := start, 0
+        for hi < len(ops) && quiet <= 2*context {
+            if ops[hi].kind == ' ' {
+                quiet++
+            } else {
+                quiet = 0
+            }
+            hi++
+        }
+        if quiet > context {
+            hi -= quiet - context
+        }
+
+        oldStart, newStart := ops[lo].oldLine, ops[lo].newLine
+        oldCount, newCount := 0, 0
+        var body strings.Builder
+        for _, op := range ops[lo:hi] {
+            body.WriteByte(op.kind)
+            body.WriteString(op.text)
+            body.WriteByte('\n')
+            if op.kind != '+' {
+                oldCount++
+            }
+            if op.kind != '-' {
+                newCount++
+            }
+        }
+        if oldCount == 0 {
+            oldStart--
+        }
+        if newCount == 0 {
+            newStart--
+        }
+        fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n%s", oldStart, oldCount, newStart, newCount, body.String())
+        start = hi
+    }
+    return out.String()
+}
+
+type diffOp struct {
+    kind             byte // ' ', '-' or '+'
+    text             string
+    oldLine, newLine int // 1-based position of the op in each side
+}
+
+func splitLines(s string) []string {
+    if s == "" {
+        return nil
+    }
+    return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines aligns two line slices by their longest common subsequence.
+func diffLines(a, b []string) []diffOp {
+    // Trim the common prefix and suffix first; most saves touch a few lines
+    prefix := 0
+    for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+        prefix++
+    }
+    suffix := 0
+    for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+        suffix++
+    }
+    ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+    var ops []diffOp
+    i, j := 0, 0
+    emit := func(kind byte, text string) {
+        ops = append(ops, diffOp{kind: kind, text: text, oldLine: i + 1, newLine: j + 1})
+        if kind != '+' {
+            i++
+        }
+        if kind != '-' {
+            j++
+        }
+    }
+    for _, line := range a[:prefix] {
+        emit(' ', line)
+    }
+
+    if len(ma)*len(mb) > MaxDiffCells {
+        for _, line := range ma {
+            emit('-', line)
+        }
+        for _, line := range mb {
+            emit('+', line)
+        }
+    } else {
+        // lcs[x][y] is the common length of ma[x:] and mb[y:]
+        lcs := make([][]int, len(ma)+1)
+        for x := range lcs {
+            lcs[x] = make([]int, len(mb)+1)
+        }
+        for x := len(ma) - 1; x >= 0; x-- {
+            for y := len(mb) - 1; y >= 0; y-- {
+                if ma[x] == mb[y] {
+                    lcs[x][y] = lcs[x+1][y+1] + 1
+                } else if lcs[x+1][y] >= lcs[x][y+1] {
+                    lcs[x][y] = lcs[x+1][y]
+                } else {
+                    lcs[x][y] = lcs[x][y+1]
+                }
+            }
+        }
+        x, y := 0, 0
+        for x < len(ma) || y < len(mb) {
+            switch {
+            case x < len(ma) && y < len(mb) && ma[x] == mb[y]:
+                emit(' ', ma[x])
+                x++
+                y++
+            case y < len(mb) && (x == len(ma) || lcs[x][y+1] > lcs[x+1][y]):
+                emit('+', mb[y])
+                y++
+            default:
+                emit('-', ma[x])
+                x++
+            }
+        }
+    }
+
+    for _, line := range a[len(a)-suffix:] {
+        emit(' ', line)
+    }
+    return ops
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "os"
+    "strings"
+    "time"
+)
+
+// Classes of version-store failure. Test with errors.Is; a command that ran
+// out of time also matches context.DeadlineExceeded.
+var (
+    // ErrLocked means another process holds a repository lock. It is
+    // retried before being returned.
+    ErrLocked = errors.New("repository is locked")
+    // ErrNotFound means a revision or path does not exist.
+    ErrNotFound = errors.New("version not found")
+    // ErrCorrupt means objects or the index are damaged.
+    ErrCorrupt = errors.New("repository is corrupt")
+    // ErrNoRepository means the directory is not under version control.
+    ErrNoRepository = errors.New("not a repository")
+    // ErrNothingToCommit means the files match the latest version.
+    ErrNothingToCommit = errors.New("nothing to commit")
+)
+
+// Lock contention is retried LockRetries times, waiting LockBackoff and then
+// twice as long each time.
+var (
+    LockRetries = 4
+    LockBackoff = 100 * time.Millisecond
+)
+
+// Error is a failed git command.
+type Error struct {
+    Op     string // git subcommand
+    Output string // what git printed
+    Kind   error  // one of the Err* classes, nil when unrecognised
+    Err    error  // the exec or context error
+}
+
+func (e *Error) Error() string {
+    if e.Output != "" {
+        // git follows a lock error with several lines of advice
+        first, _, _ := strings.Cut(e.Output, "\n")
+        return "git " + e.Op + ": " + first
+    }
+    return "git " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+    if e.Kind == nil {
+        return []error{e.Err}
+    }
+    return []error{e.Kind, e.Err}
+}
+
+// errorPatterns map git's messages to classes; the first match wins.
+var errorPatterns = []struct {
+    kind    error
+    markers []string
+}{
+    {ErrNothingToCommit, []string{"nothing to commit", "nothing added to commit", "no changes added to commit"}},
+    {ErrLocked, []string{".lock': File exists", "Unable to create", "cannot lock ref", "could not lock", "Another git process seems to be running"}},
+    {ErrCorrupt, []string{"is corrupt", "is empty", "index file", "bad signature", "unable to read tree", "inflate:", "missing blob", "loose object"}},
+    {ErrNoRepository, []string{"not a git repository"}},
+    {ErrNotFound, []string{"bad revision", "unknown revision", "invalid object name", "Not a valid object name", "does not exist in", "exists on disk, but not in", "did not match any file", "does not have any commits", "bad object"}},
+}
+
+func classify(output string) error {
+    for _, p := range errorPatterns {
+        for _, marker := range p.markers {
+            if strings.Contains(output, marker) {
+                return p.kind
+            }
+        }
+    }
+    return nil
+}
+
+// run executes git in dir and returns its standard output. Lock contention
+// is retried with backoff; other failures come back as *Error.
+func run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+    return runEnv(ctx, dir, nil, args...)
+}
+
+// runEnv is run with env added to git's environment.
+func runEnv(ctx context.Context, dir string, env []string, args ...string) ([]byte, error) {
+    for attempt := 0; ; attempt++ {
+        cmd, done := git(ctx, dir, args...)
+        if len(env) > 0 {
+            cmd.Env = append(os.Environ(), env...)
+        }
+        var stderr bytes.Buffer
+        cmd.Stderr = &stderr
+        output, err := cmd.Output()
+        if err = done(err); err == nil {
+            return output, nil
+        }
+        // git commit reports "nothing to commit" on standard output
+        printed := strings.TrimSpace(stderr.String() + "\n" + string(output))
+        e := &Error{Op: args[0], Output: printed, Kind: classify(printed), Err: err}
+        if e.Kind != ErrLocked || attempt >= LockRetries {
+            return output, e
+        }
+        select {
+        case <-time.After(LockBackoff << attempt):
+        case <-ctx.Done():
+            return output, e
+        }
+    }
+}
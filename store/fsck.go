@@ -0,0 +1,131 @@
+package store
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// StaleLockAge is how old a lock file must be before Fsck treats it as left
+// behind by a crashed git rather than held by a running one.
+var StaleLockAge = time.Minute
+
+// Problem is one issue Fsck found in a repository.
+type Problem struct {
+    Kind     string `json:"kind"` // lock, detached, operation, index, objects
+    Path     string `json:"path,omitempty"`
+    Detail   string `json:"detail"`
+    Repaired bool   `json:"repaired"`
+}
+
+// Fsck checks the repository dir belongs to for stale locks, a detached
+// HEAD, an interrupted merge or rebase, a damaged index and missing or
+// corrupt objects. With repair it fixes what can be fixed without losing
+// committed history: it removes stale locks, re-attaches HEAD to a branch
+// at the same commit and rebuilds a damaged index from HEAD. Damaged
+// objects are only reported. The steps that can throw work away wait for
+// force as well: removing locks younger than StaleLockAge, whose git may
+// still be running, and aborting interrupted operations.
+func Fsck(ctx context.Context, dir string, repair, force bool) ([]Problem, error) {
+    lines, err := Lines(ctx, dir, "rev-parse", "--absolute-git-dir")
+    if err != nil {
+        return nil, err
+    }
+    gitDir := lines[0]
+    problems := make([]Problem, 0)
+
+    // Locks first: every other check (and repair) needs them gone
+    err = filepath.Walk(gitDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() || !strings.HasSuffix(path, ".lock") {
+            return nil
+        }
+        rel, _ := filepath.Rel(gitDir, path)
+        age := time.Since(info.ModTime()).Round(time.Second)
+        p := Problem{Kind: "lock", Path: filepath.ToSlash(rel), Detail: fmt.Sprintf("lock file is %s old", age)}
+        if repair && (force || age >= StaleLockAge) {
+            p.Repaired = os.Remove(path) == nil
+        } else if age < StaleLockAge {
+            p.Detail += "; another git may still be running"
+        }
+        problems = append(problems, p)
+        return nil
+    })
+    if err != nil {
+        return problems, err
+    }
+
+    // Interrupted operations leave their state files behind
+    for _, op := range []struct{ marker, command string }{
+        {"MERGE_HEAD", "merge"},
+        {"CHERRY_PICK_HEAD", "cherry-pick"},
+        {"REVERT_HEAD", "revert"},
+        {"rebase-merge", "rebase"},
+        {"rebase-apply", "rebase"},
+    } {
+        if _, err := os.Stat(filepath.Join(gitDir, op.marker)); err != nil {
+            continue
+        }
+        p := Problem{Kind: "operation", Path: op.marker, Detail: "a " + op.command + " was interrupted"}
+        if repair && force {
+            _, err := run(ctx, dir, op.command, "--abort")
+            p.Repaired = err == nil
+        } else if repair {
+            p.Detail += "; aborting it discards its progress and needs force"
+        }
+        problems = append(problems, p)
+    }
+
+    // The index can be rebuilt from HEAD without touching the files
+    index := true
+    if _, err := run(ctx, dir, "status", "--porcelain"); errors.Is(err, ErrCorrupt) {
+        p := Problem{Kind: "index", Path: "index", Detail: err.Error()}
+        if repair && os.Remove(filepath.Join(gitDir, "index")) == nil {
+            _, err := run(ctx, dir, "reset", "-q")
+            p.Repaired = err == nil
+        }
+        index = p.Repaired
+        problems = append(problems, p)
+    } else if err != nil && !errors.Is(err, ErrLocked) {
+        return problems, err
+    }
+
+    head, err := Lines(ctx, dir, "rev-parse", "--verify", "-q", "HEAD")
+    if err != nil || len(head) == 0 {
+        // No commits yet: nothing to be detached from or corrupt
+        return problems, nil
+    }
+    if _, err := run(ctx, dir, "symbolic-ref", "-q", "HEAD"); err != nil {
+        p := Problem{Kind: "detached", Path: "HEAD", Detail: "HEAD is detached at " + head[0][:7]}
+        branches, _ := Lines(ctx, dir, "for-each-ref", "--points-at", head[0], "--format=%(refname:short)", "refs/heads")
+        if len(branches) == 0 {
+            p.Detail += " and no branch points there"
+        } else if repair {
+            _, err := run(ctx, dir, "checkout", "-q", branches[0])
+            p.Repaired = err == nil
+        }
+        problems = append(problems, p)
+    }
+
+    if !index {
+        // git fsck would only repeat the index error
+        return problems, nil
+    }
+    output, err := run(ctx, dir, "fsck", "--no-progress", "--no-dangling")
+    if err != nil {
+        var e *Error
+        if !errors.As(err, &e) {
+            return problems, err
+        }
+        output = []byte(e.Output)
+    }
+    for _, line := range strings.Split(string(output), "\n") {
+        if line = strings.TrimSpace(line); line != "" {
+            problems = append(problems, Problem{Kind: "objects", Detail: line})
+        }
+    }
+    return problems, nil
+}
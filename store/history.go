@@ -0,0 +1,98 @@
+package store
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "path/filepath"
+)
+
+// History is a version store for the files under one root. Names are
+// relative to that root. Revisions are whatever the backend's Commit and Log
+// return, plus "HEAD" and "HEAD~n" counted back from the latest.
+type History interface {
+    // Commit records the current content of the named files (missing ones
+    // as removals) as one version and returns the id of the version now
+    // current, also when there was nothing new to record.
+    Commit(ctx context.Context, names []string, message string) (string, error)
+    // Log returns the n most recent versions touching name, newest first.
+    Log(ctx context.Context, name string, n int) ([]Commit, error)
+    // Show returns name as of rev.
+    Show(ctx context.Context, name, rev string) ([]byte, error)
+    // Restore puts name back to its content at rev and commits that.
+    Restore(ctx context.Context, name, rev, message string) ([]byte, error)
+    // Diff returns a unified diff of name between two revisions with the
+    // given number of context lines.
+    Diff(ctx context.Context, name, from, to string, context int) (string, error)
+}
+
+// Git keeps history in the git repository holding Dir, one commit per save.
+type Git struct {
+    Dir string
+}
+
+func (g Git) Commit(ctx context.Context, names []string, message string) (string, error) {
+    if err := CommitFiles(ctx, g.Dir, names, message); err != nil && !errors.Is(err, ErrNothingToCommit) {
+        return "", err
+    }
+    head, err := Lines(ctx, g.Dir, "rev-parse", "--short=7", "HEAD")
+    if err != nil {
+        return "", err
+    }
+    return head[0], nil
+}
+
+func (g Git) Log(ctx context.Context, name string, n int) ([]Commit, error) {
+    return Log(ctx, g.Dir, name, n), nil
+}
+
+func (g Git) Show(ctx context.Context, name, rev string) ([]byte, error) {
+    return FileAt(ctx, g.Dir, name, rev)
+}
+
+func (g Git) Restore(ctx context.Context, name, rev, message string) ([]byte, error) {
+    content, err := g.Show(ctx, name, rev)
+    if err != nil {
+        return nil, err
+    }
+    if err := ioutil.WriteFile(filepath.Join(g.Dir, filepath.FromSlash(name)), content, 0644); err != nil {
+        return nil, err
+    }
+    _, err = g.Commit(ctx, []string{name}, message)
+    return content, err
+}
+
+func (g Git) Diff(ctx context.Context, name, from, to string, unified int) (string, error) {
+    output, err := run(ctx, g.Dir, "diff", "--no-color", "--no-ext-diff", fmt.Sprintf("-U%d", unified), "--end-of-options", from, to, "--", filepath.ToSlash(name))
+    return string(output), err
+}
+
+// errNoVersion is returned for revisions a file has no version at.
+func errNoVersion(name, rev string) error {
+    return fmt.Errorf("%s has no version %s: %w", name, rev, ErrNotFound)
+}
+
+// Unversioned is the History of a root that is not under version control:
+// saves are kept without a version and there is nothing to look back at.
+type Unversioned struct{}
+
+func (Unversioned) Commit(ctx context.Context, names []string, message string) (string, error) {
+    return "", nil
+}
+
+func (Unversioned) Log(ctx context.Context, name string, n int) ([]Commit, error) {
+    return nil, nil
+}
+
+func (Unversioned) Show(ctx context.Context, name, rev string) ([]byte, error) {
+    return nil, errNoVersion(name, rev)
+}
+
+func (Unversioned) Restore(ctx context.Context, name, rev, message string) ([]byte, error) {
+    return nil, errNoVersion(name, rev)
+}
+
+func (Unversioned) Diff(ctx context.Context, name, from, to string, unified int) (string, error) {
+    return "", errNoVersion(name, from)
+}
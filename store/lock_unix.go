@@ -0,0 +1,27 @@
+//go:build !windows
+
+package store
+
+import (
+    "os"
+    "syscall"
+)
+
+// TryLock takes an exclusive advisory lock on path without waiting. The
+// lock lasts until the returned file is closed or the process exits; ok is
+// false while another process holds it. On shared storage the filesystem
+// must support flock (NFSv4 does).
+func TryLock(path string) (f *os.File, ok bool, err error) {
+    f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, false, err
+    }
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+        f.Close()
+        if err == syscall.EWOULDBLOCK {
+            return nil, false, nil
+        }
+        return nil, false, err
+    }
+    return f, true, nil
+}
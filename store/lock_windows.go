@@ -0,0 +1,13 @@
+//go:build windows
+
+package store
+
+import (
+    "errors"
+    "os"
+)
+
+// TryLock is not available on Windows; use etcd to elect a leader there.
+func TryLock(path string) (*os.File, bool, error) {
+    return nil, false, errors.New("file locks need a Unix system; use the etcd backend")
+}
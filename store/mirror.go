@@ -0,0 +1,78 @@
+package store
+
+import (
+    "context"
+    "errors"
+    "io"
+    "io/ioutil"
+    "os"
+)
+
+// ErrDiverged means a mirror has commits its primary does not, so it can no
+// longer be fast-forwarded.
+var ErrDiverged = errors.New("histories have diverged")
+
+// Head returns the commit HEAD points at in dir's repository, or "" before
+// the first commit.
+func Head(ctx context.Context, dir string) (string, error) {
+    lines, err := Lines(ctx, dir, "rev-parse", "--verify", "--quiet", "HEAD")
+    if len(lines) == 0 {
+        // rev-parse --quiet fails silently on an unborn branch
+        return "", nil
+    }
+    return lines[0], err
+}
+
+// IsAncestor reports whether commit a is b or one of b's ancestors. It is
+// false when either is unknown.
+func IsAncestor(ctx context.Context, dir, a, b string) bool {
+    _, err := run(ctx, dir, "merge-base", "--is-ancestor", a, b)
+    return err == nil
+}
+
+// Bundle packs the commits after base up to HEAD (all of them when base is
+// empty) into a git bundle.
+func Bundle(ctx context.Context, dir, base string) ([]byte, error) {
+    rev := "HEAD"
+    if base != "" {
+        rev = base + "..HEAD"
+    }
+    return run(ctx, dir, "bundle", "create", "-q", "-", rev)
+}
+
+// Unbundle fast-forwards dir's current branch, and its files, to the HEAD
+// of a bundle made by Bundle and returns the new head. ErrDiverged means
+// the branch has commits the bundle does not build on.
+func Unbundle(ctx context.Context, dir string, bundle io.Reader) (string, error) {
+    f, err := ioutil.TempFile("", "edit3-*.bundle")
+    if err != nil {
+        return "", err
+    }
+    defer os.Remove(f.Name())
+    _, err = io.Copy(f, bundle)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return "", err
+    }
+    for _, args := range [][]string{
+        {"bundle", "verify", "-q", f.Name()},
+        {"fetch", "-q", f.Name(), "HEAD"},
+    } {
+        if _, err := run(ctx, dir, args...); err != nil {
+            return "", err
+        }
+    }
+    head, err := Head(ctx, dir)
+    if err != nil {
+        return "", err
+    }
+    if head != "" && !IsAncestor(ctx, dir, head, "FETCH_HEAD") {
+        return "", ErrDiverged
+    }
+    if _, err := run(ctx, dir, "merge", "-q", "--ff-only", "FETCH_HEAD"); err != nil {
+        return "", err
+    }
+    return Head(ctx, dir)
+}
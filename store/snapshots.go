@@ -0,0 +1,202 @@
+package store
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "edit3/storage"
+)
+
+// Snapshots keeps history next to the files in any storage driver, for
+// setups where git on a shared volume is a problem (object stores, several
+// servers). Every version of a file is stored whole, content-addressed under
+// SnapshotDir/objects, and each file has a log of its versions.
+type Snapshots struct {
+    Files storage.Storage
+
+    mu sync.Mutex
+}
+
+// SnapshotDir is where Snapshots keeps its data inside the storage.
+const SnapshotDir = ".history"
+
+// snapshot is one entry of a file's log. Object is empty for a removal.
+type snapshot struct {
+    ID        string    `json:"id"`
+    Timestamp time.Time `json:"timestamp"`
+    Message   string    `json:"message"`
+    Object    string    `json:"object,omitempty"`
+}
+
+func NewSnapshots(files storage.Storage) *Snapshots {
+    return &Snapshots{Files: files}
+}
+
+func (s *Snapshots) logName(name string) string {
+    return SnapshotDir + "/log/" + name + ".json"
+}
+
+func (s *Snapshots) readLog(name string) ([]snapshot, error) {
+    content, err := s.Files.Read(s.logName(name))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var log []snapshot
+    if err := json.Unmarshal(content, &log); err != nil {
+        return nil, err
+    }
+    return log, nil
+}
+
+func (s *Snapshots) Commit(ctx context.Context, names []string, message string) (string, error) {
+    if err := ctx.Err(); err != nil {
+        return "", err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now().UTC()
+    sum := sha256.New()
+    sum.Write([]byte(now.Format(time.RFC3339Nano) + "\n" + message))
+    type pending struct {
+        name   string
+        log    []snapshot
+        object string
+    }
+    var changes []pending
+    for _, name := range names {
+        log, err := s.readLog(name)
+        if err != nil {
+            return "", err
+        }
+        object := ""
+        content, err := s.Files.Read(name)
+        switch {
+        case err == nil:
+            h := sha256.Sum256(content)
+            object = hex.EncodeToString(h[:])
+            if _, err := s.Files.Stat(SnapshotDir + "/objects/" + object); err != nil {
+                if err := s.Files.Write(SnapshotDir+"/objects/"+object, content); err != nil {
+                    return "", err
+                }
+            }
+        case !errors.Is(err, os.ErrNotExist):
+            return "", err
+        }
+        if len(log) > 0 && log[len(log)-1].Object == object || len(log) == 0 && object == "" {
+            continue // unchanged
+        }
+        sum.Write([]byte(name + "\n" + object + "\n"))
+        changes = append(changes, pending{name, log, object})
+    }
+    if len(changes) == 0 {
+        if len(names) > 0 {
+            if log, _ := s.readLog(names[0]); len(log) > 0 {
+                return log[len(log)-1].ID, nil
+            }
+        }
+        return "", nil
+    }
+
+    id := hex.EncodeToString(sum.Sum(nil))[:12]
+    for _, c := range changes {
+        log := append(c.log, snapshot{ID: id, Timestamp: now, Message: message, Object: c.object})
+        data, _ := json.Marshal(log)
+        if err := s.Files.Write(s.logName(c.name), data); err != nil {
+            return "", err
+        }
+    }
+    return id, nil
+}
+
+func (s *Snapshots) Log(ctx context.Context, name string, n int) ([]Commit, error) {
+    log, err := s.readLog(name)
+    if err != nil {
+        return nil, err
+    }
+    history := make([]Commit, 0)
+    for i := len(log) - 1; i >= 0 && len(history) < n; i-- {
+        history = append(history, Commit{Hash: log[i].ID, Timestamp: log[i].Timestamp.Format("2006-01-02 15:04:05 -0700"), Message: log[i].Message})
+    }
+    return history, nil
+}
+
+// find resolves rev against a file's log: HEAD, HEAD~n, or an id prefix.
+func (s *Snapshots) find(name, rev string) (snapshot, error) {
+    log, err := s.readLog(name)
+    if err != nil {
+        return snapshot{}, err
+    }
+    if rev == "HEAD" || strings.HasPrefix(rev, "HEAD~") {
+        back := 0
+        if rev != "HEAD" {
+            if back, err = strconv.Atoi(strings.TrimPrefix(rev, "HEAD~")); err != nil || back < 0 {
+                return snapshot{}, errNoVersion(name, rev)
+            }
+        }
+        if i := len(log) - 1 - back; i >= 0 {
+            return log[i], nil
+        }
+        return snapshot{}, errNoVersion(name, rev)
+    }
+    for i := len(log) - 1; i >= 0; i-- {
+        if rev != "" && strings.HasPrefix(log[i].ID, rev) {
+            return log[i], nil
+        }
+    }
+    return snapshot{}, errNoVersion(name, rev)
+}
+
+func (s *Snapshots) Show(ctx context.Context, name, rev string) ([]byte, error) {
+    snap, err := s.find(name, rev)
+    if err != nil {
+        return nil, err
+    }
+    if snap.Object == "" {
+        return nil, errNoVersion(name, rev)
+    }
+    return s.Files.Read(SnapshotDir + "/objects/" + snap.Object)
+}
+
+func (s *Snapshots) Restore(ctx context.Context, name, rev, message string) ([]byte, error) {
+    content, err := s.Show(ctx, name, rev)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.Files.Write(name, content); err != nil {
+        return nil, err
+    }
+    _, err = s.Commit(ctx, []string{name}, message)
+    return content, err
+}
+
+// Diff treats a from revision before the first version as empty.
+func (s *Snapshots) Diff(ctx context.Context, name, from, to string, unified int) (string, error) {
+    var sides [2][]byte
+    for i, rev := range []string{from, to} {
+        snap, err := s.find(name, rev)
+        if i == 0 && strings.HasPrefix(rev, "HEAD~") && errors.Is(err, ErrNotFound) {
+            continue // compare the first version against nothing
+        }
+        if err != nil {
+            return "", err
+        }
+        if snap.Object != "" {
+            if sides[i], err = s.Files.Read(SnapshotDir + "/objects/" + snap.Object); err != nil {
+                return "", err
+            }
+        }
+    }
+    return UnifiedDiff(name, string(sides[0]), string(sides[1]), unified), nil
+}
@@ -0,0 +1,181 @@
+// Package store is edit3's version store: a directory whose files are
+// committed to git, one commit per save, with their history and past
+// contents read back from the log.
+package store
+
+import (
+    "context"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Timeout bounds each git command on top of the caller's context, so a hung
+// git (a lock, a credential prompt, a stalled network filesystem) fails
+// instead of blocking forever.
+var Timeout = 30 * time.Second
+
+// git prepares a git command in dir. Pass its error through done, which
+// releases the timeout and reports a command killed by it (or by the
+// caller's cancellation) as such rather than as "signal: killed".
+func git(ctx context.Context, dir string, args ...string) (cmd *exec.Cmd, done func(error) error) {
+    ctx, cancel := context.WithTimeout(ctx, Timeout)
+    cmd = exec.CommandContext(ctx, "git", args...)
+    cmd.Dir = dir
+    // Helpers git spawns (ssh, credential prompts) may hold its output open
+    cmd.WaitDelay = time.Second
+    return cmd, func(err error) error {
+        defer cancel()
+        if err != nil && ctx.Err() != nil {
+            return fmt.Errorf("git %s: %w", args[0], ctx.Err())
+        }
+        return err
+    }
+}
+
+// Commit is one entry of a file's history.
+type Commit struct {
+    Hash      string `json:"hash"`
+    Timestamp string `json:"timestamp"`
+    Message   string `json:"message"`
+}
+
+// Open reports the repository dir already belongs to, if any, with its
+// checked-out branch.
+func Open(ctx context.Context, dir string) (top, branch string, ok bool) {
+    lines, err := Lines(ctx, dir, "rev-parse", "--show-toplevel")
+    if err != nil || len(lines) == 0 {
+        return "", "", false
+    }
+    branches, _ := Lines(ctx, dir, "rev-parse", "--abbrev-ref", "HEAD")
+    if len(branches) > 0 {
+        branch = branches[0]
+    }
+    return lines[0], branch, true
+}
+
+// Init creates a repository in dir with a local identity for the commits
+// the editor makes. Call it only when Open finds none.
+func Init(ctx context.Context, dir string) error {
+    for _, args := range [][]string{
+        {"init"},
+        {"config", "user.email", "edit3@local"},
+        {"config", "user.name", "Edit3 User"},
+    } {
+        if _, err := run(ctx, dir, args...); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// CommitFiles commits several paths (including deletions), relative to dir,
+// as one commit on the current branch. Unchanged files give
+// ErrNothingToCommit. Only those paths are committed, so
+// anything else staged in a shared repository is left untouched; ignored
+// files are not force-added.
+func CommitFiles(ctx context.Context, dir string, rels []string, message string) error {
+    paths := make([]string, len(rels))
+    for i, rel := range rels {
+        paths[i] = filepath.ToSlash(rel)
+    }
+    for _, args := range [][]string{
+        append([]string{"add", "-A", "--"}, paths...),
+        append([]string{"commit", "-m", message, "--"}, paths...),
+    } {
+        if _, err := run(ctx, dir, args...); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Untrack stops tracking paths, relative to dir, and commits just that on
+// the current branch: the files stay on disk and anything else staged in a
+// shared repository stays staged. git commit with a pathspec would take the
+// files back from the working tree, so the commit is built on a scratch
+// index instead.
+func Untrack(ctx context.Context, dir string, paths []string, message string) error {
+    scratch, err := ioutil.TempDir("", "edit3-index")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(scratch)
+    env := []string{"GIT_INDEX_FILE=" + filepath.Join(scratch, "index")}
+    rm := append([]string{"rm", "-r", "-q", "--cached", "--"}, paths...)
+
+    head, err := Lines(ctx, dir, "rev-parse", "HEAD")
+    if err != nil {
+        return err
+    }
+    if _, err := runEnv(ctx, dir, env, "read-tree", head[0]); err != nil {
+        return err
+    }
+    if _, err := runEnv(ctx, dir, env, rm...); err != nil {
+        return err
+    }
+    tree, err := runEnv(ctx, dir, env, "write-tree")
+    if err != nil {
+        return err
+    }
+    commit, err := run(ctx, dir, "commit-tree", strings.TrimSpace(string(tree)), "-p", head[0], "-m", message)
+    if err != nil {
+        return err
+    }
+    if _, err := run(ctx, dir, "update-ref", "-m", "commit: "+message, "HEAD", strings.TrimSpace(string(commit)), head[0]); err != nil {
+        return err
+    }
+    _, err = run(ctx, dir, rm...)
+    return err
+}
+
+// Log returns the n most recent commits touching rel, newest first. It
+// is empty, never nil, when there are none.
+func Log(ctx context.Context, dir, rel string, n int) []Commit {
+    history := make([]Commit, 0)
+    lines, err := Lines(ctx, dir, "log", "--pretty=format:%h|%ai|%s", "-n", fmt.Sprint(n), "--", filepath.ToSlash(rel))
+    if err != nil {
+        return history
+    }
+    for _, line := range lines {
+        parts := strings.SplitN(line, "|", 3)
+        if len(parts) == 3 {
+            history = append(history, Commit{Hash: parts[0], Timestamp: parts[1], Message: parts[2]})
+        }
+    }
+    return history
+}
+
+// FileAt returns the content of rel as of the given commit.
+func FileAt(ctx context.Context, dir, rel, hash string) ([]byte, error) {
+    return run(ctx, dir, "show", fmt.Sprintf("%s:./%s", hash, filepath.ToSlash(rel)))
+}
+
+// Lines runs git in dir and returns its non-empty output lines.
+func Lines(ctx context.Context, dir string, args ...string) ([]string, error) {
+    output, err := run(ctx, dir, args...)
+    if err != nil {
+        return nil, err
+    }
+    var lines []string
+    for _, line := range strings.Split(string(output), "\n") {
+        if line = strings.TrimSpace(line); line != "" {
+            lines = append(lines, line)
+        }
+    }
+    return lines, nil
+}
+
+// WriteAtomic writes through a temp file so a crash never leaves half a
+// file behind.
+func WriteAtomic(path string, data []byte, perm os.FileMode) error {
+    tmp := path + ".tmp"
+    if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}